@@ -0,0 +1,63 @@
+package applog
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var jsonOutput bool
+
+// jsonWriter writes each line from the standard logger as a JSON
+// object with "time" and "msg" fields.
+type jsonWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+type jsonLine struct {
+	Time string `json:"time"`
+	Msg  string `json:"msg"`
+}
+
+func (jw *jsonWriter) Write(p []byte) (int, error) {
+	line := jsonLine{
+		Time: time.Now().UTC().Format(time.RFC3339Nano),
+		Msg:  strings.TrimSuffix(string(p), "\n"),
+	}
+	js, err := json.Marshal(line)
+	if err != nil {
+		return 0, err
+	}
+	js = append(js, '\n')
+
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+	if _, err := jw.w.Write(js); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SetJSON switches the standard logger to write JSON lines instead
+// of plain text. The timestamp moves into the "time" field, so the
+// log prefix and flags are cleared.
+func SetJSON(enable bool) {
+	jsonOutput = enable
+	if enable {
+		log.SetPrefix("")
+		log.SetFlags(0)
+	}
+	setOutput(os.Stderr)
+}
+
+func setOutput(w io.Writer) {
+	if jsonOutput {
+		w = &jsonWriter{w: w}
+	}
+	log.SetOutput(w)
+}
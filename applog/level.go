@@ -0,0 +1,86 @@
+package applog
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the severity of a log message; messages below the level
+// set with SetLevel are discarded.
+type Level int32
+
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+var levelNames = []string{"error", "warn", "info", "debug"}
+
+var level = int32(LevelInfo)
+
+func (l Level) String() string {
+	if l < LevelError || l > LevelDebug {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named s (error, warn, info or debug).
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToLower(s)
+	if s == "warning" {
+		s = "warn"
+	}
+	for i, name := range levelNames {
+		if s == name {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s'", s)
+}
+
+// SetLevel sets the lowest level that is logged. The debug level
+// also enables Printf and Println.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+	Enabled = l >= LevelDebug
+}
+
+// GetLevel returns the current log level.
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&level))
+}
+
+func logf(l Level, prefix, format string, a []interface{}) {
+	if GetLevel() < l {
+		return
+	}
+	log.Output(3, prefix+fmt.Sprintf(format, a...))
+}
+
+// Errorf logs a message about a failure, like a zone that doesn't
+// load.
+func Errorf(format string, a ...interface{}) {
+	logf(LevelError, "error: ", format, a)
+}
+
+// Warnf logs a message about something that is probably a mistake,
+// but doesn't stop the server or a zone from working.
+func Warnf(format string, a ...interface{}) {
+	logf(LevelWarn, "warning: ", format, a)
+}
+
+// Infof logs normal events like zones being loaded.
+func Infof(format string, a ...interface{}) {
+	logf(LevelInfo, "", format, a)
+}
+
+// Debugf logs details for debugging; like Printf, but checked
+// against the level.
+func Debugf(format string, a ...interface{}) {
+	logf(LevelDebug, "", format, a)
+}
@@ -0,0 +1,53 @@
+package applog
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer SetLevel(LevelInfo)
+
+	for _, name := range []string{"error", "warn", "info", "debug"} {
+		l, err := ParseLevel(strings.ToUpper(name))
+		if err != nil || l.String() != name {
+			t.Errorf("ParseLevel(%q) = %s, %v", name, l, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("ParseLevel accepted an unknown level")
+	}
+
+	SetLevel(LevelWarn)
+	Errorf("zone %s failed", "a")
+	Warnf("zone %s looks odd", "b")
+	Infof("zone %s loaded", "c")
+	Debugf("query %d", 1)
+	Printf("query %d", 2)
+
+	out := buf.String()
+	for _, s := range []string{"error: zone a failed", "warning: zone b looks odd"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("log output '%s' doesn't include '%s'", out, s)
+		}
+	}
+	for _, s := range []string{"zone c", "query"} {
+		if strings.Contains(out, s) {
+			t.Errorf("log output '%s' includes '%s' below the level", out, s)
+		}
+	}
+
+	buf.Reset()
+	SetLevel(LevelDebug)
+	Debugf("query %d", 1)
+	Printf("query %d", 2)
+	if !strings.Contains(buf.String(), "query 1") || !strings.Contains(buf.String(), "query 2") {
+		t.Errorf("debug messages weren't logged: '%s'", buf.String())
+	}
+}
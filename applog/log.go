@@ -41,7 +41,7 @@ func logToFileMonitor() {
 		select {
 		case errc := <-ltf.closing: // a close has been requested
 			if ltf.file != nil {
-				log.SetOutput(os.Stderr)
+				setOutput(os.Stderr)
 				ltf.file.Close()
 				ltf.file = nil
 			}
@@ -54,7 +54,7 @@ func logToFileMonitor() {
 					// Send the error to the current log file - not ideal
 					log.Printf("Could not open new log file: %v", err)
 				} else {
-					log.SetOutput(f)
+					setOutput(f)
 					log.Printf("Rotating log file")
 					ltf.file.Close()
 					ltf.file = f
@@ -74,7 +74,7 @@ func FileOpen(fn string) {
 	}
 	// we deliberately do not close logFile here, because we keep it open pretty much for ever
 
-	log.SetOutput(ltf.file)
+	setOutput(ltf.file)
 	log.Printf("Opening log file")
 
 	go logToFileMonitor()
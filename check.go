@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/abh/geodns/zones"
+)
+
+// checkZones reads the config file and the zones in source, prints
+// the errors and problems found to w, and returns the exit status:
+// 2 if the config file or a zone failed to load, or a zone has
+// problems and strict is set, 0 otherwise.
+func checkZones(w io.Writer, configFileName string, source zones.ZoneSource, strict bool) int {
+	if err := configReader(configFileName); err != nil {
+		fmt.Fprintf(w, "%s: %s\n", configFileName, err)
+		return 2
+	}
+
+	results, err := zones.Check(source)
+	if err != nil {
+		fmt.Fprintf(w, "%s: %s\n", source, err)
+		return 2
+	}
+
+	status := 0
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(w, "%s: %s\n", r.Location, r.Err)
+			status = 2
+			continue
+		}
+		for _, problem := range r.Problems {
+			fmt.Fprintf(w, "%s: zone %s: %s\n", r.Location, r.Name, problem)
+			if strict {
+				status = 2
+			}
+		}
+	}
+	fmt.Fprintf(w, "checked %d zone(s) in %s\n", len(results), source)
+	return status
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/abh/geodns/zones"
+)
+
+func TestCheckZones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geodns-check.")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, data string) string {
+		fn := filepath.Join(dir, name)
+		require.Nil(t, ioutil.WriteFile(fn, []byte(data), 0644))
+		return fn
+	}
+	write("example.com.json", `{ "data": { "": { "ns": [ "ns1.example.net." ] } } }`)
+	noNS := write("example.net.json", `{ "data": { "www": { "a": [ [ "192.0.2.1" ] ] } } }`)
+
+	check := func(strict bool) (int, string) {
+		var buf bytes.Buffer
+		status := checkZones(&buf, "dns/geodns.conf.sample", zones.NewDirSource(dir), strict)
+		return status, buf.String()
+	}
+
+	// problems only fail the check with strict
+	status, out := check(false)
+	assert.Equal(t, 0, status, out)
+	assert.Contains(t, out, noNS+": zone example.net: no NS records")
+	assert.Contains(t, out, "checked 2 zone(s)")
+	status, _ = check(true)
+	assert.Equal(t, 2, status)
+
+	// zones that fail to load always do
+	require.Nil(t, os.Remove(noNS))
+	status, out = check(true)
+	assert.Equal(t, 0, status, out)
+	broken := write("example.org.json", "{\n  \"data\": {\n    \"\": { \"ns\": [ \"ns1.example.net.\" ] },\n}")
+	status, out = check(false)
+	assert.Equal(t, 2, status)
+	assert.Contains(t, out, broken+": ")
+	assert.Contains(t, out, "line 4")
+
+	// and so does a source that can't be read
+	var buf bytes.Buffer
+	status = checkZones(&buf, "dns/geodns.conf.sample", zones.NewDirSource(filepath.Join(dir, "missing")), false)
+	assert.Equal(t, 2, status)
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/abh/geodns/applog"
+	"github.com/abh/geodns/server"
+	"github.com/abh/geodns/targeting"
 	"github.com/abh/geodns/targeting/geoip2"
 
 	"github.com/fsnotify/fsnotify"
@@ -28,13 +32,28 @@ type AppConfig struct {
 		Password string
 	}
 	QueryLog struct {
-		Path    string
-		MaxSize int
-		Keep    int
+		Path      string
+		MaxSize   int
+		Keep      int
+		Sample    int
+		Anonymize bool
 	}
 	Health struct {
 		Directory string
 	}
+	Group map[string]*struct {
+		Country []string
+	}
+	Internal struct {
+		Network []string
+	}
+	Override map[string]*struct {
+		Name    string
+		Client  []string
+		Address []string
+		CNAME   string
+		TTL     int
+	}
 	Nodeping struct {
 		Token string
 	}
@@ -72,7 +91,70 @@ func (conf *AppConfig) GeoIPDirectory() string {
 	return geoip2.FindDB()
 }
 
-func configWatcher(fileName string) {
+// LocationGroups returns the countries of each location group; the
+// country variable can be repeated or list several countries.
+func (conf *AppConfig) LocationGroups() map[string][]string {
+	cfgMutex.RLock()
+	defer cfgMutex.RUnlock()
+	groups := map[string][]string{}
+	for name, group := range conf.Group {
+		ccs := []string{}
+		for _, v := range group.Country {
+			ccs = append(ccs, strings.FieldsFunc(v, func(r rune) bool {
+				return r == ',' || r == ' '
+			})...)
+		}
+		groups[name] = ccs
+	}
+	return groups
+}
+
+// Overrides returns the client overrides in the config file, sorted
+// by name so the first matching one is predictable.
+func (conf *AppConfig) Overrides() ([]*server.Override, error) {
+	cfgMutex.RLock()
+	defer cfgMutex.RUnlock()
+
+	names := make([]string, 0, len(conf.Override))
+	for name := range conf.Override {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var overrides []*server.Override
+	for _, name := range names {
+		oc := conf.Override[name]
+		var clients []string
+		for _, c := range oc.Client {
+			clients = append(clients, strings.Fields(c)...)
+		}
+		var addresses []string
+		for _, a := range oc.Address {
+			addresses = append(addresses, strings.Fields(a)...)
+		}
+		o, err := server.NewOverride(name, oc.Name, clients, addresses, oc.CNAME, oc.TTL)
+		if err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, nil
+}
+
+// loadOverrides gives srv the client overrides in the config.
+func loadOverrides(srv *server.Server) {
+	overrides, err := Config.Overrides()
+	if err != nil {
+		applog.Errorf("Failed to load client overrides: %s", err)
+		return
+	}
+	srv.SetOverrides(overrides)
+	if len(overrides) > 0 {
+		applog.Infof("Loaded %d client overrides", len(overrides))
+	}
+}
+
+func configWatcher(fileName string, srv *server.Server) {
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -96,11 +178,13 @@ func configWatcher(fileName string) {
 					ev.Op&fsnotify.Rename == fsnotify.Rename ||
 					ev.Op&fsnotify.Chmod == fsnotify.Chmod {
 					time.Sleep(200 * time.Millisecond)
-					configReader(fileName)
+					if err := configReader(fileName); err == nil {
+						loadOverrides(srv)
+					}
 				}
 			}
 		case err := <-watcher.Errors:
-			log.Println("fsnotify error:", err)
+			applog.Errorf("fsnotify error: %s", err)
 		}
 	}
 
@@ -112,7 +196,7 @@ func configReader(fileName string) error {
 
 	stat, err := os.Stat(fileName)
 	if err != nil {
-		log.Printf("Failed to find config file: %s\n", err)
+		applog.Errorf("Failed to find config file: %s", err)
 		return err
 	}
 
@@ -122,18 +206,33 @@ func configReader(fileName string) error {
 
 	lastReadConfig = time.Now()
 
-	log.Printf("Loading config: %s\n", fileName)
+	applog.Infof("Loading config: %s", fileName)
 
 	cfg := new(AppConfig)
 
 	err = gcfg.ReadFileInto(cfg, fileName)
 	if err != nil {
-		log.Printf("Failed to parse config data: %s\n", err)
+		applog.Errorf("Failed to parse config data: %s", err)
 		return err
 	}
 
 	cfg.Flags.HasStatHat = len(cfg.StatHat.ApiKey) > 0
 
+	if err := targeting.SetGroups(cfg.LocationGroups()); err != nil {
+		applog.Errorf("Failed to parse config data: %s", err)
+		return err
+	}
+
+	if err := targeting.SetInternalNetworks(cfg.Internal.Network); err != nil {
+		applog.Errorf("Failed to parse config data: %s", err)
+		return err
+	}
+
+	if _, err := cfg.Overrides(); err != nil {
+		applog.Errorf("Failed to parse config data: %s", err)
+		return err
+	}
+
 	// log.Println("STATHAT APIKEY:", cfg.StatHat.ApiKey)
 	// log.Println("STATHAT FLAG  :", cfg.Flags.HasStatHat)
 
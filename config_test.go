@@ -1,6 +1,15 @@
 package main
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/abh/geodns/targeting"
+)
 
 func TestConfig(t *testing.T) {
 	// check that the sample config parses
@@ -9,3 +18,89 @@ func TestConfig(t *testing.T) {
 		t.Fatalf("Could not read config: %s", err)
 	}
 }
+
+func TestConfigGroups(t *testing.T) {
+	defer targeting.SetGroups(nil)
+
+	for _, tc := range []struct {
+		conf string
+		ok   bool
+	}{
+		{"[group \"emea\"]\ncountry = de fr\ncountry = za\n", true},
+		{"[group \"emea\"]\ncountry = de xx\n", false},
+	} {
+		f, err := ioutil.TempFile("", "geodns-conf.")
+		require.Nil(t, err)
+		defer os.Remove(f.Name())
+		f.WriteString(tc.conf)
+		f.Close()
+
+		lastReadConfig = time.Time{}
+		err = configReader(f.Name())
+		if tc.ok {
+			require.Nil(t, err)
+			require.Equal(t, []string{"de", "fr", "za"}, Config.LocationGroups()["emea"])
+			require.True(t, targeting.HasGroup("emea"))
+		} else {
+			require.Error(t, err)
+		}
+	}
+}
+
+func TestConfigInternal(t *testing.T) {
+	defer targeting.SetInternalNetworks(nil)
+
+	for _, tc := range []struct {
+		conf string
+		ok   bool
+	}{
+		{"[internal]\nnetwork = 10.0.0.0/8 192.168.0.0/16\nnetwork = 2001:db8::/32\n", true},
+		{"[internal]\nnetwork = 10.0.0.0/40\n", false},
+	} {
+		f, err := ioutil.TempFile("", "geodns-conf.")
+		require.Nil(t, err)
+		defer os.Remove(f.Name())
+		f.WriteString(tc.conf)
+		f.Close()
+
+		lastReadConfig = time.Time{}
+		err = configReader(f.Name())
+		if tc.ok {
+			require.Nil(t, err)
+			require.True(t, targeting.HasInternalNetworks())
+		} else {
+			require.Error(t, err)
+		}
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	for _, tc := range []struct {
+		conf string
+		ok   bool
+	}{
+		{"[override \"office\"]\nname = www.example.com\nclient = 192.0.2.10 198.51.100.0/24\naddress = 192.0.2.1\naddress = 2001:db8::1\n", true},
+		{"[override \"office\"]\nname = www.example.com\nclient = 192.0.2.300\naddress = 192.0.2.1\n", false},
+		{"[override \"office\"]\nname = www.example.com\nclient = 192.0.2.10\n", false},
+	} {
+		f, err := ioutil.TempFile("", "geodns-conf.")
+		require.Nil(t, err)
+		defer os.Remove(f.Name())
+		f.WriteString(tc.conf)
+		f.Close()
+
+		lastReadConfig = time.Time{}
+		err = configReader(f.Name())
+		if !tc.ok {
+			require.Error(t, err)
+			continue
+		}
+		require.Nil(t, err)
+		overrides, err := Config.Overrides()
+		require.Nil(t, err)
+		require.Len(t, overrides, 1)
+		require.Equal(t, "www.example.com.", overrides[0].Qname)
+		require.Len(t, overrides[0].Clients, 2)
+		require.Len(t, overrides[0].Records, 2)
+	}
+}
@@ -1,7 +1,7 @@
 package countries
 
 import (
-	"log"
+	"github.com/abh/geodns/applog"
 )
 
 var RegionGroups = map[string]string{
@@ -72,7 +72,7 @@ func CountryRegionGroup(country, region string) string {
 		return group
 	}
 
-	log.Printf("Did not find a region group for '%s'/'%s'", country, region)
+	applog.Debugf("Did not find a region group for '%s'/'%s'", country, region)
 	return ""
 }
 
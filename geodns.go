@@ -17,6 +17,8 @@ package main
 */
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
@@ -26,7 +28,10 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/abh/geodns/applog"
@@ -57,15 +62,80 @@ var (
 	flagconfig       = flag.String("config", "./dns/", "directory of zone files")
 	flagconfigfile   = flag.String("configfile", "geodns.conf", "filename of config file (in 'config' directory)")
 	flagcheckconfig  = flag.Bool("checkconfig", false, "check configuration and exit")
+	flagCheck        = flag.Bool("check", false, "check the configuration and zones, print the problems and exit with status 2 if there are any")
+	flagZonesURL     = flag.String("zonesurl", "", "URL of a JSON bundle of zones to load instead of the zone files in -config")
+	flagZonesPoll    = flag.Duration("zonespoll", time.Minute, "how often to check -zonesurl for changes")
 	flagidentifier   = flag.String("identifier", "", "identifier (hostname, pop name or similar)")
 	flaginter        = flag.String("interface", "*", "set the listener address")
 	flagport         = flag.String("port", "53", "default port number")
-	flaghttp         = flag.String("http", ":8053", "http listen address (:8053)")
-	flaglog          = flag.Bool("log", false, "be more verbose")
+	flagTLSPort      = flag.String("tlsport", "853", "port number for DNS over TLS")
+	flagTLSCert      = flag.String("tlscert", "", "certificate file for DNS over TLS")
+	flagTLSKey       = flag.String("tlskey", "", "private key file for DNS over TLS")
+	flaghttp         = flag.String("http", ":8053", "http listen address (:8053), or unix:/path/to/sock")
+	flagHTTPMode     = flag.String("httpmode", "0660", "file mode of the socket when -http is unix:/path/to/sock")
+	flagHTTPCert     = flag.String("httpcert", "", "certificate file to serve the http interface over HTTPS, read again when it changes")
+	flagHTTPKey      = flag.String("httpkey", "", "private key file for -httpcert")
+	flagHTTPACME     = flag.String("httpacme", "", "hostnames (comma separated) to get a certificate for from Let's Encrypt, to serve the http interface over HTTPS")
+	flagHTTPACMEDir  = flag.String("httpacmecache", "./acme/", "directory to keep the -httpacme certificates in")
+	flagHTTPToken    = flag.String("httptoken", "", "shared secret for the HTTP endpoints that change or inspect the server (/reload, /debug, /config, /drain, /maintenance)")
+	flagPprof        = flag.Bool("pprof", false, "serve the Go profiles at /debug/pprof/ on the http interface; only use on a trusted interface")
+	flagQueryBuffer  = flag.Int("querybuffer", 0, "number of recent queries to keep in memory for /queries (0 to disable)")
+	flagQueryWindow  = flag.Duration("querywindow", 0, "length of the windows of the per-zone query counts in /querycounts, for example 1h (0 to disable)")
+	flaglog          = flag.Bool("log", false, "be more verbose (same as -loglevel=debug)")
+	flagLogLevel     = flag.String("loglevel", "info", "lowest level to log: error, warn, info or debug")
 	flagcpus         = flag.Int("cpus", 1, "Set the maximum number of CPUs to use")
 	flagLogFile      = flag.String("logfile", "", "log to file")
+	flagLogJSON      = flag.Bool("logjson", false, "log JSON lines instead of plain text")
 	flagPrivateDebug = flag.Bool("privatedebug", false, "Make debugging queries accepted only on loopback")
 
+	flagRateLimit       = flag.Int("ratelimit", 0, "maximum queries per second per client network (0 for no limit)")
+	flagRateBurst       = flag.Int("rateburst", 0, "number of queries a client network can burst over the rate limit")
+	flagRateLimitRefuse = flag.Bool("ratelimitrefuse", false, "answer rate limited queries with REFUSED instead of dropping them")
+	flagSlowDown        = flag.Int("slowdown", 0, "delay UDP answers to client networks over this many queries per second (0 to disable)")
+	flagSlowDownDelay   = flag.Duration("slowdowndelay", 5*time.Millisecond, "how long to delay answers for -slowdown")
+	flagRRL             = flag.Int("rrl", 0, "maximum identical UDP responses per second per client network, response rate limiting (0 to disable)")
+	flagRRLSlip         = flag.Int("rrlslip", 2, "send every n'th response over -rrl truncated instead of dropping it (0 to drop them all)")
+	flagIPv6Prefix      = flag.Int("ipv6prefix", targeting.DefaultIPv6ClientPrefix, "prefix length IPv6 clients are aggregated by for rate limiting, sticky selection and the GeoIP cache")
+
+	flagMaxConcurrent  = flag.Int("maxconcurrent", 0, "maximum number of queries processed at the same time; UDP queries over it are dropped and TCP connections closed (0 for no limit)")
+	flagTCPTimeout     = flag.Duration("tcptimeout", 2*time.Second, "how long a TCP connection can take to send its first query or read an answer")
+	flagTCPIdleTimeout = flag.Duration("tcpidletimeout", 8*time.Second, "how long a TCP connection can be idle between queries")
+
+	flagMaintenance         = flag.Bool("maintenance", false, "start in maintenance mode, answering all queries with -maintenanceresponse (toggled with /maintenance)")
+	flagMaintenanceResponse = flag.String("maintenanceresponse", "servfail", "answer in maintenance mode: servfail, refused or IP addresses (comma separated)")
+
+	flagSeed      = flag.Int64("seed", 0, "seed for the random selection of weighted records, for reproducible tests (or set GEODNS_SEED)")
+	flagNoShuffle = flag.Bool("noshuffle", false, "return weighted records in zone file order instead of randomly")
+
+	flagDefaultTtl = flag.Int("ttl", 0, "default TTL for zones without a ttl option (default 120, or set GEODNS_TTL)")
+	flagCNAMEDepth = flag.Int("cnamedepth", 8, "how many CNAMEs within a zone to follow in an answer")
+
+	flagMaxUDPSize = flag.Int("maxudpsize", 4096, "largest UDP answer to send, regardless of the client's EDNS buffer size (512-4096)")
+	flagEDNSSize   = flag.Int("ednssize", 0, "EDNS buffer size to advertise in answers, lowered to the client's (512-4096, default -maxudpsize)")
+	flagCompress   = flag.Bool("compress", true, "compress the names in answers")
+	flagMinimalANY = flag.Bool("minimalany", true, "answer ANY queries over UDP with a single HINFO record (RFC 8482); -minimalany=false answers with all the records")
+
+	flagUnknownZone = flag.String("unknownzone", "refused", "how to answer queries outside the loaded zones: refused, noerror or drop")
+
+	flagChaosVersion  = flag.String("chaosversion", "unknown", "answer to CHAOS version.bind queries: a string, 'real' for the GeoDNS version or 'refused'")
+	flagChaosHostname = flag.String("chaoshostname", "unknown", "answer to CHAOS hostname.bind queries: a string, 'real' for the -identifier or 'refused'")
+
+	flagDNS64       = flag.Bool("dns64", false, "synthesize AAAA records from A records for labels without AAAA records")
+	flagDNS64Prefix = flag.String("dns64prefix", server.DefaultDNS64Prefix, "NAT64 /96 prefix for -dns64")
+
+	flagFlattenResolver = flag.String("flattenresolver", zones.FlattenResolver, "resolver for looking up the targets of flattened CNAMEs")
+
+	flagRequireCookie = flag.Bool("requirecookie", false, "truncate UDP answers over 512 bytes unless the query has a valid DNS server cookie")
+
+	flagBlocklist = flag.String("blocklist", "", "file with names to answer with NXDOMAIN (or -sinkhole), reloaded on SIGHUP")
+	flagSinkhole  = flag.String("sinkhole", "", "comma separated addresses to answer blocked A and AAAA queries with instead of NXDOMAIN")
+
+	flagGeoCache     = flag.Int("geocache", 10000, "number of client networks to cache the GeoIP lookups for (0 to disable)")
+	flagGeoOverrides = flag.String("geooverrides", "", "file with networks to place in a country and region instead of the GeoIP lookup, reloaded on SIGHUP")
+	flagNoGeoIP      = flag.Bool("nogeoip", false, "don't load the GeoIP databases; only target the networks in -geooverrides")
+	flagStrictZones  = flag.Bool("strictzones", false, "don't start if a zone fails to load or validate")
+	flagStrictGeo    = flag.Bool("strictgeo", false, "answer geo targeted queries with SERVFAIL when the GeoIP database isn't loaded")
+
 	flagShowVersion = flag.Bool("version", false, "Show GeoDNS version")
 
 	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
@@ -82,6 +152,14 @@ func init() {
 
 	serverInfo = &monitor.ServerInfo{}
 	serverInfo.Version = VERSION
+	serverInfo.Commit = "unknown"
+	if len(gitVersion) > 0 {
+		serverInfo.Commit = gitVersion
+	}
+	serverInfo.BuildDate = "unknown"
+	if len(buildTime) > 0 {
+		serverInfo.BuildDate = buildTime
+	}
 	serverInfo.UUID = uuid.New()
 	serverInfo.Started = time.Now()
 
@@ -104,8 +182,17 @@ func main() {
 		os.Exit(0)
 	}
 
+	logLevel, err := applog.ParseLevel(*flagLogLevel)
+	if err != nil {
+		log.Fatalf("Invalid -loglevel: %s", err)
+	}
 	if *flaglog {
-		applog.Enabled = true
+		logLevel = applog.LevelDebug
+	}
+	applog.SetLevel(logLevel)
+
+	if *flagLogJSON {
+		applog.SetJSON(true)
 	}
 
 	if len(*flagLogFile) > 0 {
@@ -128,24 +215,8 @@ func main() {
 		configFileName = filepath.Clean(filepath.Join(*flagconfig, *flagconfigfile))
 	}
 
-	if *flagcheckconfig {
-		err := configReader(configFileName)
-		if err != nil {
-			log.Println("Errors reading config", err)
-			os.Exit(2)
-		}
-
-		dirName := *flagconfig
-
-		_, err = zones.NewMuxManager(dirName, &zones.NilReg{})
-		if err != nil {
-			log.Println("Errors reading zones", err)
-			os.Exit(2)
-		}
-
-		// todo: setup health stuff when configured
-
-		return
+	if *flagcheckconfig || *flagCheck {
+		os.Exit(checkZones(os.Stdout, configFileName, zoneSource(), *flagCheck || *flagStrictZones))
 	}
 
 	if *flagcpus == 0 {
@@ -180,9 +251,6 @@ func main() {
 		go health.DirectoryReader(Config.Health.Directory)
 	}
 
-	// load (and re-load) zone data
-	go configWatcher(configFileName)
-
 	if *flaginter == "*" {
 		addrs, _ := net.InterfaceAddrs()
 		ips := make([]string, 0)
@@ -202,52 +270,265 @@ func main() {
 	inter := getInterfaces()
 
 	if Config.HasStatHat() {
-		log.Println("StatHat integration has been removed in favor of more generic metrics")
+		applog.Warnf("StatHat integration has been removed in favor of more generic metrics")
 	}
 
-	if len(Config.GeoIPDirectory()) > 0 {
+	if *flagNoGeoIP {
+		applog.Infof("not loading the GeoIP databases (-nogeoip)")
+	} else if len(Config.GeoIPDirectory()) > 0 {
 		geoProvider, err := geoip2.New(Config.GeoIPDirectory())
 		if err != nil {
-			log.Printf("Configuring geo provider: %s", err)
+			applog.Errorf("Configuring geo provider: %s", err)
 		}
 		if geoProvider != nil {
-			targeting.Setup(geoProvider)
+			if *flagGeoCache > 0 {
+				cache := targeting.NewGeoCache(geoProvider, *flagGeoCache)
+				geoProvider.OnLoad(cache.Flush)
+				targeting.Setup(cache)
+			} else {
+				targeting.Setup(geoProvider)
+			}
+			go geoProvider.Watch()
+		}
+	}
+
+	if len(*flagGeoOverrides) > 0 {
+		overrides, err := targeting.NewGeoOverrides(*flagGeoOverrides, targeting.Geo())
+		if err != nil {
+			log.Fatalf("Could not read geo overrides: %s", err)
+		}
+		targeting.Setup(overrides)
+		applog.Infof("loaded %d geo overrides from '%s'", overrides.Len(), *flagGeoOverrides)
+
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				if err := overrides.Reload(); err != nil {
+					applog.Errorf("could not reload geo overrides, keeping the old ones: %s", err)
+					continue
+				}
+				applog.Infof("reloaded geo overrides '%s', %d networks", *flagGeoOverrides, overrides.Len())
+			}
+		}()
+	}
+
+	if *flagSeed == 0 {
+		if env := os.Getenv("GEODNS_SEED"); len(env) > 0 {
+			seed, err := strconv.ParseInt(env, 10, 64)
+			if err != nil {
+				log.Fatalf("Invalid GEODNS_SEED '%s': %s", env, err)
+			}
+			*flagSeed = seed
+		}
+	}
+	if *flagDefaultTtl == 0 {
+		if env := os.Getenv("GEODNS_TTL"); len(env) > 0 {
+			ttl, err := strconv.Atoi(env)
+			if err != nil {
+				log.Fatalf("Invalid GEODNS_TTL '%s': %s", env, err)
+			}
+			*flagDefaultTtl = ttl
 		}
 	}
+	if *flagDefaultTtl < 0 {
+		log.Fatalf("Invalid -ttl %d", *flagDefaultTtl)
+	}
+	if *flagDefaultTtl > 0 {
+		log.Printf("Using default TTL %d", *flagDefaultTtl)
+		zones.SetDefaultTtl(*flagDefaultTtl)
+	}
+
+	if *flagSeed != 0 {
+		log.Printf("Using random seed %d", *flagSeed)
+		zones.SetRandomSeed(*flagSeed)
+	}
+	zones.SetShuffle(!*flagNoShuffle)
+	zones.FlattenResolver = *flagFlattenResolver
+
+	if err := targeting.SetIPv6ClientPrefix(*flagIPv6Prefix); err != nil {
+		log.Fatalf("Invalid -ipv6prefix: %s", err)
+	}
 
 	srv := server.NewServer(serverInfo)
+	srv.SetRateLimit(*flagRateLimit, *flagRateBurst, *flagRateLimitRefuse)
+	srv.SetSlowDown(*flagSlowDown, *flagSlowDownDelay)
+	srv.SetResponseRateLimit(*flagRRL, *flagRRLSlip)
+	srv.SetMaxConcurrent(*flagMaxConcurrent)
+	srv.SetTCPTimeouts(*flagTCPTimeout, *flagTCPIdleTimeout)
+	srv.SetStrictGeo(*flagStrictGeo)
+	srv.SetMaxUDPSize(*flagMaxUDPSize)
+	srv.SetEDNSBufferSize(*flagEDNSSize)
+	srv.SetCompression(*flagCompress)
+	srv.SetMinimalANY(*flagMinimalANY)
+	if err := srv.SetMaintenanceResponse(*flagMaintenanceResponse); err != nil {
+		log.Fatalf("Invalid -maintenanceresponse: %s", err)
+	}
+	srv.SetMaintenance(*flagMaintenance)
+	if err := srv.SetUnknownZone(*flagUnknownZone); err != nil {
+		log.Fatalf("Invalid -unknownzone: %s", err)
+	}
+	if err := srv.SetChaos(*flagChaosVersion, *flagChaosHostname); err != nil {
+		log.Fatalf("Invalid -chaosversion or -chaoshostname: %s", err)
+	}
+	srv.SetCNAMEDepth(*flagCNAMEDepth)
+	srv.SetRequireCookie(*flagRequireCookie)
+	if *flagDNS64 {
+		if err := srv.SetDNS64(*flagDNS64Prefix); err != nil {
+			log.Fatalf("Invalid -dns64prefix: %s", err)
+		}
+	}
+	loadOverrides(srv)
+
+	// re-load the config (and the client overrides)
+	go configWatcher(configFileName, srv)
+
+	if len(*flagBlocklist) > 0 {
+		bl, err := server.NewBlocklist(*flagBlocklist)
+		if err != nil {
+			log.Fatalf("Could not read blocklist: %s", err)
+		}
+		var sinkhole []net.IP
+		if len(*flagSinkhole) > 0 {
+			for _, s := range strings.Split(*flagSinkhole, ",") {
+				ip := net.ParseIP(strings.TrimSpace(s))
+				if ip == nil {
+					log.Fatalf("Invalid -sinkhole address '%s'", s)
+				}
+				sinkhole = append(sinkhole, ip)
+			}
+		}
+		srv.SetBlocklist(bl, sinkhole)
+		applog.Infof("blocking %d names from '%s'", bl.Len(), *flagBlocklist)
 
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				if err := bl.Reload(); err != nil {
+					applog.Errorf("could not reload blocklist, keeping the old one: %s", err)
+					continue
+				}
+				applog.Infof("reloaded blocklist '%s', %d names", *flagBlocklist, bl.Len())
+			}
+		}()
+	}
+
+	var queryLoggers []querylog.QueryLogger
 	if qlc := Config.QueryLog; len(qlc.Path) > 0 {
 		ql, err := querylog.NewFileLogger(qlc.Path, qlc.MaxSize, qlc.Keep)
 		if err != nil {
 			log.Fatalf("Could not start file query logger: %s", err)
 		}
-		srv.SetQueryLogger(ql)
+		ql.SetSample(qlc.Sample)
+		ql.SetAnonymize(qlc.Anonymize)
+		queryLoggers = append(queryLoggers, ql)
+
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				log.Printf("reopening query log '%s'", qlc.Path)
+				if err := ql.Reopen(); err != nil {
+					applog.Errorf("could not close query log: %s", err)
+				}
+			}
+		}()
 	}
 
-	muxm, err := zones.NewMuxManager(*flagconfig, srv)
+	var queryBuffer *querylog.RingLogger
+	if *flagQueryBuffer > 0 {
+		if *flagQueryBuffer > querylog.MaxRingSize {
+			applog.Warnf("-querybuffer %d is over the maximum, keeping %d queries", *flagQueryBuffer, querylog.MaxRingSize)
+		}
+		queryBuffer = querylog.NewRingLogger(*flagQueryBuffer)
+		queryBuffer.SetAnonymize(Config.QueryLog.Anonymize)
+		queryLoggers = append(queryLoggers, queryBuffer)
+	}
+	if len(queryLoggers) == 1 {
+		srv.SetQueryLogger(queryLoggers[0])
+	} else if len(queryLoggers) > 1 {
+		srv.SetQueryLogger(querylog.NewMultiLogger(queryLoggers...))
+	}
+
+	muxm, err := zones.NewMuxManagerSource(zoneSource(), srv)
 	if err != nil {
-		log.Printf("error loading zones: %s", err)
+		applog.Errorf("error loading zones: %s", err)
+	}
+	valid := validateZones(muxm)
+	if *flagStrictZones && (err != nil || !valid) {
+		applog.Errorf("not starting with invalid zones (-strictzones)")
+		os.Exit(1)
 	}
 	go muxm.Run()
 
+	var queryWindows *queryWindows
+	if *flagQueryWindow > 0 {
+		queryWindows = newQueryWindows(muxm, *flagQueryWindow)
+		go queryWindows.run()
+	}
+
 	for _, host := range inter {
 		go srv.ListenAndServe(host)
 	}
 
+	if len(*flagTLSCert) > 0 || len(*flagTLSKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(*flagTLSCert, *flagTLSKey)
+		if err != nil {
+			log.Fatalf("Could not load TLS certificate: %s", err)
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+		for _, host := range inter {
+			ip, _, _ := net.SplitHostPort(host)
+			go srv.ListenAndServeTLS(net.JoinHostPort(ip, *flagTLSPort), tlsConfig)
+		}
+	}
+
+	var hs *httpServer
 	if len(*flaghttp) > 0 {
-		go func() {
-			hs := NewHTTPServer(muxm, serverInfo)
-			hs.Run(*flaghttp)
-		}()
+		hs = NewHTTPServer(muxm, srv, serverInfo)
+		hs.token = *flagHTTPToken
+		mode, err := strconv.ParseUint(*flagHTTPMode, 8, 32)
+		if err != nil {
+			log.Fatalf("Invalid -httpmode '%s': %s", *flagHTTPMode, err)
+		}
+		hs.socketMode = os.FileMode(mode)
+		switch {
+		case len(*flagHTTPACME) > 0:
+			if len(*flagHTTPCert) > 0 || len(*flagHTTPKey) > 0 {
+				log.Fatalf("-httpacme can't be used with -httpcert and -httpkey")
+			}
+			hs.tlsConfig = newACMEConfig(*flagHTTPACME, *flagHTTPACMEDir)
+		case len(*flagHTTPCert) > 0 || len(*flagHTTPKey) > 0:
+			certs, err := newCertReloader(*flagHTTPCert, *flagHTTPKey)
+			if err != nil {
+				log.Fatalf("Could not load the HTTP certificate: %s", err)
+			}
+			hs.tlsConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+		}
+		hs.queries = queryBuffer
+		hs.queryWindows = queryWindows
+		if *flagPprof {
+			hs.EnablePprof()
+		}
+		go hs.Run(*flaghttp)
 	}
 
-	terminate := make(chan os.Signal)
-	signal.Notify(terminate, os.Interrupt)
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, os.Interrupt, syscall.SIGTERM)
 
 	<-terminate
 	log.Printf("geodns: signal received, stopping")
 
+	if hs != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := hs.Shutdown(ctx); err != nil {
+			applog.Errorf("stopping http interface: %s", err)
+		}
+		cancel()
+	}
+
 	if *memprofile != "" {
 		f, err := os.Create(*memprofile)
 		if err != nil {
@@ -258,3 +539,29 @@ func main() {
 	}
 	applog.FileClose()
 }
+
+// zoneSource returns where the zones are loaded from: the zone files
+// in the -config directory, or the bundle at -zonesurl.
+func zoneSource() zones.ZoneSource {
+	if len(*flagZonesURL) > 0 {
+		return zones.NewHTTPSource(*flagZonesURL, *flagZonesPoll)
+	}
+	return zones.NewDirSource(*flagconfig)
+}
+
+// validateZones logs the problems found in the loaded zones and
+// returns true if there were none.
+func validateZones(mm *zones.MuxManager) bool {
+	invalid := mm.Validate()
+	names := make([]string, 0, len(invalid))
+	for name := range invalid {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, problem := range invalid[name] {
+			applog.Warnf("zone %s: %s", name, problem)
+		}
+	}
+	return len(invalid) == 0
+}
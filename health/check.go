@@ -0,0 +1,272 @@
+package health
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/abh/geodns/applog"
+	"github.com/abh/geodns/typeutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var checkTargets *prometheus.GaugeVec
+
+// The checker that sets the gauges of each check name; the checker of
+// a reloaded zone takes them over from the old one, so closing the old
+// checker doesn't remove them.
+var (
+	ownersMu sync.Mutex
+	owners   = map[string]*Checker{}
+)
+
+func init() {
+	checkTargets = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "geodns_health_check_targets",
+			Help: "Number of actively health checked targets by status",
+		},
+		[]string{"check", "status"},
+	)
+	prometheus.MustRegister(checkTargets)
+}
+
+// DefaultJitter is the default fraction of the frequency the time
+// between two checks of a target varies by, so the checks of many
+// targets and servers don't hit the backends in bursts.
+const DefaultJitter = 0.2
+
+// maxJitter keeps the time between checks at least half the frequency.
+const maxJitter = 0.5
+
+// Checker actively checks a set of targets (IP addresses or host
+// names) with a TCP connect or an HTTP GET. Targets are healthy
+// until a check fails.
+type Checker struct {
+	name      string
+	kind      string
+	port      int
+	path      string
+	host      string
+	frequency time.Duration
+	timeout   time.Duration
+	jitter    float64
+
+	mu      sync.RWMutex
+	targets map[string]StatusType
+	quit    chan struct{}
+	closed  bool
+}
+
+// NewCheckerFromMap sets up a checker from the "health" options of
+// a label, for example {"check": "http", "port": 8080, "path": "/ok"}.
+// The name is used in logs and metrics.
+func NewCheckerFromMap(name string, i map[string]interface{}) (*Checker, error) {
+	c := &Checker{
+		name:      name,
+		kind:      typeutil.ToString(i["check"]),
+		path:      "/",
+		frequency: 30 * time.Second,
+		timeout:   5 * time.Second,
+		jitter:    DefaultJitter,
+		targets:   map[string]StatusType{},
+		quit:      make(chan struct{}),
+	}
+
+	switch c.kind {
+	case "tcp":
+	case "http":
+		c.port = 80
+	default:
+		return nil, fmt.Errorf("unknown health check '%s'", c.kind)
+	}
+
+	for k, v := range i {
+		switch k {
+		case "port":
+			c.port = typeutil.ToInt(v)
+		case "path":
+			c.path = typeutil.ToString(v)
+		case "host":
+			c.host = typeutil.ToString(v)
+		case "frequency":
+			c.frequency = time.Duration(typeutil.ToInt(v)) * time.Second
+		case "timeout":
+			c.timeout = time.Duration(typeutil.ToInt(v)) * time.Second
+		case "jitter":
+			c.jitter = typeutil.ToFloat(v)
+		}
+	}
+
+	if c.port <= 0 {
+		return nil, fmt.Errorf("%s health check requires a port", c.kind)
+	}
+	if c.frequency < time.Second {
+		c.frequency = time.Second
+	}
+	if c.timeout < time.Second {
+		c.timeout = time.Second
+	}
+	switch {
+	case c.jitter < 0:
+		c.jitter = 0
+	case c.jitter > maxJitter:
+		c.jitter = maxJitter
+	}
+
+	return c, nil
+}
+
+// Add starts checking target, if it isn't checked already.
+func (c *Checker) Add(target string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.targets[target]; ok || c.closed {
+		return
+	}
+	c.targets[target] = StatusHealthy
+	ownersMu.Lock()
+	owners[c.name] = c
+	ownersMu.Unlock()
+	c.updateMetrics()
+
+	go c.run(target)
+}
+
+// GetStatus returns the status of target, or StatusUnknown if
+// the target isn't being checked.
+func (c *Checker) GetStatus(target string) StatusType {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.targets[target]
+}
+
+// Reload is a no-op; the checks are configured in the zone file.
+func (c *Checker) Reload() error {
+	return nil
+}
+
+// Close stops the checks. It doesn't wait for the checks in progress,
+// so a reload isn't held up by them; their results are ignored.
+func (c *Checker) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.quit)
+	c.mu.Unlock()
+
+	ownersMu.Lock()
+	defer ownersMu.Unlock()
+	if owners[c.name] == c {
+		delete(owners, c.name)
+		checkTargets.DeleteLabelValues(c.name, StatusHealthy.String())
+		checkTargets.DeleteLabelValues(c.name, StatusUnhealthy.String())
+	}
+	return nil
+}
+
+// run checks target until the checker is closed. The first check is
+// delayed by a random part of the jitter, and the time between checks
+// varies by up to the jitter around the frequency, to spread the
+// checks of targets that were added at the same time.
+func (c *Checker) run(target string) {
+	timer := time.NewTimer(c.startDelay(rand.Float64()))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-timer.C:
+		}
+
+		status := StatusUnhealthy
+		if c.check(target) {
+			status = StatusHealthy
+		}
+		c.setStatus(target, status)
+
+		timer.Reset(c.interval(rand.Float64()))
+	}
+}
+
+// startDelay is the delay before the first check for r in [0, 1).
+func (c *Checker) startDelay(r float64) time.Duration {
+	return time.Duration(r * c.jitter * float64(c.frequency))
+}
+
+// interval is the time until the next check for r in [0, 1), within
+// the jitter around the frequency.
+func (c *Checker) interval(r float64) time.Duration {
+	return time.Duration((1 + c.jitter*(2*r-1)) * float64(c.frequency))
+}
+
+func (c *Checker) setStatus(target string, status StatusType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || c.targets[target] == status {
+		return
+	}
+	applog.Infof("health check %s: %s is %s", c.name, target, status)
+	c.targets[target] = status
+	c.updateMetrics()
+}
+
+// updateMetrics sets the healthy and unhealthy gauges, unless another
+// checker took them over; the caller must hold the lock.
+func (c *Checker) updateMetrics() {
+	ownersMu.Lock()
+	defer ownersMu.Unlock()
+	if owners[c.name] != c {
+		return
+	}
+
+	counts := map[StatusType]int{}
+	for _, st := range c.targets {
+		counts[st]++
+	}
+	for _, st := range []StatusType{StatusHealthy, StatusUnhealthy} {
+		checkTargets.WithLabelValues(c.name, st.String()).Set(float64(counts[st]))
+	}
+}
+
+func (c *Checker) check(target string) bool {
+	addr := net.JoinHostPort(target, strconv.Itoa(c.port))
+
+	switch c.kind {
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", addr, c.timeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+
+	case "http":
+		req, err := http.NewRequest("GET", "http://"+addr+c.path, nil)
+		if err != nil {
+			return false
+		}
+		if len(c.host) > 0 {
+			req.Host = c.host
+		}
+		client := &http.Client{Timeout: c.timeout}
+		resp, err := client.Do(req)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}
+
+	return false
+}
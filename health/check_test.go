@@ -0,0 +1,189 @@
+package health
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func waitStatus(t *testing.T, c *Checker, target string, expected StatusType) {
+	deadline := time.Now().Add(2 * time.Second)
+	for c.GetStatus(target) != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %s is %s, expected %s", c.name, target, c.GetStatus(target), expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCheckerJitter(t *testing.T) {
+	c, err := NewCheckerFromMap("jitter", map[string]interface{}{"check": "tcp", "port": float64(80), "frequency": float64(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.jitter != DefaultJitter {
+		t.Errorf("jitter is %v, expected the default %v", c.jitter, DefaultJitter)
+	}
+	for _, tc := range []struct {
+		r     float64
+		delay time.Duration
+		next  time.Duration
+	}{
+		{0, 0, 8 * time.Second},
+		{0.5, time.Second, 10 * time.Second},
+		{0.75, 1500 * time.Millisecond, 11 * time.Second},
+	} {
+		if d := c.startDelay(tc.r); d != tc.delay {
+			t.Errorf("start delay for %v is %s, expected %s", tc.r, d, tc.delay)
+		}
+		if d := c.interval(tc.r); d != tc.next {
+			t.Errorf("interval for %v is %s, expected %s", tc.r, d, tc.next)
+		}
+	}
+
+	for jitter, expected := range map[string]float64{"0": 0, "0.1": 0.1, "-1": 0, "2": maxJitter} {
+		c, err := NewCheckerFromMap("jitter", map[string]interface{}{"check": "tcp", "port": float64(80), "jitter": jitter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.jitter != expected {
+			t.Errorf("jitter %s is %v, expected %v", jitter, c.jitter, expected)
+		}
+	}
+	c.jitter = 0
+	if d := c.startDelay(0.9); d != 0 {
+		t.Errorf("start delay without jitter is %s", d)
+	}
+	if d := c.interval(0.9); d != c.frequency {
+		t.Errorf("interval without jitter is %s", d)
+	}
+}
+
+func TestChecker(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	if _, err := NewCheckerFromMap("bad", map[string]interface{}{"check": "ping"}); err == nil {
+		t.Errorf("unknown check type was accepted")
+	}
+
+	tcp, err := NewCheckerFromMap("tcp", map[string]interface{}{"check": "tcp", "port": float64(p), "jitter": float64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp.Add("127.0.0.1")
+	tcp.Add("127.0.0.2")
+	waitStatus(t, tcp, "127.0.0.1", StatusHealthy)
+	waitStatus(t, tcp, "127.0.0.2", StatusUnhealthy)
+
+	if st := tcp.GetStatus("192.0.2.1"); st != StatusUnknown {
+		t.Errorf("target that isn't checked was %s", st)
+	}
+
+	ok, err := NewCheckerFromMap("http-ok", map[string]interface{}{"check": "http", "port": float64(p), "jitter": float64(0), "path": "/ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok.Add("127.0.0.1")
+	waitStatus(t, ok, "127.0.0.1", StatusHealthy)
+
+	fail, err := NewCheckerFromMap("http-fail", map[string]interface{}{"check": "http", "port": float64(p), "jitter": float64(0), "path": "/fail"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail.Add("127.0.0.1")
+	waitStatus(t, fail, "127.0.0.1", StatusUnhealthy)
+
+	for _, c := range []*Checker{tcp, ok, fail} {
+		c.Close()
+	}
+
+	// targets added after Close aren't checked
+	tcp.Add("127.0.0.3")
+	if st := tcp.GetStatus("127.0.0.3"); st != StatusUnknown {
+		t.Errorf("target added after Close was %s", st)
+	}
+}
+
+// targetGauges returns the geodns_health_check_targets gauges of the
+// check name by status.
+func targetGauges(t *testing.T, name string) map[string]float64 {
+	ch := make(chan prometheus.Metric, 100)
+	checkTargets.Collect(ch)
+	close(ch)
+
+	gauges := map[string]float64{}
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		labels := map[string]string{}
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		if labels["check"] == name {
+			gauges[labels["status"]] = m.GetGauge().GetValue()
+		}
+	}
+	return gauges
+}
+
+func TestCheckerReload(t *testing.T) {
+	// the HTTP checks don't get an answer until the test is done
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	options := map[string]interface{}{"check": "http", "port": float64(p), "jitter": float64(0), "timeout": float64(10)}
+
+	old, err := NewCheckerFromMap("www.example.com", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Add("127.0.0.1")
+	old.Add("127.0.0.2")
+	if g := targetGauges(t, "www.example.com"); g["healthy"] != 2 {
+		t.Errorf("got gauges %v, expected 2 healthy targets", g)
+	}
+
+	// the checker of the reloaded zone takes over the gauges
+	c, err := NewCheckerFromMap("www.example.com", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Add("127.0.0.1")
+
+	start := time.Now()
+	old.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Close waited %s for the checks in progress", d)
+	}
+	if g := targetGauges(t, "www.example.com"); g["healthy"] != 1 {
+		t.Errorf("got gauges %v after closing the old checker, expected 1 healthy target", g)
+	}
+
+	c.Close()
+	if g := targetGauges(t, "www.example.com"); len(g) != 0 {
+		t.Errorf("got gauges %v after closing the last checker, expected none", g)
+	}
+}
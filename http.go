@@ -1,21 +1,76 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/abh/geodns/applog"
 	"github.com/abh/geodns/monitor"
+	"github.com/abh/geodns/querylog"
+	"github.com/abh/geodns/server"
+	"github.com/abh/geodns/targeting"
+	"github.com/abh/geodns/targeting/geoip2"
 	"github.com/abh/geodns/zones"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type httpServer struct {
 	mux        *http.ServeMux
+	server     *http.Server
 	zones      *zones.MuxManager
+	dns        *server.Server
 	serverInfo *monitor.ServerInfo
+
+	// token required by the endpoints that change the server,
+	// they are disabled when it isn't set
+	token string
+
+	// draining makes /health fail while the DNS server keeps
+	// answering, to take the server out of a load balancer
+	draining int32
+
+	// socketMode is the file mode of the socket when listening
+	// on a unix:/path address
+	socketMode os.FileMode
+
+	// queries are the most recent queries, shown by /queries
+	queries *querylog.RingLogger
+
+	// queryWindows are the query counts of the zones, shown by
+	// /querycounts
+	queryWindows *queryWindows
+
+	// tlsConfig serves the interface over HTTPS when it's set
+	tlsConfig *tls.Config
+}
+
+var drainingGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "geodns_draining",
+		Help: "1 if the server is draining (/health fails, queries are still answered)",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(drainingGauge)
 }
 
 type rate struct {
@@ -56,26 +111,92 @@ func topParam(req *http.Request, def int) int {
 	return topOption
 }
 
-func NewHTTPServer(mm *zones.MuxManager, serverInfo *monitor.ServerInfo) *httpServer {
+func NewHTTPServer(mm *zones.MuxManager, dnsServer *server.Server, serverInfo *monitor.ServerInfo) *httpServer {
 
 	hs := &httpServer{
 		zones:      mm,
+		dns:        dnsServer,
 		mux:        &http.ServeMux{},
 		serverInfo: serverInfo,
+		socketMode: 0660,
 	}
 	hs.mux.HandleFunc("/", hs.mainServer)
+	hs.mux.HandleFunc("/health", hs.healthServer)
 	hs.mux.Handle("/metrics", promhttp.Handler())
+	hs.mux.HandleFunc("/zones", hs.zonesServer)
+	hs.mux.HandleFunc("/labels", hs.labelsServer)
+	hs.mux.HandleFunc("/reload", hs.tokenAuth("POST", hs.reloadServer))
+	hs.mux.HandleFunc("/debug", hs.tokenAuth("GET", hs.debugServer))
+	hs.mux.HandleFunc("/config", hs.tokenAuth("GET", hs.configServer))
+	hs.mux.HandleFunc("/queries", hs.tokenAuth("GET", hs.queriesServer))
+	hs.mux.HandleFunc("/querycounts", hs.tokenAuth("GET", hs.queryCountsServer))
+	hs.mux.HandleFunc("/drain", hs.tokenAuth("POST", hs.drainServer(true)))
+	hs.mux.HandleFunc("/undrain", hs.tokenAuth("POST", hs.drainServer(false)))
+	hs.mux.HandleFunc("/maintenance", hs.tokenAuth("POST", hs.maintenanceServer))
+
+	hs.server = &http.Server{Handler: &basicauth{h: hs.mux}}
 
 	return hs
 }
 
+// EnablePprof serves the net/http/pprof profiles under /debug/pprof/.
+// They show the internals of the process and can use a lot of CPU,
+// so they are only enabled with -pprof. The command line isn't served,
+// as it has the -httptoken.
+func (hs *httpServer) EnablePprof() {
+	hs.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	hs.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	hs.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	hs.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
 func (hs *httpServer) Mux() *http.ServeMux {
 	return hs.mux
 }
 
+// Run serves the HTTP interface on listen, a TCP address or a Unix
+// socket given as unix:/path/to/sock, over TLS if tlsConfig is set.
 func (hs *httpServer) Run(listen string) {
 	log.Println("Starting HTTP interface on", listen)
-	log.Fatal(http.ListenAndServe(listen, &basicauth{h: hs.mux}))
+	l, err := hs.listen(listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if hs.tlsConfig != nil {
+		l = tls.NewListener(l, hs.tlsConfig)
+	}
+	err = hs.server.Serve(l)
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+func (hs *httpServer) listen(listen string) (net.Listener, error) {
+	if !strings.HasPrefix(listen, "unix:") {
+		hs.server.Addr = listen
+		return net.Listen("tcp", listen)
+	}
+
+	path := strings.TrimPrefix(listen, "unix:")
+	// remove the socket left behind by a previous run
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, hs.socketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Shutdown stops the HTTP interface, waiting for active requests
+// to finish until the context expires.
+func (hs *httpServer) Shutdown(ctx context.Context) error {
+	return hs.server.Shutdown(ctx)
 }
 
 func (hs *httpServer) mainServer(w http.ResponseWriter, req *http.Request) {
@@ -85,7 +206,345 @@ func (hs *httpServer) mainServer(w http.ResponseWriter, req *http.Request) {
 	}
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(200)
-	io.WriteString(w, `GeoDNS `+hs.serverInfo.Version+`\n`)
+	fmt.Fprintf(w, "GeoDNS %s\ncommit: %s\nbuild date: %s\n",
+		hs.serverInfo.Version, hs.serverInfo.Commit, hs.serverInfo.BuildDate)
+}
+
+// healthServer is a readiness check for load balancers; it returns
+// 200 when zones have been loaded and the DNS server is listening.
+func (hs *httpServer) healthServer(w http.ResponseWriter, req *http.Request) {
+	zoneCount := hs.zones.ZoneCount()
+	listening := hs.dns != nil && hs.dns.Listening()
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	switch {
+	case hs.Draining():
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "draining\n")
+	case zoneCount == 0:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "no zones loaded\n")
+	case !listening:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "DNS server not listening\n")
+	default:
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "OK\n")
+	}
+	fmt.Fprintf(w, "zones: %d\n", zoneCount)
+	if hs.dns != nil && hs.dns.Maintenance() {
+		io.WriteString(w, "maintenance: true\n")
+	}
+}
+
+// Draining returns true after a request to /drain, until /undrain.
+func (hs *httpServer) Draining() bool {
+	return atomic.LoadInt32(&hs.draining) == 1
+}
+
+// drainServer returns a handler that sets or clears the draining
+// state.
+func (hs *httpServer) drainServer(drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if drain {
+			atomic.StoreInt32(&hs.draining, 1)
+			drainingGauge.Set(1)
+			applog.Infof("draining, /health returns 503")
+		} else {
+			atomic.StoreInt32(&hs.draining, 0)
+			drainingGauge.Set(0)
+			applog.Infof("not draining")
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "draining: %t\n", drain)
+	}
+}
+
+// maintenanceServer turns the maintenance mode of the DNS server on,
+// or off with enable=false.
+func (hs *httpServer) maintenanceServer(w http.ResponseWriter, req *http.Request) {
+	if hs.dns == nil {
+		http.Error(w, "no DNS server", http.StatusServiceUnavailable)
+		return
+	}
+	on := true
+	if s := req.URL.Query().Get("enable"); len(s) > 0 {
+		var err error
+		if on, err = strconv.ParseBool(s); err != nil {
+			http.Error(w, "invalid enable", http.StatusBadRequest)
+			return
+		}
+	}
+	hs.dns.SetMaintenance(on)
+	if on {
+		applog.Infof("maintenance mode, all queries get the maintenance response")
+	} else {
+		applog.Infof("maintenance mode off")
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "maintenance: %t\n", on)
+}
+
+// zonesServer lists the loaded zones with their serial and the
+// modification time of the zone file, to compare servers, and the
+// problems found in each zone.
+func (hs *httpServer) zonesServer(w http.ResponseWriter, req *http.Request) {
+	type zoneInfo struct {
+		Name     string    `json:"name"`
+		Serial   int       `json:"serial"`
+		File     string    `json:"file"`
+		Modified time.Time `json:"modified"`
+		Problems []string  `json:"problems,omitempty"`
+	}
+
+	zl := hs.zones.Zones()
+	list := make([]zoneInfo, 0, len(zl))
+	for name, zone := range zl {
+		if name == "pgeodns" {
+			continue
+		}
+		list = append(list, zoneInfo{
+			Name:     name,
+			Serial:   zone.Options.Serial,
+			File:     zone.FileName,
+			Modified: zone.ModTime,
+			Problems: zone.Validate(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// labelsServer lists the busiest labels of each zone in its recent
+// queries (the last 10000 per zone), to see which names are hot right
+// now. The zones with the most queries are first; ?top=N sets how
+// many labels are listed for each zone (default 10), the rest are
+// counted as "Others".
+func (hs *httpServer) labelsServer(w http.ResponseWriter, req *http.Request) {
+	type zoneLabels struct {
+		Name    string      `json:"name"`
+		Queries int64       `json:"queries"`
+		Labels  interface{} `json:"labels"`
+	}
+
+	top := topParam(req, 10)
+	if top < 1 {
+		top = 1
+	}
+
+	list := rates{}
+	for name, zone := range hs.zones.Zones() {
+		if name == "pgeodns" || zone.Metrics.LabelStats == nil {
+			continue
+		}
+		r := &rate{Name: name, Metrics: zone.Metrics}
+		for _, count := range zone.Metrics.LabelStats.Counts() {
+			r.Count += int64(count)
+		}
+		list = append(list, r)
+	}
+	sort.Sort(ratesByCount{list})
+
+	result := make([]zoneLabels, 0, len(list))
+	for _, r := range list {
+		result = append(result, zoneLabels{
+			Name:    r.Name,
+			Queries: r.Count,
+			Labels:  r.Metrics.LabelStats.TopCounts(top),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// tokenAuth only calls h for requests with the given method and the
+// shared secret in the X-GeoDNS-Token header.
+func (hs *httpServer) tokenAuth(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if len(hs.token) == 0 {
+			http.Error(w, "disabled, no -httptoken configured", http.StatusForbidden)
+			return
+		}
+		if req.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		token := req.Header.Get("X-GeoDNS-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(hs.token)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// reloadServer reloads the zone files and returns a JSON summary of
+// the zones that were added, changed, removed or failed to load.
+func (hs *httpServer) reloadServer(w http.ResponseWriter, req *http.Request) {
+	summary, err := hs.zones.Reload()
+
+	result := struct {
+		*zones.ReloadSummary
+		Error string `json:"error,omitempty"`
+	}{ReloadSummary: summary}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		result.Error = err.Error()
+		if len(summary.Failed) == 0 {
+			// the zone directory couldn't be read
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// debugServer shows how a query for name in zone from ip would be
+// answered, as JSON.
+func (hs *httpServer) debugServer(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+
+	zone, ok := hs.zones.Zones()[q.Get("zone")]
+	if !ok {
+		http.Error(w, "unknown zone", http.StatusNotFound)
+		return
+	}
+
+	ip := net.ParseIP(q.Get("ip"))
+	if ip == nil {
+		http.Error(w, "invalid ip", http.StatusBadRequest)
+		return
+	}
+
+	qtype := dns.TypeA
+	if t := q.Get("type"); len(t) > 0 {
+		if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+			http.Error(w, "unknown type", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// the name can be relative to the zone or a full name
+	name := strings.ToLower(strings.TrimSuffix(q.Get("name"), "."))
+	if name == zone.Origin {
+		name = ""
+	}
+	name = strings.TrimSuffix(name, "."+zone.Origin)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(zone.Trace(name, qtype, ip))
+}
+
+// queriesServer returns the most recent queries as JSON, the oldest
+// first; "n" limits the number of queries.
+func (hs *httpServer) queriesServer(w http.ResponseWriter, req *http.Request) {
+	if hs.queries == nil {
+		http.Error(w, "the query buffer isn't enabled (-querybuffer)", http.StatusNotFound)
+		return
+	}
+	n := 0
+	if s := req.URL.Query().Get("n"); len(s) > 0 {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hs.queries.Entries(n))
+}
+
+// queryCountsServer returns the number of queries for each zone in
+// the current window so far and in the last completed windows, as
+// JSON.
+func (hs *httpServer) queryCountsServer(w http.ResponseWriter, req *http.Request) {
+	if hs.queryWindows == nil {
+		http.Error(w, "the query windows aren't enabled (-querywindow)", http.StatusNotFound)
+		return
+	}
+	current, windows := hs.queryWindows.current()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Interval string        `json:"interval"`
+		Current  queryWindow   `json:"current"`
+		Windows  []queryWindow `json:"windows"`
+	}{hs.queryWindows.interval.String(), current, windows})
+}
+
+// secretFlags are the flags that aren't shown by /config.
+var secretFlags = map[string]bool{
+	"httptoken": true,
+}
+
+// urlFlags are the flags with URLs that can have credentials; /config
+// shows them without the user info and the query string.
+var urlFlags = map[string]bool{
+	"zonesurl": true,
+}
+
+// redactURL returns s without the user info and the query string.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "REDACTED"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// configServer returns the flags and the settings derived from them,
+// as JSON, to compare the configuration of servers.
+func (hs *httpServer) configServer(w http.ResponseWriter, req *http.Request) {
+	type configInfo struct {
+		Flags          map[string]string `json:"flags"`
+		ZonesDirectory string            `json:"zones_directory"`
+		GeoIPDirectory string            `json:"geoip_directory"`
+		GeoIPDatabases []geoip2.Database `json:"geoip_databases"`
+		Listen         []string          `json:"listen"`
+		HTTP           string            `json:"http"`
+	}
+
+	info := configInfo{
+		Flags:          map[string]string{},
+		ZonesDirectory: *flagconfig,
+		GeoIPDirectory: Config.GeoIPDirectory(),
+		GeoIPDatabases: []geoip2.Database{},
+		Listen:         getInterfaces(),
+		HTTP:           *flaghttp,
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch {
+		case len(value) == 0:
+		case secretFlags[f.Name]:
+			value = "REDACTED"
+		case urlFlags[f.Name]:
+			value = redactURL(value)
+		}
+		info.Flags[f.Name] = value
+	})
+	p := targeting.Geo()
+	if o, ok := p.(*targeting.GeoOverrides); ok {
+		p = o.Provider
+	}
+	if c, ok := p.(*targeting.GeoCache); ok {
+		p = c.Provider
+	}
+	if g, ok := p.(*geoip2.GeoIP2); ok {
+		info.GeoIPDatabases = g.Databases()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
 }
 
 type basicauth struct {
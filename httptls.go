@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abh/geodns/applog"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certCheckInterval is how often the certificate files of the HTTP
+// interface are checked for changes.
+const certCheckInterval = time.Minute
+
+// certReloader serves the certificate in certFile and keyFile, and
+// reads them again when they change, so a certificate renewed by an
+// ACME client (like certbot or lego) is used without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// modified returns the latest modification time of the files.
+func (c *certReloader) modified() time.Time {
+	var t time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
+
+func (c *certReloader) load() error {
+	modTime := c.modified()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now := time.Now(); now.Sub(c.checked) >= certCheckInterval {
+		c.checked = now
+		if c.modified().After(c.modTime) {
+			if err := c.load(); err != nil {
+				// a renewal can be caught between writing the two
+				// files; the old certificate is used until both are
+				// readable
+				applog.Warnf("could not reload the HTTP certificate, keeping the old one: %s", err)
+			} else {
+				applog.Infof("reloaded the HTTP certificate '%s'", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// newACMEConfig returns the TLS configuration that gets and renews
+// the certificates for hosts (comma separated) from Let's Encrypt,
+// keeping them in cacheDir so a restart doesn't request them again.
+// The CA checks the hosts with the TLS-ALPN-01 challenge, so the
+// interface has to be reachable on port 443 of each host.
+func newACMEConfig(hosts, cacheDir string) *tls.Config {
+	var names []string
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.TrimSpace(h); len(h) > 0 {
+			names = append(names, h)
+		}
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(names...),
+		Cache:      autocert.DirCache(cacheDir),
+	}
+	return m.TLSConfig()
+}
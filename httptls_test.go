@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes a self-signed certificate for name and its key
+// to certFile and keyFile, modified at modTime.
+func writeTestCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	require.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	for _, name := range []string{certFile, keyFile} {
+		require.Nil(t, os.Chtimes(name, modTime, modTime))
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geodns-cert")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	writeTestCert(t, certFile, keyFile, "first", start)
+
+	c, err := newCertReloader(certFile, keyFile)
+	require.Nil(t, err)
+
+	name := func() string {
+		cert, err := c.GetCertificate(nil)
+		require.Nil(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.Nil(t, err)
+		return leaf.Subject.CommonName
+	}
+	require.Equal(t, "first", name())
+
+	// renewed, it's only read after the check interval
+	writeTestCert(t, certFile, keyFile, "renewed", start.Add(time.Minute))
+	require.Equal(t, "first", name())
+	c.checked = time.Time{}
+	require.Equal(t, "renewed", name())
+
+	// a broken renewal keeps the certificate
+	require.Nil(t, ioutil.WriteFile(keyFile, []byte("broken"), 0600))
+	c.checked = time.Time{}
+	require.Equal(t, "renewed", name())
+
+	_, err = newCertReloader(certFile, filepath.Join(dir, "missing.pem"))
+	require.Error(t, err)
+}
+
+func TestACMEConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geodns-acme")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// a certificate from an earlier run, in the autocert cache format
+	// (the key, then the certificate chain)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "geodns1.example.com"},
+		DNSNames:     []string{"geodns1.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	cached := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "geodns1.example.com"), cached, 0600))
+
+	config := newACMEConfig("geodns1.example.com, geodns2.example.com", dir)
+	require.Contains(t, config.NextProtos, "acme-tls/1", "TLS-ALPN-01 challenge")
+
+	hello := func(name string) *tls.ClientHelloInfo {
+		return &tls.ClientHelloInfo{
+			ServerName:        name,
+			SupportedCurves:   []tls.CurveID{tls.CurveP256},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedVersions: []uint16{tls.VersionTLS12},
+			CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		}
+	}
+
+	cert, err := config.GetCertificate(hello("geodns1.example.com"))
+	require.Nil(t, err, "served from the cache")
+	require.Equal(t, der, cert.Certificate[0])
+
+	_, err = config.GetCertificate(hello("other.example.com"))
+	require.Error(t, err, "not one of the hosts")
+}
@@ -6,12 +6,15 @@ import (
 
 // ServerInfo has the configured ID and groups and the first IP
 // address for the server among other 'who am I' information. The
-// UUID is reset on each restart.
+// UUID is reset on each restart. Commit and BuildDate are set at
+// build time, or "unknown".
 type ServerInfo struct {
-	Version string
-	ID      string
-	IP      string
-	UUID    string
-	Groups  []string
-	Started time.Time
+	Version   string
+	Commit    string
+	BuildDate string
+	ID        string
+	IP        string
+	UUID      string
+	Groups    []string
+	Started   time.Time
 }
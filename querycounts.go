@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/abh/geodns/zones"
+)
+
+// maxQueryWindows is how many completed windows are kept.
+const maxQueryWindows = 24
+
+// queryWindows reads and resets the query counts of the zones at the
+// end of each window of interval, aligned to the clock (hourly windows
+// end on the hour), and keeps the counts of the last windows for
+// /querycounts.
+type queryWindows struct {
+	zones    *zones.MuxManager
+	interval time.Duration
+
+	mu      sync.Mutex
+	start   time.Time
+	windows []queryWindow
+}
+
+// queryWindow is the number of queries for each zone from Start until
+// End.
+type queryWindow struct {
+	Start time.Time        `json:"start"`
+	End   time.Time        `json:"end"`
+	Zones map[string]int64 `json:"zones"`
+}
+
+func newQueryWindows(mm *zones.MuxManager, interval time.Duration) *queryWindows {
+	return &queryWindows{zones: mm, interval: interval, start: time.Now()}
+}
+
+func (qw *queryWindows) run() {
+	for {
+		end := time.Now().Truncate(qw.interval).Add(qw.interval)
+		time.Sleep(time.Until(end))
+		qw.rotate(end)
+	}
+}
+
+// rotate ends the current window at end and starts the next one.
+func (qw *queryWindows) rotate(end time.Time) {
+	qw.mu.Lock()
+	defer qw.mu.Unlock()
+
+	w := queryWindow{Start: qw.start, End: end, Zones: map[string]int64{}}
+	for name, zone := range qw.zones.Zones() {
+		if name == "pgeodns" || zone.Metrics.Queries == nil {
+			continue
+		}
+		w.Zones[name] = zone.Metrics.Queries.Reset()
+	}
+	qw.windows = append(qw.windows, w)
+	if len(qw.windows) > maxQueryWindows {
+		qw.windows = qw.windows[len(qw.windows)-maxQueryWindows:]
+	}
+	qw.start = end
+}
+
+// current returns the counts of the window so far, and the completed
+// windows, oldest first.
+func (qw *queryWindows) current() (queryWindow, []queryWindow) {
+	qw.mu.Lock()
+	defer qw.mu.Unlock()
+
+	w := queryWindow{Start: qw.start, End: time.Now(), Zones: map[string]int64{}}
+	for name, zone := range qw.zones.Zones() {
+		if name == "pgeodns" || zone.Metrics.Queries == nil {
+			continue
+		}
+		w.Zones[name] = zone.Metrics.Queries.Count()
+	}
+	windows := make([]queryWindow, len(qw.windows))
+	copy(windows, qw.windows)
+	return w, windows
+}
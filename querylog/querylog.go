@@ -2,6 +2,11 @@ package querylog
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 )
@@ -23,10 +28,22 @@ type Entry struct {
 	RemoteAddr string
 	ClientAddr string
 	HasECS     bool
+
+	// MatchedBy is the targeting LabelName was found with: "@"
+	// for the label itself, "country", "continent" and so on (see
+	// targeting.TargetType)
+	MatchedBy string `json:",omitempty"`
+
+	// Comments are the comments of the answer records in the zone
+	Comments []string `json:",omitempty"`
 }
 
 type FileLogger struct {
 	logger lumberjack.Logger
+
+	sample    uint64
+	count     uint64
+	anonymize bool
 }
 
 func NewFileLogger(filename string, maxsize int, keep int) (*FileLogger, error) {
@@ -39,7 +56,35 @@ func NewFileLogger(filename string, maxsize int, keep int) (*FileLogger, error)
 	return fl, nil
 }
 
+// SetSample makes the logger write only one in every n queries.
+func (l *FileLogger) SetSample(n int) {
+	if n < 1 {
+		n = 1
+	}
+	l.sample = uint64(n)
+}
+
+// SetAnonymize makes the logger truncate the client addresses to
+// the /24 (IPv4) or /64 (IPv6) network.
+func (l *FileLogger) SetAnonymize(anonymize bool) {
+	l.anonymize = anonymize
+}
+
+// Reopen closes the log file so it's opened again on the next write,
+// for when it has been moved by an external log rotation.
+func (l *FileLogger) Reopen() error {
+	return l.logger.Close()
+}
+
 func (l *FileLogger) Write(e *Entry) error {
+	if l.sample > 1 && atomic.AddUint64(&l.count, 1)%l.sample != 0 {
+		return nil
+	}
+
+	if l.anonymize {
+		e = anonymizeEntry(e)
+	}
+
 	js, err := json.Marshal(e)
 	if err != nil {
 		return err
@@ -48,3 +93,49 @@ func (l *FileLogger) Write(e *Entry) error {
 	_, err = l.logger.Write(js)
 	return err
 }
+
+// anonymizeEntry returns a copy of e with the addresses anonymized.
+func anonymizeEntry(e *Entry) *Entry {
+	anon := *e
+	anon.RemoteAddr = anonymizeAddr(e.RemoteAddr)
+	anon.ClientAddr = anonymizeAddr(e.ClientAddr)
+	return &anon
+}
+
+var (
+	cidr24Mask = net.CIDRMask(24, 32)
+	cidr64Mask = net.CIDRMask(64, 128)
+)
+
+// anonymizeAddr truncates an "ip" or "ip/len" address to the /24
+// or /64 network (or the given prefix, if it's shorter).
+func anonymizeAddr(addr string) string {
+	if len(addr) == 0 {
+		return addr
+	}
+
+	prefix := -1
+	if i := strings.Index(addr, "/"); i >= 0 {
+		if n, err := strconv.Atoi(addr[i+1:]); err == nil {
+			prefix = n
+		}
+		addr = addr[:i]
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+
+	mask, bits := cidr64Mask, 64
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		mask, bits = cidr24Mask, 24
+	}
+	if prefix >= 0 && prefix < bits {
+		bits = prefix
+		mask = net.CIDRMask(bits, len(ip)*8)
+	}
+
+	return fmt.Sprintf("%s/%d", ip.Mask(mask), bits)
+}
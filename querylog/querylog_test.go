@@ -0,0 +1,157 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAnonymizeAddr(t *testing.T) {
+	tests := []struct {
+		addr, expected string
+	}{
+		{"192.0.2.123", "192.0.2.0/24"},
+		{"192.0.2.123/32", "192.0.2.0/24"},
+		{"192.0.2.123/16", "192.0.0.0/16"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:3:4:5:6/128", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:3:4:5:6/48", "2001:db8:1::/48"},
+		{"", ""},
+		{"not-an-ip", ""},
+	}
+	for _, test := range tests {
+		if got := anonymizeAddr(test.addr); got != test.expected {
+			t.Errorf("anonymizeAddr(%q) = %q, expected %q", test.addr, got, test.expected)
+		}
+	}
+}
+
+func TestFileLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geodns-querylog.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queries.log")
+
+	fl, err := NewFileLogger(path, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl.SetSample(10)
+	fl.SetAnonymize(true)
+
+	e := &Entry{Name: "www.example.com.", RemoteAddr: "192.0.2.10", ClientAddr: "198.51.100.20/32"}
+	for i := 0; i < 100; i++ {
+		if err := fl.Write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e.RemoteAddr != "192.0.2.10" {
+		t.Errorf("Write modified the entry: %q", e.RemoteAddr)
+	}
+
+	// moved away by an external log rotation
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	fl.Reopen()
+	for i := 0; i < 10; i++ {
+		fl.Write(e)
+	}
+	fl.Reopen()
+
+	countLines := func(name string) int {
+		fh, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fh.Close()
+
+		n := 0
+		scanner := bufio.NewScanner(fh)
+		for scanner.Scan() {
+			var logged Entry
+			if err := json.Unmarshal(scanner.Bytes(), &logged); err != nil {
+				t.Fatal(err)
+			}
+			if logged.RemoteAddr != "192.0.2.0/24" || logged.ClientAddr != "198.51.100.0/24" {
+				t.Errorf("addresses weren't anonymized: %+v", logged)
+			}
+			n++
+		}
+		return n
+	}
+
+	if n := countLines(path + ".1"); n != 10 {
+		t.Errorf("logged %d of 100 queries, expected 10", n)
+	}
+	if n := countLines(path); n != 1 {
+		t.Errorf("logged %d queries after reopening, expected 1", n)
+	}
+}
+
+func TestRingLogger(t *testing.T) {
+	rl := NewRingLogger(3)
+	if got := rl.Entries(0); len(got) != 0 {
+		t.Errorf("got %d entries from an empty logger", len(got))
+	}
+
+	names := func(entries []Entry) []string {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		return names
+	}
+
+	for _, name := range []string{"a.", "b."} {
+		rl.Write(&Entry{Name: name})
+	}
+	if got := names(rl.Entries(0)); !reflect.DeepEqual(got, []string{"a.", "b."}) {
+		t.Errorf("got %v before the buffer is full", got)
+	}
+
+	for _, name := range []string{"c.", "d.", "e."} {
+		rl.Write(&Entry{Name: name})
+	}
+	if got := names(rl.Entries(0)); !reflect.DeepEqual(got, []string{"c.", "d.", "e."}) {
+		t.Errorf("got %v, expected the last 3 queries", got)
+	}
+	if got := names(rl.Entries(2)); !reflect.DeepEqual(got, []string{"d.", "e."}) {
+		t.Errorf("got %v, expected the last 2 queries", got)
+	}
+	if got := names(rl.Entries(10)); len(got) != 3 {
+		t.Errorf("got %d entries, expected at most the buffer size", len(got))
+	}
+
+	rl.SetAnonymize(true)
+	e := &Entry{Name: "f.", RemoteAddr: "192.0.2.10"}
+	rl.Write(e)
+	if got := rl.Entries(1)[0].RemoteAddr; got != "192.0.2.0/24" {
+		t.Errorf("got address %q, expected it anonymized", got)
+	}
+	if e.RemoteAddr != "192.0.2.10" {
+		t.Errorf("Write modified the entry: %q", e.RemoteAddr)
+	}
+
+	if max := NewRingLogger(MaxRingSize + 1); len(max.entries) != MaxRingSize {
+		t.Errorf("got a buffer of %d entries, expected the maximum %d", len(max.entries), MaxRingSize)
+	}
+}
+
+func TestMultiLogger(t *testing.T) {
+	a, b := NewRingLogger(2), NewRingLogger(2)
+	ml := NewMultiLogger(a, b)
+	if err := ml.Write(&Entry{Name: "a."}); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Entries(0)) != 1 || len(b.Entries(0)) != 1 {
+		t.Errorf("the query wasn't written to all the loggers")
+	}
+}
@@ -0,0 +1,91 @@
+package querylog
+
+import "sync"
+
+// MaxRingSize is the largest number of queries a RingLogger keeps.
+const MaxRingSize = 100000
+
+// RingLogger keeps the most recent queries in memory.
+type RingLogger struct {
+	mu        sync.Mutex
+	entries   []Entry
+	next      int
+	full      bool
+	anonymize bool
+}
+
+// NewRingLogger returns a logger keeping the last size queries, up to
+// MaxRingSize.
+func NewRingLogger(size int) *RingLogger {
+	if size > MaxRingSize {
+		size = MaxRingSize
+	}
+	if size < 1 {
+		size = 1
+	}
+	return &RingLogger{entries: make([]Entry, size)}
+}
+
+// SetAnonymize makes the logger truncate the client addresses to
+// the /24 (IPv4) or /64 (IPv6) network.
+func (l *RingLogger) SetAnonymize(anonymize bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.anonymize = anonymize
+}
+
+func (l *RingLogger) Write(e *Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.anonymize {
+		e = anonymizeEntry(e)
+	}
+	l.entries[l.next] = *e
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+	return nil
+}
+
+// Entries returns up to n of the most recent queries, the oldest
+// first; all of them if n is 0.
+func (l *RingLogger) Entries(n int) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := l.next
+	if l.full {
+		count = len(l.entries)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+	entries := make([]Entry, 0, n)
+	start := l.next - n
+	if start < 0 {
+		start += len(l.entries)
+	}
+	for i := 0; i < n; i++ {
+		entries = append(entries, l.entries[(start+i)%len(l.entries)])
+	}
+	return entries
+}
+
+type multiLogger []QueryLogger
+
+// NewMultiLogger returns a logger writing the queries to all the
+// loggers.
+func NewMultiLogger(loggers ...QueryLogger) QueryLogger {
+	return multiLogger(loggers)
+}
+
+func (m multiLogger) Write(e *Entry) error {
+	var err error
+	for _, l := range m {
+		if lerr := l.Write(e); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/abh/geodns/zones"
+	"github.com/miekg/dns"
+)
+
+// aliasWriter answers a query for an alias of a zone that was served
+// as a query for the zone origin; the names in the answer are
+// rewritten back to the alias before it's sent.
+type aliasWriter struct {
+	dns.ResponseWriter
+	origin   string
+	alias    string
+	question []dns.Question
+}
+
+func (srv *Server) setupAliasFunc(zone *zones.Zone, alias string) func(dns.ResponseWriter, *dns.Msg) {
+	origin := dns.Fqdn(zone.Origin)
+	alias = dns.Fqdn(alias)
+
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		req := r.Copy()
+		for i, q := range req.Question {
+			req.Question[i].Name = renameOrigin(q.Name, alias, origin)
+		}
+		aw := &aliasWriter{
+			ResponseWriter: w,
+			origin:         origin,
+			alias:          alias,
+			question:       r.Question,
+		}
+		srv.serve(aw, req, zone)
+	}
+}
+
+// queryName returns the name that was queried; for an alias that's
+// the name in the alias, not the zone origin.
+func queryName(w dns.ResponseWriter, qname string) string {
+	if aw, ok := w.(*aliasWriter); ok && len(aw.question) > 0 {
+		return aw.question[0].Name
+	}
+	return qname
+}
+
+func (w *aliasWriter) WriteMsg(m *dns.Msg) error {
+	m.Question = w.question
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for i, rr := range section {
+			section[i] = w.rename(rr)
+		}
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// rename returns rr with the names in the zone moved to the alias;
+// the records can be shared with the zone, so they're copied first.
+func (w *aliasWriter) rename(rr dns.RR) dns.RR {
+	if rr.Header().Rrtype == dns.TypeOPT {
+		return rr
+	}
+	rr = dns.Copy(rr)
+	h := rr.Header()
+	for _, q := range w.question {
+		if strings.EqualFold(h.Name, renameOrigin(q.Name, w.alias, w.origin)) {
+			// keep the case of the question
+			h.Name = q.Name
+		}
+	}
+	h.Name = renameOrigin(h.Name, w.origin, w.alias)
+
+	switch rr := rr.(type) {
+	case *dns.SOA:
+		rr.Ns = renameOrigin(rr.Ns, w.origin, w.alias)
+		rr.Mbox = renameOrigin(rr.Mbox, w.origin, w.alias)
+	case *dns.NS:
+		rr.Ns = renameOrigin(rr.Ns, w.origin, w.alias)
+	case *dns.CNAME:
+		rr.Target = renameOrigin(rr.Target, w.origin, w.alias)
+	}
+	return rr
+}
+
+// renameOrigin replaces the from suffix of name with to.
+func renameOrigin(name, from, to string) string {
+	switch {
+	case strings.EqualFold(name, from):
+		return to
+	case len(name) > len(from) && strings.EqualFold(name[len(name)-len(from)-1:], "."+from):
+		return name[:len(name)-len(from)] + to
+	}
+	return name
+}
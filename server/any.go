@@ -0,0 +1,38 @@
+package server
+
+import (
+	"github.com/abh/geodns/zones"
+	"github.com/miekg/dns"
+)
+
+// SetMinimalANY sets if ANY queries over UDP get a minimal answer (RFC
+// 8482), the default, instead of all the records of the name, so they
+// can't be used for amplification. Queries over TCP always get all
+// the records.
+func (srv *Server) SetMinimalANY(enabled bool) {
+	srv.update(func(s *settings) {
+		s.minimalAny = enabled
+	})
+}
+
+// minimalANY answers an ANY query for a name with records with a
+// synthesized HINFO record (RFC 8482 4.2) and the zone SOA, and
+// returns no matches. A signed zone can't sign the HINFO, so with
+// dnssec only the match for the first record type is returned, to
+// answer with that RRset (RFC 8482 4.1). It returns false if the
+// name doesn't have any records, so the answer is the usual one.
+func minimalANY(m *dns.Msg, z *zones.Zone, matches []zones.LabelMatch, qname string, dnssec bool) ([]zones.LabelMatch, bool) {
+	for i, match := range matches {
+		if match.Type == 0 || zones.IsDnssecType(match.Type) {
+			continue
+		}
+		if dnssec {
+			return matches[i : i+1], true
+		}
+		h := dns.RR_Header{Name: qname, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: uint32(z.Options.Ttl)}
+		m.Answer = []dns.RR{&dns.HINFO{Hdr: h, Cpu: "RFC8482"}}
+		m.Ns = append(m.Ns, dns.Copy(z.SoaRR()))
+		return nil, true
+	}
+	return matches, false
+}
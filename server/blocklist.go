@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/abh/geodns/zones"
+	"github.com/miekg/dns"
+)
+
+// Blocklist is a list of names that are answered with NXDOMAIN (or a
+// sinkhole address) before the zone data is looked at. The file has
+// a name per line; "*.example.com" blocks the names below
+// example.com, and lines starting with # are comments.
+type Blocklist struct {
+	path string
+
+	mu        sync.RWMutex
+	names     map[string]bool
+	wildcards map[string]bool
+}
+
+// NewBlocklist reads the blocklist from path.
+func NewBlocklist(path string) (*Blocklist, error) {
+	bl := &Blocklist{path: path}
+	if err := bl.Reload(); err != nil {
+		return nil, err
+	}
+	return bl, nil
+}
+
+// Reload reads the blocklist file again; if it can't be read the
+// current list is kept.
+func (bl *Blocklist) Reload() error {
+	fh, err := os.Open(bl.path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	names := map[string]bool{}
+	wildcards := map[string]bool{}
+
+	scanner := bufio.NewScanner(fh)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := dns.Fqdn(strings.ToLower(line))
+		wildcard := strings.HasPrefix(name, "*.")
+		if wildcard {
+			name = name[2:]
+		}
+		if _, ok := dns.IsDomainName(name); !ok || strings.Contains(name, "*") {
+			return fmt.Errorf("%s:%d: invalid name '%s'", bl.path, n, line)
+		}
+		if wildcard {
+			wildcards[name] = true
+		} else {
+			names[name] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	bl.mu.Lock()
+	bl.names = names
+	bl.wildcards = wildcards
+	bl.mu.Unlock()
+
+	return nil
+}
+
+// Len returns the number of names and wildcards in the list.
+func (bl *Blocklist) Len() int {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	return len(bl.names) + len(bl.wildcards)
+}
+
+// Blocked returns true if name is on the list or below a wildcard.
+func (bl *Blocklist) Blocked(name string) bool {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+
+	if bl.names[name] {
+		return true
+	}
+	for i := strings.Index(name, "."); i >= 0 && i < len(name)-1; i = strings.Index(name, ".") {
+		name = name[i+1:]
+		if bl.wildcards[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// SetBlocklist makes the server answer the names on bl with NXDOMAIN,
+// or with the sinkhole addresses for A and AAAA queries if given. A
+// nil list disables it.
+func (srv *Server) SetBlocklist(bl *Blocklist, sinkhole []net.IP) {
+	srv.update(func(s *settings) {
+		s.blocklist = bl
+		s.sinkhole = sinkhole
+	})
+}
+
+// blocked sets the answer for a blocked name.
+func (srv *Server) blocked(m *dns.Msg, z *zones.Zone, qname string, qtype uint16) {
+	srv.metrics.Blocked.Inc()
+
+	sinkhole := srv.settings().sinkhole
+	if len(sinkhole) == 0 {
+		m.Rcode = dns.RcodeNameError
+		m.Ns = []dns.RR{z.NegativeSoaRR()}
+		return
+	}
+
+	h := dns.RR_Header{Name: qname, Class: dns.ClassINET, Ttl: uint32(z.Options.Ttl)}
+	for _, ip := range sinkhole {
+		switch {
+		case qtype == dns.TypeA && ip.To4() != nil:
+			h.Rrtype = dns.TypeA
+			m.Answer = append(m.Answer, &dns.A{Hdr: h, A: ip.To4()})
+		case qtype == dns.TypeAAAA && ip.To4() == nil:
+			h.Rrtype = dns.TypeAAAA
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: h, AAAA: ip})
+		}
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = []dns.RR{z.NegativeSoaRR()}
+	}
+}
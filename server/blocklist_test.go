@@ -0,0 +1,55 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeBlocklist(t *testing.T, data string) string {
+	fh, err := ioutil.TempFile("", "geodns-blocklist.")
+	require.Nil(t, err)
+	defer fh.Close()
+	_, err = fh.WriteString(data)
+	require.Nil(t, err)
+	return fh.Name()
+}
+
+func TestBlocklist(t *testing.T) {
+	path := writeBlocklist(t, `
+# compromised hosts
+www.test.example.com
+*.bad.test.example.com.
+`)
+	defer os.Remove(path)
+
+	bl, err := NewBlocklist(path)
+	require.Nil(t, err)
+	assert.Equal(t, 2, bl.Len())
+
+	for name, blocked := range map[string]bool{
+		"www.test.example.com.":     true,
+		"WWW.Test.Example.COM":      true,
+		"foo.www.test.example.com.": false,
+		"bad.test.example.com.":     false,
+		"a.bad.test.example.com.":   true,
+		"a.b.bad.test.example.com.": true,
+		"bar.test.example.com.":     false,
+	} {
+		assert.Equal(t, blocked, bl.Blocked(name), name)
+	}
+
+	// a broken file keeps the old list
+	require.Nil(t, ioutil.WriteFile(path, []byte("bar.test.example.com\nfoo..example.com\n"), 0644))
+	assert.Error(t, bl.Reload())
+	assert.True(t, bl.Blocked("www.test.example.com."))
+	assert.False(t, bl.Blocked("bar.test.example.com."))
+
+	require.Nil(t, ioutil.WriteFile(path, []byte("bar.test.example.com\n"), 0644))
+	require.Nil(t, bl.Reload())
+	assert.False(t, bl.Blocked("www.test.example.com."))
+	assert.True(t, bl.Blocked("bar.test.example.com."))
+}
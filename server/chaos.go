@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The answers to the CHAOS class queries for the server version and
+// name; other strings are answered as they are.
+const (
+	chaosRefused = "refused"
+	chaosReal    = "real"
+)
+
+const defaultChaos = "unknown"
+
+// SetChaos sets the answers to the CHAOS class TXT queries for
+// version.bind and version.server (version), and hostname.bind and
+// id.server (hostname). "refused" answers with REFUSED, "real" with
+// the GeoDNS version or the server identifier, and any other string
+// is the answer. An empty string is the default, "unknown".
+func (srv *Server) SetChaos(version, hostname string) error {
+	for _, s := range []string{version, hostname} {
+		if len(s) > 255 {
+			return fmt.Errorf("answer '%s' is longer than 255 characters", s)
+		}
+	}
+	if len(version) == 0 {
+		version = defaultChaos
+	}
+	if len(hostname) == 0 {
+		hostname = defaultChaos
+	}
+	srv.update(func(s *settings) {
+		s.chaosVersion = version
+		s.chaosHostname = hostname
+	})
+	return nil
+}
+
+// serveChaos answers the CHAOS class queries, used to ask a server
+// for its version and name; other names are refused.
+func (srv *Server) serveChaos(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+
+	s := srv.settings()
+
+	var answer, real string
+	switch strings.ToLower(q.Name) {
+	case "version.bind.", "version.server.":
+		answer = s.chaosVersion
+		real = "geodns " + srv.info.Version
+	case "hostname.bind.", "id.server.":
+		answer = s.chaosHostname
+		real = srv.info.ID
+	}
+
+	m := new(dns.Msg)
+	if len(answer) == 0 || answer == chaosRefused || (answer == chaosReal && len(real) == 0) {
+		m.SetRcode(req, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+	if answer == chaosReal {
+		answer = real
+	}
+
+	m.SetReply(req)
+	m.Authoritative = true
+	if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY {
+		m.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: []string{answer},
+		}}
+	}
+	w.WriteMsg(m)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net"
+	"strings"
+
+	"github.com/abh/geodns/targeting/geo"
+	"github.com/abh/geodns/zones"
+	"github.com/miekg/dns"
+)
+
+// defaultCNAMEDepth is how many CNAMEs within a zone are followed
+// for an answer.
+const defaultCNAMEDepth = 8
+
+// SetCNAMEDepth sets how many CNAMEs pointing within the zone are
+// followed, adding the records of each target to the answer. A depth
+// of 0 only returns the first CNAME.
+func (srv *Server) SetCNAMEDepth(depth int) {
+	if depth < 0 {
+		depth = 0
+	}
+	srv.update(func(s *settings) {
+		s.cnameDepth = depth
+	})
+}
+
+// followCNAME adds the records of the targets of the CNAME chain at
+// the end of the answer in m, in the order they are resolved. It
+// stops at a target outside the zone, or when the depth is reached;
+// it returns false if the chain is a loop. With dnssec the
+// signatures of each step are added too. The records are picked for
+// the client address.
+func (srv *Server) followCNAME(m *dns.Msg, z *zones.Zone, targets []string, qtype uint16, location *geo.Location, client net.IP, dnssec bool) bool {
+	if qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return true
+	}
+
+	origin := dns.Fqdn(z.Origin)
+	seen := map[string]bool{}
+	for _, q := range m.Question {
+		seen[strings.ToLower(q.Name)] = true
+	}
+
+	for depth := 0; depth < srv.settings().cnameDepth && len(m.Answer) > 0; depth++ {
+		cname, ok := lastRR(m.Answer).(*dns.CNAME)
+		if !ok || !dns.IsSubDomain(origin, cname.Target) {
+			return true
+		}
+		name := strings.ToLower(cname.Target)
+		if seen[name] {
+			return false
+		}
+		seen[name] = true
+
+		qlabel := getQuestionName(z, name)
+		if z.Delegation(qlabel) != nil {
+			return true
+		}
+
+		var rrs []dns.RR
+		for _, match := range z.FindLabels(qlabel, targets, []uint16{dns.TypeMF, dns.TypeCNAME, qtype}) {
+			if match.Type == 0 {
+				continue
+			}
+			loc := location
+			if !match.Label.Closest {
+				loc = nil
+			}
+			for _, record := range z.PickerFor(match.Label, match.Type, match.Label.MaxHosts, loc, client) {
+				rr := dns.Copy(record.RR)
+				rr.Header().Name = cname.Target
+				rrs = append(rrs, rr)
+			}
+			if len(rrs) > 0 {
+				if dnssec {
+					rrs = append(rrs, z.Signatures(match.Label, match.Type, cname.Target)...)
+				}
+				break
+			}
+		}
+		if len(rrs) == 0 {
+			return true
+		}
+		m.Answer = append(m.Answer, rrs...)
+	}
+	return true
+}
+
+// lastRR returns the last record in rrs that isn't a signature.
+func lastRR(rrs []dns.RR) dns.RR {
+	for i := len(rrs) - 1; i >= 0; i-- {
+		if rrs[i].Header().Rrtype != dns.TypeRRSIG {
+			return rrs[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SetCompression enables or disables name compression in answers.
+// It's enabled by default; some old clients can't parse compressed
+// names.
+func (srv *Server) SetCompression(enabled bool) {
+	srv.update(func(s *settings) {
+		s.compress = enabled
+	})
+}
+
+// compressWriter sets the name compression of every answer written.
+type compressWriter struct {
+	dns.ResponseWriter
+	compress bool
+}
+
+func (w *compressWriter) WriteMsg(m *dns.Msg) error {
+	m.Compress = w.compress
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// truncate removes the records that don't fit in size bytes from m,
+// like dns.Msg.Truncate, which always compresses answers it has to
+// truncate. Without compression the records are removed from the
+// end of the message until it fits.
+func truncate(m *dns.Msg, size int, compress bool) {
+	m.Truncate(size)
+	m.Compress = compress
+	if compress || m.Len() <= size {
+		return
+	}
+
+	// the OPT record stays, at the end of the message
+	var opt dns.RR
+	if o := m.IsEdns0(); o != nil {
+		opt = o
+		extra := m.Extra[:0]
+		for _, rr := range m.Extra {
+			if rr != opt {
+				extra = append(extra, rr)
+			}
+		}
+		m.Extra = extra
+		size -= dns.Len(opt)
+	}
+	for _, section := range []*[]dns.RR{&m.Extra, &m.Ns, &m.Answer} {
+		for len(*section) > 0 && m.Len() > size {
+			*section = (*section)[:len(*section)-1]
+			if section == &m.Answer {
+				m.Truncated = true
+			}
+		}
+	}
+	if opt != nil {
+		m.Extra = append(m.Extra, opt)
+	}
+}
+
+// truncateWriter truncates the UDP answers that don't fit the client's
+// buffer, or -maxudpsize, and sets the TC bit so the client retries
+// with TCP. Every answer is written through it, also the ones that
+// aren't the end of the normal lookup, like referrals and NXDOMAIN.
+type truncateWriter struct {
+	dns.ResponseWriter
+	srv *Server
+	s   *settings
+	req *dns.Msg
+}
+
+func (w *truncateWriter) WriteMsg(m *dns.Msg) error {
+	m.Compress = w.s.compress
+	size := udpSize(w.req, w.s.maxUDPSize)
+	switch {
+	case w.s.requireCookie && m.Len() > dns.MinMsgSize && !w.validCookie():
+		// large answers need a server cookie from an earlier answer,
+		// so the source address can't be spoofed
+		size = dns.MinMsgSize
+		w.srv.metrics.CookieTruncated.Inc()
+	case m.Len() > size && udpSize(w.req, dns.MaxMsgSize) > size:
+		// the answer would have fit what the client asked for
+		w.srv.metrics.UDPClamped.Inc()
+	}
+	truncate(m, size, w.s.compress)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// validCookie returns true if the query has a valid server cookie.
+func (w *truncateWriter) validCookie() bool {
+	opt := w.req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if cookie, ok := o.(*dns.EDNS0_COOKIE); ok {
+			status, _ := w.srv.checkCookie(cookie, remoteIP(w), time.Now())
+			return status == cookieValid
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cookieStatus is how a query used DNS cookies (RFC 7873).
+type cookieStatus uint8
+
+const (
+	cookieNone cookieStatus = iota
+	cookieClient
+	cookieValid
+	cookieInvalid
+	cookieMalformed
+)
+
+func (s cookieStatus) String() string {
+	switch s {
+	case cookieClient:
+		return "client"
+	case cookieValid:
+		return "valid"
+	case cookieInvalid:
+		return "invalid"
+	case cookieMalformed:
+		return "malformed"
+	}
+	return "none"
+}
+
+// server cookies are valid for an hour, and a few minutes from the
+// future to allow for clock differences within a cluster
+const (
+	cookieLifetime = time.Hour
+	cookieSkew     = 5 * time.Minute
+)
+
+func newCookieSecret() []byte {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// serverCookie returns the 16 byte server cookie for the client
+// cookie and address at time now: a version byte, three reserved
+// bytes, the time and a hash of those with the client cookie and
+// address (the layout from RFC 9018, with a truncated HMAC-SHA256).
+func (srv *Server) serverCookie(client []byte, ip net.IP, now time.Time) []byte {
+	cookie := make([]byte, 16)
+	cookie[0] = 1
+	binary.BigEndian.PutUint32(cookie[4:8], uint32(now.Unix()))
+
+	mac := hmac.New(sha256.New, srv.cookieSecret)
+	mac.Write(client)
+	mac.Write(cookie[:8])
+	mac.Write(ip)
+	copy(cookie[8:], mac.Sum(nil))
+
+	return cookie
+}
+
+// checkCookie returns the status of the COOKIE option from a query
+// and the cookie to send in the answer.
+func (srv *Server) checkCookie(opt *dns.EDNS0_COOKIE, ip net.IP, now time.Time) (cookieStatus, *dns.EDNS0_COOKIE) {
+	cookie, err := hex.DecodeString(opt.Cookie)
+	// a client cookie, optionally followed by a server cookie of
+	// 8 to 32 bytes
+	if err != nil || len(cookie) < 8 || (len(cookie) > 8 && len(cookie) < 16) || len(cookie) > 40 {
+		return cookieMalformed, nil
+	}
+
+	client := cookie[:8]
+	status := cookieClient
+
+	if len(cookie) == 24 && cookie[8] == 1 {
+		ts := time.Unix(int64(binary.BigEndian.Uint32(cookie[12:16])), 0)
+		expected := srv.serverCookie(client, ip, ts)
+		switch {
+		case !hmac.Equal(expected, cookie[8:]):
+			status = cookieInvalid
+		case ts.Before(now.Add(-cookieLifetime)) || ts.After(now.Add(cookieSkew)):
+			status = cookieInvalid
+		default:
+			status = cookieValid
+		}
+	} else if len(cookie) > 8 {
+		status = cookieInvalid
+	}
+
+	reply := &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(append(client, srv.serverCookie(client, ip, now)...)),
+	}
+	return status, reply
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCookies(t *testing.T) {
+	srv := &Server{cookieSecret: newCookieSecret()}
+	ip := net.ParseIP("192.0.2.1")
+	now := time.Now()
+
+	client := "0102030405060708"
+
+	status, reply := srv.checkCookie(&dns.EDNS0_COOKIE{Cookie: client}, ip, now)
+	assert.Equal(t, cookieClient, status)
+	if assert.NotNil(t, reply) {
+		assert.Len(t, reply.Cookie, 48, "client and server cookie")
+		assert.Equal(t, client, reply.Cookie[:16], "client cookie echoed")
+	}
+
+	// the server cookie from the answer is valid in the next query
+	status, _ = srv.checkCookie(reply, ip, now.Add(time.Minute))
+	assert.Equal(t, cookieValid, status)
+
+	// ... but not from another address, or after it expired
+	status, _ = srv.checkCookie(reply, net.ParseIP("192.0.2.2"), now)
+	assert.Equal(t, cookieInvalid, status)
+	status, _ = srv.checkCookie(reply, ip, now.Add(2*time.Hour))
+	assert.Equal(t, cookieInvalid, status)
+
+	// a server cookie from another server
+	other := &Server{cookieSecret: newCookieSecret()}
+	status, reply = other.checkCookie(reply, ip, now)
+	assert.Equal(t, cookieInvalid, status)
+	assert.NotNil(t, reply, "a new server cookie is sent for invalid ones")
+
+	for _, c := range []string{"", "01020304", client + "0102", client + hex.EncodeToString(make([]byte, 33)), "xyz"} {
+		status, reply = srv.checkCookie(&dns.EDNS0_COOKIE{Cookie: c}, ip, now)
+		assert.Equal(t, cookieMalformed, status, "cookie %q", c)
+		assert.Nil(t, reply)
+	}
+}
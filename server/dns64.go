@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/abh/geodns/zones"
+	"github.com/miekg/dns"
+)
+
+// DefaultDNS64Prefix is the well-known NAT64 prefix from RFC 6052.
+const DefaultDNS64Prefix = "64:ff9b::/96"
+
+// SetDNS64 enables synthesizing AAAA records from the A records of
+// labels without AAAA records (RFC 6147), embedding the IPv4 address
+// in the last 32 bits of prefix. An empty prefix disables DNS64.
+func (srv *Server) SetDNS64(prefix string) error {
+	if len(prefix) == 0 {
+		srv.update(func(s *settings) {
+			s.dns64Prefix = nil
+		})
+		return nil
+	}
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return err
+	}
+	if ip.To4() != nil {
+		return fmt.Errorf("DNS64 prefix '%s' isn't an IPv6 prefix", prefix)
+	}
+	if ones, _ := ipnet.Mask.Size(); ones != 96 {
+		return fmt.Errorf("DNS64 prefix '%s' must be a /96", prefix)
+	}
+	srv.update(func(s *settings) {
+		s.dns64Prefix = ipnet.IP.To16()
+	})
+	return nil
+}
+
+// synthesizeAAAA returns an AAAA record with the DNS64 prefix for
+// each A record.
+func (s *settings) synthesizeAAAA(records zones.Records, name string) []dns.RR {
+	var rrs []dns.RR
+	for _, record := range records {
+		a, ok := record.RR.(*dns.A)
+		if !ok {
+			continue
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, s.dns64Prefix)
+		copy(ip[12:], a.A.To4())
+
+		h := *a.Header()
+		h.Name = name
+		h.Rrtype = dns.TypeAAAA
+		h.Rdlength = 0
+		rrs = append(rrs, &dns.AAAA{Hdr: h, AAAA: ip})
+	}
+	return rrs
+}
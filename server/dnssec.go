@@ -0,0 +1,32 @@
+package server
+
+import (
+	"github.com/abh/geodns/zones"
+	"github.com/miekg/dns"
+)
+
+// negativeRRs returns the authority section for an NXDOMAIN or
+// NODATA answer for label s; the SOA record, and for a signed zone
+// its signature and the NSEC or NSEC3 records proving the answer.
+func negativeRRs(z *zones.Zone, s string, nxdomain, dnssec bool) []dns.RR {
+	soa := z.NegativeSoaRR()
+	rrs := []dns.RR{soa}
+	if !dnssec {
+		return rrs
+	}
+	rrs = append(rrs, z.Signatures(z.Labels[""], dns.TypeSOA, soa.Header().Name)...)
+	return append(rrs, z.Denial(s, nxdomain)...)
+}
+
+// delegationDS returns the signed DS records of a delegation, or the
+// proof that the delegated zone isn't signed (RFC 4035 3.1.4).
+func delegationDS(z *zones.Zone, label *zones.Label) []dns.RR {
+	if len(label.Records[dns.TypeDS]) == 0 {
+		return z.Denial(label.Label, false)
+	}
+	var rrs []dns.RR
+	for _, record := range label.Records[dns.TypeDS] {
+		rrs = append(rrs, dns.Copy(record.RR))
+	}
+	return append(rrs, z.Signatures(label, dns.TypeDS, label.Records[dns.TypeDS][0].RR.Header().Name)...)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"github.com/miekg/dns"
+)
+
+// SetEDNSBufferSize sets the UDP payload size advertised in the OPT
+// record of the answers. The size is lowered to the buffer size of
+// the client, so the answer advertises what both ends accept. 0 (the
+// default) advertises the -maxudpsize; other sizes outside 512-4096
+// are clamped to that range.
+func (srv *Server) SetEDNSBufferSize(size int) {
+	switch {
+	case size == 0:
+	case size < dns.MinMsgSize:
+		size = dns.MinMsgSize
+	case size > defaultMaxUDPSize:
+		size = defaultMaxUDPSize
+	}
+	srv.update(func(s *settings) {
+		s.ednsBufferSize = size
+	})
+}
+
+// ednsSize returns the UDP payload size to advertise in the answer to
+// req, which must have an OPT record.
+func (s *settings) ednsSize(req *dns.Msg) uint16 {
+	size := s.ednsBufferSize
+	if size == 0 {
+		size = s.maxUDPSize
+	}
+	// RFC 6891 6.2.5; sizes below 512 are treated as 512
+	client := int(req.IsEdns0().UDPSize())
+	if client < dns.MinMsgSize {
+		client = dns.MinMsgSize
+	}
+	if client < size {
+		size = client
+	}
+	return uint16(size)
+}
+
+// ednsWriter adds an OPT record to the answers to queries with one
+// that don't have it yet, like REFUSED answers, as RFC 6891 6.1.1
+// asks.
+type ednsWriter struct {
+	dns.ResponseWriter
+	req  *dns.Msg
+	size uint16
+}
+
+func (w *ednsWriter) WriteMsg(m *dns.Msg) error {
+	if m.IsEdns0() == nil {
+		m.SetEdns0(w.size, w.req.IsEdns0().Do())
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// maintenanceTtl is the TTL of the addresses in maintenance answers,
+// short so the clients come back soon after maintenance ends.
+const maintenanceTtl = 30
+
+// maintenanceResponse is how queries are answered in maintenance
+// mode: with the rcode, or with the addresses for A and AAAA queries.
+type maintenanceResponse struct {
+	rcode int
+	ips   []net.IP
+}
+
+// SetMaintenanceResponse sets the answer for all queries in
+// maintenance mode: "servfail" (the default), "refused", or a comma
+// separated list of IP addresses, like a maintenance page, for the A
+// and AAAA queries (other types get an empty answer).
+func (srv *Server) SetMaintenanceResponse(response string) error {
+	r := &maintenanceResponse{}
+	switch strings.ToLower(response) {
+	case "servfail", "":
+		r.rcode = dns.RcodeServerFailure
+	case "refused":
+		r.rcode = dns.RcodeRefused
+	default:
+		r.rcode = dns.RcodeSuccess
+		for _, s := range strings.Split(response, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				return fmt.Errorf("invalid maintenance response '%s', expected servfail, refused or IP addresses", s)
+			}
+			r.ips = append(r.ips, ip)
+		}
+	}
+	srv.maintenanceResponse.Store(r)
+	return nil
+}
+
+// SetMaintenance turns maintenance mode on or off. In maintenance mode
+// all queries, except for the CHAOS class, are answered with the
+// maintenance response without looking at the zones.
+func (srv *Server) SetMaintenance(on bool) {
+	if on {
+		atomic.StoreInt32(&srv.maintenance, 1)
+	} else {
+		atomic.StoreInt32(&srv.maintenance, 0)
+	}
+}
+
+// Maintenance returns true if maintenance mode is on.
+func (srv *Server) Maintenance() bool {
+	return atomic.LoadInt32(&srv.maintenance) == 1
+}
+
+func (srv *Server) serveMaintenance(w dns.ResponseWriter, req *dns.Msg) {
+	srv.metrics.Maintenance.Inc()
+
+	r := srv.maintenanceResponse.Load().(*maintenanceResponse)
+	m := new(dns.Msg)
+	if r.rcode != dns.RcodeSuccess {
+		m.SetRcode(req, r.rcode)
+		w.WriteMsg(m)
+		return
+	}
+
+	m.SetReply(req)
+	m.Authoritative = true
+	q := req.Question[0]
+	for _, ip := range r.ips {
+		h := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: maintenanceTtl}
+		ip4 := ip.To4()
+		switch {
+		case ip4 != nil && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY):
+			h.Rrtype = dns.TypeA
+			m.Answer = append(m.Answer, &dns.A{Hdr: h, A: ip4})
+		case ip4 == nil && (q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY):
+			h.Rrtype = dns.TypeAAAA
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: h, AAAA: ip})
+		}
+	}
+	w.WriteMsg(m)
+}
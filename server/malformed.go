@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxTCPQuerySize is the largest query read from a TCP connection;
+// DNS queries are much smaller, larger messages close the connection.
+const maxTCPQuerySize = 4096
+
+const headerSize = 12
+
+var (
+	errOversized = errors.New("oversized query")
+	errMalformed = errors.New("malformed query")
+)
+
+// packetReader drops the messages that are too short or don't unpack,
+// instead of answering them with FORMERR, and counts them. A FORMERR
+// answer to a spoofed query would be sent to someone else.
+type packetReader struct {
+	dns.Reader
+	malformed *prometheus.CounterVec
+}
+
+func (srv *Server) decorateReader(r dns.Reader) dns.Reader {
+	return &packetReader{Reader: r, malformed: srv.metrics.Malformed}
+}
+
+func (r *packetReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	m, s, err := r.Reader.ReadUDP(conn, timeout)
+	if err == nil && !r.valid(m) {
+		// the dns package skips messages shorter than a header
+		return m[:0], s, nil
+	}
+	return m, s, err
+}
+
+func (r *packetReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	lc := &lengthConn{Conn: conn}
+	m, err := r.Reader.ReadTCP(lc, timeout)
+	if lc.oversized {
+		r.malformed.WithLabelValues("oversized").Inc()
+		return nil, errOversized
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !r.valid(m) {
+		return nil, errMalformed
+	}
+	return m, nil
+}
+
+// valid returns true if m has a header and unpacks, and counts it
+// otherwise.
+func (r *packetReader) valid(m []byte) bool {
+	if len(m) < headerSize {
+		r.malformed.WithLabelValues("short").Inc()
+		return false
+	}
+	if err := new(dns.Msg).Unpack(m); err != nil {
+		r.malformed.WithLabelValues("unpack").Inc()
+		return false
+	}
+	return true
+}
+
+// lengthConn notes a TCP query with a length over maxTCPQuerySize and
+// fails the reads after it, so the query isn't read at all.
+type lengthConn struct {
+	net.Conn
+	length    [2]byte
+	n         int
+	oversized bool
+}
+
+func (c *lengthConn) Read(b []byte) (int, error) {
+	if c.oversized {
+		return 0, errOversized
+	}
+	n, err := c.Conn.Read(b)
+	for i := 0; i < n && c.n < len(c.length); i++ {
+		c.length[c.n] = b[i]
+		c.n++
+		if c.n == len(c.length) && binary.BigEndian.Uint16(c.length[:]) > maxTCPQuerySize {
+			c.oversized = true
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// zoneMux finds the handler for the zone of a query. Unlike
+// dns.ServeMux it has no fallback handler for the root, which gets
+// all the DS queries there.
+type zoneMux struct {
+	mu       sync.RWMutex
+	handlers map[string]dns.Handler
+}
+
+func newZoneMux() *zoneMux {
+	return &zoneMux{handlers: make(map[string]dns.Handler)}
+}
+
+func (mux *zoneMux) HandleFunc(name string, handler func(dns.ResponseWriter, *dns.Msg)) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	mux.handlers[dns.Fqdn(strings.ToLower(name))] = dns.HandlerFunc(handler)
+}
+
+func (mux *zoneMux) HandleRemove(name string) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	delete(mux.handlers, dns.Fqdn(strings.ToLower(name)))
+}
+
+// match returns the handler of the closest zone of name, or nil if
+// name isn't in any zone. The DS records of a zone are in its parent,
+// so DS queries go to the closest zone of the parent name if there is
+// one.
+func (mux *zoneMux) match(name string, qtype uint16) dns.Handler {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+
+	name = strings.ToLower(name)
+	if qtype == dns.TypeDS {
+		if off, end := dns.NextLabel(name, 0); !end {
+			if h := mux.closest(name, off); h != nil {
+				return h
+			}
+		}
+	}
+	return mux.closest(name, 0)
+}
+
+func (mux *zoneMux) closest(name string, off int) dns.Handler {
+	for end := false; !end; off, end = dns.NextLabel(name, off) {
+		if h, ok := mux.handlers[name[off:]]; ok {
+			return h
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/abh/geodns/targeting"
+	"github.com/abh/geodns/zones"
+	"github.com/miekg/dns"
+)
+
+// Override pins the answer for a name for some client networks, for
+// testing a new endpoint with a few clients ("canary"). The records
+// are returned instead of the zone data, regardless of targeting.
+type Override struct {
+	Name    string
+	Qname   string
+	Clients []*net.IPNet
+	Records []dns.RR
+}
+
+// NewOverride returns the override called name answering qname for
+// the clients (addresses or CIDR networks) with the A and AAAA
+// addresses, or a CNAME to cname. A ttl of 0 uses the zone TTL.
+func NewOverride(name, qname string, clients, addresses []string, cname string, ttl int) (*Override, error) {
+	o := &Override{Name: name, Qname: dns.Fqdn(strings.ToLower(qname))}
+	if _, ok := dns.IsDomainName(o.Qname); !ok || len(qname) == 0 {
+		return nil, fmt.Errorf("override '%s': invalid name '%s'", name, qname)
+	}
+
+	for _, c := range clients {
+		ipnet, err := targeting.ParseNetwork(c)
+		if err != nil {
+			return nil, fmt.Errorf("override '%s': invalid client '%s'", name, c)
+		}
+		o.Clients = append(o.Clients, ipnet)
+	}
+	if len(o.Clients) == 0 {
+		return nil, fmt.Errorf("override '%s': no clients", name)
+	}
+
+	h := dns.RR_Header{Name: o.Qname, Class: dns.ClassINET, Ttl: uint32(ttl)}
+	for _, a := range addresses {
+		ip := net.ParseIP(a)
+		switch {
+		case ip == nil:
+			return nil, fmt.Errorf("override '%s': invalid address '%s'", name, a)
+		case ip.To4() != nil:
+			h.Rrtype = dns.TypeA
+			o.Records = append(o.Records, &dns.A{Hdr: h, A: ip.To4()})
+		default:
+			h.Rrtype = dns.TypeAAAA
+			o.Records = append(o.Records, &dns.AAAA{Hdr: h, AAAA: ip})
+		}
+	}
+	if len(cname) > 0 {
+		if len(o.Records) > 0 {
+			return nil, fmt.Errorf("override '%s': a cname can't have addresses", name)
+		}
+		h.Rrtype = dns.TypeCNAME
+		o.Records = append(o.Records, &dns.CNAME{Hdr: h, Target: dns.Fqdn(cname)})
+	}
+	if len(o.Records) == 0 {
+		return nil, fmt.Errorf("override '%s': no records", name)
+	}
+	return o, nil
+}
+
+// SetOverrides replaces the overrides of the server.
+func (srv *Server) SetOverrides(o []*Override) {
+	srv.update(func(s *settings) {
+		s.overrides = o
+	})
+}
+
+// findOverride returns the override for queries for qname from ip.
+func (s *settings) findOverride(qname string, ip net.IP) *Override {
+	if len(s.overrides) == 0 {
+		return nil
+	}
+	qname = strings.ToLower(qname)
+	for _, o := range s.overrides {
+		if o.Qname != qname {
+			continue
+		}
+		for _, ipnet := range o.Clients {
+			if ipnet.Contains(ip) {
+				return o
+			}
+		}
+	}
+	return nil
+}
+
+// answer sets the answer in m to the records of the override for
+// qtype, or the CNAME; without either it's a NODATA answer. Records
+// without a TTL get the zone TTL.
+func (o *Override) answer(m *dns.Msg, z *zones.Zone, qname string, qtype uint16) {
+	for _, rr := range o.Records {
+		if t := rr.Header().Rrtype; t == qtype || t == dns.TypeCNAME || qtype == dns.TypeANY {
+			rr = dns.Copy(rr)
+			rr.Header().Name = qname
+			if rr.Header().Ttl == 0 {
+				rr.Header().Ttl = uint32(z.Options.Ttl)
+			}
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = []dns.RR{z.NegativeSoaRR()}
+	}
+}
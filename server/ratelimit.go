@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/abh/geodns/targeting"
+)
+
+var cidr24Mask = net.CIDRMask(24, 32)
+
+// rateLimiter keeps a token bucket for each client network; IPv4
+// clients are aggregated by /24 and IPv6 clients by the client prefix
+// (/56 by default, see targeting.SetIPv6ClientPrefix).
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+
+	// limited counts the queries over the limit, for the RRL slip
+	limited int
+}
+
+func newRateLimiter(qps, burst int) *rateLimiter {
+	if burst < qps {
+		burst = qps
+	}
+	return &rateLimiter{
+		rate:    float64(qps),
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// clientNetwork returns the key used to aggregate queries from ip.
+func clientNetwork(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(cidr24Mask).String()
+	}
+	return targeting.ClientNetwork(ip).String()
+}
+
+// allow takes a token from the bucket for the network of ip and
+// returns false if the bucket was empty.
+func (rl *rateLimiter) allow(ip net.IP, now time.Time) bool {
+	ok, _ := rl.take(clientNetwork(ip), now)
+	return ok
+}
+
+// take takes a token from the bucket for key. If the bucket was
+// empty it returns false and the number of queries over the limit
+// since the bucket was created.
+func (rl *rateLimiter) take(key string, now time.Time) (bool, int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.prune(now)
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		b.limited++
+		return false, b.limited
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune removes buckets that have been refilled completely, so
+// the map doesn't grow with every client we have ever seen.
+func (rl *rateLimiter) prune(now time.Time) {
+	if now.Sub(rl.lastPrune) < time.Minute {
+		return
+	}
+	rl.lastPrune = now
+
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(10, 20)
+	now := time.Now()
+
+	ip := net.ParseIP("192.0.2.10")
+
+	for i := 0; i < 20; i++ {
+		if !rl.allow(ip, now) {
+			t.Fatalf("query %d was limited within the burst", i)
+		}
+	}
+
+	// same /24 shares the bucket
+	if rl.allow(net.ParseIP("192.0.2.200"), now) {
+		t.Errorf("query over the burst was allowed")
+	}
+
+	// a different network has its own bucket
+	if !rl.allow(net.ParseIP("198.51.100.1"), now) {
+		t.Errorf("query from another network was limited")
+	}
+
+	// 10 qps refills one token every 100ms
+	now = now.Add(100 * time.Millisecond)
+	if !rl.allow(ip, now) {
+		t.Errorf("query after refill was limited")
+	}
+	if rl.allow(ip, now) {
+		t.Errorf("second query after refilling one token was allowed")
+	}
+
+	// IPv6 clients are aggregated by /64
+	ip6 := net.ParseIP("2001:db8:1:2::1")
+	for i := 0; i < 20; i++ {
+		rl.allow(ip6, now)
+	}
+	if rl.allow(net.ParseIP("2001:db8:1:2:ffff::1"), now) {
+		t.Errorf("query from the same /64 was allowed over the burst")
+	}
+	// and by /56 by default
+	if rl.allow(net.ParseIP("2001:db8:1:ff::1"), now) {
+		t.Errorf("query from the same /56 was allowed over the burst")
+	}
+	if !rl.allow(net.ParseIP("2001:db8:1:100::1"), now) {
+		t.Errorf("query from another /56 was limited")
+	}
+
+	// full buckets get pruned
+	now = now.Add(2 * time.Minute)
+	rl.allow(ip, now)
+	if len(rl.buckets) != 1 {
+		t.Errorf("expected 1 bucket after pruning, got %d", len(rl.buckets))
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultRRLSlip is how often a response over the RRL limit is sent
+// truncated instead of dropped, as in BIND.
+const defaultRRLSlip = 2
+
+// responseRateLimiter limits identical UDP responses to a client
+// network (response rate limiting, RRL), so the server can't be used
+// to amplify spoofed queries. Clients that are really asking get some
+// truncated answers and can retry over TCP.
+type responseRateLimiter struct {
+	limiter *rateLimiter
+	slip    int
+}
+
+// SetResponseRateLimit limits the identical UDP responses to each
+// client network to rps per second. Of the responses over the limit
+// every slip'th is sent truncated and the others dropped; with slip
+// 0 they're all dropped.
+func (srv *Server) SetResponseRateLimit(rps, slip int) {
+	if slip < 0 {
+		slip = 0
+	}
+	srv.update(func(s *settings) {
+		if rps <= 0 {
+			s.rrl = nil
+			return
+		}
+		s.rrl = &responseRateLimiter{limiter: newRateLimiter(rps, rps), slip: slip}
+	})
+}
+
+// rrlKey returns the key for the responses that count as identical
+// for a client network: the answers by name and type, the negative
+// answers by the zone (the SOA) they come from, and errors by rcode.
+func rrlKey(network string, m *dns.Msg) string {
+	var kind, name string
+	var qtype uint16
+	if len(m.Question) > 0 {
+		name = strings.ToLower(m.Question[0].Name)
+		qtype = m.Question[0].Qtype
+	}
+	switch {
+	case m.Rcode == dns.RcodeSuccess && len(m.Answer) > 0:
+		kind = "answer"
+	case m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError:
+		kind = "nodata"
+		if m.Rcode == dns.RcodeNameError {
+			kind, qtype = "nxdomain", 0
+		}
+		for _, rr := range m.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				name = strings.ToLower(rr.Header().Name)
+				break
+			}
+		}
+	default:
+		kind, name, qtype = "error", dns.RcodeToString[m.Rcode], 0
+	}
+	return network + "/" + kind + "/" + name + "/" + strconv.Itoa(int(qtype))
+}
+
+// rrlWriter applies the response rate limit to the UDP answers.
+type rrlWriter struct {
+	dns.ResponseWriter
+	rrl     *responseRateLimiter
+	metrics *prometheus.CounterVec
+}
+
+func (w *rrlWriter) WriteMsg(m *dns.Msg) error {
+	key := rrlKey(clientNetwork(remoteIP(w)), m)
+	ok, limited := w.rrl.limiter.take(key, time.Now())
+	if ok {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	if w.rrl.slip == 0 || limited%w.rrl.slip != 0 {
+		w.metrics.WithLabelValues("dropped").Inc()
+		return nil
+	}
+	w.metrics.WithLabelValues("slipped").Inc()
+	tc := new(dns.Msg)
+	tc.SetReply(m)
+	tc.Rcode = m.Rcode
+	tc.Authoritative = m.Authoritative
+	tc.Truncated = true
+	if opt := m.IsEdns0(); opt != nil {
+		tc.Extra = []dns.RR{opt}
+	}
+	return w.ResponseWriter.WriteMsg(tc)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRRLKey(t *testing.T) {
+	soa, _ := dns.NewRR("example.com. 60 IN SOA ns1.example.com. hostmaster.example.com. 1 5400 5400 1209600 3600")
+	a, _ := dns.NewRR("www.example.com. 60 IN A 192.0.2.1")
+
+	msg := func(name string, qtype uint16, rcode int, answer, ns []dns.RR) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		m.Rcode = rcode
+		m.Answer = answer
+		m.Ns = ns
+		return m
+	}
+
+	answer := rrlKey("192.0.2.0", msg("www.example.com.", dns.TypeA, dns.RcodeSuccess, []dns.RR{a}, nil))
+	if answer != rrlKey("192.0.2.0", msg("WWW.example.com.", dns.TypeA, dns.RcodeSuccess, []dns.RR{a}, nil)) {
+		t.Errorf("answers for the same name and type have different keys")
+	}
+	if answer == rrlKey("192.0.2.0", msg("www.example.com.", dns.TypeAAAA, dns.RcodeSuccess, []dns.RR{a}, nil)) {
+		t.Errorf("answers for other types have the same key")
+	}
+	if answer == rrlKey("198.51.100.0", msg("www.example.com.", dns.TypeA, dns.RcodeSuccess, []dns.RR{a}, nil)) {
+		t.Errorf("answers to other networks have the same key")
+	}
+
+	// negative answers count by zone
+	nx := rrlKey("192.0.2.0", msg("a.example.com.", dns.TypeA, dns.RcodeNameError, nil, []dns.RR{soa}))
+	if nx != rrlKey("192.0.2.0", msg("b.example.com.", dns.TypeMX, dns.RcodeNameError, nil, []dns.RR{soa})) {
+		t.Errorf("NXDOMAIN answers in the same zone have different keys")
+	}
+	nodata := rrlKey("192.0.2.0", msg("a.example.com.", dns.TypeMX, dns.RcodeSuccess, nil, []dns.RR{soa}))
+	if nodata == nx {
+		t.Errorf("NODATA and NXDOMAIN answers have the same key")
+	}
+
+	refused := rrlKey("192.0.2.0", msg("a.example.net.", dns.TypeA, dns.RcodeRefused, nil, nil))
+	if refused != rrlKey("192.0.2.0", msg("b.example.org.", dns.TypeTXT, dns.RcodeRefused, nil, nil)) {
+		t.Errorf("errors with the same rcode have different keys")
+	}
+}
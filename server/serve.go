@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/abh/geodns/applog"
 	"github.com/abh/geodns/querylog"
+	"github.com/abh/geodns/targeting"
 	"github.com/abh/geodns/zones"
 
 	"github.com/miekg/dns"
@@ -24,6 +26,98 @@ func getQuestionName(z *zones.Zone, fqdn string) string {
 	return strings.ToLower(strings.Join(ql, "."))
 }
 
+// qtypeLabel returns the metrics label for the query type. Types
+// the dns library doesn't know are counted as "other" to keep the
+// number of label values bounded.
+func qtypeLabel(qtype uint16) string {
+	if s, ok := dns.TypeToString[qtype]; ok {
+		return s
+	}
+	return "other"
+}
+
+// remoteIP returns a copy of the IP address of the client
+func remoteIP(w dns.ResponseWriter) net.IP {
+	var ip net.IP
+	if addr, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		ip = make(net.IP, len(addr.IP))
+		copy(ip, addr.IP)
+	} else if addr, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		ip = make(net.IP, len(addr.IP))
+		copy(ip, addr.IP)
+	}
+	return ip
+}
+
+// udpSize returns the size of the largest UDP answer the client
+// accepts, up to max bytes.
+func udpSize(req *dns.Msg, max int) int {
+	size := dns.MinMsgSize
+	if e := req.IsEdns0(); e != nil && int(e.UDPSize()) > size {
+		size = int(e.UDPSize())
+	}
+	if size > max {
+		size = max
+	}
+	return size
+}
+
+// referral sets up m as a referral to the nameservers of the
+// delegated sub-zone in label, with the addresses of nameservers
+// that are in the zone as glue.
+func (srv *Server) referral(m *dns.Msg, z *zones.Zone, label *zones.Label, dnssec bool) {
+	m.Authoritative = false
+	var glueRRs []dns.RR
+	for _, record := range label.Records[dns.TypeNS] {
+		ns := dns.Copy(record.RR).(*dns.NS)
+		m.Ns = append(m.Ns, ns)
+
+		if !dns.IsSubDomain(z.Origin+".", ns.Ns) {
+			continue
+		}
+		glueLabel := strings.TrimSuffix(strings.TrimSuffix(ns.Ns, "."), "."+z.Origin)
+		glue, ok := z.Labels[glueLabel]
+		if !ok {
+			continue
+		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			for _, record := range glue.Records[qtype] {
+				rr := dns.Copy(record.RR)
+				rr.Header().Name = ns.Ns
+				glueRRs = append(glueRRs, rr)
+			}
+		}
+	}
+	if dnssec {
+		m.Ns = append(m.Ns, delegationDS(z, label)...)
+	}
+	// before the OPT record
+	m.Extra = append(glueRRs, m.Extra...)
+}
+
+// refused answers the query with REFUSED and returns true if the
+// zone doesn't allow queries from ip.
+func (srv *Server) refused(w dns.ResponseWriter, req *dns.Msg, z *zones.Zone, ip net.IP) bool {
+	if z.Allowed(ip) {
+		return false
+	}
+	srv.metrics.ACLRefused.WithLabelValues(z.Origin).Inc()
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	w.WriteMsg(m)
+	return true
+}
+
+// hasType returns true if one of the matches has records of qtype.
+func hasType(matches []zones.LabelMatch, qtype uint16) bool {
+	for _, match := range matches {
+		if match.Type == qtype {
+			return true
+		}
+	}
+	return false
+}
+
 func getIPFromDomain(domain string) (net.IP, error) {
 	dashedIP := strings.Split(domain, ".")[0]
 	ipstr := strings.ReplaceAll(dashedIP, "-", ".")
@@ -39,7 +133,13 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *zones.Zone) {
 	qnamefqdn := req.Question[0].Name
 	qtype := req.Question[0].Qtype
 
+	z.Metrics.Queries.Add()
+
 	if qtype == dns.TypeA && z.ParseIP == true {
+		if srv.refused(w, req, z, remoteIP(w)) {
+			return
+		}
+
 		m := new(dns.Msg)
 		m.SetReply(req)
 
@@ -51,20 +151,23 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *zones.Zone) {
 		h := dns.RR_Header{Name: qnamefqdn, Rrtype: 1, Class: 1, Ttl: 86400, Rdlength: 0}
 
 		m.Answer = []dns.RR{&dns.A{Hdr: h, A: ip}}
+		m.Authoritative = true
 		w.WriteMsg(m)
 		return
 	}
 
+	s := srv.settings()
+
 	var qle *querylog.Entry
 
-	if srv.queryLogger != nil {
+	if s.queryLogger != nil {
 		qle = &querylog.Entry{
 			Time:   time.Now().UnixNano(),
 			Origin: z.Origin,
 			Name:   strings.ToLower(qnamefqdn),
 			Qtype:  qtype,
 		}
-		defer srv.queryLogger.Write(qle)
+		defer s.queryLogger.Write(qle)
 	}
 
 	applog.Printf("[zone %s] incoming  %s %s (id %d) from %s\n", z.Origin, qnamefqdn,
@@ -78,15 +181,7 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *zones.Zone) {
 	z.Metrics.LabelStats.Add(qlabel)
 
 	// IP that's talking to us (not EDNS CLIENT SUBNET)
-	var realIP net.IP
-
-	if addr, ok := w.RemoteAddr().(*net.UDPAddr); ok {
-		realIP = make(net.IP, len(addr.IP))
-		copy(realIP, addr.IP)
-	} else if addr, ok := w.RemoteAddr().(*net.TCPAddr); ok {
-		realIP = make(net.IP, len(addr.IP))
-		copy(realIP, addr.IP)
-	}
+	realIP := remoteIP(w)
 	if qle != nil {
 		qle.RemoteAddr = realIP.String()
 	}
@@ -95,17 +190,19 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *zones.Zone) {
 
 	var ip net.IP // EDNS or real IP
 	var edns *dns.EDNS0_SUBNET
-	var opt_rr *dns.OPT
+	var nsid bool
+	var cookie *dns.EDNS0_COOKIE
 
 	for _, extra := range req.Extra {
 
 		switch extra.(type) {
 		case *dns.OPT:
 			for _, o := range extra.(*dns.OPT).Option {
-				opt_rr = extra.(*dns.OPT)
 				switch e := o.(type) {
 				case *dns.EDNS0_NSID:
-					// do stuff with e.Nsid
+					nsid = true
+				case *dns.EDNS0_COOKIE:
+					cookie = e
 				case *dns.EDNS0_SUBNET:
 					applog.Println("Got edns", e.Address, e.Family, e.SourceNetmask, e.SourceScope)
 					if e.Address != nil {
@@ -129,7 +226,20 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *zones.Zone) {
 		}
 	}
 
-	targets, netmask, location := z.Options.Targeting.GetTargets(ip, z.HasClosest)
+	if srv.refused(w, req, z, ip) {
+		if qle != nil {
+			qle.Rcode = dns.RcodeRefused
+		}
+		return
+	}
+
+	targets, netmask, location := z.Options.Targeting.GetTargetsFrom(ip, realIP, z.NeedsLocation())
+	if z.Options.NearestRegion {
+		targets = z.NearestRegionTargets(qlabel, targets, location)
+	}
+	if z.HasSplit {
+		targets = z.SplitTargets(qlabel, targets, ip)
+	}
 
 	m := new(dns.Msg)
 
@@ -142,20 +252,117 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *zones.Zone) {
 	}
 
 	m.SetReply(req)
-	if e := m.IsEdns0(); e != nil {
-		m.SetEdns0(4096, e.Do())
+	// RFC 4035 3.1; the DNSSEC records of a signed zone are only
+	// added for queries with the DO bit
+	dnssec := false
+	if e := req.IsEdns0(); e != nil {
+		m.SetEdns0(s.ednsSize(req), e.Do())
+		dnssec = e.Do() && z.Signed()
 	}
 	m.Authoritative = true
 
+	// RFC 5001; identify the server with the server id
+	if nsid && len(srv.info.ID) > 0 {
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_NSID{
+			Code: dns.EDNS0NSID,
+			Nsid: hex.EncodeToString([]byte(srv.info.ID)),
+		})
+	}
+
+	// RFC 7873; echo the client cookie with a new server cookie
+	cookieState := cookieNone
+	var cookieReply *dns.EDNS0_COOKIE
+	if cookie != nil {
+		cookieState, cookieReply = srv.checkCookie(cookie, realIP, time.Now())
+	}
+	srv.metrics.Cookies.WithLabelValues(cookieState.String()).Inc()
+	if cookieState == cookieMalformed {
+		m.SetRcode(req, dns.RcodeFormatError)
+		m.Authoritative = false
+		w.WriteMsg(m)
+		return
+	}
+	if cookieReply != nil {
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, cookieReply)
+	}
+
 	// TODO: set scope to 0 if there are no alternate responses
 	if edns != nil {
 		if edns.Family != 0 {
 			if netmask < 16 {
 				netmask = 16
 			}
-			edns.SourceScope = uint8(netmask)
-			m.Extra = append(m.Extra, opt_rr)
+			// echo the client subnet option with the scope we used
+			ecs := *edns
+			ecs.SourceScope = uint8(netmask)
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &ecs)
+		}
+	}
+
+	if s.blocklist != nil && s.blocklist.Blocked(queryName(w, qnamefqdn)) {
+		srv.blocked(m, z, qnamefqdn, qtype)
+		srv.metrics.Queries.With(
+			prometheus.Labels{
+				"zone":  z.Origin,
+				"qtype": qtypeLabel(qtype),
+				"qname": "_blocked",
+				"rcode": dns.RcodeToString[m.Rcode],
+			}).Inc()
+		w.WriteMsg(m)
+		return
+	}
+
+	if o := s.findOverride(queryName(w, qnamefqdn), ip); o != nil {
+		applog.Infof("[zone %s] override '%s' for %s from %s", z.Origin, o.Name, qnamefqdn, ip)
+		srv.metrics.Overrides.WithLabelValues(o.Name).Inc()
+		o.answer(m, z, qnamefqdn, qtype)
+		srv.metrics.Queries.With(
+			prometheus.Labels{
+				"zone":  z.Origin,
+				"qtype": qtypeLabel(qtype),
+				"qname": "_override",
+				"rcode": dns.RcodeToString[m.Rcode],
+			}).Inc()
+		if qle != nil {
+			qle.LabelName = "_override"
 		}
+		w.WriteMsg(m)
+		return
+	}
+
+	if s.strictGeo && targeting.Geo() == nil && z.RequiresGeo(qlabel) {
+		srv.metrics.GeoUnavailable.Inc()
+		m.SetRcode(req, dns.RcodeServerFailure)
+		m.Authoritative = false
+		srv.metrics.Queries.With(
+			prometheus.Labels{
+				"zone":  z.Origin,
+				"qtype": qtypeLabel(qtype),
+				"qname": qlabel,
+				"rcode": dns.RcodeToString[m.Rcode],
+			}).Inc()
+		w.WriteMsg(m)
+		return
+	}
+
+	// the DS records of a delegation are answered by the parent zone
+	if label := z.Delegation(qlabel); label != nil && !(qtype == dns.TypeDS && label.Label == qlabel) {
+		srv.referral(m, z, label, dnssec)
+		srv.metrics.Queries.With(
+			prometheus.Labels{
+				"zone":  z.Origin,
+				"qtype": qtypeLabel(qtype),
+				"qname": label.Label,
+				"rcode": dns.RcodeToString[m.Rcode],
+			}).Inc()
+		if qle != nil {
+			qle.LabelName = label.Label
+		}
+		w.WriteMsg(m)
+		return
 	}
 
 	labelMatches := z.FindLabels(qlabel, targets, []uint16{dns.TypeMF, dns.TypeCNAME, qtype})
@@ -174,7 +381,7 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *zones.Zone) {
 			if qtype == dns.TypeANY || qtype == dns.TypeTXT {
 				m.Answer = srv.statusRR(qlabel + "." + z.Origin + ".")
 			} else {
-				m.Ns = append(m.Ns, z.SoaRR())
+				m.Ns = append(m.Ns, z.NegativeSoaRR())
 			}
 			m.Authoritative = true
 			w.WriteMsg(m)
@@ -189,7 +396,7 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *zones.Zone) {
 				w.WriteMsg(m)
 				return
 			}
-			m.Ns = append(m.Ns, z.SoaRR())
+			m.Ns = append(m.Ns, z.NegativeSoaRR())
 			m.Authoritative = true
 			w.WriteMsg(m)
 			return
@@ -205,7 +412,7 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *zones.Zone) {
 					ip.String(),
 				}
 
-				targets, netmask, location := z.Options.Targeting.GetTargets(ip, z.HasClosest)
+				targets, netmask, location := z.Options.Targeting.GetTargetsFrom(ip, realIP, z.NeedsLocation())
 				txt = append(txt, strings.Join(targets, " "))
 				txt = append(txt, fmt.Sprintf("/%d", netmask), srv.info.ID, srv.info.IP)
 				if location != nil {
@@ -218,7 +425,7 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *zones.Zone) {
 					Txt: txt,
 				}}
 			} else {
-				m.Ns = append(m.Ns, z.SoaRR())
+				m.Ns = append(m.Ns, z.NegativeSoaRR())
 			}
 
 			m.Authoritative = true
@@ -232,18 +439,27 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *zones.Zone) {
 		srv.metrics.Queries.With(
 			prometheus.Labels{
 				"zone":  z.Origin,
-				"qtype": dns.TypeToString[qtype],
+				"qtype": qtypeLabel(qtype),
 				"qname": "_error",
 				"rcode": dns.RcodeToString[m.Rcode],
 			}).Inc()
 		m.Authoritative = true
 
-		m.Ns = []dns.RR{z.SoaRR()}
+		m.Ns = negativeRRs(z, qlabel, true, dnssec)
 
 		w.WriteMsg(m)
 		return
 	}
 
+	clientLocation := location
+
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok && qtype == dns.TypeANY && s.minimalAny {
+		var minimized bool
+		if labelMatches, minimized = minimalANY(m, z, labelMatches, qnamefqdn, dnssec); minimized {
+			srv.metrics.MinimalANY.Inc()
+		}
+	}
+
 	for _, match := range labelMatches {
 		label := match.Label
 		labelQtype := match.Type
@@ -252,38 +468,114 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *zones.Zone) {
 			location = nil
 		}
 
-		if servers := z.Picker(label, labelQtype, label.MaxHosts, location); servers != nil {
+		if label.Flatten != nil && labelQtype == dns.TypeCNAME && qtype != dns.TypeCNAME {
+			if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+				// the flattened CNAME only provides addresses
+				continue
+			}
+			// answer with the addresses of the CNAME target; until
+			// they have been looked up the CNAME is returned
+			if rrs, ok := label.Flatten.Records(qtype, qnamefqdn); ok {
+				m.Answer = rrs
+				if qle != nil {
+					qle.LabelName = label.Label
+					qle.MatchedBy = targeting.TargetType(match.Target)
+				}
+				break
+			}
+		}
+
+		if qtype == dns.TypeANY {
+			// ANY gets the records of every type, but a CNAME
+			// only when it's the most specific match
+			if labelQtype == dns.TypeCNAME && len(m.Answer) > 0 {
+				continue
+			}
+			if !dnssec && zones.IsDnssecType(labelQtype) {
+				continue
+			}
+		}
+
+		if z.HealthFailed(label, labelQtype) {
+			// too few healthy records, and the label doesn't
+			// fail open
+			m.SetRcode(req, dns.RcodeServerFailure)
+			m.Authoritative = false
+			m.Answer = nil
+			break
+		}
+
+		if servers := z.PickerFor(label, labelQtype, label.MaxHosts, location, ip); servers != nil {
 			var rrs []dns.RR
 			for _, record := range servers {
 				rr := dns.Copy(record.RR)
 				rr.Header().Name = qnamefqdn
 				rrs = append(rrs, rr)
+				if qle != nil && len(record.Comment) > 0 {
+					qle.Comments = append(qle.Comments, record.Comment)
+				}
+			}
+			if dnssec && len(rrs) > 0 {
+				rrs = append(rrs, z.Signatures(label, labelQtype, qnamefqdn)...)
 			}
-			m.Answer = rrs
+			m.Answer = append(m.Answer, rrs...)
 		}
 		if len(m.Answer) > 0 {
-			// maxHosts only matter within a "targeting group"; at least that's
-			// how it has been working, so we stop looking for answers as soon
-			// as we have some.
-
 			if qle != nil {
-				qle.LabelName = label.Label
+				if len(qle.LabelName) == 0 {
+					qle.LabelName = label.Label
+					qle.MatchedBy = targeting.TargetType(match.Target)
+				}
 				qle.Answers = len(m.Answer)
 			}
 
+			if qtype == dns.TypeANY && labelQtype != dns.TypeCNAME {
+				continue
+			}
+
+			// maxHosts only matter within a "targeting group"; at least that's
+			// how it has been working, so we stop looking for answers as soon
+			// as we have some.
 			break
 		}
 	}
 
-	if len(m.Answer) == 0 {
+	if !srv.followCNAME(m, z, targets, qtype, clientLocation, ip, dnssec) {
+		applog.Warnf("[zone %s] CNAME loop for %s", z.Origin, qnamefqdn)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		m.Authoritative = false
+		m.Answer = nil
+	}
+
+	if len(m.Answer) == 0 && m.Rcode == dns.RcodeSuccess && qtype == dns.TypeAAAA && s.dns64Prefix != nil && !hasType(labelMatches, dns.TypeAAAA) {
+		// DNS64; synthesize AAAA records from the A records
+		for _, match := range z.FindLabels(qlabel, targets, []uint16{dns.TypeMF, dns.TypeA}) {
+			if match.Type != dns.TypeA {
+				continue
+			}
+			if servers := z.PickerFor(match.Label, dns.TypeA, match.Label.MaxHosts, nil, ip); servers != nil {
+				m.Answer = s.synthesizeAAAA(servers, qnamefqdn)
+			}
+			if len(m.Answer) > 0 {
+				if qle != nil {
+					qle.LabelName = match.Label.Label
+					qle.MatchedBy = targeting.TargetType(match.Target)
+					qle.Answers = len(m.Answer)
+				}
+				break
+			}
+		}
+	}
+
+	if len(m.Answer) == 0 && m.Rcode == dns.RcodeSuccess {
 		// Return a SOA so the NOERROR answer gets cached
-		m.Ns = append(m.Ns, z.SoaRR())
+		m.Ns = append(m.Ns, negativeRRs(z, qlabel, false, dnssec)...)
 	}
 
 	srv.metrics.Queries.With(
 		prometheus.Labels{
 			"zone":  z.Origin,
-			"qtype": dns.TypeToString[qtype],
+			"qtype": qtypeLabel(qtype),
 			"qname": qlabel,
 			"rcode": dns.RcodeToString[m.Rcode],
 		}).Inc()
@@ -294,6 +586,7 @@ func (srv *Server) serve(w dns.ResponseWriter, req *dns.Msg, z *zones.Zone) {
 		// should this be in the match loop above?
 		qle.Rcode = m.Rcode
 	}
+
 	err := w.WriteMsg(m)
 	if err != nil {
 		// if Pack'ing fails the Write fails. Return SERVFAIL.
@@ -315,6 +608,7 @@ func (srv *Server) statusRR(label string) []dns.RR {
 	}
 
 	status["up"] = strconv.Itoa(int(time.Since(srv.info.Started).Seconds()))
+	status["ttl"] = strconv.Itoa(zones.DefaultTtl())
 
 	js, err := json.Marshal(status)
 
@@ -1,7 +1,18 @@
 package server
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -10,17 +21,23 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/abh/geodns/countries"
 	"github.com/abh/geodns/monitor"
+	"github.com/abh/geodns/querylog"
+	"github.com/abh/geodns/targeting"
+	"github.com/abh/geodns/targeting/geo"
 	"github.com/abh/geodns/zones"
 	"github.com/miekg/dns"
+	dto "github.com/prometheus/client_model/go"
 )
 
 const (
-	PORT = ":8853"
+	PORT    = ":8853"
+	TLSPORT = ":8854"
 )
 
 func TestServe(t *testing.T) {
-	serverInfo := &monitor.ServerInfo{}
+	serverInfo := &monitor.ServerInfo{ID: "geodns-test"}
 
 	srv := NewServer(serverInfo)
 
@@ -30,14 +47,57 @@ func TestServe(t *testing.T) {
 	}
 	go mm.Run()
 
+	// short TCP timeouts, so testServingTCPTimeout doesn't wait long
+	srv.SetTCPTimeouts(time.Second, time.Second)
+
 	// listenAndServe returns after listening on udp + tcp, so just
 	// wait for it before continuing
 	srv.ListenAndServe(PORT)
+	go srv.ListenAndServeTLS(TLSPORT, testTLSConfig(t))
 
 	// ensure service has properly started before we query it
 	time.Sleep(500 * time.Millisecond)
 
 	t.Run("Serving", testServing)
+	t.Run("EDNS", testServingEDNS)
+	t.Run("TLS", testServingTLS)
+	t.Run("NSID", testServingNSID)
+	t.Run("Fallback", testServingFallback)
+	t.Run("Truncate", testServingTruncate)
+	t.Run("StrictGeo", func(t *testing.T) { testServingStrictGeo(t, srv) })
+	t.Run("Flags", testServingFlags)
+	t.Run("Negative", testServingNegative)
+	t.Run("ACL", func(t *testing.T) { testServingACL(t, srv) })
+	t.Run("Cookie", func(t *testing.T) { testServingCookie(t, srv) })
+	t.Run("DNS64", func(t *testing.T) { testServingDNS64(t, srv) })
+	t.Run("MaxUDPSize", func(t *testing.T) { testServingMaxUDPSize(t, srv) })
+	t.Run("Compression", func(t *testing.T) { testServingCompression(t, srv) })
+	t.Run("ANY", func(t *testing.T) { testServingANY(t, srv) })
+	t.Run("HTTPS", testServingHTTPS)
+	t.Run("SlowDown", func(t *testing.T) { testServingSlowDown(t, srv) })
+	t.Run("Alias", testServingAlias)
+	t.Run("Blocklist", func(t *testing.T) { testServingBlocklist(t, srv) })
+	t.Run("Responses", func(t *testing.T) { testServingResponses(t, srv) })
+	t.Run("CNAMEChain", func(t *testing.T) { testServingCNAMEChain(t, srv) })
+	t.Run("DNSSEC", testServingDNSSEC)
+	t.Run("Override", func(t *testing.T) { testServingOverride(t, srv) })
+	t.Run("MaxConcurrent", func(t *testing.T) { testServingMaxConcurrent(t, srv) })
+	t.Run("UnknownZone", func(t *testing.T) { testServingUnknownZone(t, srv) })
+	t.Run("QueryCase", testServingQueryCase)
+	t.Run("Comment", func(t *testing.T) { testServingComment(t, srv) })
+	t.Run("TCPTimeout", func(t *testing.T) { testServingTCPTimeout(t, srv) })
+	t.Run("Chaos", func(t *testing.T) { testServingChaos(t, srv) })
+	t.Run("Internal", testServingInternal)
+	t.Run("Malformed", func(t *testing.T) { testServingMalformed(t, srv) })
+	t.Run("ApexNoData", testServingApexNoData)
+	t.Run("Maintenance", func(t *testing.T) { testServingMaintenance(t, srv) })
+	t.Run("RRL", func(t *testing.T) { testServingRRL(t, srv) })
+	t.Run("EDNSSize", func(t *testing.T) { testServingEDNSSize(t, srv) })
+
+	// every query is timed
+	var m dto.Metric
+	require.Nil(t, srv.metrics.Duration.Write(&m))
+	assert.True(t, m.GetHistogram().GetSampleCount() > 0, "query durations observed")
 
 }
 
@@ -153,6 +213,19 @@ func testServing(t *testing.T) {
 
 	name := r.Answer[0].(*dns.PTR).Ptr
 	assert.Equal(t, name, "bar.example.com.", "PTR record")
+
+	// IPv6 PTR, with the label written as the address in the zone
+	arpa, _ := dns.ReverseAddr("2001:db8::53")
+	r = exchange(t, arpa, dns.TypePTR)
+	require.Len(t, r.Answer, 1, "expect 1 answer record for %s", arpa)
+	assert.Equal(t, "ns.example.com.", r.Answer[0].(*dns.PTR).Ptr)
+	assert.True(t, r.Authoritative)
+
+	// weighted PTR records are picked like other records
+	arpa, _ = dns.ReverseAddr("2001:db8::1")
+	r = exchange(t, arpa, dns.TypePTR)
+	require.Len(t, r.Answer, 1, "max_hosts limits the PTR records for %s", arpa)
+	assert.Contains(t, []string{"host1.example.com.", "host2.example.com."}, r.Answer[0].(*dns.PTR).Ptr)
 }
 
 // func TestServingMixedCase(t *testing.T) {
@@ -219,25 +292,42 @@ func testServing(t *testing.T) {
 
 // }
 
-// func testServingEDNS(t *testing.T) {
-// 	// MX test
-// 	r := exchangeSubnet(t, "test.example.com.", dns.TypeMX, "194.239.134.1")
-// 	c.Check(r.Answer, HasLen, 1)
-// 	if len(r.Answer) > 0 {
-// 		c.Check(r.Answer[0].(*dns.MX).Mx, Equals, "mx-eu.example.net.")
-// 	}
-
-// 	c.Log("Testing www.test.example.com from .dk, should match www.europe (a cname)")
-
-// 	r = exchangeSubnet(c, "www.test.example.com.", dns.TypeA, "194.239.134.0")
-// 	// www.test from .dk IP address gets at least one answer
-// 	c.Check(r.Answer, HasLen, 1)
-// 	if len(r.Answer) > 0 {
-// 		// EDNS-SUBNET test (request A, respond CNAME)
-// 		c.Check(r.Answer[0].(*dns.CNAME).Target, Equals, "geo-europe.bitnames.com.")
-// 	}
-
-// }
+func testServingEDNS(t *testing.T) {
+	targeting.Setup(&testGeo{})
+	defer targeting.Setup(nil)
+
+	// MX test
+	r := exchangeSubnet(t, "test.example.com.", dns.TypeMX, "194.239.134.1")
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, "mx-eu.example.net.", r.Answer[0].(*dns.MX).Mx)
+
+	// the client subnet is echoed in the single OPT record with a scope
+	opts := 0
+	for _, rr := range r.Extra {
+		if _, ok := rr.(*dns.OPT); ok {
+			opts++
+		}
+	}
+	assert.Equal(t, 1, opts, "OPT records in response")
+	opt := r.IsEdns0()
+	require.NotNil(t, opt)
+	require.Len(t, opt.Option, 1)
+	ecs := opt.Option[0].(*dns.EDNS0_SUBNET)
+	assert.Equal(t, "194.239.134.1", ecs.Address.String())
+	assert.Equal(t, uint8(16), ecs.SourceScope)
+
+	t.Log("Testing www.test.example.com from .dk, should match www.europe (a cname)")
+
+	r = exchangeSubnet(t, "www.test.example.com.", dns.TypeA, "194.239.134.0")
+	// www.test from .dk IP address gets at least one answer
+	require.Len(t, r.Answer, 1)
+	// EDNS-SUBNET test (request A, respond CNAME)
+	assert.Equal(t, "geo-europe.bitnames.com.", r.Answer[0].(*dns.CNAME).Target)
+
+	// without the client subnet option the source address is used
+	r = exchange(t, "test.example.com.", dns.TypeMX)
+	assert.Len(t, r.Answer, 2)
+}
 
 // func TestServeRace(t *testing.T) {
 // 	wg := sync.WaitGroup{}
@@ -273,6 +363,67 @@ func testServing(t *testing.T) {
 // 	}
 // }
 
+func testServingTLS(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("_country.foo.pgeodns.", dns.TypeTXT)
+
+	cli := &dns.Client{
+		Net:       "tcp-tls",
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	r, _, err := cli.Exchange(msg, "127.0.0.1"+TLSPORT)
+	require.Nil(t, err)
+	require.Len(t, r.Answer, 1)
+
+	// the client address is taken from the TLS connection
+	txt := r.Answer[0].(*dns.TXT).Txt[0]
+	if !strings.HasPrefix(txt, "127.0.0.1:") {
+		t.Log("Unexpected result for _country.foo.pgeodns over TLS", txt)
+		t.Fail()
+	}
+}
+
+func TestQtypeLabel(t *testing.T) {
+	assert.Equal(t, "A", qtypeLabel(dns.TypeA))
+	assert.Equal(t, "AAAA", qtypeLabel(dns.TypeAAAA))
+	assert.Equal(t, "ANY", qtypeLabel(dns.TypeANY))
+	assert.Equal(t, "other", qtypeLabel(65280))
+}
+
+// testGeo is a geo provider placing 194.239.134.0/24 in Denmark
+type testGeo struct{}
+
+// testGeoNets places a few /24 networks in countries; the continent is
+// looked up from the country like the GeoIP provider does.
+var testGeoNets = map[string]string{
+	"194.239.134.0": "dk",
+	"192.0.2.0":     "se",
+	"198.51.100.0":  "fr",
+	"203.0.113.0":   "us",
+}
+
+func (g *testGeo) HasCountry() (bool, error)  { return true, nil }
+func (g *testGeo) HasASN() (bool, error)      { return false, nil }
+func (g *testGeo) HasLocation() (bool, error) { return true, nil }
+
+func (g *testGeo) GetCountry(ip net.IP) (string, string, int) {
+	if ip4 := ip.To4(); ip4 != nil {
+		if country, ok := testGeoNets[ip4.Mask(net.CIDRMask(24, 32)).String()]; ok {
+			return country, countries.CountryContinent[country], 24
+		}
+	}
+	return "", "", 0
+}
+
+func (g *testGeo) GetASN(net.IP) (string, int, error) {
+	return "", 0, nil
+}
+
+func (g *testGeo) GetLocation(ip net.IP) (*geo.Location, error) {
+	country, continent, netmask := g.GetCountry(ip)
+	return &geo.Location{Country: country, Continent: continent, Netmask: netmask}, nil
+}
+
 func checkRcode(t *testing.T, rcode int, expected int, name string) {
 	if rcode != expected {
 		t.Logf("'%s': rcode!=%s: %s", name, dns.RcodeToString[expected], dns.RcodeToString[rcode])
@@ -319,3 +470,1197 @@ func dorequest(t *testing.T, msg *dns.Msg) *dns.Msg {
 	}
 	return r
 }
+
+func testServingNSID(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("bar.test.example.com.", dns.TypeA)
+
+	// no NSID unless it's requested
+	msg.SetEdns0(4096, false)
+	r := dorequest(t, msg)
+	require.NotNil(t, r.IsEdns0())
+	for _, o := range r.IsEdns0().Option {
+		if _, ok := o.(*dns.EDNS0_NSID); ok {
+			t.Errorf("got NSID without requesting it")
+		}
+	}
+
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	r = dorequest(t, msg)
+	require.NotNil(t, r.IsEdns0())
+
+	var nsid string
+	for _, o := range r.IsEdns0().Option {
+		if e, ok := o.(*dns.EDNS0_NSID); ok {
+			nsid = e.Nsid
+		}
+	}
+	id, err := hex.DecodeString(nsid)
+	require.Nil(t, err)
+	assert.Equal(t, "geodns-test", string(id))
+}
+
+func testServingFallback(t *testing.T) {
+	targeting.Setup(&testGeo{})
+	defer targeting.Setup(nil)
+
+	// country hit: www.se
+	r := exchangeSubnet(t, "www.test.example.com.", dns.TypeA, "192.0.2.1")
+	require.NotEmpty(t, r.Answer)
+	target := r.Answer[0].(*dns.CNAME).Target
+	if target != "geo-europe.test.example.com." && target != "geo-dk.test.example.com." {
+		t.Errorf("client in se got '%s', expected the www.se answer", target)
+	}
+
+	// no www.fr label, continent fallback to www.europe
+	r = exchangeSubnet(t, "www.test.example.com.", dns.TypeA, "198.51.100.1")
+	require.NotEmpty(t, r.Answer)
+	assert.Equal(t, "geo-europe.bitnames.com.", r.Answer[0].(*dns.CNAME).Target)
+
+	// no label for us or north-america, global fallback
+	r = exchangeSubnet(t, "www.test.example.com.", dns.TypeA, "203.0.113.1")
+	require.NotEmpty(t, r.Answer)
+	assert.Equal(t, "geo.bitnames.com.", r.Answer[0].(*dns.CNAME).Target)
+}
+
+func testServingTruncate(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("bigtxt.test.example.com.", dns.TypeTXT)
+
+	// the answer is over 512 bytes, so it gets truncated over UDP
+	r := dorequest(t, msg)
+	require.NotNil(t, r)
+	assert.True(t, r.Truncated, "TC bit set on UDP answer")
+	assert.True(t, len(r.Answer) < 8, "truncated UDP answer has fewer records")
+
+	cli := &dns.Client{Net: "tcp"}
+	r, _, err := cli.Exchange(msg, "127.0.0.1"+PORT)
+	require.Nil(t, err)
+	assert.False(t, r.Truncated, "TC bit not set on TCP answer")
+	assert.Len(t, r.Answer, 8)
+
+	// with a larger EDNS buffer it fits in UDP
+	msg.SetEdns0(4096, false)
+	r = dorequest(t, msg)
+	require.NotNil(t, r)
+	assert.False(t, r.Truncated, "TC bit not set with EDNS buffer size 4096")
+	assert.Len(t, r.Answer, 8)
+}
+
+func testServingMaxUDPSize(t *testing.T, srv *Server) {
+	srv.SetMaxUDPSize(512)
+	defer srv.SetMaxUDPSize(4096)
+
+	var m dto.Metric
+	require.Nil(t, srv.metrics.UDPClamped.Write(&m))
+	clamped := m.GetCounter().GetValue()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("bigtxt.test.example.com.", dns.TypeTXT)
+	msg.SetEdns0(4096, false)
+
+	// the client accepts 4096 bytes, but the answer is clamped to 512
+	r := dorequest(t, msg)
+	require.NotNil(t, r)
+	assert.True(t, r.Truncated, "TC bit set on answer over the maximum UDP size")
+	assert.Equal(t, uint16(512), r.IsEdns0().UDPSize(), "advertise the maximum UDP size")
+
+	require.Nil(t, srv.metrics.UDPClamped.Write(&m))
+	assert.Equal(t, clamped+1, m.GetCounter().GetValue(), "clamped answer counted")
+
+	// small answers aren't affected
+	r = exchange(t, "foo.test.example.com.", dns.TypeA)
+	assert.False(t, r.Truncated)
+	require.Nil(t, srv.metrics.UDPClamped.Write(&m))
+	assert.Equal(t, clamped+1, m.GetCounter().GetValue())
+}
+
+// chanLogger sends the query log entries to a channel.
+type chanLogger chan *querylog.Entry
+
+func (l chanLogger) Write(e *querylog.Entry) error {
+	l <- e
+	return nil
+}
+
+func testServingComment(t *testing.T, srv *Server) {
+	entries := make(chanLogger, 1)
+	srv.SetQueryLogger(entries)
+	defer srv.SetQueryLogger(nil)
+
+	// the comment is only in the query log, not in the answer
+	r := exchange(t, "tagged.test.example.com.", dns.TypeA)
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, "192.0.2.80", r.Answer[0].(*dns.A).A.String())
+
+	select {
+	case e := <-entries:
+		assert.Equal(t, []string{"ams1 rack 4"}, e.Comments)
+	case <-time.After(time.Second):
+		t.Fatal("no query log entry")
+	}
+
+	exchange(t, "bar.test.example.com.", dns.TypeA)
+	select {
+	case e := <-entries:
+		assert.Empty(t, e.Comments)
+		assert.Equal(t, "bar", e.LabelName)
+		assert.Equal(t, "@", e.MatchedBy)
+	case <-time.After(time.Second):
+		t.Fatal("no query log entry")
+	}
+}
+
+func testServingQueryCase(t *testing.T) {
+	// resolvers using 0x20 randomization expect the case of the
+	// query name to be kept in the question and the answer
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+	}{
+		{"WwW.ExAmPlE.com.", dns.TypeA, dns.RcodeSuccess},
+		{"FoO.eXaMpLe.CoM.", dns.TypeA, dns.RcodeSuccess},
+		{"FoO.eXaMpLe.CoM.", dns.TypeANY, dns.RcodeSuccess},
+		{"cNaMe-InTeRnAl-ReFeRaL.example.com.", dns.TypeA, dns.RcodeSuccess},
+		{"wWw.TeSt.ExAmPlE.cOm.", dns.TypeTXT, dns.RcodeSuccess},
+		{"NoNe.ExAmPlE.cOm.", dns.TypeA, dns.RcodeNameError},
+		{"wWw.DnSsEc.ExAmPlE.cOm.", dns.TypeA, dns.RcodeSuccess},
+		{"WwW.eXaMpLe.OrG.", dns.TypeA, dns.RcodeRefused},
+	} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(q.name, q.qtype)
+		msg.SetEdns0(4096, true)
+		r := dorequest(t, msg)
+		require.NotNil(t, r)
+		checkRcode(t, r.Rcode, q.rcode, q.name)
+		if assert.Len(t, r.Question, 1) {
+			assert.Equal(t, q.name, r.Question[0].Name, "question name case")
+		}
+		if q.rcode == dns.RcodeSuccess && q.qtype != dns.TypeTXT {
+			require.NotEmpty(t, r.Answer, q.name)
+			assert.Equal(t, q.name, r.Answer[0].Header().Name, "answer owner name case")
+		}
+		for _, rr := range r.Answer {
+			if strings.EqualFold(rr.Header().Name, q.name) {
+				assert.Equal(t, q.name, rr.Header().Name, "owner name case of %s", rr)
+			}
+		}
+	}
+}
+
+func testServingUnknownZone(t *testing.T, srv *Server) {
+	defer srv.SetUnknownZone("refused")
+
+	var m dto.Metric
+	require.Nil(t, srv.metrics.UnknownZone.Write(&m))
+	unknown := m.GetCounter().GetValue()
+
+	r := exchange(t, "www.example.org.", dns.TypeA)
+	require.NotNil(t, r)
+	checkRcode(t, r.Rcode, dns.RcodeRefused, "www.example.org")
+
+	require.Nil(t, srv.SetUnknownZone("noerror"))
+	r = exchange(t, "www.example.org.", dns.TypeA)
+	require.NotNil(t, r)
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "www.example.org")
+	assert.Len(t, r.Answer, 0)
+	assert.False(t, r.Authoritative)
+
+	require.Nil(t, srv.SetUnknownZone("drop"))
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.org.", dns.TypeA)
+	cli := &dns.Client{Timeout: 200 * time.Millisecond}
+	_, _, err := cli.Exchange(msg, "127.0.0.1"+PORT)
+	assert.NotNil(t, err, "no answer for dropped query")
+
+	// the zones are answered as usual
+	r = exchange(t, "foo.test.example.com.", dns.TypeA)
+	require.NotNil(t, r)
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "foo.test.example.com")
+
+	require.Nil(t, srv.metrics.UnknownZone.Write(&m))
+	assert.Equal(t, unknown+3, m.GetCounter().GetValue(), "unknown zone queries counted")
+
+	assert.NotNil(t, srv.SetUnknownZone("nxdomain"))
+}
+
+func testServingCompression(t *testing.T, srv *Server) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("bigtxt.test.example.com.", dns.TypeTXT)
+
+	// the size of the answer on the wire, read over TCP
+	answerSize := func() int {
+		conn, err := dns.Dial("tcp", "127.0.0.1"+PORT)
+		require.Nil(t, err)
+		defer conn.Close()
+		require.Nil(t, conn.WriteMsg(msg))
+		buf, err := conn.ReadMsgHeader(nil)
+		require.Nil(t, err)
+		r := new(dns.Msg)
+		require.Nil(t, r.Unpack(buf))
+		require.Len(t, r.Answer, 8)
+		return len(buf)
+	}
+
+	compressed := answerSize()
+
+	srv.SetCompression(false)
+	defer srv.SetCompression(true)
+
+	uncompressed := answerSize()
+	// each of the 8 answers repeats the 25 byte name instead of a
+	// 2 byte pointer
+	assert.Equal(t, compressed+8*23, uncompressed, "answer sizes with and without compression")
+
+	// answers are still truncated to fit over UDP
+	r := dorequest(t, msg)
+	require.NotNil(t, r)
+	assert.True(t, r.Truncated, "TC bit set on UDP answer")
+	assert.True(t, len(r.Answer) > 0 && len(r.Answer) < 8)
+}
+
+func testServingANY(t *testing.T, srv *Server) {
+	types := func(r *dns.Msg) map[uint16]string {
+		found := map[uint16]string{}
+		for _, rr := range r.Answer {
+			found[rr.Header().Rrtype] = strings.TrimPrefix(rr.String(), rr.Header().String())
+		}
+		return found
+	}
+
+	var m dto.Metric
+	require.Nil(t, srv.metrics.MinimalANY.Write(&m))
+	minimized := m.GetCounter().GetValue()
+
+	// a minimal answer by default
+	r := exchange(t, "any.test.example.com.", dns.TypeANY)
+	require.Len(t, r.Answer, 1)
+	hinfo, ok := r.Answer[0].(*dns.HINFO)
+	require.True(t, ok, "minimal ANY answer is HINFO")
+	assert.Equal(t, "RFC8482", hinfo.Cpu)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	require.Len(t, r.Ns, 1)
+	assert.Equal(t, dns.TypeSOA, r.Ns[0].Header().Rrtype)
+	require.Nil(t, srv.metrics.MinimalANY.Write(&m))
+	assert.Equal(t, minimized+1, m.GetCounter().GetValue())
+
+	// names without records and other types aren't affected
+	r = exchange(t, "bar.nxdomain.test.example.com.", dns.TypeANY)
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+	r = exchange(t, "any.test.example.com.", dns.TypeA)
+	assert.Equal(t, "192.168.2.1", types(r)[dns.TypeA])
+	require.Nil(t, srv.metrics.MinimalANY.Write(&m))
+	assert.Equal(t, minimized+1, m.GetCounter().GetValue())
+
+	// TCP queries get all the records
+	msg := new(dns.Msg)
+	msg.SetQuestion("any.test.example.com.", dns.TypeANY)
+	cli := &dns.Client{Net: "tcp"}
+	r, _, err := cli.Exchange(msg, "127.0.0.1"+PORT)
+	require.Nil(t, err)
+	assert.Len(t, r.Answer, 4)
+
+	// and so do UDP queries with full ANY answers enabled
+	srv.SetMinimalANY(false)
+	defer srv.SetMinimalANY(true)
+
+	// every type at the label, the A record from the IP targeted label
+	r = exchangeSubnet(t, "any.test.example.com.", dns.TypeANY, "192.0.2.1")
+	require.NotNil(t, r)
+	assert.Equal(t, map[uint16]string{
+		dns.TypeA:    "192.168.2.2",
+		dns.TypeAAAA: "fd06:c1d3:e902::2",
+		dns.TypeMX:   "10 mx.example.net.",
+		dns.TypeTXT:  `"any records"`,
+	}, types(r))
+
+	r = exchange(t, "any.test.example.com.", dns.TypeANY)
+	assert.Equal(t, "192.168.2.1", types(r)[dns.TypeA])
+	assert.Len(t, r.Answer, 4)
+
+	// the alias isn't in the answer
+	r = exchange(t, "any-alias.test.example.com.", dns.TypeANY)
+	assert.Len(t, r.Answer, 4)
+	assert.NotContains(t, types(r), dns.TypeMF)
+
+	// only the CNAME for a name with one
+	r = exchange(t, "www.test.example.com.", dns.TypeANY)
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, dns.TypeCNAME, r.Answer[0].Header().Rrtype)
+
+	require.Nil(t, srv.metrics.MinimalANY.Write(&m))
+	assert.Equal(t, minimized+1, m.GetCounter().GetValue())
+}
+
+func testServingHTTPS(t *testing.T) {
+	r := exchange(t, "svc.test.example.com.", zones.TypeHTTPS)
+	require.Len(t, r.Answer, 1)
+	rr, ok := r.Answer[0].(*dns.RFC3597)
+	require.True(t, ok, "HTTPS record")
+	assert.Equal(t, zones.TypeHTTPS, rr.Hdr.Rrtype)
+	assert.Equal(t, uint32(600), rr.Hdr.Ttl)
+	// priority 1, target ".", alpn h2,h3 and port 8443
+	assert.Equal(t, "000100"+"00010006026832026833"+"0003000220fb", rr.Rdata)
+
+	r = exchange(t, "foo.test.example.com.", zones.TypeHTTPS)
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "no HTTPS records")
+	assert.Len(t, r.Answer, 0)
+}
+
+func testServingSlowDown(t *testing.T, srv *Server) {
+	srv.SetSlowDown(2, 200*time.Millisecond)
+	defer srv.SetSlowDown(0, 0)
+
+	var m dto.Metric
+	require.Nil(t, srv.metrics.Delayed.Write(&m))
+	delayed := m.GetCounter().GetValue()
+
+	timed := func() time.Duration {
+		start := time.Now()
+		r := exchange(t, "foo.test.example.com.", dns.TypeA)
+		require.NotNil(t, r)
+		return time.Since(start)
+	}
+
+	// the first queries are within the threshold
+	assert.True(t, timed() < 200*time.Millisecond)
+	assert.True(t, timed() < 200*time.Millisecond)
+
+	assert.True(t, timed() >= 200*time.Millisecond, "answer over the threshold is delayed")
+	require.Nil(t, srv.metrics.Delayed.Write(&m))
+	assert.Equal(t, delayed+1, m.GetCounter().GetValue(), "delayed answer counted")
+}
+
+func testServingAlias(t *testing.T) {
+	for label, qtype := range map[string]uint16{"bar": dns.TypeA, "foo": dns.TypeTXT} {
+		r := exchange(t, label+".test.example.com.", qtype)
+		ra := exchange(t, label+".test.example.info.", qtype)
+		require.NotEmpty(t, r.Answer)
+		require.Len(t, ra.Answer, len(r.Answer))
+		assert.Equal(t, label+".test.example.info.", ra.Question[0].Name)
+		for i, rr := range ra.Answer {
+			assert.Equal(t, label+".test.example.info.", rr.Header().Name)
+			assert.Equal(t,
+				strings.TrimPrefix(r.Answer[i].String(), r.Answer[i].Header().Name),
+				strings.TrimPrefix(rr.String(), rr.Header().Name),
+			)
+		}
+	}
+
+	// the question case is kept
+	r := exchange(t, "Foo.Test.Example.Info.", dns.TypeA)
+	require.NotEmpty(t, r.Answer)
+	assert.Equal(t, "Foo.Test.Example.Info.", r.Answer[0].Header().Name)
+
+	r = exchange(t, "test.example.info.", dns.TypeSOA)
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, "test.example.info.", r.Answer[0].Header().Name)
+
+	r = exchange(t, "nxdomain.test.example.info.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+	require.Len(t, r.Ns, 1)
+	assert.Equal(t, "test.example.info.", r.Ns[0].Header().Name)
+
+	// referrals and glue are moved to the alias too
+	r = exchange(t, "www.sub.test.example.info.", dns.TypeA)
+	require.NotEmpty(t, r.Ns)
+	var ns []string
+	for _, rr := range r.Ns {
+		assert.Equal(t, "sub.test.example.info.", rr.Header().Name)
+		ns = append(ns, rr.(*dns.NS).Ns)
+	}
+	assert.Contains(t, ns, "ns1.sub.test.example.info.")
+	assert.Contains(t, ns, "ns.example.net.")
+	require.NotEmpty(t, r.Extra)
+	assert.Equal(t, "ns1.sub.test.example.info.", r.Extra[0].Header().Name)
+
+	// the original zone isn't changed
+	r = exchange(t, "www.sub.test.example.com.", dns.TypeA)
+	require.NotEmpty(t, r.Extra)
+	assert.Equal(t, "ns1.sub.test.example.com.", r.Extra[0].Header().Name)
+}
+
+func testServingBlocklist(t *testing.T, srv *Server) {
+	path := writeBlocklist(t, "bar.test.example.com\n*.sub.test.example.com\nfoo.test.example.info\n")
+	defer os.Remove(path)
+	bl, err := NewBlocklist(path)
+	require.Nil(t, err)
+
+	srv.SetBlocklist(bl, nil)
+	defer srv.SetBlocklist(nil, nil)
+
+	var m dto.Metric
+	require.Nil(t, srv.metrics.Blocked.Write(&m))
+	blocked := m.GetCounter().GetValue()
+
+	for _, name := range []string{"bar.test.example.com.", "www.sub.test.example.com.", "foo.test.example.info."} {
+		r := exchange(t, name, dns.TypeA)
+		checkRcode(t, r.Rcode, dns.RcodeNameError, name)
+		assert.Empty(t, r.Answer)
+		require.Len(t, r.Ns, 1, "SOA for blocked %s", name)
+		assert.True(t, r.Authoritative)
+	}
+
+	// other names, and the alias of a blocked name, still work
+	r := exchange(t, "bar.test.example.info.", dns.TypeA)
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "bar.test.example.info")
+	assert.Len(t, r.Answer, 1)
+
+	require.Nil(t, srv.metrics.Blocked.Write(&m))
+	assert.Equal(t, blocked+3, m.GetCounter().GetValue(), "blocked queries counted")
+
+	srv.SetBlocklist(bl, []net.IP{net.ParseIP("192.0.2.250"), net.ParseIP("2001:db8::250")})
+
+	r = exchange(t, "bar.test.example.com.", dns.TypeA)
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "sinkholed bar.test.example.com")
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, "192.0.2.250", r.Answer[0].(*dns.A).A.String())
+
+	r = exchange(t, "bar.test.example.com.", dns.TypeAAAA)
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, "2001:db8::250", r.Answer[0].(*dns.AAAA).AAAA.String())
+
+	r = exchange(t, "bar.test.example.com.", dns.TypeMX)
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "sinkholed bar.test.example.com MX")
+	assert.Empty(t, r.Answer)
+	assert.Len(t, r.Ns, 1)
+
+	// answers that don't go through the whole lookup are truncated too
+	var sinkhole []net.IP
+	for i := 1; i <= 50; i++ {
+		sinkhole = append(sinkhole, net.IPv4(192, 0, 2, byte(i)))
+	}
+	srv.SetBlocklist(bl, sinkhole)
+	r = exchange(t, "bar.test.example.com.", dns.TypeA)
+	assert.True(t, r.Truncated, "TC bit set on a large sinkhole answer")
+	assert.True(t, len(r.Answer) < len(sinkhole), "truncated sinkhole answer has fewer records")
+}
+
+func testServingResponses(t *testing.T, srv *Server) {
+	count := func(qtype, rcode string) float64 {
+		var m dto.Metric
+		require.Nil(t, srv.metrics.Responses.WithLabelValues(qtype, rcode).Write(&m))
+		return m.GetCounter().GetValue()
+	}
+
+	nxdomain := count("A", "NXDOMAIN")
+	noerror := count("TXT", "NOERROR")
+
+	exchange(t, "nxdomain.test.example.com.", dns.TypeA)
+	exchange(t, "foo.test.example.com.", dns.TypeTXT)
+	exchange(t, "_status.pgeodns.", dns.TypeTXT)
+
+	assert.Equal(t, nxdomain+1, count("A", "NXDOMAIN"))
+	assert.Equal(t, noerror+2, count("TXT", "NOERROR"), "every answer is counted")
+}
+
+func testServingCNAMEChain(t *testing.T, srv *Server) {
+	r := exchange(t, "cname-chain.test.example.com.", dns.TypeA)
+	require.Len(t, r.Answer, 3, "two CNAMEs and the A record")
+	assert.Equal(t, "cname-internal-referal.test.example.com.", r.Answer[0].(*dns.CNAME).Target)
+	assert.Equal(t, "cname-internal-referal.test.example.com.", r.Answer[1].Header().Name)
+	assert.Equal(t, "bar.test.example.com.", r.Answer[1].(*dns.CNAME).Target)
+	assert.Equal(t, "bar.test.example.com.", r.Answer[2].Header().Name)
+	assert.Equal(t, "192.168.1.2", r.Answer[2].(*dns.A).A.String())
+
+	// a CNAME query isn't followed
+	r = exchange(t, "cname-chain.test.example.com.", dns.TypeCNAME)
+	assert.Len(t, r.Answer, 1)
+
+	r = exchange(t, "cname-loop-a.test.example.com.", dns.TypeA)
+	checkRcode(t, r.Rcode, dns.RcodeServerFailure, "cname loop")
+	assert.Len(t, r.Answer, 0)
+
+	srv.SetCNAMEDepth(1)
+	defer srv.SetCNAMEDepth(defaultCNAMEDepth)
+	r = exchange(t, "cname-chain.test.example.com.", dns.TypeA)
+	assert.Len(t, r.Answer, 2, "chain followed to the depth")
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "cname chain over the depth")
+}
+
+func testServingDNSSEC(t *testing.T) {
+	query := func(name string, qtype uint16, do bool) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		msg.SetEdns0(4096, do)
+		r := dorequest(t, msg)
+		require.NotNil(t, r)
+		assert.False(t, r.AuthenticatedData, "AD isn't set by the authoritative server")
+		return r
+	}
+	split := func(rrs []dns.RR) (records []dns.RR, sigs []*dns.RRSIG) {
+		for _, rr := range rrs {
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				sigs = append(sigs, sig)
+			} else {
+				records = append(records, rr)
+			}
+		}
+		return
+	}
+
+	r := query("dnssec.example.com.", dns.TypeDNSKEY, true)
+	keys, sigs := split(r.Answer)
+	require.Len(t, keys, 1)
+	require.Len(t, sigs, 1)
+	key := keys[0].(*dns.DNSKEY)
+	assert.Nil(t, sigs[0].Verify(key, keys), "DNSKEY signature")
+
+	r = query("www.dnssec.example.com.", dns.TypeA, true)
+	records, sigs := split(r.Answer)
+	require.Len(t, records, 1)
+	require.Len(t, sigs, 1)
+	assert.Nil(t, sigs[0].Verify(key, records), "A signature")
+
+	// without the DO bit there are no signatures
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeANY} {
+		r = query("www.dnssec.example.com.", qtype, false)
+		_, sigs = split(r.Answer)
+		assert.Len(t, sigs, 0, "no signatures for %s without DO", dns.TypeToString[qtype])
+		for _, rr := range r.Answer {
+			assert.NotEqual(t, dns.TypeNSEC, rr.Header().Rrtype)
+		}
+	}
+	r = query("nxdomain.dnssec.example.com.", dns.TypeA, false)
+	assert.Len(t, r.Ns, 1, "only the SOA without DO")
+
+	r = query("nxdomain.dnssec.example.com.", dns.TypeA, true)
+	checkRcode(t, r.Rcode, dns.RcodeNameError, "nxdomain with DO")
+	records, sigs = split(r.Ns)
+	require.Len(t, sigs, 2, "SOA and NSEC signatures")
+	var nsec *dns.NSEC
+	for _, rr := range records {
+		if n, ok := rr.(*dns.NSEC); ok {
+			nsec = n
+		}
+	}
+	require.NotNil(t, nsec, "NSEC record for nxdomain")
+	assert.Equal(t, "dnssec.example.com.", nsec.Hdr.Name, "NSEC covering nxdomain")
+	assert.Equal(t, "www.dnssec.example.com.", nsec.NextDomain)
+	for _, sig := range sigs {
+		var rrset []dns.RR
+		for _, rr := range records {
+			if rr.Header().Rrtype == sig.TypeCovered {
+				rrset = append(rrset, rr)
+			}
+		}
+		assert.Nil(t, sig.Verify(key, rrset), "%s signature", dns.TypeToString[sig.TypeCovered])
+	}
+
+	// NODATA is proven by the NSEC record of the name
+	r = query("www.dnssec.example.com.", dns.TypeTXT, true)
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "nodata with DO")
+	records, _ = split(r.Ns)
+	require.Len(t, records, 2)
+	if assert.IsType(t, &dns.NSEC{}, records[1]) {
+		assert.Equal(t, "www.dnssec.example.com.", records[1].Header().Name)
+	}
+
+	// a referral to a signed sub-zone has the signed DS records
+	r = query("www.zone.dnssec.example.com.", dns.TypeA, true)
+	assert.False(t, r.Authoritative, "referral isn't authoritative")
+	assert.Len(t, r.Answer, 0)
+	records, sigs = split(r.Ns)
+	require.Len(t, records, 2, "NS and DS")
+	assert.IsType(t, &dns.NS{}, records[0])
+	if assert.IsType(t, &dns.DS{}, records[1]) {
+		ds := records[1].(*dns.DS)
+		assert.Equal(t, "zone.dnssec.example.com.", ds.Hdr.Name)
+		assert.Equal(t, dns.SHA256, ds.DigestType)
+	}
+	require.Len(t, sigs, 1)
+	assert.Equal(t, dns.TypeDS, sigs[0].TypeCovered)
+	assert.Nil(t, sigs[0].Verify(key, records[1:]), "DS signature")
+
+	r = query("www.zone.dnssec.example.com.", dns.TypeA, false)
+	require.Len(t, r.Ns, 1, "only the NS record without DO")
+	assert.IsType(t, &dns.NS{}, r.Ns[0])
+
+	// the DS records are answered by the parent, names below are referred
+	r = query("zone.dnssec.example.com.", dns.TypeDS, true)
+	assert.True(t, r.Authoritative)
+	records, sigs = split(r.Answer)
+	require.Len(t, records, 1)
+	require.Len(t, sigs, 1)
+	assert.Nil(t, sigs[0].Verify(key, records), "DS answer signature")
+
+	r = query("www.zone.dnssec.example.com.", dns.TypeDS, true)
+	assert.False(t, r.Authoritative, "DS below the delegation is referred")
+	assert.Len(t, r.Answer, 0)
+}
+
+func testServingOverride(t *testing.T, srv *Server) {
+	canary, err := NewOverride("canary", "bar.test.example.com", []string{"127.0.0.0/8"}, []string{"192.0.2.99"}, "", 0)
+	require.Nil(t, err)
+	other, err := NewOverride("other", "foo.test.example.com", []string{"192.0.2.1"}, nil, "canary.example.net", 60)
+	require.Nil(t, err)
+	srv.SetOverrides([]*Override{canary, other})
+	defer srv.SetOverrides(nil)
+
+	var m dto.Metric
+	require.Nil(t, srv.metrics.Overrides.WithLabelValues("canary").Write(&m))
+	hits := m.GetCounter().GetValue()
+
+	r := exchange(t, "bar.test.example.com.", dns.TypeA)
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, "192.0.2.99", r.Answer[0].(*dns.A).A.String(), "override answer")
+	assert.Equal(t, uint32(600), r.Answer[0].Header().Ttl, "override has the zone ttl")
+
+	r = exchange(t, "bar.test.example.com.", dns.TypeAAAA)
+	require.Len(t, r.Answer, 0, "no AAAA override")
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "override nodata")
+
+	require.Nil(t, srv.metrics.Overrides.WithLabelValues("canary").Write(&m))
+	assert.Equal(t, hits+2, m.GetCounter().GetValue(), "override hits counted")
+
+	// other clients get the zone data
+	r = exchangeSubnet(t, "foo.test.example.com.", dns.TypeTXT, "192.0.2.2")
+	require.Len(t, r.Answer, 1)
+	assert.IsType(t, &dns.TXT{}, r.Answer[0])
+
+	r = exchangeSubnet(t, "foo.test.example.com.", dns.TypeTXT, "192.0.2.1")
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, "canary.example.net.", r.Answer[0].(*dns.CNAME).Target, "override for the client subnet")
+}
+
+func testServingMaxConcurrent(t *testing.T, srv *Server) {
+	srv.SetMaxConcurrent(1)
+	defer srv.SetMaxConcurrent(0)
+
+	var m dto.Metric
+	require.Nil(t, srv.metrics.Overloaded.Write(&m))
+	dropped := m.GetCounter().GetValue()
+
+	// hold the only slot
+	require.True(t, srv.acquire())
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("foo.test.example.com.", dns.TypeA)
+	for _, n := range []string{"udp", "tcp"} {
+		cli := &dns.Client{Net: n, Timeout: 300 * time.Millisecond}
+		_, _, err := cli.Exchange(msg, "127.0.0.1"+PORT)
+		assert.NotNil(t, err, "%s query over the limit isn't answered", n)
+	}
+	require.Nil(t, srv.metrics.Overloaded.Write(&m))
+	assert.Equal(t, dropped+2, m.GetCounter().GetValue(), "dropped queries counted")
+
+	srv.release()
+	r := exchange(t, "foo.test.example.com.", dns.TypeA)
+	require.NotNil(t, r)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+}
+
+func testServingFlags(t *testing.T) {
+	query := func(name string, qtype uint16, rd bool) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		msg.RecursionDesired = rd
+		r := dorequest(t, msg)
+		require.NotNil(t, r)
+		assert.False(t, r.RecursionAvailable, "RA bit is never set for %s", name)
+		assert.Equal(t, rd, r.RecursionDesired, "RD bit is copied for %s", name)
+		return r
+	}
+
+	for _, rd := range []bool{true, false} {
+		r := query("bar.test.example.com.", dns.TypeA, rd)
+		checkRcode(t, r.Rcode, dns.RcodeSuccess, "bar.test.example.com")
+		assert.True(t, r.Authoritative, "matched label is authoritative")
+		assert.Len(t, r.Answer, 1)
+
+		r = query("nothere.test.example.com.", dns.TypeA, rd)
+		checkRcode(t, r.Rcode, dns.RcodeNameError, "nothere.test.example.com")
+		assert.True(t, r.Authoritative, "NXDOMAIN is authoritative")
+
+		// sub.test.example.com is delegated to other nameservers
+		r = query("www.sub.test.example.com.", dns.TypeA, rd)
+		checkRcode(t, r.Rcode, dns.RcodeSuccess, "www.sub.test.example.com")
+		assert.False(t, r.Authoritative, "referral isn't authoritative")
+		assert.Len(t, r.Answer, 0)
+		if assert.Len(t, r.Ns, 2) {
+			assert.Equal(t, "sub.test.example.com.", r.Ns[0].Header().Name)
+			assert.Equal(t, dns.TypeNS, r.Ns[0].Header().Rrtype)
+		}
+		if assert.Len(t, r.Extra, 1, "glue for the nameserver in the zone") {
+			glue := r.Extra[0].(*dns.A)
+			assert.Equal(t, "ns1.sub.test.example.com.", glue.Hdr.Name)
+			assert.Equal(t, "192.0.2.53", glue.A.String())
+		}
+	}
+}
+
+func testServingNegative(t *testing.T) {
+	checkSOA := func(r *dns.Msg, name string) {
+		if assert.Len(t, r.Ns, 1, "SOA in the authority section for %s", name) {
+			soa, ok := r.Ns[0].(*dns.SOA)
+			if assert.True(t, ok, "SOA record for %s", name) {
+				assert.Equal(t, "test.example.com.", soa.Hdr.Name)
+				assert.True(t, soa.Hdr.Ttl <= soa.Minttl, "negative TTL at most the SOA minimum")
+			}
+		}
+	}
+
+	// the name doesn't exist
+	r := exchange(t, "nothere.test.example.com.", dns.TypeA)
+	checkRcode(t, r.Rcode, dns.RcodeNameError, "nothere.test.example.com")
+	assert.Len(t, r.Answer, 0)
+	checkSOA(r, "NXDOMAIN")
+
+	r = exchange(t, "x.bar.test.example.com.", dns.TypeA)
+	checkRcode(t, r.Rcode, dns.RcodeNameError, "x.bar.test.example.com")
+
+	// the name exists, but doesn't have records of the type (NODATA)
+	r = exchange(t, "foo.test.example.com.", dns.TypeMX)
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "foo.test.example.com MX")
+	assert.Len(t, r.Answer, 0)
+	checkSOA(r, "NODATA")
+
+	// names that only exist because there are names below them
+	r = exchange(t, "two.one.test.example.com.", dns.TypeA)
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "two.one.test.example.com")
+	assert.Len(t, r.Answer, 0)
+	checkSOA(r, "empty non-terminal")
+}
+
+func testServingACL(t *testing.T, srv *Server) {
+	fh, err := ioutil.TempFile("", "geodns-zone.")
+	require.Nil(t, err)
+	defer os.Remove(fh.Name())
+	fh.WriteString(`{
+		"allow": [ "192.0.2.0/24" ],
+		"data": {
+			"": { "ns": [ "ns1.example.net." ] },
+			"www": { "a": [ [ "198.51.100.1" ] ] }
+		}
+	}`)
+	fh.Close()
+
+	zone := zones.NewZone("acl.example")
+	require.Nil(t, zone.ReadZoneFile(fh.Name()))
+	zone.SetupMetrics(nil)
+	defer zone.Close()
+	srv.Add("acl.example.", zone)
+	defer srv.Remove("acl.example.")
+
+	var m dto.Metric
+	refused := srv.metrics.ACLRefused.WithLabelValues("acl.example")
+
+	r := exchangeSubnet(t, "www.acl.example.", dns.TypeA, "192.0.2.10")
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "allowed client")
+	assert.Len(t, r.Answer, 1)
+
+	r = exchangeSubnet(t, "www.acl.example.", dns.TypeA, "198.51.100.10")
+	checkRcode(t, r.Rcode, dns.RcodeRefused, "client outside the allowed networks")
+	assert.Len(t, r.Answer, 0)
+
+	// without a client subnet the source address (127.0.0.1) is used
+	r = exchange(t, "www.acl.example.", dns.TypeA)
+	checkRcode(t, r.Rcode, dns.RcodeRefused, "loopback client")
+
+	require.Nil(t, refused.Write(&m))
+	assert.Equal(t, float64(2), m.GetCounter().GetValue())
+
+	// zones without an allow list answer everyone
+	r = exchangeSubnet(t, "bar.test.example.com.", dns.TypeA, "198.51.100.10")
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "zone without allow list")
+}
+
+func testServingCookie(t *testing.T, srv *Server) {
+	query := func(cookie string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("bigtxt.test.example.com.", dns.TypeTXT)
+		msg.SetEdns0(4096, false)
+		if len(cookie) > 0 {
+			opt := msg.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+		}
+		r := dorequest(t, msg)
+		require.NotNil(t, r)
+		return r
+	}
+	replyCookie := func(r *dns.Msg) string {
+		if opt := r.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+					return c.Cookie
+				}
+			}
+		}
+		return ""
+	}
+
+	client := "0102030405060708"
+
+	r := query(client)
+	assert.False(t, r.Truncated, "cookies aren't required by default")
+	cookie := replyCookie(r)
+	assert.Len(t, cookie, 48)
+
+	srv.SetRequireCookie(true)
+	defer srv.SetRequireCookie(false)
+
+	r = query("")
+	assert.True(t, r.Truncated, "large answer without a cookie is truncated")
+	r = query(client)
+	assert.True(t, r.Truncated, "large answer with only a client cookie is truncated")
+
+	r = query(cookie)
+	assert.False(t, r.Truncated, "large answer with a valid server cookie")
+	assert.Len(t, r.Answer, 8)
+
+	// small answers don't need a cookie
+	r = exchange(t, "bar.test.example.com.", dns.TypeA)
+	assert.False(t, r.Truncated)
+
+	r = query("0102")
+	checkRcode(t, r.Rcode, dns.RcodeFormatError, "malformed cookie")
+}
+
+func testServingDNS64(t *testing.T, srv *Server) {
+	// without DNS64 a label with only A records has no AAAA answer
+	r := exchange(t, "bar.test.example.com.", dns.TypeAAAA)
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "bar.test.example.com AAAA")
+	assert.Len(t, r.Answer, 0)
+
+	require.Nil(t, srv.SetDNS64(DefaultDNS64Prefix))
+	defer srv.SetDNS64("")
+
+	r = exchange(t, "bar.test.example.com.", dns.TypeAAAA)
+	if assert.Len(t, r.Answer, 1) {
+		aaaa := r.Answer[0].(*dns.AAAA)
+		assert.Equal(t, "64:ff9b::c0a8:102", aaaa.AAAA.String())
+		assert.Equal(t, "bar.test.example.com.", aaaa.Hdr.Name)
+		assert.Equal(t, uint32(601), aaaa.Hdr.Ttl)
+	}
+
+	// real AAAA records are returned as they are
+	r = exchange(t, "foo.test.example.com.", dns.TypeAAAA)
+	if assert.NotEmpty(t, r.Answer) {
+		aaaa := r.Answer[0].(*dns.AAAA)
+		assert.True(t, strings.HasPrefix(aaaa.AAAA.String(), "fd06:"), "real AAAA record for foo")
+	}
+
+	// A queries aren't affected
+	r = exchange(t, "bar.test.example.com.", dns.TypeA)
+	if assert.Len(t, r.Answer, 1) {
+		assert.Equal(t, "192.168.1.2", r.Answer[0].(*dns.A).A.String())
+	}
+
+	assert.Error(t, srv.SetDNS64("64:ff9b::/64"))
+	assert.Error(t, srv.SetDNS64("192.0.2.0/24"))
+}
+
+func testServingStrictGeo(t *testing.T, srv *Server) {
+	srv.SetStrictGeo(true)
+	defer srv.SetStrictGeo(false)
+
+	// www has a www.europe variant, foo isn't targeted
+	r := exchange(t, "www.test.example.com.", dns.TypeA)
+	checkRcode(t, r.Rcode, dns.RcodeServerFailure, "www.test.example.com without geo provider")
+
+	r = exchange(t, "foo.test.example.com.", dns.TypeA)
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "foo.test.example.com without geo provider")
+
+	targeting.Setup(&testGeo{})
+	defer targeting.Setup(nil)
+
+	r = exchange(t, "www.test.example.com.", dns.TypeA)
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "www.test.example.com with geo provider")
+}
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "geodns test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+func testServingTCPTimeout(t *testing.T, srv *Server) {
+	var m dto.Metric
+	require.Nil(t, srv.metrics.TCPTimeouts.Write(&m))
+	timeouts := m.GetCounter().GetValue()
+
+	// a connection that never sends a query
+	silent, err := net.Dial("tcp", "127.0.0.1"+PORT)
+	require.Nil(t, err)
+	defer silent.Close()
+
+	// and one that stays idle after a query
+	idle, err := dns.Dial("tcp", "127.0.0.1"+PORT)
+	require.Nil(t, err)
+	defer idle.Close()
+	msg := new(dns.Msg)
+	msg.SetQuestion("bar.test.example.com.", dns.TypeA)
+	require.Nil(t, idle.WriteMsg(msg))
+	r, err := idle.ReadMsg()
+	require.Nil(t, err)
+	assert.Len(t, r.Answer, 1)
+
+	start := time.Now()
+	for _, c := range []net.Conn{silent, idle.Conn} {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := c.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err, "connection closed by the server")
+	}
+	assert.True(t, time.Since(start) < 3*time.Second, "closed after the timeout")
+
+	require.Nil(t, srv.metrics.TCPTimeouts.Write(&m))
+	assert.Equal(t, timeouts+2, m.GetCounter().GetValue(), "timed out connections")
+}
+
+func testServingEDNSSize(t *testing.T, srv *Server) {
+	defer srv.SetEDNSBufferSize(0)
+
+	size := func(name string, clientSize uint16) uint16 {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.SetEdns0(clientSize, false)
+		r := dorequest(t, msg)
+		require.NotNil(t, r)
+		opt := r.IsEdns0()
+		require.NotNil(t, opt, "OPT record in the answer")
+		assert.Equal(t, ".", opt.Hdr.Name)
+		assert.Equal(t, 0, int(opt.Version()))
+		return opt.UDPSize()
+	}
+
+	// the -maxudpsize by default, lowered to the client's
+	assert.Equal(t, uint16(defaultMaxUDPSize), size("bar.test.example.com.", 8192))
+	assert.Equal(t, uint16(1232), size("bar.test.example.com.", 1232))
+	assert.Equal(t, uint16(dns.MinMsgSize), size("bar.test.example.com.", 100))
+
+	srv.SetEDNSBufferSize(1400)
+	assert.Equal(t, uint16(1400), size("bar.test.example.com.", 4096))
+	assert.Equal(t, uint16(1232), size("bar.test.example.com.", 1232))
+
+	// REFUSED answers outside the zones have the OPT record too
+	assert.Equal(t, uint16(1400), size("www.example.org.", 4096))
+
+	// and queries without EDNS get answers without it
+	r := exchange(t, "bar.test.example.com.", dns.TypeA)
+	assert.Nil(t, r.IsEdns0())
+}
+
+func testServingRRL(t *testing.T, srv *Server) {
+	srv.SetResponseRateLimit(1, 2)
+	defer srv.SetResponseRateLimit(0, 0)
+
+	count := func(action string) float64 {
+		var m dto.Metric
+		require.Nil(t, srv.metrics.RRL.WithLabelValues(action).Write(&m))
+		return m.GetCounter().GetValue()
+	}
+	dropped, slipped := count("dropped"), count("slipped")
+
+	c := &dns.Client{Timeout: 200 * time.Millisecond}
+	msg := new(dns.Msg)
+	msg.SetQuestion("bar.test.example.com.", dns.TypeA)
+
+	var answered, truncated, lost int
+	for i := 0; i < 10; i++ {
+		r, _, err := c.Exchange(msg, "127.0.0.1"+PORT)
+		switch {
+		case err != nil:
+			lost++
+		case r.Truncated:
+			assert.Empty(t, r.Answer)
+			truncated++
+		default:
+			assert.Len(t, r.Answer, 1)
+			answered++
+		}
+	}
+	assert.True(t, answered >= 1, "answered %d", answered)
+	assert.True(t, truncated >= 1, "truncated %d", truncated)
+	assert.True(t, lost >= 1, "dropped %d", lost)
+	assert.Equal(t, dropped+float64(lost), count("dropped"))
+	assert.Equal(t, slipped+float64(truncated), count("slipped"))
+
+	// other answers and TCP aren't limited
+	r := exchange(t, "foo.test.example.com.", dns.TypeTXT)
+	assert.Len(t, r.Answer, 1)
+	c = &dns.Client{Net: "tcp"}
+	r, _, err := c.Exchange(msg, "127.0.0.1"+PORT)
+	require.Nil(t, err)
+	assert.Len(t, r.Answer, 1)
+}
+
+func testServingMaintenance(t *testing.T, srv *Server) {
+	defer srv.SetMaintenanceResponse("servfail")
+	defer srv.SetMaintenance(false)
+
+	var m dto.Metric
+	require.Nil(t, srv.metrics.Maintenance.Write(&m))
+	count := m.GetCounter().GetValue()
+
+	srv.SetMaintenance(true)
+	r := exchange(t, "bar.test.example.com.", dns.TypeA)
+	checkRcode(t, r.Rcode, dns.RcodeServerFailure, "maintenance")
+	assert.Empty(t, r.Answer)
+
+	require.Nil(t, srv.SetMaintenanceResponse("192.0.2.99, 2001:db8::99"))
+	r = exchange(t, "bar.test.example.com.", dns.TypeA)
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "maintenance")
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, "192.0.2.99", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, uint32(maintenanceTtl), r.Answer[0].Header().Ttl)
+
+	r = exchange(t, "www.example.net.", dns.TypeAAAA)
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "maintenance for names outside the zones")
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, "2001:db8::99", r.Answer[0].(*dns.AAAA).AAAA.String())
+
+	r = exchange(t, "test.example.com.", dns.TypeMX)
+	checkRcode(t, r.Rcode, dns.RcodeSuccess, "maintenance")
+	assert.Empty(t, r.Answer, "no answer for other types")
+
+	require.Nil(t, srv.metrics.Maintenance.Write(&m))
+	assert.Equal(t, count+4, m.GetCounter().GetValue())
+
+	assert.Error(t, srv.SetMaintenanceResponse("192.0.2.300"))
+
+	srv.SetMaintenance(false)
+	r = exchange(t, "bar.test.example.com.", dns.TypeA)
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, "192.168.1.2", r.Answer[0].(*dns.A).A.String())
+}
+
+func testServingApexNoData(t *testing.T) {
+	// test.example.org only has records for subdomains
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		r := exchange(t, "test.example.org.", qtype)
+		checkRcode(t, r.Rcode, dns.RcodeSuccess, "test.example.org.")
+		assert.Empty(t, r.Answer)
+		require.Len(t, r.Ns, 1)
+		assert.Equal(t, dns.TypeSOA, r.Ns[0].Header().Rrtype)
+	}
+}
+
+func testServingMalformed(t *testing.T, srv *Server) {
+	count := func(reason string) float64 {
+		var m dto.Metric
+		require.Nil(t, srv.metrics.Malformed.WithLabelValues(reason).Write(&m))
+		return m.GetCounter().GetValue()
+	}
+	short, unpack, oversized := count("short"), count("unpack"), count("oversized")
+
+	// a header for one question, and a name running past the end
+	garbage := []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0, 0x3f, 'x'}
+
+	// a query with an OPT record that runs past the end
+	msg := new(dns.Msg)
+	msg.SetQuestion("bar.test.example.com.", dns.TypeA)
+	msg.SetEdns0(4096, false)
+	badOPT, err := msg.Pack()
+	require.Nil(t, err)
+	badOPT[len(badOPT)-1] = 8 // RDLENGTH
+
+	udp, err := net.Dial("udp", "127.0.0.1"+PORT)
+	require.Nil(t, err)
+	defer udp.Close()
+	for _, b := range [][]byte{garbage[:5], garbage, badOPT} {
+		_, err := udp.Write(b)
+		require.Nil(t, err)
+	}
+	udp.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = udp.Read(make([]byte, 512))
+	assert.Error(t, err, "no answer to malformed queries")
+
+	conn, err := net.Dial("tcp", "127.0.0.1"+PORT)
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write(append([]byte{0, byte(len(garbage))}, garbage...))
+	require.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "closed after a malformed query")
+
+	big, err := net.Dial("tcp", "127.0.0.1"+PORT)
+	require.Nil(t, err)
+	defer big.Close()
+	_, err = big.Write([]byte{0xff, 0xff})
+	require.Nil(t, err)
+	big.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = big.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "closed after the length of an oversized query")
+
+	assert.Equal(t, short+1, count("short"))
+	assert.Equal(t, unpack+3, count("unpack"))
+	assert.Equal(t, oversized+1, count("oversized"))
+
+	// and still answering
+	r := exchange(t, "bar.test.example.com.", dns.TypeA)
+	assert.Len(t, r.Answer, 1)
+}
+
+func testServingChaos(t *testing.T, srv *Server) {
+	query := func(name string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeTXT)
+		msg.Question[0].Qclass = dns.ClassCHAOS
+		r := dorequest(t, msg)
+		require.NotNil(t, r)
+		return r
+	}
+	txt := func(r *dns.Msg) string {
+		checkRcode(t, r.Rcode, dns.RcodeSuccess, r.Question[0].Name)
+		require.Len(t, r.Answer, 1)
+		assert.Equal(t, uint16(dns.ClassCHAOS), r.Answer[0].Header().Class)
+		return r.Answer[0].(*dns.TXT).Txt[0]
+	}
+
+	// nothing is given away by default
+	assert.Equal(t, "unknown", txt(query("version.bind.")))
+	assert.Equal(t, "unknown", txt(query("hostname.bind.")))
+	checkRcode(t, query("authors.bind.").Rcode, dns.RcodeRefused, "authors.bind")
+
+	require.Nil(t, srv.SetChaos("real", "pop1"))
+	defer srv.SetChaos("", "")
+	assert.Equal(t, "geodns "+srv.info.Version, txt(query("VERSION.bind.")))
+	assert.Equal(t, "pop1", txt(query("id.server.")))
+
+	require.Nil(t, srv.SetChaos("refused", "real"))
+	checkRcode(t, query("version.server.").Rcode, dns.RcodeRefused, "version.server")
+	assert.Equal(t, "geodns-test", txt(query("hostname.bind.")))
+
+	assert.Error(t, srv.SetChaos(strings.Repeat("x", 256), ""))
+}
+
+func testServingInternal(t *testing.T) {
+	defer targeting.SetInternalNetworks(nil)
+
+	address := func() string {
+		r := exchange(t, "split.test.example.com.", dns.TypeA)
+		require.Len(t, r.Answer, 1)
+		return r.Answer[0].(*dns.A).A.String()
+	}
+
+	assert.Equal(t, "192.0.2.90", address(), "without internal networks")
+
+	require.Nil(t, targeting.SetInternalNetworks([]string{"127.0.0.0/8"}))
+	assert.Equal(t, "10.0.0.90", address(), "internal client")
+
+	require.Nil(t, targeting.SetInternalNetworks([]string{"10.0.0.0/8"}))
+	assert.Equal(t, "198.51.100.90", address(), "external client")
+
+	// an internal client subnet doesn't make an outside client internal
+	r := exchangeSubnet(t, "split.test.example.com.", dns.TypeA, "10.0.0.1")
+	require.Len(t, r.Answer, 1)
+	assert.Equal(t, "198.51.100.90", r.Answer[0].(*dns.A).A.String(), "external client with an internal subnet")
+
+	// other labels are the same for both
+	r = exchange(t, "bar.test.example.com.", dns.TypeA)
+	require.Len(t, r.Answer, 1)
+}
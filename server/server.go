@@ -1,7 +1,12 @@
 package server
 
 import (
+	"crypto/tls"
 	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/abh/geodns/monitor"
 	"github.com/abh/geodns/querylog"
@@ -11,20 +16,58 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// defaultMaxUDPSize is the EDNS buffer size we advertise and the
+// largest UDP answer we send.
+const defaultMaxUDPSize = 4096
+
 type serverMetrics struct {
-	Queries *prometheus.CounterVec
+	Queries     *prometheus.CounterVec
+	Responses   *prometheus.CounterVec
+	Duration    prometheus.Histogram
+	RateLimited prometheus.Counter
+	Delayed     prometheus.Counter
+	Blocked     prometheus.Counter
+	Overrides   *prometheus.CounterVec
+	Overloaded  prometheus.Counter
+	Listening   *prometheus.GaugeVec
+	UDPClamped  prometheus.Counter
+	ACLRefused  *prometheus.CounterVec
+	UnknownZone prometheus.Counter
+
+	Cookies         *prometheus.CounterVec
+	CookieTruncated prometheus.Counter
+
+	GeoUnavailable prometheus.Counter
+	GeoStrict      prometheus.Gauge
+
+	TCPTimeouts prometheus.Counter
+	Malformed   *prometheus.CounterVec
+	Maintenance prometheus.Counter
+	RRL         *prometheus.CounterVec
+	MinimalANY  prometheus.Counter
 }
 
 type Server struct {
-	queryLogger        querylog.QueryLogger
-	mux                *dns.ServeMux
+	mux                *zoneMux
 	PublicDebugQueries bool
 	info               *monitor.ServerInfo
 	metrics            *serverMetrics
+	listening          int32
+
+	settingsMu sync.Mutex
+	current    atomic.Value // *settings
+
+	maxConcurrent int64
+	inflight      int64
+
+	maintenance         int32
+	maintenanceResponse atomic.Value
+
+	cookieSecret []byte
 }
 
 func NewServer(si *monitor.ServerInfo) *Server {
-	mux := dns.NewServeMux()
+	mux := newZoneMux()
 
 	queries := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -35,12 +78,30 @@ func NewServer(si *monitor.ServerInfo) *Server {
 	)
 	prometheus.MustRegister(queries)
 
+	responses := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "geodns_responses_total",
+			Help: "Number of responses written, by query type and response code",
+		},
+		[]string{"qtype", "rcode"},
+	)
+	prometheus.MustRegister(responses)
+
+	duration := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "dns_query_duration_seconds",
+			Help:    "Time from receiving a query to writing the response",
+			Buckets: prometheus.ExponentialBuckets(0.00005, 2, 14),
+		},
+	)
+	prometheus.MustRegister(duration)
+
 	buildInfo := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "geodns_build_info",
 			Help: "GeoDNS build information (in labels)",
 		},
-		[]string{"Version", "ID", "IP", "Group"},
+		[]string{"Version", "Commit", "BuildDate", "ID", "IP", "Group"},
 	)
 	prometheus.MustRegister(buildInfo)
 
@@ -48,7 +109,7 @@ func NewServer(si *monitor.ServerInfo) *Server {
 	if len(si.Groups) > 0 {
 		group = si.Groups[0]
 	}
-	buildInfo.WithLabelValues(si.Version, si.ID, si.IP, group).Set(1)
+	buildInfo.WithLabelValues(si.Version, si.Commit, si.BuildDate, si.ID, si.IP, group).Set(1)
 
 	startTime := prometheus.NewGauge(
 		prometheus.GaugeOpts{
@@ -61,20 +122,318 @@ func NewServer(si *monitor.ServerInfo) *Server {
 	nano := si.Started.UnixNano()
 	startTime.Set(float64(nano) / 1e9)
 
+	rateLimited := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "geodns_ratelimited_queries_total",
+			Help: "Number of queries dropped or refused by the rate limiter",
+		},
+	)
+	prometheus.MustRegister(rateLimited)
+
+	delayed := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "geodns_delayed_queries_total",
+			Help: "Number of UDP queries answered with a delay because the client network was over the slow down threshold",
+		},
+	)
+	prometheus.MustRegister(delayed)
+
+	blocked := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "geodns_blocked_queries_total",
+			Help: "Number of queries for names on the blocklist",
+		},
+	)
+	prometheus.MustRegister(blocked)
+
+	overrides := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "geodns_override_queries_total",
+			Help: "Number of queries answered by a client override",
+		},
+		[]string{"override"},
+	)
+	prometheus.MustRegister(overrides)
+
+	overloaded := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "geodns_overload_dropped_total",
+			Help: "Number of queries dropped because the maximum number of concurrent queries was reached",
+		},
+	)
+	prometheus.MustRegister(overloaded)
+
+	listening := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "geodns_listening",
+			Help: "DNS listeners that have been opened",
+		},
+		[]string{"address", "net"},
+	)
+	prometheus.MustRegister(listening)
+
+	geoUnavailable := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "geodns_geoip_unavailable_total",
+			Help: "Number of geo targeted queries answered with SERVFAIL because the geo provider isn't loaded",
+		},
+	)
+	prometheus.MustRegister(geoUnavailable)
+
+	geoStrict := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "geodns_geoip_strict",
+			Help: "1 if geo targeted queries fail when the geo provider isn't loaded",
+		},
+	)
+	prometheus.MustRegister(geoStrict)
+
+	udpClamped := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "geodns_udp_clamped_total",
+			Help: "Number of UDP answers truncated because of the maximum UDP size, but within the client's EDNS buffer",
+		},
+	)
+	prometheus.MustRegister(udpClamped)
+
+	aclRefused := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "geodns_acl_refused_total",
+			Help: "Number of queries refused by the allow list of the zone",
+		},
+		[]string{"zone"},
+	)
+	prometheus.MustRegister(aclRefused)
+
+	unknownZone := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "geodns_unknown_zone_queries_total",
+			Help: "Number of queries for names outside all the loaded zones",
+		},
+	)
+	prometheus.MustRegister(unknownZone)
+
+	cookies := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "geodns_cookie_queries_total",
+			Help: "Number of queries by DNS cookie status (none, client, valid, invalid, malformed)",
+		},
+		[]string{"status"},
+	)
+	prometheus.MustRegister(cookies)
+
+	cookieTruncated := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "geodns_cookie_truncated_total",
+			Help: "Number of UDP answers truncated because the query didn't have a valid server cookie",
+		},
+	)
+	prometheus.MustRegister(cookieTruncated)
+
+	tcpTimeouts := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "geodns_tcp_timeouts_total",
+			Help: "Number of TCP connections closed because they were idle or too slow to send a query or read an answer",
+		},
+	)
+	prometheus.MustRegister(tcpTimeouts)
+
+	malformed := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "geodns_queries_malformed_total",
+			Help: "Number of queries dropped because they couldn't be read, by reason (short, unpack, oversized)",
+		},
+		[]string{"reason"},
+	)
+	prometheus.MustRegister(malformed)
+
+	maintenance := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "geodns_maintenance_queries_total",
+			Help: "Number of queries answered with the maintenance response",
+		},
+	)
+	prometheus.MustRegister(maintenance)
+
+	rrl := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "geodns_rrl_responses_total",
+			Help: "Number of UDP responses over the response rate limit, by action (dropped, slipped)",
+		},
+		[]string{"action"},
+	)
+	prometheus.MustRegister(rrl)
+
+	minimalAny := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "geodns_any_minimized_total",
+			Help: "Number of ANY queries answered with a minimal answer (RFC 8482)",
+		},
+	)
+	prometheus.MustRegister(minimalAny)
+
 	metrics := &serverMetrics{
-		Queries: queries,
+		Queries:         queries,
+		Responses:       responses,
+		Duration:        duration,
+		RateLimited:     rateLimited,
+		Delayed:         delayed,
+		Blocked:         blocked,
+		Overrides:       overrides,
+		Overloaded:      overloaded,
+		Listening:       listening,
+		UDPClamped:      udpClamped,
+		ACLRefused:      aclRefused,
+		UnknownZone:     unknownZone,
+		Cookies:         cookies,
+		CookieTruncated: cookieTruncated,
+		GeoUnavailable:  geoUnavailable,
+		GeoStrict:       geoStrict,
+		TCPTimeouts:     tcpTimeouts,
+		Malformed:       malformed,
+		Maintenance:     maintenance,
+		RRL:             rrl,
+		MinimalANY:      minimalAny,
 	}
 
-	return &Server{mux: mux, info: si, metrics: metrics}
+	srv := &Server{
+		mux:          mux,
+		info:         si,
+		metrics:      metrics,
+		cookieSecret: newCookieSecret(),
+	}
+	srv.current.Store(defaultSettings())
+
+	inflight := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "geodns_queries_inflight",
+			Help: "Number of queries being processed",
+		},
+		func() float64 { return float64(atomic.LoadInt64(&srv.inflight)) },
+	)
+	prometheus.MustRegister(inflight)
+
+	maintenanceMode := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "geodns_maintenance",
+			Help: "1 if the server is in maintenance mode (all queries get the maintenance response)",
+		},
+		func() float64 { return float64(atomic.LoadInt32(&srv.maintenance)) },
+	)
+	prometheus.MustRegister(maintenanceMode)
+	srv.SetMaintenanceResponse("servfail")
+
+	return srv
 }
 
 // Setup the QueryLogger. For now it only supports writing to a file (and all
 // zones get logged to the same file).
 func (srv *Server) SetQueryLogger(logger querylog.QueryLogger) {
-	srv.queryLogger = logger
+	srv.update(func(s *settings) {
+		s.queryLogger = logger
+	})
 }
 
+// SetRateLimit enables a per client network limit of qps queries per
+// second (allowing bursts of up to 'burst' queries). Queries over the
+// limit are dropped, or answered with REFUSED if refuse is set.
+func (srv *Server) SetRateLimit(qps, burst int, refuse bool) {
+	srv.update(func(s *settings) {
+		if qps <= 0 {
+			s.rateLimiter = nil
+			return
+		}
+		s.rateLimiter = newRateLimiter(qps, burst)
+		s.rateLimitRefuse = refuse
+	})
+}
+
+// SetSlowDown delays the UDP answers to client networks sending more
+// than qps queries per second by delay, to slow down abusive clients
+// below the rate limit. A qps or delay of 0 disables it.
+func (srv *Server) SetSlowDown(qps int, delay time.Duration) {
+	srv.update(func(s *settings) {
+		if qps <= 0 || delay <= 0 {
+			s.slowDown = nil
+			return
+		}
+		s.slowDown = newRateLimiter(qps, qps)
+		s.slowDownDelay = delay
+	})
+}
+
+// SetMaxConcurrent limits the number of queries processed at the
+// same time to max; further UDP queries are dropped and TCP
+// connections closed until some finish. A max of 0 removes the limit.
+func (srv *Server) SetMaxConcurrent(max int) {
+	if max < 0 {
+		max = 0
+	}
+	atomic.StoreInt64(&srv.maxConcurrent, int64(max))
+}
+
+// acquire counts a query as in flight and returns false if that's
+// over the limit of concurrent queries; release must be called when
+// it returns true.
+func (srv *Server) acquire() bool {
+	n := atomic.AddInt64(&srv.inflight, 1)
+	if max := atomic.LoadInt64(&srv.maxConcurrent); max > 0 && n > max {
+		atomic.AddInt64(&srv.inflight, -1)
+		return false
+	}
+	return true
+}
+
+func (srv *Server) release() {
+	atomic.AddInt64(&srv.inflight, -1)
+}
+
+// SetStrictGeo makes queries for geo targeted labels fail with
+// SERVFAIL when there's no geo provider, instead of being answered
+// with the global ("@") records.
+func (srv *Server) SetStrictGeo(strict bool) {
+	srv.update(func(s *settings) {
+		s.strictGeo = strict
+	})
+	if strict {
+		srv.metrics.GeoStrict.Set(1)
+	} else {
+		srv.metrics.GeoStrict.Set(0)
+	}
+}
+
+// SetMaxUDPSize sets the largest UDP answer the server sends,
+// regardless of the EDNS buffer size the client advertises. Larger
+// answers are truncated so the client retries with TCP. Sizes
+// outside 512-4096 are clamped to that range.
+func (srv *Server) SetMaxUDPSize(size int) {
+	switch {
+	case size < dns.MinMsgSize:
+		size = dns.MinMsgSize
+	case size > defaultMaxUDPSize:
+		size = defaultMaxUDPSize
+	}
+	srv.update(func(s *settings) {
+		s.maxUDPSize = size
+	})
+}
+
+// SetRequireCookie makes UDP answers larger than 512 bytes require a
+// valid server cookie (RFC 7873) in the query; without one they are
+// truncated so the client retries with TCP.
+func (srv *Server) SetRequireCookie(require bool) {
+	srv.update(func(s *settings) {
+		s.requireCookie = require
+	})
+}
+
+// Add serves the zone for name; a name other than the zone origin is
+// an alias of the zone.
 func (srv *Server) Add(name string, zone *zones.Zone) {
+	if name != zone.Origin {
+		srv.mux.HandleFunc(name, srv.setupAliasFunc(zone, name))
+		return
+	}
 	srv.mux.HandleFunc(name, srv.setupServerFunc(zone))
 }
 
@@ -89,7 +448,109 @@ func (srv *Server) setupServerFunc(zone *zones.Zone) func(dns.ResponseWriter, *d
 }
 
 func (srv *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	srv.mux.ServeDNS(w, r)
+	start := time.Now()
+	defer func() {
+		srv.metrics.Duration.Observe(time.Since(start).Seconds())
+	}()
+
+	if !srv.acquire() {
+		srv.metrics.Overloaded.Inc()
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+			w.Close()
+		}
+		return
+	}
+	// a delayed answer is still in flight until it's written
+	delayed := false
+	defer func() {
+		if !delayed {
+			srv.release()
+		}
+	}()
+
+	s := srv.settings()
+
+	w = &compressWriter{ResponseWriter: w, compress: s.compress}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		w = &truncateWriter{ResponseWriter: w, srv: srv, s: s, req: r}
+	}
+	if r.IsEdns0() != nil {
+		w = &ednsWriter{ResponseWriter: w, req: r, size: s.ednsSize(r)}
+	}
+	w = &countingWriter{ResponseWriter: w, responses: srv.metrics.Responses}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok && s.rrl != nil {
+		w = &rrlWriter{ResponseWriter: w, rrl: s.rrl, metrics: srv.metrics.RRL}
+	}
+
+	if s.rateLimiter != nil && !s.rateLimiter.allow(remoteIP(w), time.Now()) {
+		srv.metrics.RateLimited.Inc()
+		if s.rateLimitRefuse {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(m)
+		}
+		return
+	}
+
+	if s.slowDown != nil && !s.slowDown.allow(remoteIP(w), time.Now()) {
+		// UDP answers can be written after the handler returned, so
+		// the delay doesn't hold up a server goroutine. TCP queries
+		// on a connection are answered in order and aren't delayed.
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			srv.metrics.Delayed.Inc()
+			delayed = true
+			time.AfterFunc(s.slowDownDelay, func() {
+				defer srv.release()
+				srv.dispatch(w, r)
+			})
+			return
+		}
+	}
+	srv.dispatch(w, r)
+}
+
+// dispatch passes the query on to the handler of its zone.
+func (srv *Server) dispatch(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) == 0 {
+		dns.HandleFailed(w, r)
+		return
+	}
+	if r.Question[0].Qclass == dns.ClassCHAOS {
+		srv.serveChaos(w, r)
+		return
+	}
+	if srv.Maintenance() {
+		srv.serveMaintenance(w, r)
+		return
+	}
+	h := srv.mux.match(r.Question[0].Name, r.Question[0].Qtype)
+	if h == nil {
+		srv.serveUnknownZone(w, r)
+		return
+	}
+	h.ServeDNS(w, r)
+}
+
+// countingWriter counts the responses by query type and response
+// code as they are written, whichever way the query was answered.
+type countingWriter struct {
+	dns.ResponseWriter
+	responses *prometheus.CounterVec
+}
+
+func (w *countingWriter) WriteMsg(m *dns.Msg) error {
+	qtype := "none"
+	if len(m.Question) > 0 {
+		qtype = qtypeLabel(m.Question[0].Qtype)
+	}
+	w.responses.WithLabelValues(qtype, dns.RcodeToString[m.Rcode]).Inc()
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// Listening returns true when at least one DNS listener has been
+// opened.
+func (srv *Server) Listening() bool {
+	return atomic.LoadInt32(&srv.listening) > 0
 }
 
 func (srv *Server) ListenAndServe(ip string) {
@@ -99,16 +560,68 @@ func (srv *Server) ListenAndServe(ip string) {
 	for _, prot := range prots {
 		go func(p string) {
 			server := &dns.Server{
-				Addr:    ip,
-				Net:     p,
-				Handler: srv,
+				Addr:           ip,
+				Net:            p,
+				Handler:        srv,
+				DecorateReader: srv.decorateReader,
+				NotifyStartedFunc: func() {
+					atomic.AddInt32(&srv.listening, 1)
+					srv.metrics.Listening.WithLabelValues(ip, p).Set(1)
+				},
 			}
 
 			log.Printf("Opening on %s %s", ip, p)
-			if err := server.ListenAndServe(); err != nil {
+			var err error
+			if p == "tcp" {
+				err = srv.serveTCP(server, nil)
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err != nil {
 				log.Fatalf("geodns: failed to setup %s %s: %s", ip, p, err)
 			}
 			log.Fatalf("geodns: ListenAndServe unexpectedly returned")
 		}(prot)
 	}
 }
+
+// ListenAndServeTLS serves DNS over TLS (RFC 7858) on addr. Queries are
+// handled the same way as the plain UDP and TCP queries.
+func (srv *Server) ListenAndServeTLS(addr string, config *tls.Config) {
+	p := "tcp-tls"
+
+	server := &dns.Server{
+		Addr:           addr,
+		Net:            p,
+		Handler:        srv,
+		DecorateReader: srv.decorateReader,
+		NotifyStartedFunc: func() {
+			atomic.AddInt32(&srv.listening, 1)
+			srv.metrics.Listening.WithLabelValues(addr, p).Set(1)
+		},
+	}
+
+	log.Printf("Opening on %s %s", addr, p)
+	if err := srv.serveTCP(server, config); err != nil {
+		log.Fatalf("geodns: failed to setup %s %s: %s", addr, p, err)
+	}
+	log.Fatalf("geodns: ListenAndServe unexpectedly returned")
+}
+
+// serveTCP opens the TCP listener of server, with TLS if config is
+// set, and serves it with the TCP timeouts.
+func (srv *Server) serveTCP(server *dns.Server, config *tls.Config) error {
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	s := srv.settings()
+	server.Listener = s.tcpListener(l, srv.metrics.TCPTimeouts)
+	if config != nil {
+		server.Listener = tls.NewListener(server.Listener, config)
+	}
+	server.ReadTimeout = s.tcpTimeout
+	idle := s.tcpIdleTimeout
+	server.IdleTimeout = func() time.Duration { return idle }
+	return server.ActivateAndServe()
+}
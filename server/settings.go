@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/abh/geodns/querylog"
+)
+
+// settings are the options of the server that can be changed while
+// it's answering queries. They are never modified once stored; the
+// setters store a changed copy, so a query sees either the old or the
+// new settings.
+type settings struct {
+	queryLogger querylog.QueryLogger
+
+	rateLimiter     *rateLimiter
+	rateLimitRefuse bool
+
+	rrl *responseRateLimiter
+
+	slowDown      *rateLimiter
+	slowDownDelay time.Duration
+
+	blocklist *Blocklist
+	sinkhole  []net.IP
+
+	overrides []*Override
+
+	strictGeo bool
+
+	maxUDPSize     int
+	ednsBufferSize int
+
+	cnameDepth int
+
+	compress   bool
+	minimalAny bool
+
+	tcpTimeout     time.Duration
+	tcpIdleTimeout time.Duration
+
+	chaosVersion  string
+	chaosHostname string
+
+	unknownZone int
+
+	dns64Prefix net.IP
+
+	requireCookie bool
+}
+
+func defaultSettings() *settings {
+	return &settings{
+		maxUDPSize: defaultMaxUDPSize,
+		cnameDepth: defaultCNAMEDepth,
+		compress:   true,
+		minimalAny: true,
+
+		tcpTimeout:     defaultTCPTimeout,
+		tcpIdleTimeout: defaultTCPIdleTimeout,
+
+		chaosVersion:  defaultChaos,
+		chaosHostname: defaultChaos,
+	}
+}
+
+// settings returns the current settings.
+func (srv *Server) settings() *settings {
+	return srv.current.Load().(*settings)
+}
+
+// update changes a copy of the current settings with fn and makes it
+// the current settings.
+func (srv *Server) update(fn func(s *settings)) {
+	srv.settingsMu.Lock()
+	defer srv.settingsMu.Unlock()
+
+	s := *srv.settings()
+	fn(&s)
+	srv.current.Store(&s)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Defaults for the deadlines of TCP connections; the read timeout is
+// for the first query and writing an answer, the idle timeout for
+// the following queries on the connection (RFC 7766 6.2.3).
+const (
+	defaultTCPTimeout     = 2 * time.Second
+	defaultTCPIdleTimeout = 8 * time.Second
+)
+
+// SetTCPTimeouts sets how long a TCP connection can take to send the
+// first query or read an answer (timeout), and how long it can be
+// idle between queries (idle), before it's closed. A timeout of 0
+// keeps the default. It applies to the listeners opened after it.
+func (srv *Server) SetTCPTimeouts(timeout, idle time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultTCPTimeout
+	}
+	if idle <= 0 {
+		idle = defaultTCPIdleTimeout
+	}
+	srv.update(func(s *settings) {
+		s.tcpTimeout = timeout
+		s.tcpIdleTimeout = idle
+	})
+}
+
+// tcpListener wraps the TCP listener l to set a write deadline for the
+// answers, and count the connections closed after a timeout.
+func (s *settings) tcpListener(l net.Listener, timeouts prometheus.Counter) net.Listener {
+	return &timeoutListener{Listener: l, write: s.tcpTimeout, timeouts: timeouts}
+}
+
+type timeoutListener struct {
+	net.Listener
+	write    time.Duration
+	timeouts prometheus.Counter
+}
+
+func (l *timeoutListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &timeoutConn{Conn: c, write: l.write, timeouts: l.timeouts}, nil
+}
+
+type timeoutConn struct {
+	net.Conn
+	write    time.Duration
+	timeouts prometheus.Counter
+	timedOut int32
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.check(err)
+	return n, err
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.write))
+	n, err := c.Conn.Write(b)
+	c.check(err)
+	return n, err
+}
+
+// check counts the connection once if err is a timeout.
+func (c *timeoutConn) check(err error) {
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		if atomic.CompareAndSwapInt32(&c.timedOut, 0, 1) {
+			c.timeouts.Inc()
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// How queries for names outside all the loaded zones are answered.
+const (
+	unknownZoneRefused = iota
+	unknownZoneNoError
+	unknownZoneDrop
+)
+
+// SetUnknownZone sets how queries for names outside all the loaded
+// zones are answered: "refused" (the default), "noerror" for an empty
+// answer, or "drop" to not answer at all.
+func (srv *Server) SetUnknownZone(mode string) error {
+	var unknownZone int
+	switch mode {
+	case "refused", "":
+		unknownZone = unknownZoneRefused
+	case "noerror":
+		unknownZone = unknownZoneNoError
+	case "drop":
+		unknownZone = unknownZoneDrop
+	default:
+		return fmt.Errorf("unknown mode '%s', expected refused, noerror or drop", mode)
+	}
+	srv.update(func(s *settings) {
+		s.unknownZone = unknownZone
+	})
+	return nil
+}
+
+// serveUnknownZone answers the queries that don't match any zone, so
+// misrouted traffic can be told apart from the queries for our zones.
+func (srv *Server) serveUnknownZone(w dns.ResponseWriter, req *dns.Msg) {
+	srv.metrics.UnknownZone.Inc()
+
+	m := new(dns.Msg)
+	switch srv.settings().unknownZone {
+	case unknownZoneDrop:
+		return
+	case unknownZoneNoError:
+		m.SetReply(req)
+	default:
+		m.SetRcode(req, dns.RcodeRefused)
+	}
+	w.WriteMsg(m)
+}
@@ -0,0 +1,54 @@
+package targeting
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// DefaultIPv6ClientPrefix is the prefix length IPv6 clients are
+// aggregated by; a single site usually gets a /56 or a /48, so the
+// addresses in it are one client.
+const DefaultIPv6ClientPrefix = 56
+
+var ipv6ClientPrefix int32 = DefaultIPv6ClientPrefix
+
+// SetIPv6ClientPrefix sets the prefix length IPv6 clients are
+// aggregated by for the per client state, like the rate limits and
+// the sticky selection of records.
+func SetIPv6ClientPrefix(bits int) error {
+	if bits < 1 || bits > 128 {
+		return fmt.Errorf("invalid IPv6 prefix length %d", bits)
+	}
+	atomic.StoreInt32(&ipv6ClientPrefix, int32(bits))
+	return nil
+}
+
+// ClientNetwork returns the address that identifies the client at ip:
+// the address for IPv4, and the network of the IPv6 client prefix for
+// IPv6.
+func ClientNetwork(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	if len(ip) != net.IPv6len {
+		return ip
+	}
+	bits := int(atomic.LoadInt32(&ipv6ClientPrefix))
+	return ip.Mask(net.CIDRMask(bits, 128))
+}
+
+// ParseNetwork parses a CIDR network, or a single address as the
+// network of just that address (a /32 or /128).
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
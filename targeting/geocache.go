@@ -0,0 +1,213 @@
+package targeting
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/abh/geodns/targeting/geo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var geoCacheLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "geodns_geoip_cache_lookups_total",
+		Help: "Number of cached geo lookups by type (country, asn, location) and result (hit, miss)",
+	},
+	[]string{"lookup", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(geoCacheLookups)
+}
+
+// GeoCache is a geo provider that caches the country, ASN and
+// location lookups of the wrapped provider for the most recently used
+// client networks (IPv4 /24 and the IPv6 client prefix). Results for
+// smaller networks aren't cached. It must be flushed when the
+// databases of the provider change.
+type GeoCache struct {
+	geo.Provider
+
+	country  *lru
+	asn      *lru
+	location *lru
+}
+
+type countryResult struct {
+	country, continent string
+	netmask            int
+}
+
+type asnResult struct {
+	asn     string
+	netmask int
+	err     error
+}
+
+type locationResult struct {
+	location *geo.Location
+	err      error
+}
+
+// NewGeoCache returns a cache of the lookups for up to size networks
+// of each type in front of p.
+func NewGeoCache(p geo.Provider, size int) *GeoCache {
+	return &GeoCache{
+		Provider: p,
+		country:  newLRU("country", size),
+		asn:      newLRU("asn", size),
+		location: newLRU("location", size),
+	}
+}
+
+// Flush removes all the cached lookups.
+func (c *GeoCache) Flush() {
+	c.country.flush()
+	c.asn.flush()
+	c.location.flush()
+}
+
+// geoCacheKey returns the client network of ip the lookups are cached
+// for, the IPv4 /24 or the IPv6 -ipv6prefix, and its prefix length.
+func geoCacheKey(ip net.IP) (string, int) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4.Mask(net.CIDRMask(24, 32))), 24
+	}
+	bits := int(atomic.LoadInt32(&ipv6ClientPrefix))
+	return string(ip.Mask(net.CIDRMask(bits, 128))), bits
+}
+
+// cacheable returns true if a result for a network with netmask is
+// the same for the whole client network of the key. The netmask of
+// the GeoIP database results is unknown (0); the ECS scope of the
+// answers already treats them as the same for the /16.
+func cacheable(netmask, bits int) bool {
+	return netmask <= bits
+}
+
+func (c *GeoCache) GetCountry(ip net.IP) (country, continent string, netmask int) {
+	key, bits := geoCacheKey(ip)
+	v, gen, ok := c.country.get(key)
+	if ok {
+		r := v.(countryResult)
+		return r.country, r.continent, r.netmask
+	}
+	country, continent, netmask = c.Provider.GetCountry(ip)
+	if cacheable(netmask, bits) {
+		c.country.add(key, countryResult{country, continent, netmask}, gen)
+	}
+	return country, continent, netmask
+}
+
+func (c *GeoCache) GetASN(ip net.IP) (string, int, error) {
+	key, bits := geoCacheKey(ip)
+	v, gen, ok := c.asn.get(key)
+	if ok {
+		r := v.(asnResult)
+		return r.asn, r.netmask, r.err
+	}
+	asn, netmask, err := c.Provider.GetASN(ip)
+	if cacheable(netmask, bits) {
+		c.asn.add(key, asnResult{asn, netmask, err}, gen)
+	}
+	return asn, netmask, err
+}
+
+func (c *GeoCache) GetLocation(ip net.IP) (*geo.Location, error) {
+	key, bits := geoCacheKey(ip)
+	v, gen, ok := c.location.get(key)
+	if !ok {
+		l, err := c.Provider.GetLocation(ip)
+		if l != nil && !cacheable(l.Netmask, bits) {
+			return l, err
+		}
+		v = locationResult{l, err}
+		c.location.add(key, v, gen)
+	}
+	r := v.(locationResult)
+	if r.location == nil {
+		return nil, r.err
+	}
+	// every caller gets its own copy
+	l := *r.location
+	return &l, r.err
+}
+
+// lru is a least recently used cache of up to size values. Each
+// flush starts a new generation; values looked up before it aren't
+// added.
+type lru struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	list    *list.List
+	gen     uint64
+
+	hits, misses prometheus.Counter
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRU(name string, size int) *lru {
+	c := &lru{
+		size:   size,
+		hits:   geoCacheLookups.WithLabelValues(name, "hit"),
+		misses: geoCacheLookups.WithLabelValues(name, "miss"),
+	}
+	c.flush()
+	return c
+}
+
+func (c *lru) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.list = list.New()
+	c.gen++
+}
+
+func (c *lru) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.list.Len()
+}
+
+// get returns the value for key, and the current generation.
+func (c *lru) get(key string) (interface{}, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses.Inc()
+		return nil, c.gen, false
+	}
+	c.hits.Inc()
+	c.list.MoveToFront(el)
+	return el.Value.(*lruEntry).value, c.gen, true
+}
+
+// add adds the value for key, looked up in generation gen.
+func (c *lru) add(key string, value interface{}, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*lruEntry).value = value
+		c.list.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.list.PushFront(&lruEntry{key: key, value: value})
+	if c.list.Len() > c.size {
+		oldest := c.list.Back()
+		c.list.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
@@ -8,10 +8,13 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/abh/geodns/applog"
 	"github.com/abh/geodns/countries"
 	"github.com/abh/geodns/targeting/geo"
 	geoip2 "github.com/oschwald/geoip2-golang"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type geoType uint8
@@ -22,8 +25,22 @@ const (
 	asnDB
 )
 
+func (t geoType) String() string {
+	switch t {
+	case countryDB:
+		return "country"
+	case cityDB:
+		return "city"
+	case asnDB:
+		return "asn"
+	}
+	return fmt.Sprintf("geotype=%d", t)
+}
+
 var dbFiles map[geoType][]string
 
+var loadTime *prometheus.GaugeVec
+
 // GeoIP2 contains the geoip implementation of the GeoDNS geo
 // targeting interface
 type GeoIP2 struct {
@@ -32,15 +49,41 @@ type GeoIP2 struct {
 	country *geoip2.Reader
 	city    *geoip2.Reader
 	asn     *geoip2.Reader
+	files   map[geoType]dbFile
+	onLoad  []func()
 	mu      sync.RWMutex
 }
 
+// dbFile is the file a database was loaded from
+type dbFile struct {
+	name    string
+	modTime time.Time
+	loaded  time.Time
+}
+
+// Database describes a loaded database file.
+type Database struct {
+	Type     string    `json:"type"`
+	File     string    `json:"file"`
+	Modified time.Time `json:"modified"`
+	Loaded   time.Time `json:"loaded"`
+}
+
 func init() {
 	dbFiles = map[geoType][]string{
 		countryDB: []string{"GeoIP2-Country.mmdb", "GeoLite2-Country.mmdb"},
 		asnDB:     []string{"GeoIP2-ASN.mmdb", "GeoLite2-ASN.mmdb"},
 		cityDB:    []string{"GeoIP2-City.mmdb", "GeoLite2-City.mmdb"},
 	}
+
+	loadTime = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "geodns_geoip_load_time_seconds",
+			Help: "Unix time each GeoIP database was last loaded",
+		},
+		[]string{"db"},
+	)
+	prometheus.MustRegister(loadTime)
 }
 
 // FindDB returns a guess at a directory path for GeoIP data files
@@ -81,6 +124,18 @@ func (g *GeoIP2) open(t geoType, db string) (*geoip2.Reader, error) {
 		}
 	}
 
+	return g.openFile(t, fileName)
+}
+
+// openFile loads the database and replaces the current one for the
+// type. The old database is closed after a minute, when lookups
+// still using it have finished.
+func (g *GeoIP2) openFile(t geoType, fileName string) (*geoip2.Reader, error) {
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+
 	n, err := geoip2.Open(fileName)
 	if err != nil {
 		return nil, err
@@ -88,17 +143,89 @@ func (g *GeoIP2) open(t geoType, db string) (*geoip2.Reader, error) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
+	var old *geoip2.Reader
+
 	switch t {
 	case countryDB:
-		g.country = n
+		old, g.country = g.country, n
 	case cityDB:
-		g.city = n
+		old, g.city = g.city, n
 	case asnDB:
-		g.asn = n
+		old, g.asn = g.asn, n
+	}
+	g.files[t] = dbFile{name: fileName, modTime: fi.ModTime(), loaded: time.Now()}
+
+	if old != nil {
+		time.AfterFunc(time.Minute, func() { old.Close() })
 	}
+
+	loadTime.WithLabelValues(t.String()).Set(float64(time.Now().UnixNano()) / 1e9)
+
+	for _, f := range g.onLoad {
+		f()
+	}
+
 	return n, nil
 }
 
+// OnLoad adds a function that's called when a database is loaded,
+// for example to flush a cache of the lookups. It's called with the
+// databases locked, so it can't do lookups.
+func (g *GeoIP2) OnLoad(f func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.onLoad = append(g.onLoad, f)
+}
+
+// Databases returns the database files that are loaded, with the
+// time they were loaded.
+func (g *GeoIP2) Databases() []Database {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var dbs []Database
+	for _, t := range []geoType{countryDB, cityDB, asnDB} {
+		if f, ok := g.files[t]; ok {
+			dbs = append(dbs, Database{Type: t.String(), File: f.name, Modified: f.modTime, Loaded: f.loaded})
+		}
+	}
+	return dbs
+}
+
+// Reload loads the databases again if the files have been modified.
+// If loading a database fails the old one is kept.
+func (g *GeoIP2) Reload() {
+	g.mu.RLock()
+	files := make(map[geoType]dbFile, len(g.files))
+	for t, f := range g.files {
+		files[t] = f
+	}
+	g.mu.RUnlock()
+
+	for t, f := range files {
+		fi, err := os.Stat(f.name)
+		if err != nil {
+			applog.Errorf("could not check %s database '%s': %s", t, f.name, err)
+			continue
+		}
+		if fi.ModTime().Equal(f.modTime) {
+			continue
+		}
+		if _, err := g.openFile(t, f.name); err != nil {
+			applog.Errorf("could not reload %s database '%s', keeping the old one: %s", t, f.name, err)
+			continue
+		}
+		applog.Infof("reloaded %s database '%s'", t, f.name)
+	}
+}
+
+// Watch checks for updated database files every minute.
+func (g *GeoIP2) Watch() {
+	for range time.Tick(time.Minute) {
+		g.Reload()
+	}
+}
+
 func (g *GeoIP2) get(t geoType, db string) (*geoip2.Reader, error) {
 	g.mu.RLock()
 
@@ -126,7 +253,8 @@ func (g *GeoIP2) get(t geoType, db string) (*geoip2.Reader, error) {
 // New returns a new GeoIP2 provider
 func New(dir string) (*GeoIP2, error) {
 	g := &GeoIP2{
-		dir: dir,
+		dir:   dir,
+		files: map[geoType]dbFile{},
 	}
 	_, err := g.open(countryDB, "")
 	if err != nil {
@@ -175,7 +303,7 @@ func (g *GeoIP2) GetCountry(ip net.IP) (country, continent string, netmask int)
 	r, err := g.get(countryDB, "")
 	c, err := r.Country(ip)
 	if err != nil {
-		log.Printf("Could not lookup country for '%s': %s", ip.String(), err)
+		applog.Debugf("Could not lookup country for '%s': %s", ip.String(), err)
 		return "", "", 0
 	}
 
@@ -201,9 +329,14 @@ func (g *GeoIP2) HasLocation() (bool, error) {
 
 // GetLocation returns a geo.Location object for the given IP
 func (g *GeoIP2) GetLocation(ip net.IP) (l *geo.Location, err error) {
-	c, err := g.city.City(ip)
+	r, err := g.get(cityDB, "")
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := r.City(ip)
 	if err != nil {
-		log.Printf("Could not lookup CountryRegion for '%s': %s", ip.String(), err)
+		applog.Debugf("Could not lookup CountryRegion for '%s': %s", ip.String(), err)
 		return
 	}
 
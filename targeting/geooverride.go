@@ -0,0 +1,224 @@
+package targeting
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/abh/geodns/countries"
+	"github.com/abh/geodns/targeting/geo"
+)
+
+// GeoOverrides is a geo provider that places the networks in an
+// override file, to correct the GeoIP database for them. Addresses
+// outside the networks are looked up in the wrapped provider.
+//
+// The file has a network per line, with the country, and optionally
+// the region and the "latitude,longitude" used for "closest"
+// targeting; the continent and region group follow from them. Lines
+// starting with # are comments.
+//
+//	192.0.2.0/24     de
+//	198.51.100.0/24  us  us-ca  37.77,-122.42
+type GeoOverrides struct {
+	geo.Provider
+
+	path string
+
+	mu       sync.RWMutex
+	networks []geoOverride
+}
+
+type geoOverride struct {
+	network  *net.IPNet
+	location geo.Location
+}
+
+// NewGeoOverrides reads the overrides in path; other addresses are
+// looked up in p, which can be nil.
+func NewGeoOverrides(path string, p geo.Provider) (*GeoOverrides, error) {
+	o := &GeoOverrides{Provider: p, path: path}
+	if err := o.Reload(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Reload reads the override file again; if it can't be read or has
+// an invalid line the current overrides are kept.
+func (o *GeoOverrides) Reload() error {
+	fh, err := os.Open(o.path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	var networks []geoOverride
+
+	scanner := bufio.NewScanner(fh)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		override, err := parseGeoOverride(strings.Fields(line))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", o.path, n, err)
+		}
+		networks = append(networks, override)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// the most specific network is used
+	sort.SliceStable(networks, func(i, j int) bool {
+		return networks[i].location.Netmask > networks[j].location.Netmask
+	})
+
+	o.mu.Lock()
+	o.networks = networks
+	o.mu.Unlock()
+
+	return nil
+}
+
+func parseGeoOverride(fields []string) (geoOverride, error) {
+	var override geoOverride
+	if len(fields) < 2 || len(fields) > 4 {
+		return override, fmt.Errorf("expected a network, the country, and optionally the region and location")
+	}
+
+	_, network, err := net.ParseCIDR(fields[0])
+	if err != nil {
+		return override, fmt.Errorf("invalid network '%s'", fields[0])
+	}
+	override.network = network
+	l := &override.location
+	l.Netmask, _ = network.Mask.Size()
+
+	l.Country = strings.ToLower(fields[1])
+	continent, ok := countries.CountryContinent[l.Country]
+	if !ok {
+		return override, fmt.Errorf("unknown country '%s'", fields[1])
+	}
+	l.Continent = continent
+
+	for _, f := range fields[2:] {
+		if strings.Contains(f, ",") {
+			ll := strings.SplitN(f, ",", 2)
+			lat, err := strconv.ParseFloat(ll[0], 64)
+			if err != nil || lat < -90 || lat > 90 {
+				return override, fmt.Errorf("invalid latitude '%s'", ll[0])
+			}
+			lng, err := strconv.ParseFloat(ll[1], 64)
+			if err != nil || lng < -180 || lng > 180 {
+				return override, fmt.Errorf("invalid longitude '%s'", ll[1])
+			}
+			l.Latitude, l.Longitude = lat, lng
+			continue
+		}
+		region := strings.ToLower(f)
+		if !strings.HasPrefix(region, l.Country+"-") {
+			return override, fmt.Errorf("region '%s' isn't in country '%s'", f, l.Country)
+		}
+		l.Region = region
+		l.RegionGroup = countries.CountryRegionGroup(l.Country, l.Region)
+	}
+
+	return override, nil
+}
+
+// Len returns the number of networks with an override.
+func (o *GeoOverrides) Len() int {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return len(o.networks)
+}
+
+func (o *GeoOverrides) lookup(ip net.IP) *geo.Location {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for i := range o.networks {
+		if o.networks[i].network.Contains(ip) {
+			l := o.networks[i].location
+			return &l
+		}
+	}
+	return nil
+}
+
+// hasLocation returns true if any of the networks has a location.
+func (o *GeoOverrides) hasLocation() bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for i := range o.networks {
+		if l := o.networks[i].location; l.Latitude != 0 || l.Longitude != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// HasCountry is true if there are overrides, also when the wrapped
+// provider doesn't have a country database.
+func (o *GeoOverrides) HasCountry() (bool, error) {
+	if o.Len() > 0 {
+		return true, nil
+	}
+	if o.Provider == nil {
+		return false, nil
+	}
+	return o.Provider.HasCountry()
+}
+
+// HasLocation is true if any of the overrides has a location, or the
+// wrapped provider has a location database.
+func (o *GeoOverrides) HasLocation() (bool, error) {
+	if o.hasLocation() {
+		return true, nil
+	}
+	if o.Provider == nil {
+		return false, nil
+	}
+	return o.Provider.HasLocation()
+}
+
+func (o *GeoOverrides) HasASN() (bool, error) {
+	if o.Provider == nil {
+		return false, fmt.Errorf("no ASN database")
+	}
+	return o.Provider.HasASN()
+}
+
+func (o *GeoOverrides) GetASN(ip net.IP) (string, int, error) {
+	if o.Provider == nil {
+		return "", 0, fmt.Errorf("no ASN database")
+	}
+	return o.Provider.GetASN(ip)
+}
+
+func (o *GeoOverrides) GetCountry(ip net.IP) (country, continent string, netmask int) {
+	if l := o.lookup(ip); l != nil {
+		return l.Country, l.Continent, l.Netmask
+	}
+	if o.Provider == nil {
+		return "", "", 0
+	}
+	return o.Provider.GetCountry(ip)
+}
+
+func (o *GeoOverrides) GetLocation(ip net.IP) (*geo.Location, error) {
+	if l := o.lookup(ip); l != nil {
+		return l, nil
+	}
+	if o.Provider == nil {
+		return nil, nil
+	}
+	return o.Provider.GetLocation(ip)
+}
@@ -0,0 +1,78 @@
+package targeting
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/abh/geodns/countries"
+)
+
+// GroupPrefix is the prefix of location group targets, so the
+// countries of the "emea" group are targeted with the "group:emea"
+// label.
+const GroupPrefix = "group:"
+
+var (
+	groupsMu      sync.RWMutex
+	groupNames    map[string]bool
+	countryGroups map[string][]string
+)
+
+// SetGroups replaces the location groups; groups maps a group name to
+// the ISO codes of its countries. An unknown country code is an error
+// and leaves the current groups in place.
+func SetGroups(groups map[string][]string) error {
+	names := map[string]bool{}
+	byCountry := map[string][]string{}
+
+	for name, ccs := range groups {
+		name = strings.ToLower(name)
+		if len(name) == 0 || strings.ContainsAny(name, ". ") {
+			return fmt.Errorf("invalid location group name '%s'", name)
+		}
+		names[name] = true
+		for _, cc := range ccs {
+			cc = strings.ToLower(cc)
+			if _, ok := countries.CountryContinent[cc]; !ok {
+				return fmt.Errorf("location group '%s': unknown country '%s'", name, cc)
+			}
+			if !containsString(byCountry[cc], GroupPrefix+name) {
+				byCountry[cc] = append(byCountry[cc], GroupPrefix+name)
+			}
+		}
+	}
+	for _, targets := range byCountry {
+		sort.Strings(targets)
+	}
+
+	groupsMu.Lock()
+	groupNames = names
+	countryGroups = byCountry
+	groupsMu.Unlock()
+
+	return nil
+}
+
+// HasGroup returns true if the location group name is defined.
+func HasGroup(name string) bool {
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+	return groupNames[name]
+}
+
+func groupTargets(country string) []string {
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+	return countryGroups[country]
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
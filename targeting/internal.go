@@ -0,0 +1,66 @@
+package targeting
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// The targets of "internal" targeting: clients in the internal
+// networks get the "www.internal" label, others "www.external".
+const (
+	InternalTarget = "internal"
+	ExternalTarget = "external"
+)
+
+var (
+	internalMu       sync.RWMutex
+	internalNetworks []*net.IPNet
+)
+
+// SetInternalNetworks replaces the networks of the internal clients;
+// each string can have several networks (or addresses) separated by
+// spaces. An invalid network is an error and leaves the current ones
+// in place.
+func SetInternalNetworks(list []string) error {
+	var networks []*net.IPNet
+	for _, s := range list {
+		for _, n := range strings.Fields(s) {
+			network, err := ParseNetwork(n)
+			if err != nil {
+				return fmt.Errorf("invalid internal network '%s'", n)
+			}
+			networks = append(networks, network)
+		}
+	}
+
+	internalMu.Lock()
+	internalNetworks = networks
+	internalMu.Unlock()
+
+	return nil
+}
+
+// HasInternalNetworks returns true if internal networks are defined.
+func HasInternalNetworks() bool {
+	internalMu.RLock()
+	defer internalMu.RUnlock()
+	return len(internalNetworks) > 0
+}
+
+// internalTarget returns the internal or external target for ip, or
+// an empty string if no internal networks are defined.
+func internalTarget(ip net.IP) string {
+	internalMu.RLock()
+	defer internalMu.RUnlock()
+	if len(internalNetworks) == 0 {
+		return ""
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return InternalTarget
+		}
+	}
+	return ExternalTarget
+}
@@ -2,10 +2,13 @@ package targeting
 
 import (
 	"fmt"
-	"log"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/abh/geodns/applog"
+	"github.com/abh/geodns/countries"
 	"github.com/abh/geodns/targeting/geo"
 )
 
@@ -19,35 +22,46 @@ const (
 	TargetRegion
 	TargetASN
 	TargetIP
+	TargetInternal
 )
 
-var cidr48Mask net.IPMask
+var cidr24Mask, cidr48Mask net.IPMask
 
 func init() {
+	cidr24Mask = net.CIDRMask(24, 32)
 	cidr48Mask = net.CIDRMask(48, 128)
 }
 
-var g geo.Provider
+var (
+	geoMu sync.RWMutex
+	g     geo.Provider
+)
 
 // Setup sets the global geo provider
 func Setup(gn geo.Provider) error {
+	geoMu.Lock()
 	g = gn
+	geoMu.Unlock()
 	return nil
 }
 
 // Geo returns the global geo provider
 func Geo() geo.Provider {
+	geoMu.RLock()
+	defer geoMu.RUnlock()
 	return g
 }
 
-func (t TargetOptions) getGeoTargets(ip net.IP, hasClosest bool) ([]string, int, *geo.Location) {
+func (t TargetOptions) getGeoTargets(g geo.Provider, ip net.IP, hasClosest bool) ([]string, int, *geo.Location) {
 
 	targets := make([]string, 0)
 
 	if t&TargetASN > 0 {
+		// without an ASN database GetASN returns an error for
+		// every query; only log it in debug mode
 		asn, _, err := g.GetASN(ip)
 		if err != nil {
-			log.Printf("GetASN error: %s", err)
+			applog.Printf("GetASN error: %s", err)
 		}
 		if len(asn) > 0 {
 			targets = append(targets, asn)
@@ -86,6 +100,10 @@ func (t TargetOptions) getGeoTargets(ip net.IP, hasClosest bool) ([]string, int,
 		targets = append(targets, country)
 	}
 
+	if (t&TargetCountry > 0 || t&TargetContinent > 0) && len(country) > 0 {
+		targets = append(targets, groupTargets(country)...)
+	}
+
 	if t&TargetContinent > 0 && len(continent) > 0 {
 		targets = append(targets, continent)
 	}
@@ -94,19 +112,35 @@ func (t TargetOptions) getGeoTargets(ip net.IP, hasClosest bool) ([]string, int,
 }
 
 func (t TargetOptions) GetTargets(ip net.IP, hasClosest bool) ([]string, int, *geo.Location) {
+	return t.GetTargetsFrom(ip, ip, hasClosest)
+}
+
+// GetTargetsFrom returns the targets for a query from source on behalf
+// of the client at ip (from EDNS Client Subnet). The internal or
+// external view is chosen by source, as anyone can send an internal
+// address as the client subnet.
+func (t TargetOptions) GetTargetsFrom(ip, source net.IP, hasClosest bool) ([]string, int, *geo.Location) {
 
 	targets := make([]string, 0)
 	var location *geo.Location
 	var netmask int
 
+	// the internal or external view comes before everything else
+	if t&TargetInternal > 0 {
+		if target := internalTarget(source); len(target) > 0 {
+			targets = append(targets, target)
+		}
+	}
+
 	if t&TargetIP > 0 {
 		ipStr := ip.String()
 		targets = append(targets, "["+ipStr+"]")
 		ip4 := ip.To4()
 		if ip4 != nil {
 			if ip4[3] != 0 {
-				ip4[3] = 0
-				targets = append(targets, "["+ip4.String()+"]")
+				// Mask returns a copy, the caller's IP isn't modified
+				ip24 := ip4.Mask(cidr24Mask)
+				targets = append(targets, "["+ip24.String()+"]")
 			}
 		} else {
 			// v6 address, also target the /48 address
@@ -115,9 +149,9 @@ func (t TargetOptions) GetTargets(ip net.IP, hasClosest bool) ([]string, int, *g
 		}
 	}
 
-	if g != nil {
+	if g := Geo(); g != nil {
 		var geotargets []string
-		geotargets, netmask, location = t.getGeoTargets(ip, hasClosest)
+		geotargets, netmask, location = t.getGeoTargets(g, ip, hasClosest)
 		targets = append(targets, geotargets...)
 	}
 
@@ -150,9 +184,50 @@ func (t TargetOptions) String() string {
 	if t&TargetIP > 0 {
 		targets = append(targets, "ip")
 	}
+	if t&TargetInternal > 0 {
+		targets = append(targets, "internal")
+	}
 	return strings.Join(targets, " ")
 }
 
+// TargetType returns the targeting option that adds target to the
+// targets from GetTargets: "@", "internal" (for the internal and
+// external views), "ip", "asn", "region", "regiongroup", "country",
+// "group" (for location groups) or "continent". Other targets, like
+// the ones of a label split, are "".
+func TargetType(target string) string {
+	switch {
+	case target == "@":
+		return "@"
+	case target == InternalTarget || target == ExternalTarget:
+		return "internal"
+	case strings.HasPrefix(target, "["):
+		return "ip"
+	case strings.HasPrefix(target, GroupPrefix):
+		return "group"
+	}
+	if _, ok := countries.CountryContinent[target]; ok {
+		return "country"
+	}
+	if _, ok := countries.ContinentCountries[target]; ok {
+		return "continent"
+	}
+	if _, ok := countries.RegionGroupRegions[target]; ok {
+		return "regiongroup"
+	}
+	if i := strings.Index(target, "-"); i > 0 {
+		if _, ok := countries.CountryContinent[target[:i]]; ok {
+			return "region"
+		}
+	}
+	if strings.HasPrefix(target, "as") {
+		if _, err := strconv.Atoi(target[2:]); err == nil {
+			return "asn"
+		}
+	}
+	return ""
+}
+
 func ParseTargets(v string) (tgt TargetOptions, err error) {
 	targets := strings.Split(v, " ")
 	for _, t := range targets {
@@ -172,6 +247,8 @@ func ParseTargets(v string) (tgt TargetOptions, err error) {
 			x = TargetASN
 		case "ip":
 			x = TargetIP
+		case "internal":
+			x = TargetInternal
 		default:
 			err = fmt.Errorf("Unknown targeting option '%s'", t)
 		}
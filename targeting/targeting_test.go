@@ -1,10 +1,14 @@
 package targeting
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"reflect"
 	"testing"
 
+	"github.com/abh/geodns/targeting/geo"
 	"github.com/abh/geodns/targeting/geoip2"
 )
 
@@ -18,6 +22,28 @@ func TestTargetString(t *testing.T) {
 	}
 }
 
+func TestTargetType(t *testing.T) {
+	for target, typ := range map[string]string{
+		"@":               "@",
+		"internal":        "internal",
+		"external":        "internal",
+		"[192.0.2.1]":     "ip",
+		"[2001:db8::]":    "ip",
+		"as65536":         "asn",
+		"us-ca":           "region",
+		"us-west":         "regiongroup",
+		"dk":              "country",
+		"europe":          "continent",
+		GroupPrefix + "x": "group",
+		"asia-east":       "",
+		"pop1":            "",
+	} {
+		if got := TargetType(target); got != typ {
+			t.Errorf("TargetType(%q) = %q, expected %q", target, got, typ)
+		}
+	}
+}
+
 func TestTargetParse(t *testing.T) {
 	tgt, err := ParseTargets("@ foo country")
 	str := tgt.String()
@@ -117,3 +143,425 @@ func TestGetTargets(t *testing.T) {
 
 	}
 }
+
+// testProvider is a geo provider that places every IP in
+// San Francisco on AS7012, optionally without the ASN database.
+type testProvider struct {
+	noASN bool
+}
+
+func (p *testProvider) HasCountry() (bool, error)  { return true, nil }
+func (p *testProvider) HasLocation() (bool, error) { return true, nil }
+
+func (p *testProvider) HasASN() (bool, error) {
+	if p.noASN {
+		return false, fmt.Errorf("no ASN database")
+	}
+	return true, nil
+}
+
+func (p *testProvider) GetCountry(ip net.IP) (string, string, int) {
+	return "us", "north-america", 0
+}
+
+func (p *testProvider) GetASN(ip net.IP) (string, int, error) {
+	if p.noASN {
+		return "", 0, fmt.Errorf("no ASN database")
+	}
+	return "as7012", 0, nil
+}
+
+func (p *testProvider) GetLocation(ip net.IP) (*geo.Location, error) {
+	return &geo.Location{
+		Country:     "us",
+		Continent:   "north-america",
+		Region:      "us-ca",
+		RegionGroup: "us-west",
+	}, nil
+}
+
+func TestGetTargetsOrder(t *testing.T) {
+	defer Setup(g)
+
+	ip := net.ParseIP("207.171.1.1")
+	tgt, _ := ParseTargets("@ continent regiongroup country region asn ip")
+
+	Setup(&testProvider{})
+	targets, _, _ := tgt.GetTargets(ip, false)
+	expect := []string{"[207.171.1.1]", "[207.171.1.0]", "as7012", "us-ca", "us-west", "us", "north-america", "@"}
+	if !reflect.DeepEqual(targets, expect) {
+		t.Errorf("got targets '%s', expected '%s'", targets, expect)
+	}
+	if ip.String() != "207.171.1.1" {
+		t.Errorf("GetTargets modified the IP to '%s'", ip)
+	}
+
+	// without the ASN database the asn target is skipped
+	Setup(&testProvider{noASN: true})
+	targets, _, _ = tgt.GetTargets(ip, false)
+	expect = []string{"[207.171.1.1]", "[207.171.1.0]", "us-ca", "us-west", "us", "north-america", "@"}
+	if !reflect.DeepEqual(targets, expect) {
+		t.Errorf("got targets '%s', expected '%s'", targets, expect)
+	}
+}
+
+func TestGetTargetsGroups(t *testing.T) {
+	defer Setup(g)
+	defer SetGroups(nil)
+
+	err := SetGroups(map[string][]string{"amer": {"US", "ca"}, "nato": {"us", "de"}})
+	if err != nil {
+		t.Fatalf("SetGroups: %s", err)
+	}
+	if !HasGroup("amer") || HasGroup("emea") {
+		t.Errorf("HasGroup amer: %t, emea: %t", HasGroup("amer"), HasGroup("emea"))
+	}
+
+	Setup(&testProvider{})
+	tgt, _ := ParseTargets("@ continent country")
+	targets, _, _ := tgt.GetTargets(net.ParseIP("207.171.1.1"), false)
+	expect := []string{"us", "group:amer", "group:nato", "north-america", "@"}
+	if !reflect.DeepEqual(targets, expect) {
+		t.Errorf("got targets '%s', expected '%s'", targets, expect)
+	}
+
+	err = SetGroups(map[string][]string{"emea": {"de", "xx"}})
+	if err == nil || err.Error() != "location group 'emea': unknown country 'xx'" {
+		t.Errorf("expected an error for an unknown country, got '%v'", err)
+	}
+	if !HasGroup("amer") {
+		t.Errorf("a failed SetGroups replaced the groups")
+	}
+}
+
+func TestGetTargetsInternal(t *testing.T) {
+	defer Setup(g)
+	defer SetInternalNetworks(nil)
+
+	Setup(&testProvider{})
+	tgt, err := ParseTargets("@ country internal")
+	if err != nil {
+		t.Fatalf("ParseTargets: %s", err)
+	}
+	if tgt.String() != "@ country internal" {
+		t.Errorf("got '%s' for the targeting options", tgt.String())
+	}
+
+	// no internal networks, no internal or external targets
+	targets, _, _ := tgt.GetTargets(net.ParseIP("10.1.2.3"), false)
+	if expect := []string{"us", "@"}; !reflect.DeepEqual(targets, expect) {
+		t.Errorf("got targets '%s', expected '%s'", targets, expect)
+	}
+
+	if err := SetInternalNetworks([]string{"10.0.0.0/8 192.0.2.1", "2001:db8::/32"}); err != nil {
+		t.Fatalf("SetInternalNetworks: %s", err)
+	}
+	if !HasInternalNetworks() {
+		t.Errorf("HasInternalNetworks is false")
+	}
+	for ip, expect := range map[string][]string{
+		"10.1.2.3":    {"internal", "us", "@"},
+		"192.0.2.1":   {"internal", "us", "@"},
+		"192.0.2.2":   {"external", "us", "@"},
+		"2001:db8::1": {"internal", "us", "@"},
+	} {
+		targets, _, _ := tgt.GetTargets(net.ParseIP(ip), false)
+		if !reflect.DeepEqual(targets, expect) {
+			t.Errorf("for %s got targets '%s', expected '%s'", ip, targets, expect)
+		}
+	}
+
+	err = SetInternalNetworks([]string{"10.0.0.0/33"})
+	if err == nil || err.Error() != "invalid internal network '10.0.0.0/33'" {
+		t.Errorf("expected an error for an invalid network, got '%v'", err)
+	}
+	if !HasInternalNetworks() {
+		t.Errorf("a failed SetInternalNetworks replaced the networks")
+	}
+}
+
+func TestClientNetwork(t *testing.T) {
+	defer SetIPv6ClientPrefix(DefaultIPv6ClientPrefix)
+
+	same := func(a, b string) bool {
+		return ClientNetwork(net.ParseIP(a)).Equal(ClientNetwork(net.ParseIP(b)))
+	}
+
+	// two addresses in the same /56 are the same client
+	if !same("2001:db8:1:2200::1", "2001:db8:1:22ff:ffff::1") {
+		t.Errorf("addresses in the same /56 are different clients")
+	}
+	if same("2001:db8:1:2200::1", "2001:db8:1:2300::1") {
+		t.Errorf("addresses in different /56 networks are the same client")
+	}
+	if same("192.0.2.1", "192.0.2.2") {
+		t.Errorf("IPv4 addresses are aggregated")
+	}
+	if got := ClientNetwork(net.ParseIP("::ffff:192.0.2.1")).String(); got != "192.0.2.1" {
+		t.Errorf("got %s for an IPv4-mapped address", got)
+	}
+
+	if err := SetIPv6ClientPrefix(64); err != nil {
+		t.Fatalf("SetIPv6ClientPrefix: %s", err)
+	}
+	if same("2001:db8:1:2200::1", "2001:db8:1:22ff::1") {
+		t.Errorf("addresses in different /64 networks are the same client")
+	}
+	for _, bits := range []int{0, 129} {
+		if err := SetIPv6ClientPrefix(bits); err == nil {
+			t.Errorf("no error for a /%d prefix", bits)
+		}
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	for s, expected := range map[string]string{
+		"192.0.2.0/24":  "192.0.2.0/24",
+		"192.0.2.1":     "192.0.2.1/32",
+		"2001:db8::/32": "2001:db8::/32",
+		"2001:db8::1":   "2001:db8::1/128",
+	} {
+		network, err := ParseNetwork(s)
+		if err != nil {
+			t.Errorf("ParseNetwork(%s): %s", s, err)
+			continue
+		}
+		if network.String() != expected {
+			t.Errorf("ParseNetwork(%s) = %s, expected %s", s, network, expected)
+		}
+	}
+	for _, s := range []string{"", "192.0.2.300", "192.0.2.0/33", "example.com"} {
+		if _, err := ParseNetwork(s); err == nil {
+			t.Errorf("ParseNetwork(%s) didn't fail", s)
+		}
+	}
+}
+
+func TestGeoOverrides(t *testing.T) {
+	defer Setup(g)
+
+	fh, err := ioutil.TempFile("", "geodns-geooverrides.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fh.Name())
+	fmt.Fprint(fh, `
+# mislocated networks
+192.0.2.0/24       de
+192.0.2.128/25     us  us-ny  40.71,-74.01
+`)
+	fh.Close()
+
+	overrides, err := NewGeoOverrides(fh.Name(), &testProvider{})
+	if err != nil {
+		t.Fatalf("NewGeoOverrides: %s", err)
+	}
+	if overrides.Len() != 2 {
+		t.Errorf("got %d overrides, expected 2", overrides.Len())
+	}
+	Setup(overrides)
+
+	tgt, _ := ParseTargets("@ continent regiongroup country region asn")
+	for ip, expect := range map[string][]string{
+		"192.0.2.1":   {"as7012", "de", "europe", "@"},
+		"192.0.2.200": {"as7012", "us-ny", "us-east", "us", "north-america", "@"},
+		"207.171.1.1": {"as7012", "us-ca", "us-west", "us", "north-america", "@"},
+	} {
+		targets, _, _ := tgt.GetTargets(net.ParseIP(ip), false)
+		if !reflect.DeepEqual(targets, expect) {
+			t.Errorf("for %s got targets '%s', expected '%s'", ip, targets, expect)
+		}
+	}
+
+	country, continent, netmask := overrides.GetCountry(net.ParseIP("192.0.2.1"))
+	if country != "de" || continent != "europe" || netmask != 24 {
+		t.Errorf("GetCountry got %s, %s, %d", country, continent, netmask)
+	}
+	l, _ := overrides.GetLocation(net.ParseIP("192.0.2.200"))
+	if l == nil || l.Latitude != 40.71 || l.Longitude != -74.01 {
+		t.Errorf("GetLocation got %+v", l)
+	}
+
+	// an invalid file keeps the current overrides
+	ioutil.WriteFile(fh.Name(), []byte("192.0.2.0/33 de\n"), 0644)
+	err = overrides.Reload()
+	if err == nil || err.Error() != fh.Name()+":1: invalid network '192.0.2.0/33'" {
+		t.Errorf("expected an error for an invalid network, got '%v'", err)
+	}
+	if overrides.Len() != 2 {
+		t.Errorf("a failed Reload replaced the overrides")
+	}
+}
+
+func TestGeoOverridesOnly(t *testing.T) {
+	defer Setup(g)
+
+	fh, err := ioutil.TempFile("", "geodns-geooverrides.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fh.Name())
+	fmt.Fprint(fh, `
+10.0.0.0/8         de
+10.1.0.0/16        us  us-ca
+`)
+	fh.Close()
+
+	// without a GeoIP database
+	overrides, err := NewGeoOverrides(fh.Name(), nil)
+	if err != nil {
+		t.Fatalf("NewGeoOverrides: %s", err)
+	}
+	Setup(overrides)
+
+	if ok, _ := overrides.HasCountry(); !ok {
+		t.Errorf("HasCountry is false with overrides")
+	}
+	if ok, _ := overrides.HasLocation(); ok {
+		t.Errorf("HasLocation is true without any locations")
+	}
+	if ok, _ := overrides.HasASN(); ok {
+		t.Errorf("HasASN is true without a database")
+	}
+
+	tgt, _ := ParseTargets("@ continent regiongroup country region")
+	for ip, expect := range map[string][]string{
+		"10.2.0.1":    {"de", "europe", "@"},
+		"10.1.2.3":    {"us-ca", "us-west", "us", "north-america", "@"},
+		"192.168.1.1": {"@"},
+	} {
+		targets, _, _ := tgt.GetTargets(net.ParseIP(ip), false)
+		if !reflect.DeepEqual(targets, expect) {
+			t.Errorf("for %s got targets '%s', expected '%s'", ip, targets, expect)
+		}
+	}
+}
+
+// countingProvider counts the lookups of the test provider, and
+// returns the countries for networks with the given netmask.
+type countingProvider struct {
+	testProvider
+	lookups int
+	netmask int
+}
+
+func (p *countingProvider) GetCountry(ip net.IP) (string, string, int) {
+	p.lookups++
+	country, continent, _ := p.testProvider.GetCountry(ip)
+	return country, continent, p.netmask
+}
+
+func (p *countingProvider) GetLocation(ip net.IP) (*geo.Location, error) {
+	p.lookups++
+	return p.testProvider.GetLocation(ip)
+}
+
+func TestGeoCache(t *testing.T) {
+	p := &countingProvider{}
+	cache := NewGeoCache(p, 2)
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.200", "2001:db8::1", "2001:db8:0:1::1"} {
+		if country, _, _ := cache.GetCountry(net.ParseIP(ip)); country != "us" {
+			t.Errorf("got country '%s' for %s", country, ip)
+		}
+	}
+	if p.lookups != 2 {
+		t.Errorf("got %d lookups for two networks, expected 2", p.lookups)
+	}
+
+	// the least recently used network is removed
+	cache.GetCountry(net.ParseIP("198.51.100.1"))
+	cache.GetCountry(net.ParseIP("2001:db8::2"))
+	cache.GetCountry(net.ParseIP("192.0.2.2"))
+	if p.lookups != 4 {
+		t.Errorf("got %d lookups, expected 4", p.lookups)
+	}
+	if n := cache.country.len(); n != 2 {
+		t.Errorf("%d networks cached, expected 2", n)
+	}
+
+	// the cached locations are copies
+	l, _ := cache.GetLocation(net.ParseIP("192.0.2.1"))
+	l.Country = "de"
+	l, _ = cache.GetLocation(net.ParseIP("192.0.2.1"))
+	if l.Country != "us" {
+		t.Errorf("cached location was modified to '%s'", l.Country)
+	}
+
+	cache.Flush()
+	p.lookups = 0
+	cache.GetCountry(net.ParseIP("192.0.2.2"))
+	if p.lookups != 1 {
+		t.Errorf("got %d lookups after the flush, expected 1", p.lookups)
+	}
+}
+
+func TestGeoCacheNetworks(t *testing.T) {
+	defer SetIPv6ClientPrefix(DefaultIPv6ClientPrefix)
+
+	p := &countingProvider{}
+	cache := NewGeoCache(p, 10)
+
+	lookups := func(ips ...string) int {
+		p.lookups = 0
+		for _, ip := range ips {
+			cache.GetCountry(net.ParseIP(ip))
+		}
+		return p.lookups
+	}
+
+	// the IPv6 networks are the client prefix
+	if n := lookups("2001:db8:0:100::1", "2001:db8:0:1ff::1"); n != 1 {
+		t.Errorf("got %d lookups in a /56, expected 1", n)
+	}
+	if n := lookups("2001:db8:0:200::1"); n != 1 {
+		t.Errorf("got %d lookups for another /56 in the /48, expected 1", n)
+	}
+	if err := SetIPv6ClientPrefix(64); err != nil {
+		t.Fatalf("SetIPv6ClientPrefix: %s", err)
+	}
+	if n := lookups("2001:db8:0:300::1", "2001:db8:0:301::1"); n != 2 {
+		t.Errorf("got %d lookups for two /64 networks, expected 2", n)
+	}
+
+	// results for networks smaller than a /24 aren't cached
+	p.netmask = 28
+	if n := lookups("198.51.100.1", "198.51.100.200"); n != 2 {
+		t.Errorf("got %d lookups for /28 networks, expected 2", n)
+	}
+	p.netmask = 24
+	if n := lookups("203.0.113.1", "203.0.113.200"); n != 1 {
+		t.Errorf("got %d lookups for a /24 network, expected 1", n)
+	}
+}
+
+func BenchmarkGeoCache(b *testing.B) {
+	g, err := geoip2.New(geoip2.FindDB())
+	if err != nil {
+		b.Skipf("opening geoip2: %s", err)
+	}
+
+	// queries from a few thousand client networks
+	ips := make([]net.IP, 4096)
+	for i := range ips {
+		ips[i] = net.IPv4(byte(1+i%200), byte(i/200), byte(i), 1)
+	}
+
+	for _, bm := range []struct {
+		name string
+		p    geo.Provider
+	}{
+		{"uncached", g},
+		{"cached", NewGeoCache(g, len(ips))},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for _, ip := range ips {
+				bm.p.GetCountry(ip)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bm.p.GetCountry(ips[i%len(ips)])
+			}
+		})
+	}
+}
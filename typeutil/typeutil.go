@@ -58,3 +58,20 @@ func ToInt(v interface{}) (rv int) {
 	}
 	return rv
 }
+
+func ToFloat(v interface{}) (rv float64) {
+	switch v.(type) {
+	case string:
+		f, err := strconv.ParseFloat(v.(string), 64)
+		if err != nil {
+			panic("Error converting value to float")
+		}
+		rv = f
+	case float64:
+		rv = v.(float64)
+	default:
+		log.Println("Can't convert", v, "to float")
+		panic("Can't convert value")
+	}
+	return rv
+}
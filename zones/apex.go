@@ -0,0 +1,50 @@
+package zones
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// setupApexDefault answers A and AAAA queries for the apex with the
+// address records of the ApexDefault label, when the apex doesn't
+// have any addresses (or a CNAME or alias) of its own.
+func (zone *Zone) setupApexDefault() error {
+	name := zone.Options.ApexDefault
+	if len(name) == 0 {
+		return nil
+	}
+
+	apex := zone.Labels[""]
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeMF} {
+		if len(apex.Records[qtype]) > 0 {
+			return nil
+		}
+	}
+
+	label, ok := zone.Labels[name]
+	if !ok {
+		return fmt.Errorf("apex_default label '%s' isn't in the zone", name)
+	}
+	if zone.Signed() {
+		// the synthesized records wouldn't have signatures
+		return fmt.Errorf("apex_default can't be used in a signed zone")
+	}
+
+	origin := dns.Fqdn(zone.Origin)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		if len(label.Records[qtype]) == 0 {
+			continue
+		}
+		records := make(Records, len(label.Records[qtype]))
+		for i, record := range label.Records[qtype] {
+			r := *record
+			r.RR = dns.Copy(record.RR)
+			r.RR.Header().Name = origin
+			records[i] = &r
+		}
+		apex.Records[qtype] = records
+		apex.Weight[qtype] = label.Weight[qtype]
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package zones
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApexDefault(t *testing.T) {
+	zone, err := readTestZone(t, "example.com", `{
+		"apex_default": "www",
+		"data": {
+			"": { "ns": [ "ns1.example.net." ] },
+			"www": {
+				"a": [ [ "192.0.2.1", 10 ], [ "192.0.2.2", 20 ] ],
+				"aaaa": [ [ "2001:db8::1" ] ],
+				"txt": "www"
+			}
+		}
+	}`)
+	require.Nil(t, err)
+
+	apex := zone.Labels[""]
+	require.Len(t, apex.Records[dns.TypeA], 2)
+	assert.Equal(t, "example.com.", apex.Records[dns.TypeA][0].RR.Header().Name)
+	assert.Equal(t, 30, apex.Weight[dns.TypeA])
+	assert.Len(t, apex.Records[dns.TypeAAAA], 1)
+	assert.Empty(t, apex.Records[dns.TypeTXT], "only the addresses")
+	assert.Equal(t, "www.example.com.", zone.Labels["www"].Records[dns.TypeA][0].RR.Header().Name)
+
+	// the apex addresses aren't replaced
+	zone, err = readTestZone(t, "example.com", `{
+		"apex_default": "www",
+		"data": {
+			"": { "ns": [ "ns1.example.net." ], "a": [ [ "192.0.2.10" ] ] },
+			"www": { "a": [ [ "192.0.2.1" ] ], "aaaa": [ [ "2001:db8::1" ] ] }
+		}
+	}`)
+	require.Nil(t, err)
+	apex = zone.Labels[""]
+	require.Len(t, apex.Records[dns.TypeA], 1)
+	assert.Equal(t, "192.0.2.10", apex.Records[dns.TypeA][0].RR.(*dns.A).A.String())
+	assert.Empty(t, apex.Records[dns.TypeAAAA])
+
+	_, err = readTestZone(t, "example.com", `{
+		"apex_default": "web",
+		"data": { "": { "ns": [ "ns1.example.net." ] } }
+	}`)
+	assert.EqualError(t, err, "apex_default label 'web' isn't in the zone")
+}
@@ -0,0 +1,46 @@
+package zones
+
+import (
+	"sort"
+)
+
+// CheckResult is the outcome of checking one zone of a source.
+type CheckResult struct {
+	Name     string
+	Location string
+
+	// Err is why the zone failed to load; Problems are what
+	// Validate found in a zone that loaded
+	Err      error
+	Problems []string
+}
+
+// Check reads all the zones in source like the MuxManager loads them
+// and validates them, without registering them or starting their
+// health checks. The results are sorted by zone name.
+func Check(source ZoneSource) ([]CheckResult, error) {
+	list, err := source.Zones()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]CheckResult, 0, len(list))
+	for _, sz := range list {
+		r := CheckResult{Name: sz.Name, Location: sz.Location}
+		zone, err := readSourceZone(sz)
+		if err != nil {
+			r.Err = err
+		} else {
+			r.Problems = zone.Validate()
+		}
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results, nil
+}
+
+// readSourceZone reads a zone from its source.
+func readSourceZone(sz SourceZone) (*Zone, error) {
+	zone := NewZone(sz.Name)
+	return zone, sz.Read(zone)
+}
@@ -0,0 +1,261 @@
+package zones
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/abh/geodns/typeutil"
+	"github.com/miekg/dns"
+)
+
+// dnssecRecordTypes are the record types of a zone signed by an
+// external signer. They are written in the zone file in the
+// presentation format of the record data, for example
+// "257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0d...".
+var dnssecRecordTypes = map[string]uint16{
+	"dnskey":     dns.TypeDNSKEY,
+	"ds":         dns.TypeDS,
+	"rrsig":      dns.TypeRRSIG,
+	"nsec":       dns.TypeNSEC,
+	"nsec3":      dns.TypeNSEC3,
+	"nsec3param": dns.TypeNSEC3PARAM,
+}
+
+// IsDnssecType returns true for the record types that are only added
+// to answers for queries with the DO bit.
+func IsDnssecType(qtype uint16) bool {
+	switch qtype {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	}
+	return false
+}
+
+// dsDigestLengths are the lengths of the DS digests in hex by digest
+// type.
+var dsDigestLengths = map[uint8]int{
+	dns.SHA1:   40,
+	dns.SHA256: 64,
+	dns.GOST94: 64,
+	dns.SHA384: 96,
+}
+
+// parseDnssecRR reads a pre-signed record; rec is the record data as
+// a string, or an object with the data in "rdata". A DS record can
+// also be an object with the "key_tag", "algorithm", "digest_type" and
+// "digest" fields.
+func parseDnssecRR(h dns.RR_Header, rec interface{}, dk string) dns.RR {
+	var rdata string
+	switch r := rec.(type) {
+	case string:
+		rdata = r
+	case map[string]interface{}:
+		if v, ok := r["rdata"]; ok {
+			rdata = typeutil.ToString(v)
+		} else if _, ok := r["digest"]; ok && h.Rrtype == dns.TypeDS {
+			rdata = fmt.Sprintf("%d %d %d %s",
+				typeutil.ToInt(r["key_tag"]), typeutil.ToInt(r["algorithm"]),
+				typeutil.ToInt(r["digest_type"]), typeutil.ToString(r["digest"]))
+		}
+	}
+	typ := dns.TypeToString[h.Rrtype]
+	if len(rdata) == 0 {
+		panic(fmt.Errorf("empty %s record for '%s'", typ, dk))
+	}
+
+	rr, err := dns.NewRR(fmt.Sprintf("%s 0 IN %s %s", h.Name, typ, rdata))
+	if err != nil || rr == nil {
+		panic(fmt.Errorf("bad %s record for '%s': %v", typ, dk, err))
+	}
+	rr.Header().Ttl = h.Ttl
+	if sig, ok := rr.(*dns.RRSIG); ok && h.Ttl == 0 {
+		// a signature has the TTL of the records it covers
+		sig.Hdr.Ttl = sig.OrigTtl
+	}
+	if ds, ok := rr.(*dns.DS); ok {
+		if err := checkDS(ds); err != nil {
+			panic(fmt.Errorf("bad DS record for '%s': %s", dk, err))
+		}
+	}
+	return rr
+}
+
+// checkDS returns an error if the algorithm or digest type of a DS
+// record is unknown, or the digest is too short or long for the type.
+func checkDS(ds *dns.DS) error {
+	if _, ok := dns.AlgorithmToString[ds.Algorithm]; !ok {
+		return fmt.Errorf("unknown algorithm %d", ds.Algorithm)
+	}
+	n, ok := dsDigestLengths[ds.DigestType]
+	if !ok {
+		return fmt.Errorf("unknown digest type %d", ds.DigestType)
+	}
+	if len(ds.Digest) != n {
+		return fmt.Errorf("digest of %d hex digits, expected %d for digest type %d",
+			len(ds.Digest), n, ds.DigestType)
+	}
+	return nil
+}
+
+// Signed returns true if the zone has DNSKEY records at the apex.
+func (z *Zone) Signed() bool {
+	label, ok := z.Labels[""]
+	return ok && len(label.Records[dns.TypeDNSKEY]) > 0
+}
+
+// Signatures returns the RRSIG records of label covering the records
+// of qtype, with name as the owner name.
+func (z *Zone) Signatures(label *Label, qtype uint16, name string) []dns.RR {
+	var rrs []dns.RR
+	for _, record := range label.Records[dns.TypeRRSIG] {
+		if record.RR.(*dns.RRSIG).TypeCovered != qtype {
+			continue
+		}
+		rr := dns.Copy(record.RR)
+		rr.Header().Name = name
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// Denial returns the NSEC or NSEC3 records, with their signatures,
+// proving that the label s has no records of the query type. With
+// nxdomain set they prove that s doesn't exist.
+func (z *Zone) Denial(s string, nxdomain bool) []dns.RR {
+	fqdn := z.fqdn(s)
+
+	if !nxdomain {
+		if label, ok := z.Labels[s]; ok && len(label.Records[dns.TypeNSEC]) > 0 {
+			return z.denialRRs(label, dns.TypeNSEC)
+		}
+		if label := z.nsec3Match(fqdn); label != nil {
+			return z.denialRRs(label, dns.TypeNSEC3)
+		}
+		return nil
+	}
+
+	// the closest encloser is the longest name above s in the zone
+	encloser := s
+	for {
+		i := strings.Index(encloser, ".")
+		if i < 0 {
+			encloser = ""
+		} else {
+			encloser = encloser[i+1:]
+		}
+		if _, ok := z.Labels[encloser]; ok || encloser == "" {
+			break
+		}
+	}
+	wildcard := "*"
+	if encloser != "" {
+		wildcard += "." + encloser
+	}
+
+	var rrs []dns.RR
+	seen := map[*Label]bool{}
+	add := func(label *Label, qtype uint16) {
+		if label != nil && !seen[label] {
+			seen[label] = true
+			rrs = append(rrs, z.denialRRs(label, qtype)...)
+		}
+	}
+
+	if z.hasNsec() {
+		add(z.nsecCover(fqdn), dns.TypeNSEC)
+		add(z.nsecCover(z.fqdn(wildcard)), dns.TypeNSEC)
+		return rrs
+	}
+
+	// RFC 5155 7.2.2; the closest encloser, the next closer name
+	// and the wildcard at the closest encloser
+	rest := s
+	if encloser != "" {
+		rest = strings.TrimSuffix(s, "."+encloser)
+	}
+	nextCloser := rest[strings.LastIndex(rest, ".")+1:]
+	if encloser != "" {
+		nextCloser += "." + encloser
+	}
+	add(z.nsec3Match(z.fqdn(encloser)), dns.TypeNSEC3)
+	add(z.nsec3Cover(z.fqdn(nextCloser)), dns.TypeNSEC3)
+	add(z.nsec3Cover(z.fqdn(wildcard)), dns.TypeNSEC3)
+	return rrs
+}
+
+func (z *Zone) fqdn(s string) string {
+	if len(s) == 0 {
+		return dns.Fqdn(z.Origin)
+	}
+	return s + "." + dns.Fqdn(z.Origin)
+}
+
+// denialRRs returns the records of qtype of label with the
+// signatures covering them.
+func (z *Zone) denialRRs(label *Label, qtype uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, record := range label.Records[qtype] {
+		rrs = append(rrs, record.RR)
+	}
+	return append(rrs, z.Signatures(label, qtype, z.fqdn(label.Label))...)
+}
+
+func (z *Zone) hasNsec() bool {
+	for _, label := range z.Labels {
+		if len(label.Records[dns.TypeNSEC]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCover returns the label with the NSEC record covering name.
+func (z *Zone) nsecCover(name string) *Label {
+	for _, label := range z.Labels {
+		if len(label.Records[dns.TypeNSEC]) == 0 {
+			continue
+		}
+		nsec := label.FirstRR(dns.TypeNSEC).(*dns.NSEC)
+		owner, next := nsec.Hdr.Name, nsec.NextDomain
+		if canonicalLess(owner, next) {
+			if canonicalLess(owner, name) && canonicalLess(name, next) {
+				return label
+			}
+		} else if canonicalLess(owner, name) || canonicalLess(name, next) {
+			// the last NSEC record wraps around to the apex
+			return label
+		}
+	}
+	return nil
+}
+
+func (z *Zone) nsec3Match(name string) *Label {
+	for _, label := range z.Labels {
+		if len(label.Records[dns.TypeNSEC3]) > 0 && label.FirstRR(dns.TypeNSEC3).(*dns.NSEC3).Match(name) {
+			return label
+		}
+	}
+	return nil
+}
+
+func (z *Zone) nsec3Cover(name string) *Label {
+	for _, label := range z.Labels {
+		if len(label.Records[dns.TypeNSEC3]) > 0 && label.FirstRR(dns.TypeNSEC3).(*dns.NSEC3).Cover(name) {
+			return label
+		}
+	}
+	return nil
+}
+
+// canonicalLess returns true if a sorts before b in the canonical
+// DNS name order (RFC 4034 6.1).
+func canonicalLess(a, b string) bool {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if la[i] != lb[j] {
+			return la[i] < lb[j]
+		}
+	}
+	return len(la) < len(lb)
+}
@@ -0,0 +1,120 @@
+package zones
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadDnssec(t *testing.T) {
+	zone, err := readTestZone(t, "example.net", `{
+		"data": {
+			"": {
+				"ns": [ "ns1.example.net." ],
+				"dnskey": [ "257 3 13 7murwvFqSHAKCr0pvghwdcQwZrXMzSzGCKJvZitWeiklhpfembw6LrJ9ZMyj0Rdcn43ig5N6mFOJ5gZMencBDQ==" ],
+				"rrsig": [ "DNSKEY 13 2 300 20461001000000 20261001000000 11562 example.net. h2mtsjk86shv/mdzxliK5K76ECY7wme2ti5586KDexXQZRLTcGVIKI6XWs8Lhf7YfJmqGjFUZ0PTXGpuGJEAOw==" ]
+			},
+			"sub": {
+				"ns": [ "ns1.example.org." ],
+				"ds": [ { "rdata": "11562 13 2 4A8D0E4E0B2C16F0F1F1E4C3F1F1F1F1F1F1F1F1F1F1F1F1F1F1F1F1F1F1F1F1", "ttl": 60 } ]
+			}
+		}
+	}`)
+	require.Nil(t, err)
+
+	assert.True(t, zone.Signed())
+	apex := zone.Labels[""]
+	sigs := zone.Signatures(apex, dns.TypeDNSKEY, "example.net.")
+	require.Len(t, sigs, 1)
+	assert.Equal(t, uint32(300), sigs[0].Header().Ttl, "the RRSIG TTL defaults to the original TTL")
+	assert.Len(t, zone.Signatures(apex, dns.TypeA, "example.net."), 0)
+
+	ds := zone.Labels["sub"].FirstRR(dns.TypeDS).(*dns.DS)
+	assert.Equal(t, uint16(11562), ds.KeyTag)
+	assert.Equal(t, uint32(60), ds.Hdr.Ttl)
+
+	zone, err = readTestZone(t, "example.net", `{ "data": { "sub": {
+		"ns": [ "ns1.example.org." ],
+		"ds": [ { "key_tag": 18795, "algorithm": 13, "digest_type": 2, "digest": "11A0182F7A3D8DAC2768F21E57B362D821D4417BC42BEF19C8295D9278006D16", "ttl": 60 } ]
+	} } }`)
+	require.Nil(t, err)
+	ds = zone.Labels["sub"].FirstRR(dns.TypeDS).(*dns.DS)
+	assert.Equal(t, uint16(18795), ds.KeyTag)
+	assert.Equal(t, dns.ECDSAP256SHA256, ds.Algorithm)
+	assert.Equal(t, dns.SHA256, ds.DigestType)
+	assert.Equal(t, uint32(60), ds.Hdr.Ttl)
+
+	for _, x := range []struct{ ds, err string }{
+		{`"18795 13 2 11A0182F"`, "digest of 8 hex digits, expected 64"},
+		{`"18795 13 9 11A0182F"`, "unknown digest type 9"},
+		{`"18795 99 2 11A0182F7A3D8DAC2768F21E57B362D821D4417BC42BEF19C8295D9278006D16"`, "unknown algorithm 99"},
+		{`{ "key_tag": 18795, "algorithm": 13, "digest_type": 1, "digest": "11A0182F7A3D8DAC2768F21E57B362D821D4417BC42BEF19C8295D9278006D16" }`, "expected 40"},
+		{`"18795 13 2 not-hex"`, "bad DS record"},
+	} {
+		_, err = readTestZone(t, "example.net", `{ "data": { "sub": { "ns": [ "ns1.example.org." ], "ds": [ `+x.ds+` ] } } }`)
+		if assert.Error(t, err, x.ds) {
+			assert.Contains(t, err.Error(), x.err, x.ds)
+		}
+	}
+
+	_, err = readTestZone(t, "example.net", `{ "data": { "": { "dnskey": [ "257 three 13 AAAA" ] } } }`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "bad DNSKEY record")
+	}
+
+	zone, err = readTestZone(t, "example.net", `{ "data": { "": { "ns": [ "ns1.example.net." ] } } }`)
+	require.Nil(t, err)
+	assert.False(t, zone.Signed())
+}
+
+func TestDenialNSEC3(t *testing.T) {
+	hash := func(name string) string {
+		return dns.HashName(name, dns.SHA1, 0, "")
+	}
+
+	hashes := []string{hash("example.net."), hash("www.example.net.")}
+	sort.Strings(hashes)
+	var labels []string
+	for i, h := range hashes {
+		next := hashes[(i+1)%len(hashes)]
+		labels = append(labels, fmt.Sprintf(`"%s": { "nsec3": [ "1 0 0 - %s A RRSIG" ] }`, strings.ToLower(h), next))
+	}
+	zone, err := readTestZone(t, "example.net", `{ "data": {
+		"": { "ns": [ "ns1.example.net." ] },
+		"www": { "a": [ [ "192.0.2.1" ] ] },
+		`+strings.Join(labels, ",\n")+` } }`)
+	require.Nil(t, err)
+
+	nsec3 := func(rrs []dns.RR) []*dns.NSEC3 {
+		var r []*dns.NSEC3
+		for _, rr := range rrs {
+			if n, ok := rr.(*dns.NSEC3); ok {
+				r = append(r, n)
+			}
+		}
+		return r
+	}
+
+	nodata := nsec3(zone.Denial("www", false))
+	require.Len(t, nodata, 1)
+	assert.True(t, nodata[0].Match("www.example.net."))
+
+	nxdomain := nsec3(zone.Denial("foo", true))
+	require.NotEmpty(t, nxdomain)
+	var match bool
+	covered := map[string]bool{}
+	for _, n := range nxdomain {
+		match = match || n.Match("example.net.")
+		for _, name := range []string{"foo.example.net.", "*.example.net."} {
+			covered[name] = covered[name] || n.Cover(name)
+		}
+	}
+	assert.True(t, match, "closest encloser proof")
+	assert.True(t, covered["foo.example.net."], "next closer name covered")
+	assert.True(t, covered["*.example.net."], "wildcard covered")
+}
@@ -0,0 +1,179 @@
+package zones
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/abh/geodns/applog"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var flattenFailures *prometheus.CounterVec
+
+func init() {
+	flattenFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "geodns_flatten_failures_total",
+			Help: "Number of failed lookups of flattened CNAME targets",
+		},
+		[]string{"target"},
+	)
+	prometheus.MustRegister(flattenFailures)
+}
+
+// FlattenResolver is the recursive resolver used to look up the
+// targets of flattened CNAMEs.
+var FlattenResolver = defaultFlattenResolver()
+
+func defaultFlattenResolver() string {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil || len(conf.Servers) == 0 {
+		return "127.0.0.1:53"
+	}
+	return conf.Servers[0] + ":" + conf.Port
+}
+
+const (
+	flattenMinTtl = 30 * time.Second
+	flattenMaxTtl = time.Hour
+)
+
+// Flattener answers A and AAAA queries for a label with a CNAME (like
+// the zone apex, where a CNAME isn't allowed) with the addresses of
+// the CNAME target. The addresses are looked up in the background and
+// refreshed when their TTL expires; after a failed lookup the last
+// addresses are kept.
+type Flattener struct {
+	target string
+
+	mu      sync.RWMutex
+	records map[uint16][]dns.RR
+
+	once sync.Once
+	quit chan struct{}
+}
+
+func newFlattener(target string) *Flattener {
+	return &Flattener{
+		target:  target,
+		records: map[uint16][]dns.RR{},
+		quit:    make(chan struct{}),
+	}
+}
+
+// Start looks up the target and keeps refreshing it until Close.
+func (f *Flattener) Start() {
+	f.once.Do(func() {
+		go f.run()
+	})
+}
+
+// Close stops refreshing the target. A lookup in progress isn't waited
+// for, so a reload isn't held up by a slow resolver.
+func (f *Flattener) Close() {
+	select {
+	case <-f.quit:
+	default:
+		close(f.quit)
+	}
+}
+
+// keep answers with the last records of old, the flattener of the
+// label before a reload, until the target has been looked up again.
+func (f *Flattener) keep(old *Flattener) {
+	if old.target != f.target {
+		return
+	}
+	old.mu.RLock()
+	defer old.mu.RUnlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for qtype, rrs := range old.records {
+		if _, ok := f.records[qtype]; !ok {
+			f.records[qtype] = rrs
+		}
+	}
+}
+
+// Records returns the addresses of the target for qtype (A or AAAA)
+// renamed to name. It returns false if the target hasn't been looked
+// up successfully yet.
+func (f *Flattener) Records(qtype uint16, name string) ([]dns.RR, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	records, ok := f.records[qtype]
+	if !ok {
+		return nil, false
+	}
+	rrs := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		rrs = append(rrs, rr)
+	}
+	return rrs, true
+}
+
+func (f *Flattener) run() {
+	for {
+		wait := flattenMaxTtl
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			ttl, err := f.lookup(qtype)
+			if err != nil {
+				applog.Warnf("flatten %s %s: %s", f.target, dns.TypeToString[qtype], err)
+				flattenFailures.WithLabelValues(f.target).Inc()
+				ttl = flattenMinTtl
+			}
+			if ttl < wait {
+				wait = ttl
+			}
+		}
+
+		select {
+		case <-f.quit:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// lookup resolves the target and stores the answers; it returns
+// how long they can be cached.
+func (f *Flattener) lookup(qtype uint16) (time.Duration, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(f.target, qtype)
+
+	c := &dns.Client{Timeout: 5 * time.Second}
+	r, _, err := c.Exchange(msg, FlattenResolver)
+	if err != nil {
+		return 0, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("lookup failed with %s", dns.RcodeToString[r.Rcode])
+	}
+
+	ttl := flattenMaxTtl
+	var rrs []dns.RR
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype != qtype {
+			// the CNAME chain to the addresses
+			continue
+		}
+		if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+			ttl = t
+		}
+		rrs = append(rrs, rr)
+	}
+	if ttl < flattenMinTtl {
+		ttl = flattenMinTtl
+	}
+
+	f.mu.Lock()
+	f.records[qtype] = rrs
+	f.mu.Unlock()
+
+	return ttl, nil
+}
@@ -0,0 +1,127 @@
+package zones
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestResolver answers A queries for cdn.example.net with a
+// CNAME to edge.example.net and its address, and SERVFAIL for
+// anything else.
+func startTestResolver(t *testing.T) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		switch {
+		case q.Name != "cdn.example.net.":
+			m.Rcode = dns.RcodeServerFailure
+		case q.Qtype == dns.TypeA:
+			cname, _ := dns.NewRR("cdn.example.net. 300 IN CNAME edge.example.net.")
+			a, _ := dns.NewRR("edge.example.net. 60 IN A 192.0.2.80")
+			m.Answer = []dns.RR{cname, a}
+		}
+		w.WriteMsg(m)
+	})
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go srv.ActivateAndServe()
+
+	return pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+func TestFlatten(t *testing.T) {
+	addr, stop := startTestResolver(t)
+	defer stop()
+
+	resolver := FlattenResolver
+	FlattenResolver = addr
+	defer func() { FlattenResolver = resolver }()
+
+	zone, err := readTestZone(t, "example.com", `{
+		"data": {
+			"": { "ns": [ "ns1.example.com." ], "cname": "cdn.example.net.", "flatten": true },
+			"broken": { "cname": "broken.example.net.", "flatten": true }
+		}
+	}`)
+	require.Nil(t, err)
+
+	label := zone.Labels[""]
+	require.NotNil(t, label.Flatten)
+
+	_, ok := label.Flatten.Records(dns.TypeA, "example.com.")
+	assert.False(t, ok, "no records before the lookup")
+
+	zone.startFlatten(nil)
+	defer zone.closeFlatten()
+
+	var rrs []dns.RR
+	for i := 0; i < 50 && !ok; i++ {
+		time.Sleep(10 * time.Millisecond)
+		rrs, ok = label.Flatten.Records(dns.TypeA, "example.com.")
+	}
+	require.True(t, ok, "target was looked up")
+	if assert.Len(t, rrs, 1) {
+		a := rrs[0].(*dns.A)
+		assert.Equal(t, "example.com.", a.Hdr.Name)
+		assert.Equal(t, "192.0.2.80", a.A.String())
+		assert.Equal(t, uint32(60), a.Hdr.Ttl)
+	}
+
+	// the target has no AAAA records
+	rrs, ok = label.Flatten.Records(dns.TypeAAAA, "example.com.")
+	assert.True(t, ok)
+	assert.Len(t, rrs, 0)
+
+	// failed lookups are counted
+	var m dto.Metric
+	failures := flattenFailures.WithLabelValues("broken.example.net.")
+	for i := 0; i < 50; i++ {
+		require.Nil(t, failures.Write(&m))
+		if m.GetCounter().GetValue() > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, m.GetCounter().GetValue() > 0, "failed lookup counted")
+	_, ok = zone.Labels["broken"].Flatten.Records(dns.TypeA, "broken.example.com.")
+	assert.False(t, ok)
+
+	// a reloaded zone has the addresses until it looks them up again,
+	// from a resolver that doesn't answer
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer silent.Close()
+	FlattenResolver = silent.LocalAddr().String()
+
+	reloaded, err := readTestZone(t, "example.com", `{
+		"data": { "": { "ns": [ "ns1.example.com." ], "cname": "cdn.example.net.", "flatten": true } }
+	}`)
+	require.Nil(t, err)
+	reloaded.startFlatten(zone)
+	rrs, ok = reloaded.Labels[""].Flatten.Records(dns.TypeA, "example.com.")
+	assert.True(t, ok, "records kept on reload")
+	if assert.Len(t, rrs, 1) {
+		assert.Equal(t, "192.0.2.80", rrs[0].(*dns.A).A.String())
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	reloaded.closeFlatten()
+	assert.True(t, time.Since(start) < time.Second, "Close doesn't wait for the lookup")
+
+	_, err = readTestZone(t, "example.com", `{
+		"data": { "": { "ns": [ "ns1.example.com." ], "flatten": true } }
+	}`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no cname")
+	}
+}
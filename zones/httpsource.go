@@ -0,0 +1,124 @@
+package zones
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// httpSource polls a URL for a bundle of zones, a JSON object with the
+// zone names as keys and the zones in the zone file format as values:
+//
+//	{ "example.com": { "serial": 3, "data": { ... } }, ... }
+//
+// The ETag and Last-Modified headers of the answer are sent back with
+// If-None-Match and If-Modified-Since, so an unchanged bundle isn't
+// downloaded and read again.
+type httpSource struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+
+	mu           sync.Mutex
+	etag         string
+	lastModified string
+	zones        []SourceZone
+}
+
+// NewHTTPSource returns a source for the bundle of zones at url,
+// checked for changes every interval.
+func NewHTTPSource(url string, interval time.Duration) ZoneSource {
+	return &httpSource{
+		url:      url,
+		interval: interval,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *httpSource) Zones() ([]SourceZone, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.etag) > 0 {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	if len(s.lastModified) > 0 {
+		req.Header.Set("If-Modified-Since", s.lastModified)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch '%s': %s", s.url, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return s.zones, nil
+	default:
+		return nil, fmt.Errorf("could not fetch '%s': %s", s.url, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch '%s': %s", s.url, err)
+	}
+	var bundle map[string]json.RawMessage
+	if err := json.Unmarshal(body, &bundle); err != nil {
+		return nil, fmt.Errorf("could not parse the zones in '%s': %s", s.url, err)
+	}
+
+	// The zones are (re)read if their data changed since the last
+	// fetch. The serial defaults to the Last-Modified time of the
+	// bundle, like the modification time of a zone file.
+	fetched := time.Now()
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		modTime = fetched
+	}
+
+	list := make([]SourceZone, 0, len(bundle))
+	for name, data := range bundle {
+		if len(name) == 0 || name == "pgeodns" {
+			return nil, fmt.Errorf("invalid zone name '%s' in '%s'", name, s.url)
+		}
+		data := data
+		hash := sha256.Sum256(data)
+		list = append(list, SourceZone{
+			Name:     name,
+			ModTime:  fetched,
+			Location: s.url + "#" + name,
+			Hash:     func() string { return hex.EncodeToString(hash[:]) },
+			Read: func(zone *Zone) error {
+				zone.FileName = s.url
+				zone.ModTime = modTime
+				zone.Options.Serial = int(modTime.Unix())
+				return zone.ReadZone(data, s.url)
+			},
+		})
+	}
+
+	s.etag = resp.Header.Get("ETag")
+	s.lastModified = resp.Header.Get("Last-Modified")
+	s.zones = list
+
+	return list, nil
+}
+
+func (s *httpSource) Interval() time.Duration {
+	return s.interval
+}
+
+func (s *httpSource) String() string {
+	return s.url
+}
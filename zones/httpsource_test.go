@@ -0,0 +1,110 @@
+package zones
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPSource(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		bundle   string
+		etag     string
+		fail     bool
+		modified int
+	)
+	lastModified := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		modified++
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.Write([]byte(bundle))
+	}))
+	defer srv.Close()
+
+	set := func(tag, data string) {
+		mu.Lock()
+		defer mu.Unlock()
+		etag, bundle = tag, data
+	}
+
+	set(`"1"`, `{
+		"example.com": { "data": {
+			"": { "ns": { "ns1.example.net.": null } },
+			"www": { "a": [ [ "192.0.2.1" ] ] }
+		} },
+		"example.net": { "serial": 7, "data": {
+			"": { "ns": { "ns1.example.net.": null } }
+		} }
+	}`)
+
+	mm, err := NewMuxManagerSource(NewHTTPSource(srv.URL, time.Minute), &NilReg{})
+	require.Nil(t, err)
+	assert.Equal(t, 2, mm.ZoneCount())
+	zone := mm.Zones()["example.com"]
+	require.NotNil(t, zone)
+	assert.Equal(t, int(lastModified.Unix()), zone.Options.Serial, "serial from Last-Modified")
+	assert.Equal(t, "192.0.2.1", zone.Labels["www"].Records[dns.TypeA][0].RR.(*dns.A).A.String())
+	assert.Equal(t, 7, mm.Zones()["example.net"].Options.Serial)
+
+	// unchanged, the server answers 304
+	summary, err := mm.Reload()
+	require.Nil(t, err)
+	assert.Empty(t, summary.Added)
+	assert.Empty(t, summary.Changed)
+	assert.Empty(t, summary.Removed)
+	assert.Equal(t, 1, modified, "the bundle was only sent once")
+
+	// failing to fetch keeps the zones
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	_, err = mm.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, 2, mm.ZoneCount())
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+
+	// an invalid bundle too
+	set(`"2"`, `{ "example.com": `)
+	_, err = mm.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, 2, mm.ZoneCount())
+	assert.Equal(t, zone, mm.Zones()["example.com"])
+
+	// one zone changed, one removed, one broken
+	set(`"3"`, `{
+		"example.com": { "data": {
+			"": { "ns": { "ns1.example.net.": null } },
+			"www": { "a": [ [ "192.0.2.2" ] ] }
+		} },
+		"example.org": { "data": { "www": 1 } }
+	}`)
+	summary, err = mm.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, []string{"example.com"}, summary.Changed)
+	assert.Equal(t, []string{"example.net"}, summary.Removed)
+	assert.Contains(t, summary.Failed, "example.org")
+	zone = mm.Zones()["example.com"]
+	require.NotNil(t, zone)
+	assert.Equal(t, "192.0.2.2", zone.Labels["www"].Records[dns.TypeA][0].RR.(*dns.A).A.String())
+}
@@ -0,0 +1,116 @@
+package zones
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resolveIncludes merges the snippet files in the "include" option of
+// the zone object from the file name into it. A snippet has the zone
+// file format and can include other snippets; its path is relative to
+// the file that includes it. The zone's own options, labels and
+// record types take precedence over the snippets', and later snippets
+// over earlier ones, so the result is what the zone would be with the
+// snippets inlined. chain is the files including this one, to reject
+// circular includes.
+func (zone *Zone) resolveIncludes(objmap map[string]interface{}, name string, chain []string) (map[string]interface{}, error) {
+	v, ok := objmap["include"]
+	if !ok {
+		return objmap, nil
+	}
+	delete(objmap, "include")
+
+	var files []string
+	switch v := v.(type) {
+	case string:
+		files = []string{v}
+	case []interface{}:
+		for _, f := range v {
+			s, ok := f.(string)
+			if !ok {
+				return nil, fmt.Errorf("include must be a file name or a list of file names")
+			}
+			files = append(files, s)
+		}
+	default:
+		return nil, fmt.Errorf("include must be a file name or a list of file names")
+	}
+	if strings.Contains(name, "://") {
+		return nil, fmt.Errorf("include is only supported in zone files, not in '%s'", name)
+	}
+
+	chain = append(chain, filepath.Clean(name))
+	merged := map[string]interface{}{}
+	for _, f := range files {
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(filepath.Dir(name), f)
+		}
+		f = filepath.Clean(f)
+		for _, c := range chain {
+			if c == f {
+				return nil, fmt.Errorf("circular include of '%s' in '%s'", f, name)
+			}
+		}
+
+		buf, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not read include '%s': %s", f, err)
+		}
+		snippet, err := parseZone(buf, f)
+		if err != nil {
+			return nil, err
+		}
+		if snippet, err = zone.resolveIncludes(snippet, f, chain); err != nil {
+			return nil, err
+		}
+		mergeZoneJSON(merged, snippet)
+		zone.addInclude(f)
+	}
+	mergeZoneJSON(merged, objmap)
+	return merged, nil
+}
+
+// addInclude records an included file; a snippet newer than the zone
+// file makes the zone newer, for the default serial.
+func (zone *Zone) addInclude(f string) {
+	for _, inc := range zone.Includes {
+		if inc == f {
+			return
+		}
+	}
+	zone.Includes = append(zone.Includes, f)
+	if len(zone.FileName) == 0 {
+		return
+	}
+	if fi, err := os.Stat(f); err == nil && fi.ModTime().After(zone.ModTime) {
+		zone.ModTime = fi.ModTime()
+		zone.Options.Serial = int(zone.ModTime.Unix())
+	}
+}
+
+// mergeZoneJSON merges the zone object src into dst. The labels in
+// "data" are merged by record type, anything else in src replaces dst.
+func mergeZoneJSON(dst, src map[string]interface{}) {
+	for k, v := range src {
+		data, ok := v.(map[string]interface{})
+		dstData, dstOk := dst[k].(map[string]interface{})
+		if k != "data" || !ok || !dstOk {
+			dst[k] = v
+			continue
+		}
+		for label, lv := range data {
+			records, ok := lv.(map[string]interface{})
+			dstRecords, dstOk := dstData[label].(map[string]interface{})
+			if !ok || !dstOk {
+				dstData[label] = lv
+				continue
+			}
+			for rtype, rv := range records {
+				dstRecords[rtype] = rv
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package zones
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geodns-include.")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, data string) string {
+		fn := filepath.Join(dir, name)
+		require.Nil(t, os.MkdirAll(filepath.Dir(fn), 0755))
+		require.Nil(t, ioutil.WriteFile(fn, []byte(data), 0644))
+		return fn
+	}
+
+	write("shared/ns.json", `{
+		"ttl": 300,
+		"data": {
+			"": {
+				"ns": [ "ns1.example.net.", "ns2.example.net." ],
+				"txt": "shared"
+			}
+		}
+	}`)
+	fn := write("example.com.json", `{
+		"include": "shared/ns.json",
+		"serial": 3,
+		"data": {
+			"": { "txt": "example.com" },
+			"www": { "a": [ [ "192.0.2.1" ] ] }
+		}
+	}`)
+
+	zone := NewZone("example.com")
+	require.Nil(t, zone.ReadZoneFile(fn))
+	assert.Equal(t, []string{filepath.Join(dir, "shared/ns.json")}, zone.Includes)
+
+	inlined, err := readTestZone(t, "example.com", `{
+		"ttl": 300,
+		"serial": 3,
+		"data": {
+			"": {
+				"ns": [ "ns1.example.net.", "ns2.example.net." ],
+				"txt": "example.com"
+			},
+			"www": { "a": [ [ "192.0.2.1" ] ] }
+		}
+	}`)
+	require.Nil(t, err)
+	assert.Equal(t, inlined.Options, zone.Options)
+	assert.Equal(t, inlined.Labels, zone.Labels)
+	assert.Len(t, zone.Labels[""].Records[dns.TypeNS], 2)
+
+	// circular includes are an error
+	write("shared/a.json", `{ "include": "b.json" }`)
+	write("shared/b.json", `{ "include": "a.json" }`)
+	fn = write("example.org.json", `{
+		"include": [ "shared/ns.json", "shared/a.json" ],
+		"data": { "": { "ns": [ "ns1.example.net." ] } }
+	}`)
+	err = NewZone("example.org").ReadZoneFile(fn)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "circular include")
+
+	// the same snippet can be included twice
+	write("shared/twice.json", `{ "include": [ "ns.json", "ns.json" ] }`)
+	fn = write("example.net.json", `{ "include": "shared/twice.json" }`)
+	assert.Nil(t, NewZone("example.net").ReadZoneFile(fn))
+}
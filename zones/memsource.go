@@ -0,0 +1,91 @@
+package zones
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// MemorySource is a ZoneSource for programs embedding GeoDNS that
+// supply the zones themselves, in the zone file format, without
+// writing them to files:
+//
+//	source := zones.NewMemorySource()
+//	source.Set("example.com", data)
+//	mm, err := zones.NewMuxManagerSource(source, srv)
+//
+// Changes are loaded by MuxManager.Run within a second, or right away
+// by calling MuxManager.Reload. Like with zone files, each zone is
+// swapped in only once it's read successfully; a zone that fails to
+// load keeps the previous version.
+type MemorySource struct {
+	mu    sync.Mutex
+	zones map[string]memoryZone
+}
+
+type memoryZone struct {
+	data    []byte
+	hash    string
+	modTime time.Time
+}
+
+// NewMemorySource returns a source without any zones.
+func NewMemorySource() *MemorySource {
+	return &MemorySource{zones: make(map[string]memoryZone)}
+}
+
+// Set adds or replaces the zone name with data, a zone in the zone
+// file format (without includes). The data is copied.
+func (s *MemorySource) Set(name string, data []byte) {
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	hash := sha256.Sum256(buf)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.zones[name] = memoryZone{
+		data:    buf,
+		hash:    hex.EncodeToString(hash[:]),
+		modTime: time.Now(),
+	}
+}
+
+// Remove removes the zone name.
+func (s *MemorySource) Remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.zones, name)
+}
+
+func (s *MemorySource) Zones() ([]SourceZone, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]SourceZone, 0, len(s.zones))
+	for name, mz := range s.zones {
+		name, mz := name, mz
+		location := "memory://" + name
+		list = append(list, SourceZone{
+			Name:     name,
+			ModTime:  mz.modTime,
+			Location: location,
+			Hash:     func() string { return mz.hash },
+			Read: func(zone *Zone) error {
+				zone.FileName = location
+				zone.ModTime = mz.modTime
+				zone.Options.Serial = int(mz.modTime.Unix())
+				return zone.ReadZone(mz.data, location)
+			},
+		})
+	}
+	return list, nil
+}
+
+func (s *MemorySource) Interval() time.Duration {
+	return time.Second
+}
+
+func (s *MemorySource) String() string {
+	return "memory"
+}
@@ -0,0 +1,63 @@
+package zones
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingReg records the zones registered with it.
+type recordingReg map[string]*Zone
+
+func (r recordingReg) Add(name string, zone *Zone) { r[name] = zone }
+func (r recordingReg) Remove(name string)          { delete(r, name) }
+
+func TestMemorySource(t *testing.T) {
+	source := NewMemorySource()
+	source.Set("example.com", []byte(`{ "data": {
+		"": { "ns": [ "ns1.example.net." ] },
+		"www": { "a": [ [ "192.0.2.1" ] ] }
+	} }`))
+	source.Set("example.net", []byte(`{ "data": { "": { "ns": [ "ns1.example.net." ] } } }`))
+
+	reg := recordingReg{}
+	mm, err := NewMuxManagerSource(source, reg)
+	require.Nil(t, err)
+	assert.Equal(t, 2, mm.ZoneCount())
+	require.Contains(t, reg, "example.com")
+	assert.Equal(t, "192.0.2.1", reg["example.com"].Labels["www"].Records[dns.TypeA][0].RR.(*dns.A).A.String())
+
+	// unchanged zones aren't read again
+	summary, err := mm.Reload()
+	require.Nil(t, err)
+	assert.Empty(t, summary.Changed)
+
+	data := []byte(`{ "data": {
+		"": { "ns": [ "ns1.example.net." ] },
+		"www": { "a": [ [ "192.0.2.2" ] ] }
+	} }`)
+	source.Set("example.com", data)
+	data[0] = 'x' // Set keeps a copy
+	summary, err = mm.Reload()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"example.com"}, summary.Changed)
+	assert.Equal(t, "192.0.2.2", reg["example.com"].Labels["www"].Records[dns.TypeA][0].RR.(*dns.A).A.String())
+
+	// a broken zone keeps the loaded version, and includes don't work
+	zone := reg["example.com"]
+	source.Set("example.com", []byte(`{ "data": `))
+	source.Set("example.net", []byte(`{ "include": "ns.json" }`))
+	summary, err = mm.Reload()
+	assert.Error(t, err)
+	assert.Contains(t, summary.Failed, "example.com")
+	assert.Contains(t, summary.Failed, "example.net")
+	assert.Equal(t, zone, reg["example.com"])
+
+	source.Remove("example.net")
+	summary, err = mm.Reload()
+	require.Nil(t, err, "the broken example.com is unchanged")
+	assert.Equal(t, []string{"example.net"}, summary.Removed)
+	assert.NotContains(t, reg, "example.net")
+}
@@ -0,0 +1,78 @@
+package zones
+
+import (
+	"fmt"
+
+	"github.com/abh/geodns/health"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var healthFailOpen = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "geodns_health_fail_open_total",
+		Help: "Number of answers with all the records of a label because too few of them were healthy",
+	},
+	[]string{"zone"},
+)
+
+func init() {
+	prometheus.MustRegister(healthFailOpen)
+}
+
+// HealthPolicy is how a label with health checks answers when fewer
+// of its records than its minimum are healthy.
+type HealthPolicy int
+
+const (
+	// HealthFailOpen answers with all the records, healthy or not
+	HealthFailOpen HealthPolicy = iota
+	// HealthServfail answers with SERVFAIL
+	HealthServfail
+)
+
+// ParseHealthPolicy parses the below_min_healthy label option.
+func ParseHealthPolicy(s string) (HealthPolicy, error) {
+	switch s {
+	case "fail_open", "":
+		return HealthFailOpen, nil
+	case "servfail":
+		return HealthServfail, nil
+	}
+	return HealthFailOpen, fmt.Errorf("unknown below_min_healthy policy '%s', expected fail_open or servfail", s)
+}
+
+// minHealthy returns how many of the records must be healthy: the
+// min_healthy option of the label (default 1), up to all of them.
+func (label *Label) minHealthy(records Records) int {
+	min := label.MinHealthy
+	if min < 1 {
+		min = 1
+	}
+	if min > len(records) {
+		min = len(records)
+	}
+	return min
+}
+
+// belowMinHealthy returns true if fewer of the records of qtype in
+// label than its minimum are healthy.
+func (label *Label) belowMinHealthy(qtype uint16) bool {
+	if label.Test == nil && label.Check == nil {
+		return false
+	}
+	records := label.Records[qtype]
+	healthy := 0
+	for _, r := range records {
+		if len(r.Test) == 0 || label.healthStatus(r.Test) == health.StatusHealthy {
+			healthy++
+		}
+	}
+	return healthy < label.minHealthy(records)
+}
+
+// HealthFailed returns true if the query for qtype in label should be
+// answered with SERVFAIL, as too few of its records are healthy and
+// the label doesn't fail open.
+func (zone *Zone) HealthFailed(label *Label, qtype uint16) bool {
+	return label.BelowMinHealthy == HealthServfail && label.belowMinHealthy(qtype)
+}
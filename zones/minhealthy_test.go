@@ -0,0 +1,86 @@
+package zones
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/abh/geodns/health"
+	"github.com/miekg/dns"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMinHealthy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// only 127.0.0.1 answers the checks
+	check := `"health": { "check": "tcp", "port": ` + port + `, "jitter": 0 }`
+	zone, err := readTestZone(t, "example.net", `{
+		"data": {
+			"www": {
+				"a": [ [ "127.0.0.1", 10 ], [ "127.0.0.2", 10 ] ],
+				`+check+`
+			},
+			"open": {
+				"a": [ [ "127.0.0.1", 10 ], [ "127.0.0.2", 10 ] ],
+				"min_healthy": 2,
+				`+check+`
+			},
+			"fail": {
+				"a": [ [ "127.0.0.1", 10 ], [ "127.0.0.2", 10 ] ],
+				"min_healthy": 2,
+				"below_min_healthy": "servfail",
+				`+check+`
+			}
+		}
+	}`)
+	require.Nil(t, err)
+	zone.setupHealthTests()
+	defer zone.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for _, name := range []string{"www", "open", "fail"} {
+		label := zone.Labels[name]
+		for label.Check.GetStatus("127.0.0.1") != health.StatusHealthy ||
+			label.Check.GetStatus("127.0.0.2") != health.StatusUnhealthy {
+			if time.Now().After(deadline) {
+				t.Fatalf("health checks of '%s' didn't finish", label.Label)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	var m dto.Metric
+	require.Nil(t, healthFailOpen.WithLabelValues("example.net").Write(&m))
+	failOpen := m.GetCounter().GetValue()
+
+	// one healthy record is enough by default
+	www := zone.Labels["www"]
+	assert.False(t, zone.HealthFailed(www, dns.TypeA))
+	records := zone.Picker(www, dns.TypeA, 2, nil)
+	require.Len(t, records, 1)
+	assert.Equal(t, "127.0.0.1", records[0].RR.(*dns.A).A.String())
+
+	// below the minimum the label fails open
+	open := zone.Labels["open"]
+	assert.False(t, zone.HealthFailed(open, dns.TypeA))
+	assert.Len(t, zone.Picker(open, dns.TypeA, 2, nil), 2)
+	require.Nil(t, healthFailOpen.WithLabelValues("example.net").Write(&m))
+	assert.Equal(t, failOpen+1, m.GetCounter().GetValue())
+
+	// or is answered with SERVFAIL
+	fail := zone.Labels["fail"]
+	assert.True(t, zone.HealthFailed(fail, dns.TypeA))
+	assert.Len(t, zone.Picker(fail, dns.TypeA, 2, nil), 1)
+	assert.False(t, zone.HealthFailed(fail, dns.TypeAAAA), "no records of the type")
+
+	_, err = readTestZone(t, "example.net", `{
+		"data": { "www": { "a": [ [ "192.0.2.1" ] ], "below_min_healthy": "drop" } }
+	}`)
+	assert.Error(t, err)
+}
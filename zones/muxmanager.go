@@ -5,14 +5,27 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"path"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/abh/geodns/applog"
+	"github.com/fsnotify/fsnotify"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+var reloadErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "geodns_zone_reload_errors_total",
+		Help: "Number of times a zone file failed to load",
+	},
+	[]string{"zone"},
+)
+
+func init() {
+	prometheus.MustRegister(reloadErrors)
+}
+
 type RegistrationAPI interface {
 	Add(string, *Zone)
 	Remove(string)
@@ -21,8 +34,22 @@ type RegistrationAPI interface {
 type MuxManager struct {
 	reg      RegistrationAPI
 	zonelist ZoneList
-	path     string
+	source   ZoneSource
 	lastRead map[string]*zoneReadRecord
+	mu       sync.RWMutex
+
+	// reloadMu serializes reloads from Run and Reload
+	reloadMu sync.Mutex
+}
+
+// ReloadSummary lists the zones that were added, changed, removed or
+// failed to load in a reload. Zones that failed keep the previously
+// loaded version, if any.
+type ReloadSummary struct {
+	Added   []string          `json:"added"`
+	Changed []string          `json:"changed"`
+	Removed []string          `json:"removed"`
+	Failed  map[string]string `json:"failed"`
 }
 
 type NilReg struct{}
@@ -36,10 +63,16 @@ type zoneReadRecord struct {
 	hash string
 }
 
+// NewMuxManager loads the zone files in the directory path.
 func NewMuxManager(path string, reg RegistrationAPI) (*MuxManager, error) {
+	return NewMuxManagerSource(NewDirSource(path), reg)
+}
+
+// NewMuxManagerSource loads the zones from source.
+func NewMuxManagerSource(source ZoneSource, reg RegistrationAPI) (*MuxManager, error) {
 	mm := &MuxManager{
 		reg:      reg,
-		path:     path,
+		source:   source,
 		zonelist: make(ZoneList),
 		lastRead: map[string]*zoneReadRecord{},
 	}
@@ -52,60 +85,129 @@ func NewMuxManager(path string, reg RegistrationAPI) (*MuxManager, error) {
 	return mm, err
 }
 
+// Run reloads the zones when they change in the source. A zone
+// directory is watched with fsnotify and polled every two seconds in
+// case the notifications aren't available or get lost; other sources
+// are polled on their interval.
 func (mm *MuxManager) Run() {
+	var events chan fsnotify.Event
+	var watchErrors chan error
+
+	if dir, ok := mm.source.(*dirSource); ok {
+		watcher, err := fsnotify.NewWatcher()
+		if err == nil {
+			err = watcher.Add(dir.path)
+		}
+		if err != nil {
+			applog.Warnf("could not watch '%s' for changes, polling only: %s", dir.path, err)
+		} else {
+			defer watcher.Close()
+			events = watcher.Events
+			watchErrors = watcher.Errors
+		}
+	}
+
+	ticker := time.NewTicker(mm.source.Interval())
+	defer ticker.Stop()
+
 	for {
 		err := mm.reload()
 		if err != nil {
-			log.Printf("error reading zones: %s", err)
+			applog.Errorf("error reading zones: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-events:
+			// wait for the writes to settle and skip the
+			// events for them
+			settle := time.After(200 * time.Millisecond)
+		drain:
+			for {
+				select {
+				case <-events:
+				case <-settle:
+					break drain
+				}
+			}
+		case err := <-watchErrors:
+			applog.Errorf("fsnotify error watching '%s': %s", mm.source, err)
 		}
-		time.Sleep(2 * time.Second)
 	}
 }
 
-// GetZones returns the list of currently active zones in the mux manager.
-// (todo: rename to Zones() when the Zones struct has been renamed to ZoneList)
+// Zones returns a copy of the list of currently active zones in the
+// mux manager.
 func (mm *MuxManager) Zones() ZoneList {
-	return mm.zonelist
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	zl := make(ZoneList, len(mm.zonelist))
+	for name, zone := range mm.zonelist {
+		zl[name] = zone
+	}
+	return zl
+}
+
+// ZoneCount returns the number of zones loaded from the source (not
+// counting the built-in pgeodns zone).
+func (mm *MuxManager) ZoneCount() int {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	n := len(mm.zonelist)
+	if _, ok := mm.zonelist["pgeodns"]; ok {
+		n--
+	}
+	return n
+}
+
+// Reload reads the zone source and loads the new and changed zones,
+// like Run does when they change.
+func (mm *MuxManager) Reload() (*ReloadSummary, error) {
+	mm.reloadMu.Lock()
+	defer mm.reloadMu.Unlock()
+
+	summary := &ReloadSummary{
+		Added:   []string{},
+		Changed: []string{},
+		Removed: []string{},
+		Failed:  map[string]string{},
+	}
+	err := mm.reloadZones(summary)
+	return summary, err
 }
 
 func (mm *MuxManager) reload() error {
-	dir, err := ioutil.ReadDir(mm.path)
+	_, err := mm.Reload()
+	return err
+}
+
+func (mm *MuxManager) reloadZones(summary *ReloadSummary) error {
+	list, err := mm.source.Zones()
 	if err != nil {
-		return fmt.Errorf("could not read '%s': %s", mm.path, err)
+		return err
 	}
 
 	seenZones := map[string]bool{}
 
-	var parseErr error
-
-	for _, file := range dir {
-		fileName := file.Name()
-		if !strings.HasSuffix(strings.ToLower(fileName), ".json") ||
-			strings.HasPrefix(path.Base(fileName), ".") ||
-			file.IsDir() {
-			continue
-		}
-
-		zoneName := fileName[0:strings.LastIndex(fileName, ".")]
+	for _, sz := range list {
+		zoneName := sz.Name
 
 		seenZones[zoneName] = true
 
-		if _, ok := mm.lastRead[zoneName]; !ok || file.ModTime().After(mm.lastRead[zoneName].time) {
-			modTime := file.ModTime()
+		if _, ok := mm.lastRead[zoneName]; !ok || sz.ModTime.After(mm.lastRead[zoneName].time) {
+			modTime := sz.ModTime
 			if ok {
-				log.Printf("Reloading %s\n", fileName)
+				applog.Infof("Reloading %s", sz.Location)
 				mm.lastRead[zoneName].time = modTime
 			} else {
-				log.Printf("Reading new file %s\n", fileName)
+				applog.Infof("Reading new zone %s", sz.Location)
 				mm.lastRead[zoneName] = &zoneReadRecord{time: modTime}
 			}
 
-			filename := path.Join(mm.path, fileName)
-
-			// Check the sha256 of the file has not changed. It's worth an explanation of
-			// why there isn't a TOCTOU race here. Conceivably after checking whether the
-			// SHA has changed, the contents then change again before we actually load
-			// the JSON. This can occur in two situations:
+			// Check the sha256 of the zone has not changed. It's worth an explanation of
+			// why there isn't a TOCTOU race here for zone files. Conceivably after checking
+			// whether the SHA has changed, the contents then change again before we actually
+			// load the JSON. This can occur in two situations:
 			//
 			// 1. The SHA has not changed when we read the file for the SHA, but then
 			//    changes before we process the JSON
@@ -123,21 +225,28 @@ func (mm *MuxManager) reload() error {
 			// Provided files are replaced atomically, this should be OK. If files are not
 			// replaced atomically we have other problems (e.g. partial reads).
 
-			sha256 := sha256File(filename)
+			sha256 := sz.Hash()
 			if mm.lastRead[zoneName].hash == sha256 {
-				log.Printf("Skipping new file %s as hash is unchanged\n", filename)
+				applog.Debugf("Skipping %s as hash is unchanged", sz.Location)
 				continue
 			}
 
-			zone := NewZone(zoneName)
-			err := zone.ReadZoneFile(filename)
+			zone, err := readSourceZone(sz)
 			if zone == nil || err != nil {
-				parseErr = fmt.Errorf("Error reading zone '%s': %s", zoneName, err)
-				log.Println(parseErr.Error())
+				applog.Errorf("zone reload failed: zone=%s file=%s error=%s", zoneName, sz.Location, err)
+				reloadErrors.WithLabelValues(zoneName).Inc()
+				summary.Failed[zoneName] = err.Error()
 				continue
 			}
 
 			(mm.lastRead[zoneName]).hash = sha256
+			applog.Infof("zone reload ok: zone=%s file=%s serial=%d", zoneName, sz.Location, zone.Options.Serial)
+
+			if _, ok := mm.zonelist[zoneName]; ok {
+				summary.Changed = append(summary.Changed, zoneName)
+			} else {
+				summary.Added = append(summary.Added, zoneName)
+			}
 
 			mm.addHandler(zoneName, zone)
 		}
@@ -150,26 +259,65 @@ func (mm *MuxManager) reload() error {
 		if ok, _ := seenZones[zoneName]; ok {
 			continue
 		}
-		log.Println("Removing zone", zone.Origin)
+		applog.Infof("Removing zone %s", zone.Origin)
 		zone.Close()
 		mm.removeHandler(zoneName)
+		summary.Removed = append(summary.Removed, zoneName)
 	}
 
-	return parseErr
+	if n := len(summary.Failed); n > 0 {
+		return fmt.Errorf("%d zone file(s) failed to load", n)
+	}
+	return nil
 }
 
 func (mm *MuxManager) addHandler(name string, zone *Zone) {
 	oldZone := mm.zonelist[name]
 	zone.SetupMetrics(oldZone)
 	zone.setupHealthTests()
+	zone.startFlatten(oldZone)
+	if oldZone != nil {
+		oldZone.closeHealthChecks()
+		oldZone.closeFlatten()
+	}
+	mm.mu.Lock()
 	mm.zonelist[name] = zone
+	mm.mu.Unlock()
 	mm.reg.Add(name, zone)
+
+	aliases := map[string]bool{}
+	for _, alias := range zone.Options.Aliases {
+		if _, ok := mm.zonelist[alias]; ok {
+			applog.Warnf("zone %s: alias %s is a zone, not adding it", name, alias)
+			continue
+		}
+		aliases[alias] = true
+		mm.reg.Add(alias, zone)
+	}
+	if oldZone != nil {
+		for _, alias := range oldZone.Options.Aliases {
+			if _, ok := mm.zonelist[alias]; !ok && !aliases[alias] {
+				mm.reg.Remove(alias)
+			}
+		}
+	}
 }
 
 func (mm *MuxManager) removeHandler(name string) {
 	delete(mm.lastRead, name)
+	mm.mu.Lock()
+	zone := mm.zonelist[name]
 	delete(mm.zonelist, name)
+	mm.mu.Unlock()
 	mm.reg.Remove(name)
+
+	if zone != nil {
+		for _, alias := range zone.Options.Aliases {
+			if _, ok := mm.zonelist[alias]; !ok {
+				mm.reg.Remove(alias)
+			}
+		}
+	}
 }
 
 func (mm *MuxManager) setupPgeodnsZone() {
@@ -0,0 +1,128 @@
+package zones
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/abh/geodns/applog"
+	"github.com/abh/geodns/countries"
+	"github.com/abh/geodns/targeting"
+	"github.com/abh/geodns/targeting/geo"
+	"github.com/miekg/dns"
+)
+
+// isRegionTarget returns true for region targets like "us-ca".
+func isRegionTarget(t string) bool {
+	if len(t) < 4 || t[2] != '-' {
+		return false
+	}
+	_, ok := countries.CountryContinent[t[:2]]
+	return ok
+}
+
+// NeedsLocation returns true if the targeting for the zone needs the
+// location of the client, not just the country.
+func (z *Zone) NeedsLocation() bool {
+	return z.HasClosest || z.Options.NearestRegion
+}
+
+// setupNearestRegions finds the region labels (www.us-ca) of each
+// label for the "nearest_region" option. A region label is placed at
+// its "location" option, or at the location of its first address
+// record.
+func (z *Zone) setupNearestRegions() {
+	z.regionLabels = map[string][]*Label{}
+	if !z.Options.NearestRegion {
+		return
+	}
+
+	for name, label := range z.Labels {
+		base, target := "", name
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			base, target = name[:i], name[i+1:]
+		}
+		if !isRegionTarget(target) {
+			continue
+		}
+		if label.Location == nil {
+			label.Location = recordLocation(label)
+		}
+		if label.Location == nil {
+			applog.Warnf("zone %s: no location for region label '%s'", z.Origin, name)
+			continue
+		}
+		z.regionLabels[base] = append(z.regionLabels[base], label)
+	}
+
+	for _, labels := range z.regionLabels {
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Label < labels[j].Label })
+	}
+}
+
+// recordLocation returns the location of the first A or AAAA record
+// of the label.
+func recordLocation(label *Label) *geo.Location {
+	g := targeting.Geo()
+	if g == nil {
+		return nil
+	}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		if len(label.Records[qtype]) == 0 {
+			continue
+		}
+		var ip net.IP
+		switch rr := label.FirstRR(qtype).(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if location, err := g.GetLocation(ip); err == nil && location != nil {
+			return location
+		}
+	}
+	return nil
+}
+
+// NearestRegionTargets adds the target of the region label of s
+// closest to location when the client's own region doesn't have a
+// label. It goes right before "@", so a label for the country,
+// continent or region group still wins over a region somewhere else.
+func (z *Zone) NearestRegionTargets(s string, targets []string, location *geo.Location) []string {
+	s = z.Wildcard(s)
+	candidates := z.regionLabels[s]
+	if len(candidates) == 0 || location == nil {
+		return targets
+	}
+	for _, t := range targets {
+		if _, ok := z.Labels[targetLabel(s, t)]; ok && t == location.Region {
+			return targets
+		}
+	}
+
+	var nearest *Label
+	distance := location.MaxDistance()
+	for _, label := range candidates {
+		if d := location.Distance(label.Location); d < distance {
+			nearest, distance = label, d
+		}
+	}
+	if nearest == nil {
+		return targets
+	}
+	region := nearest.Label[strings.LastIndex(nearest.Label, ".")+1:]
+
+	pos := len(targets)
+	for i, t := range targets {
+		if t == "@" {
+			pos = i
+			break
+		}
+	}
+
+	result := make([]string, 0, len(targets)+1)
+	result = append(result, targets[:pos]...)
+	result = append(result, region)
+	return append(result, targets[pos:]...)
+}
@@ -0,0 +1,86 @@
+package zones
+
+import (
+	"testing"
+
+	"github.com/abh/geodns/targeting/geo"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNearestRegion(t *testing.T) {
+	zone, err := readTestZone(t, "example.com", `{
+		"targeting": "@ continent country region",
+		"nearest_region": true,
+		"data": {
+			"": { "ns": [ "ns1.example.net." ] },
+			"www": { "a": [ [ "192.0.2.1" ] ] },
+			"www.us-ca": { "a": [ [ "192.0.2.2" ] ], "location": [ 37.77, -122.42 ] },
+			"www.us-ny": { "a": [ [ "192.0.2.3" ] ], "location": [ 40.71, -74.01 ] },
+			"www.de": { "a": [ [ "192.0.2.4" ] ] }
+		}
+	}`)
+	require.Nil(t, err)
+	assert.True(t, zone.NeedsLocation())
+
+	lasVegas := &geo.Location{Country: "us", Region: "us-nv", Latitude: 36.17, Longitude: -115.14}
+	targets := zone.NearestRegionTargets("www", []string{"us-nv", "us", "north-america", "@"}, lasVegas)
+	assert.Equal(t, []string{"us-nv", "us", "north-america", "us-ca", "@"}, targets)
+
+	matches := zone.FindLabels("www", targets, []uint16{dns.TypeA})
+	require.NotEmpty(t, matches)
+	assert.Equal(t, "www.us-ca", matches[0].Label.Label)
+
+	// clients in a region with a label are targeted as before
+	sf := &geo.Location{Country: "us", Region: "us-ca", Latitude: 37.7, Longitude: -122.4}
+	targets = []string{"us-ca", "us", "north-america", "@"}
+	assert.Equal(t, targets, zone.NearestRegionTargets("www", targets, sf))
+
+	// the country label still wins; the region goes after it
+	berlin := &geo.Location{Country: "de", Region: "de-be", Latitude: 52.52, Longitude: 13.40}
+	targets = zone.NearestRegionTargets("www", []string{"de-be", "de", "europe", "@"}, berlin)
+	assert.Equal(t, []string{"de-be", "de", "europe", "us-ny", "@"}, targets)
+	matches = zone.FindLabels("www", targets, []uint16{dns.TypeA})
+	assert.Equal(t, "www.de", matches[0].Label.Label)
+
+	// and so does the continent label
+	zone, err = readTestZone(t, "example.com", `{
+		"targeting": "@ continent country region",
+		"nearest_region": true,
+		"data": {
+			"www": { "a": [ [ "192.0.2.1" ] ] },
+			"www.us-ca": { "a": [ [ "192.0.2.2" ] ], "location": [ 37.77, -122.42 ] },
+			"www.europe": { "a": [ [ "192.0.2.5" ] ] }
+		}
+	}`)
+	require.Nil(t, err)
+	paris := &geo.Location{Country: "fr", Region: "fr-idf", Latitude: 48.86, Longitude: 2.35}
+	targets = zone.NearestRegionTargets("www", []string{"fr-idf", "fr", "europe", "@"}, paris)
+	assert.Equal(t, []string{"fr-idf", "fr", "europe", "us-ca", "@"}, targets)
+	matches = zone.FindLabels("www", targets, []uint16{dns.TypeA})
+	assert.Equal(t, "www.europe", matches[0].Label.Label)
+
+	// labels without region variants and unknown locations are left alone
+	targets = []string{"us-nv", "us", "north-america", "@"}
+	assert.Equal(t, targets, zone.NearestRegionTargets("", targets, lasVegas))
+	assert.Equal(t, targets, zone.NearestRegionTargets("www", targets, nil))
+
+	// the fallback is opt-in
+	zone, err = readTestZone(t, "example.com", `{
+		"targeting": "@ continent country region",
+		"data": {
+			"www": { "a": [ [ "192.0.2.1" ] ] },
+			"www.us-ca": { "a": [ [ "192.0.2.2" ] ], "location": [ 37.77, -122.42 ] }
+		}
+	}`)
+	require.Nil(t, err)
+	assert.False(t, zone.NeedsLocation())
+	targets = []string{"us-nv", "us", "north-america", "@"}
+	assert.Equal(t, targets, zone.NearestRegionTargets("www", targets, lasVegas))
+
+	_, err = readTestZone(t, "example.com", `{
+		"data": { "www.us-ca": { "a": [ [ "192.0.2.2" ] ], "location": [ 137.77, -122.42 ] } }
+	}`)
+	assert.Error(t, err)
+}
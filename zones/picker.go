@@ -1,9 +1,17 @@
 package zones
 
 import (
+	"hash/fnv"
+	"math"
 	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/abh/geodns/health"
+	"github.com/abh/geodns/targeting"
 	"github.com/abh/geodns/targeting/geo"
 
 	"github.com/miekg/dns"
@@ -17,6 +25,12 @@ var AlwaysWeighted = []uint16{
 
 var alwaysWeighted map[uint16]struct{}
 
+var (
+	randMu  sync.Mutex
+	random  = rand.New(rand.NewSource(time.Now().UnixNano()))
+	shuffle = true
+)
+
 func init() {
 	alwaysWeighted = map[uint16]struct{}{}
 	for _, t := range AlwaysWeighted {
@@ -24,13 +38,49 @@ func init() {
 	}
 }
 
-func (zone *Zone) filterHealth(servers Records) (Records, int) {
+// SetRandomSeed seeds the random source used to pick weighted
+// records, so the answers for a sequence of queries are reproducible.
+func SetRandomSeed(seed int64) {
+	randMu.Lock()
+	defer randMu.Unlock()
+	random = rand.New(rand.NewSource(seed))
+}
+
+// SetShuffle enables or disables the random selection of weighted
+// records. When disabled the records are returned in the order they
+// are stored in the label, highest weight first.
+func SetShuffle(enabled bool) {
+	randMu.Lock()
+	defer randMu.Unlock()
+	shuffle = enabled
+}
+
+func randomIntn(n int) (int, bool) {
+	randMu.Lock()
+	defer randMu.Unlock()
+	if !shuffle {
+		return 0, false
+	}
+	return random.Intn(n), true
+}
+
+// healthStatus returns the status of a record's health test. Names
+// with a "/" refer to the health status registry, other names are
+// targets of the label's own health check.
+func (label *Label) healthStatus(name string) health.StatusType {
+	if label.Check != nil && !strings.Contains(name, "/") {
+		return label.Check.GetStatus(name)
+	}
+	return health.GetStatus(name)
+}
+
+func (zone *Zone) filterHealth(label *Label, servers Records) (Records, int) {
 	// Remove any unhealthy servers
 	tmpServers := servers[:0]
 
 	sum := 0
 	for i, s := range servers {
-		if len(servers[i].Test) == 0 || health.GetStatus(servers[i].Test) == health.StatusHealthy {
+		if len(servers[i].Test) == 0 || label.healthStatus(servers[i].Test) == health.StatusHealthy {
 			tmpServers = append(tmpServers, s)
 			sum += s.Weight
 		}
@@ -43,12 +93,56 @@ func (zone *Zone) filterHealth(servers Records) (Records, int) {
 // return the "closests" results, otherwise they are returned weighted
 // randomized.
 func (zone *Zone) Picker(label *Label, qtype uint16, max int, location *geo.Location) Records {
+	return zone.PickerFor(label, qtype, max, location, nil)
+}
+
+// PickerFor is like Picker, for queries from the client address (or
+// the ECS subnet); labels with "sticky" selection use it to pick the
+// records. Without a client address they are picked randomly.
+func (zone *Zone) PickerFor(label *Label, qtype uint16, max int, location *geo.Location, client net.IP) Records {
+	return zone.picker(label, qtype, max, location, client, false)
+}
+
+// picker returns the records PickerFor picks. With peek the round-robin
+// state is read without advancing it, so a trace doesn't change the
+// next answers.
+func (zone *Zone) picker(label *Label, qtype uint16, max int, location *geo.Location, client net.IP, peek bool) Records {
+	servers := zone.pick(label, qtype, max, location, client, peek)
+	if qtype == dns.TypeMX {
+		sortMX(servers)
+	}
+	return servers
+}
+
+// sortMX sorts MX records by preference, lowest first. Records with
+// the same preference are shuffled to spread the mail between them.
+func sortMX(servers Records) {
+	sort.SliceStable(servers, func(i, j int) bool {
+		return servers[i].RR.(*dns.MX).Preference < servers[j].RR.(*dns.MX).Preference
+	})
+	for start := 0; start < len(servers); {
+		end := start + 1
+		for end < len(servers) && servers[end].RR.(*dns.MX).Preference == servers[start].RR.(*dns.MX).Preference {
+			end++
+		}
+		for i := end - 1; i > start; i-- {
+			n, ok := randomIntn(i - start + 1)
+			if !ok {
+				break
+			}
+			servers[i], servers[start+n] = servers[start+n], servers[i]
+		}
+		start = end
+	}
+}
+
+func (zone *Zone) pick(label *Label, qtype uint16, max int, location *geo.Location, client net.IP, peek bool) Records {
 
 	if qtype == dns.TypeANY {
 		var result Records
 		for rtype := range label.Records {
 
-			rtypeRecords := zone.Picker(label, rtype, max, location)
+			rtypeRecords := zone.picker(label, rtype, max, location, client, peek)
 
 			tmpResult := make(Records, len(result)+len(rtypeRecords))
 
@@ -72,8 +166,16 @@ func (zone *Zone) Picker(label *Label, qtype uint16, max int, location *geo.Loca
 	servers := make(Records, len(labelRR))
 	copy(servers, labelRR)
 
-	if label.Test != nil {
-		servers, sum = zone.filterHealth(servers)
+	if label.Test != nil || label.Check != nil {
+		healthy, healthySum := zone.filterHealth(label, servers)
+		if len(healthy) < label.minHealthy(labelRR) && label.BelowMinHealthy == HealthFailOpen {
+			// rather the (probably stale) full set than no answer
+			// when the health checks fail for too many records
+			healthFailOpen.WithLabelValues(zone.Origin).Inc()
+			copy(servers, labelRR)
+		} else {
+			servers, sum = healthy, healthySum
+		}
 		// sum re-check to mirror the label.Weight[] check below
 		if sum == 0 {
 			// todo: this is wrong for cname since it misses
@@ -155,8 +257,22 @@ func (zone *Zone) Picker(label *Label, qtype uint16, max int, location *geo.Loca
 		servers = tmpServers
 	}
 
+	if label.Selection == SelectRoundRobin {
+		if peek {
+			return label.roundRobin(qtype).peek(servers, max)
+		}
+		return label.roundRobin(qtype).pick(servers, max)
+	}
+	if label.Selection == SelectSticky && client != nil {
+		return pickSticky(servers, max, client)
+	}
+
 	for si := 0; si < max; si++ {
-		n := rand.Intn(sum + 1)
+		n, ok := randomIntn(sum + 1)
+		if !ok {
+			copy(result, servers[:max])
+			break
+		}
 		s := 0
 
 		for i := range servers {
@@ -174,3 +290,105 @@ func (zone *Zone) Picker(label *Label, qtype uint16, max int, location *geo.Loca
 
 	return result
 }
+
+// roundRobin is the state of a smooth weighted round-robin (as in
+// nginx) over the records of one type in a label.
+type roundRobin struct {
+	mu      sync.Mutex
+	current map[*Record]int
+}
+
+func (l *Label) roundRobin(qtype uint16) *roundRobin {
+	l.rrMutex.Lock()
+	defer l.rrMutex.Unlock()
+	if l.rr == nil {
+		l.rr = map[uint16]*roundRobin{}
+	}
+	rr, ok := l.rr[qtype]
+	if !ok {
+		rr = &roundRobin{current: map[*Record]int{}}
+		l.rr[qtype] = rr
+	}
+	return rr
+}
+
+// pick returns up to max different servers. Each pick is one round
+// of the round-robin: every server gets its weight added to its
+// current value, then the server with the highest current value is
+// chosen and the total weight is subtracted from it.
+func (rr *roundRobin) pick(servers Records, max int) Records {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	total := 0
+	for _, s := range servers {
+		total += s.Weight
+	}
+
+	result := make(Records, 0, max)
+	chosen := make(map[*Record]bool, max)
+
+	for len(result) < max {
+		var best *Record
+		for _, s := range servers {
+			rr.current[s] += s.Weight
+			if chosen[s] {
+				continue
+			}
+			if best == nil || rr.current[s] > rr.current[best] {
+				best = s
+			}
+		}
+		rr.current[best] -= total
+		chosen[best] = true
+		result = append(result, best)
+	}
+
+	return result
+}
+
+// peek returns the servers pick would return, without changing the
+// state of rr.
+func (rr *roundRobin) peek(servers Records, max int) Records {
+	rr.mu.Lock()
+	next := &roundRobin{current: make(map[*Record]int, len(rr.current))}
+	for s, current := range rr.current {
+		next.current[s] = current
+	}
+	rr.mu.Unlock()
+	return next.pick(servers, max)
+}
+
+// pickSticky returns the max servers with the highest weighted
+// rendezvous hash of the client address and the record. The same
+// client gets the same servers as long as they are available, and
+// when one goes away only its clients move to others. Each server is
+// picked first for a share of the clients in proportion to its
+// weight.
+func pickSticky(servers Records, max int, client net.IP) Records {
+	client = targeting.ClientNetwork(client)
+
+	scores := make(map[*Record]float64, len(servers))
+	for _, s := range servers {
+		h := fnv.New64a()
+		h.Write(client)
+		h.Write([]byte(strings.TrimPrefix(s.RR.String(), s.RR.Header().String())))
+		// the hash (mixed, as FNV barely changes the high bits for
+		// the last bytes) as a number in (0, 1)
+		x := h.Sum64()
+		x ^= x >> 33
+		x *= 0xff51afd7ed558ccd
+		x ^= x >> 33
+		x *= 0xc4ceb9fe1a85ec53
+		x ^= x >> 33
+		u := (float64(x>>11) + 0.5) / (1 << 53)
+		scores[s] = -float64(s.Weight) / math.Log(u)
+	}
+
+	result := make(Records, len(servers))
+	copy(result, servers)
+	sort.SliceStable(result, func(i, j int) bool {
+		return scores[result[i]] > scores[result[j]]
+	})
+	return result[:max]
+}
@@ -0,0 +1,258 @@
+package zones
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func addTestA(l *Label, ip string, weight int) {
+	rr := &dns.A{
+		Hdr: dns.RR_Header{Name: l.Label + ".", Rrtype: dns.TypeA, Class: dns.ClassINET},
+		A:   net.ParseIP(ip),
+	}
+	l.Records[dns.TypeA] = append(l.Records[dns.TypeA], &Record{RR: rr, Weight: weight})
+	l.Weight[dns.TypeA] += weight
+}
+
+func TestPickerRoundRobin(t *testing.T) {
+	z := NewZone("example.com")
+	l := z.AddLabel("www")
+	l.Selection = SelectRoundRobin
+
+	addTestA(l, "192.0.2.1", 100)
+	addTestA(l, "192.0.2.2", 10)
+	addTestA(l, "192.0.2.3", 40)
+
+	const queries = 10000
+
+	counts := map[string]int{}
+	for i := 0; i < queries; i++ {
+		records := z.Picker(l, dns.TypeA, 1, nil)
+		if len(records) != 1 {
+			t.Fatalf("got %d records, expected 1", len(records))
+		}
+		counts[records[0].RR.(*dns.A).A.String()]++
+	}
+
+	total := float64(l.Weight[dns.TypeA])
+	for _, r := range l.Records[dns.TypeA] {
+		ip := r.RR.(*dns.A).A.String()
+		expected := queries * float64(r.Weight) / total
+		if math.Abs(float64(counts[ip])-expected) > queries*0.001 {
+			t.Errorf("%s returned %d times, expected %.0f", ip, counts[ip], expected)
+		}
+	}
+
+	// with max_hosts 2 each answer has two different records
+	for i := 0; i < 100; i++ {
+		records := z.Picker(l, dns.TypeA, 2, nil)
+		if len(records) != 2 {
+			t.Fatalf("got %d records, expected 2", len(records))
+		}
+		if records[0] == records[1] {
+			t.Fatalf("got the same record twice")
+		}
+	}
+}
+
+func TestPickerSticky(t *testing.T) {
+	z := NewZone("example.com")
+	l := z.AddLabel("www")
+	l.Selection = SelectSticky
+
+	addTestA(l, "192.0.2.1", 100)
+	addTestA(l, "192.0.2.2", 10)
+	addTestA(l, "192.0.2.3", 40)
+
+	const clients = 20000
+
+	client := func(i int) net.IP {
+		return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < clients; i++ {
+		records := z.PickerFor(l, dns.TypeA, 1, nil, client(i))
+		if len(records) != 1 {
+			t.Fatalf("got %d records, expected 1", len(records))
+		}
+		counts[records[0].RR.(*dns.A).A.String()]++
+	}
+
+	total := float64(l.Weight[dns.TypeA])
+	for _, r := range l.Records[dns.TypeA] {
+		ip := r.RR.(*dns.A).A.String()
+		expected := clients * float64(r.Weight) / total
+		if math.Abs(float64(counts[ip])-expected) > clients*0.02 {
+			t.Errorf("%s returned to %d clients, expected %.0f", ip, counts[ip], expected)
+		}
+	}
+
+	// IPv6 clients in the same /56 get the same records
+	for i := 0; i < 100; i++ {
+		a := net.ParseIP(fmt.Sprintf("2001:db8:%x:%x00::1", i, i%256))
+		b := net.ParseIP(fmt.Sprintf("2001:db8:%x:%xff:ffff::2", i, i%256))
+		if x, y := z.PickerFor(l, dns.TypeA, 1, nil, a), z.PickerFor(l, dns.TypeA, 1, nil, b); x[0] != y[0] {
+			t.Fatalf("%s and %s got different records", a, b)
+		}
+	}
+
+	// a client gets the same records for every query
+	for i := 0; i < 100; i++ {
+		first := z.PickerFor(l, dns.TypeA, 2, nil, client(i))
+		if len(first) != 2 || first[0] == first[1] {
+			t.Fatalf("expected two different records, got %v", first)
+		}
+		for j := 0; j < 10; j++ {
+			if records := z.PickerFor(l, dns.TypeA, 2, nil, client(i)); !reflect.DeepEqual(first, records) {
+				t.Fatalf("client %s got %v, then %v", client(i), first, records)
+			}
+		}
+	}
+
+	// removing a record only moves the clients that had it
+	before := make([]*Record, clients)
+	for i := range before {
+		before[i] = z.PickerFor(l, dns.TypeA, 1, nil, client(i))[0]
+	}
+	removed := l.Records[dns.TypeA][2]
+	l.Records[dns.TypeA] = l.Records[dns.TypeA][:2]
+	l.Weight[dns.TypeA] -= removed.Weight
+	for i := range before {
+		after := z.PickerFor(l, dns.TypeA, 1, nil, client(i))[0]
+		if before[i] != removed && after != before[i] {
+			t.Fatalf("client %s moved from %s to %s", client(i), before[i].RR, after.RR)
+		}
+	}
+}
+
+func TestPickerTrace(t *testing.T) {
+	z := NewZone("example.com")
+	rr := z.AddLabel("rr")
+	rr.Selection = SelectRoundRobin
+	sticky := z.AddLabel("sticky")
+	sticky.Selection = SelectSticky
+	for _, l := range []*Label{rr, sticky} {
+		l.MaxHosts = 1
+		addTestA(l, "192.0.2.1", 10)
+		addTestA(l, "192.0.2.2", 10)
+		addTestA(l, "192.0.2.3", 10)
+	}
+
+	// a trace shows the next round-robin answer without taking it
+	for i := 0; i < 5; i++ {
+		trace := z.Trace("rr", dns.TypeA, net.ParseIP("192.0.2.100"))
+		next := z.Trace("rr", dns.TypeA, net.ParseIP("192.0.2.100"))
+		if !reflect.DeepEqual(trace.Answer, next.Answer) {
+			t.Fatalf("traces changed the round-robin from %v to %v", trace.Answer, next.Answer)
+		}
+		records := z.PickerFor(rr, dns.TypeA, 1, nil, nil)
+		if len(trace.Answer) != 1 || !strings.HasSuffix(trace.Answer[0], "\t"+records[0].RR.(*dns.A).A.String()) {
+			t.Errorf("trace answered %v, the query got %s", trace.Answer, records[0].RR)
+		}
+	}
+
+	// and the sticky records of the traced client
+	for i := 0; i < 20; i++ {
+		ip := net.IPv4(10, 0, 0, byte(i))
+		trace := z.Trace("sticky", dns.TypeA, ip)
+		records := z.PickerFor(sticky, dns.TypeA, 1, nil, ip)
+		if len(trace.Answer) != 1 || !strings.HasSuffix(trace.Answer[0], "\t"+records[0].RR.(*dns.A).A.String()) {
+			t.Errorf("trace for %s answered %v, the query got %s", ip, trace.Answer, records[0].RR)
+		}
+	}
+}
+
+func TestPickerSeed(t *testing.T) {
+	z := NewZone("example.com")
+	l := z.AddLabel("www")
+
+	addTestA(l, "192.0.2.1", 100)
+	addTestA(l, "192.0.2.2", 50)
+	addTestA(l, "192.0.2.3", 10)
+
+	answers := func() []string {
+		var ips []string
+		for i := 0; i < 20; i++ {
+			for _, r := range z.Picker(l, dns.TypeA, 2, nil) {
+				ips = append(ips, r.RR.(*dns.A).A.String())
+			}
+		}
+		return ips
+	}
+
+	defer SetRandomSeed(time.Now().UnixNano())
+
+	SetRandomSeed(42)
+	first := answers()
+	SetRandomSeed(42)
+	if second := answers(); !reflect.DeepEqual(first, second) {
+		t.Errorf("answers with the same seed differ:\n%v\n%v", first, second)
+	}
+
+	SetShuffle(false)
+	defer SetShuffle(true)
+	for i := 0; i < 10; i++ {
+		records := z.Picker(l, dns.TypeA, 2, nil)
+		if len(records) != 2 {
+			t.Fatalf("got %d records, expected 2", len(records))
+		}
+		if records[0] != l.Records[dns.TypeA][0] || records[1] != l.Records[dns.TypeA][1] {
+			t.Fatalf("without shuffling the records should be in order")
+		}
+	}
+}
+
+func TestPickerMX(t *testing.T) {
+	zone, err := readTestZone(t, "example.com", `{
+		"data": {
+			"": {
+				"ns": [ "ns1.example.net." ],
+				"mx": [
+					{ "mx": "backup.example.net", "preference": 20 },
+					{ "mx": "mx1.example.net", "preference": 10 },
+					{ "mx": "last.example.net", "preference": 30 },
+					{ "mx": "mx2.example.net", "preference": 10 }
+				]
+			}
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+	label := zone.Labels[""]
+
+	first := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		records := zone.Picker(label, dns.TypeMX, label.MaxHosts, nil)
+		if len(records) != 4 {
+			t.Fatalf("got %d MX records, expected 4", len(records))
+		}
+		for j := 1; j < len(records); j++ {
+			if records[j-1].RR.(*dns.MX).Preference > records[j].RR.(*dns.MX).Preference {
+				t.Fatalf("MX records aren't sorted by preference: %v", records)
+			}
+		}
+		first[records[0].RR.(*dns.MX).Mx] = true
+	}
+	if !first["mx1.example.net."] || !first["mx2.example.net."] {
+		t.Errorf("MX records with the same preference aren't shuffled: %v", first)
+	}
+
+	for _, data := range []string{
+		`{ "data": { "": { "mx": [ { "preference": 10 } ] } } }`,
+		`{ "data": { "": { "mx": [ { "mx": "mx.example.net", "preference": -1 } ] } } }`,
+		`{ "data": { "": { "mx": [ "mx.example.net" ] } } }`,
+	} {
+		if _, err := readTestZone(t, "example.com", data); err == nil {
+			t.Errorf("invalid MX record loaded: %s", data)
+		}
+	}
+}
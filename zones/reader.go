@@ -1,8 +1,10 @@
 package zones
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -11,7 +13,9 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/abh/geodns/applog"
 	"github.com/abh/geodns/targeting"
+	"github.com/abh/geodns/targeting/geo"
 	"github.com/abh/geodns/typeutil"
 
 	"github.com/abh/errorutil"
@@ -24,7 +28,7 @@ type ZoneList map[string]*Zone
 func (zone *Zone) ReadZoneFile(fileName string) (zerr error) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("reading %s failed: %s", zone.Origin, r)
+			applog.Errorf("reading %s failed: %s", zone.Origin, r)
 			debug.PrintStack()
 			zerr = fmt.Errorf("reading %s failed: %s", zone.Origin, r)
 		}
@@ -32,31 +36,66 @@ func (zone *Zone) ReadZoneFile(fileName string) (zerr error) {
 
 	fh, err := os.Open(fileName)
 	if err != nil {
-		log.Printf("Could not read '%s': %s", fileName, err)
+		applog.Errorf("Could not read '%s': %s", fileName, err)
 		panic(err)
 	}
+	defer fh.Close()
+
+	zone.FileName = fileName
 
 	fileInfo, err := fh.Stat()
 	if err != nil {
-		log.Printf("Could not stat '%s': %s", fileName, err)
+		applog.Errorf("Could not stat '%s': %s", fileName, err)
 	} else {
+		zone.ModTime = fileInfo.ModTime()
 		zone.Options.Serial = int(fileInfo.ModTime().Unix())
 	}
 
+	data, err := ioutil.ReadAll(fh)
+	if err != nil {
+		return fmt.Errorf("could not read '%s': %s", fileName, err)
+	}
+
+	return zone.ReadZone(data, fileName)
+}
+
+// parseZoneJSON parses the JSON object in buf, from the file or URL
+// name, pointing at the position of a syntax error.
+func parseZoneJSON(buf []byte, name string) (map[string]interface{}, error) {
 	var objmap map[string]interface{}
-	decoder := json.NewDecoder(fh)
-	if err = decoder.Decode(&objmap); err != nil {
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	err := decoder.Decode(&objmap)
+	if err != nil {
 		extra := ""
 		if serr, ok := err.(*json.SyntaxError); ok {
-			if _, serr := fh.Seek(0, os.SEEK_SET); serr != nil {
-				log.Fatalf("seek error: %v", serr)
-			}
-			line, col, highlight := errorutil.HighlightBytePosition(fh, serr.Offset)
+			line, col, highlight := errorutil.HighlightBytePosition(bytes.NewReader(buf), serr.Offset)
 			extra = fmt.Sprintf(":\nError at line %d, column %d (file offset %d):\n%s",
 				line, col, serr.Offset, highlight)
 		}
-		return fmt.Errorf("error parsing JSON object in config file %s%s\n%v",
-			fh.Name(), extra, err)
+		return nil, fmt.Errorf("error parsing JSON object in config file %s%s\n%v",
+			name, extra, err)
+	}
+	return objmap, nil
+}
+
+// ReadZone reads the zone from buf, in the JSON zone file format, or
+// in YAML if name ends with .yaml or .yml; name is the file or URL it
+// came from, for the errors.
+func (zone *Zone) ReadZone(buf []byte, name string) (zerr error) {
+	defer func() {
+		if r := recover(); r != nil {
+			applog.Errorf("reading %s failed: %s", zone.Origin, r)
+			debug.PrintStack()
+			zerr = fmt.Errorf("reading %s failed: %s", zone.Origin, r)
+		}
+	}()
+
+	objmap, err := parseZone(buf, name)
+	if err != nil {
+		return err
+	}
+	if objmap, err = zone.resolveIncludes(objmap, name, nil); err != nil {
+		return err
 	}
 
 	//log.Println(objmap)
@@ -68,13 +107,21 @@ func (zone *Zone) ReadZoneFile(fileName string) (zerr error) {
 
 		switch k {
 		case "ttl":
-			zone.Options.Ttl = typeutil.ToInt(v)
+			zone.Options.Ttl, err = parseTtl(v, zone.Origin)
+			if err != nil {
+				return err
+			}
 		case "serial":
 			zone.Options.Serial = typeutil.ToInt(v)
 		case "contact":
 			zone.Options.Contact = v.(string)
 		case "max_hosts":
 			zone.Options.MaxHosts = typeutil.ToInt(v)
+		case "selection":
+			zone.Options.Selection, err = ParseSelectionMode(typeutil.ToString(v))
+			if err != nil {
+				return err
+			}
 		case "closest":
 			zone.Options.Closest = v.(bool)
 			if zone.Options.Closest {
@@ -97,7 +144,7 @@ func (zone *Zone) ReadZoneFile(fileName string) (zerr error) {
 						logging.StatHatAPI = typeutil.ToString(v)
 						logging.StatHat = true
 					default:
-						log.Println("Unknown logger option", logger)
+						applog.Warnf("Unknown logger option '%s'", logger)
 					}
 				}
 				zone.Logging = logging
@@ -105,6 +152,30 @@ func (zone *Zone) ReadZoneFile(fileName string) (zerr error) {
 			}
 			continue
 
+		case "soa":
+			err = parseSOA(v, &zone.Options.SOA)
+			if err != nil {
+				return fmt.Errorf("soa: %s", err)
+			}
+
+		case "allow":
+			zone.Options.Allow, err = parseAllow(v)
+			if err != nil {
+				return err
+			}
+
+		case "nearest_region":
+			zone.Options.NearestRegion = typeutil.ToBool(v)
+
+		case "aliases":
+			zone.Options.Aliases, err = parseAliases(v, zone.Origin)
+			if err != nil {
+				return err
+			}
+
+		case "apex_default":
+			zone.Options.ApexDefault = typeutil.ToString(v)
+
 		case "data":
 			data = v.(map[string]interface{})
 
@@ -113,7 +184,17 @@ func (zone *Zone) ReadZoneFile(fileName string) (zerr error) {
 		}
 	}
 
+	if zone.IsReverse() {
+		// geo targeting doesn't apply to reverse lookups
+		zone.Options.Targeting = targeting.TargetGlobal
+	}
+
 	setupZoneData(data, zone)
+	if err := zone.setupApexDefault(); err != nil {
+		return err
+	}
+	zone.setupGeoLabels()
+	zone.setupNearestRegions()
 
 	//log.Printf("ZO T: %T %s\n", Zones["0.us"], Zones["0.us"])
 
@@ -124,24 +205,28 @@ func (zone *Zone) ReadZoneFile(fileName string) (zerr error) {
 		return nil
 	}
 
+	if zone.Options.Targeting&targeting.TargetInternal > 0 && !targeting.HasInternalNetworks() {
+		applog.Warnf("Zone '%s' requested internal targeting but no internal networks are configured", zone.Origin)
+	}
+
 	if targeting.Geo() == nil {
-		log.Printf("'%s': No geo provider configured", zone.Origin)
+		applog.Warnf("'%s': No geo provider configured", zone.Origin)
 		return nil
 	}
 
 	switch {
-	case zone.Options.Targeting >= targeting.TargetRegionGroup || zone.HasClosest:
+	case zone.Options.Targeting&(targeting.TargetRegionGroup|targeting.TargetRegion) > 0 || zone.NeedsLocation():
 		if ok, err := targeting.Geo().HasLocation(); !ok {
-			log.Printf("Zone '%s' requested location/city targeting but geo provider isn't available: %s", zone.Origin, err)
+			applog.Warnf("Zone '%s' requested location/city targeting but geo provider isn't available: %s", zone.Origin, err)
 		}
-	case zone.Options.Targeting >= targeting.TargetContinent:
+	case zone.Options.Targeting&(targeting.TargetContinent|targeting.TargetCountry) > 0:
 		if ok, err := targeting.Geo().HasCountry(); !ok {
-			log.Printf("Zone '%s' requested country targeting but geo provider isn't available: %s", zone.Origin, err)
+			applog.Warnf("Zone '%s' requested country targeting but geo provider isn't available: %s", zone.Origin, err)
 		}
 	}
 	if zone.Options.Targeting&targeting.TargetASN > 0 {
 		if ok, err := targeting.Geo().HasASN(); !ok {
-			log.Printf("Zone '%s' requested ASN targeting but geo provider isn't available: %s", zone.Origin, err)
+			applog.Warnf("Zone '%s' requested ASN targeting but geo provider isn't available: %s", zone.Origin, err)
 		}
 	}
 
@@ -164,13 +249,32 @@ func setupZoneData(data map[string]interface{}, zone *Zone) {
 		"spf":   dns.TypeSPF,
 		"srv":   dns.TypeSRV,
 		"ptr":   dns.TypePTR,
+		"caa":   dns.TypeCAA,
+		"svcb":  TypeSVCB,
+		"https": TypeHTTPS,
 	}
+	for name, qtype := range dnssecRecordTypes {
+		recordTypes[name] = qtype
+	}
+
+	flatten := map[string]bool{}
 
 	for dk, dv_inter := range data {
 		dv := dv_inter.(map[string]interface{})
 
 		//log.Printf("K %s V %s TYPE-V %T\n", dk, dv, dv)
 
+		if zone.IsReverse() {
+			dk = reverseLabel(zone, dk)
+		}
+
+		for _, part := range strings.Split(dk, ".") {
+			if strings.HasPrefix(part, targeting.GroupPrefix) &&
+				!targeting.HasGroup(strings.TrimPrefix(part, targeting.GroupPrefix)) {
+				panic(fmt.Errorf("label '%s': undefined location group '%s'", dk, part))
+			}
+		}
+
 		label := zone.AddLabel(dk)
 
 		for rType, rdata := range dv {
@@ -178,6 +282,13 @@ func setupZoneData(data map[string]interface{}, zone *Zone) {
 			case "max_hosts":
 				label.MaxHosts = typeutil.ToInt(rdata)
 				continue
+			case "selection":
+				mode, err := ParseSelectionMode(typeutil.ToString(rdata))
+				if err != nil {
+					panic(fmt.Errorf("label '%s': %s", dk, err))
+				}
+				label.Selection = mode
+				continue
 			case "closest":
 				label.Closest = rdata.(bool)
 				if label.Closest {
@@ -185,16 +296,48 @@ func setupZoneData(data map[string]interface{}, zone *Zone) {
 				}
 				continue
 			case "ttl":
-				label.Ttl = typeutil.ToInt(rdata)
+				ttl, err := parseTtl(rdata, dk)
+				if err != nil {
+					panic(err)
+				}
+				label.Ttl = ttl
 				continue
 			case "health":
 				zone.addHealthReference(label, rdata)
 				continue
+			case "min_healthy":
+				label.MinHealthy = typeutil.ToInt(rdata)
+				continue
+			case "below_min_healthy":
+				policy, err := ParseHealthPolicy(typeutil.ToString(rdata))
+				if err != nil {
+					panic(fmt.Errorf("label '%s': %s", dk, err))
+				}
+				label.BelowMinHealthy = policy
+				continue
+			case "flatten":
+				flatten[dk] = typeutil.ToBool(rdata)
+				continue
+			case "location":
+				location, err := parseLocation(rdata)
+				if err != nil {
+					panic(fmt.Errorf("label '%s': %s", dk, err))
+				}
+				label.Location = location
+				continue
+			case "split":
+				split, err := parseSplit(rdata)
+				if err != nil {
+					panic(fmt.Errorf("label '%s': %s", dk, err))
+				}
+				label.Split = split
+				zone.HasSplit = true
+				continue
 			}
 
 			dnsType, ok := recordTypes[rType]
 			if !ok {
-				log.Printf("'%s' unsupported record type '%s'\n", zone.Origin, rType)
+				applog.Warnf("'%s' unsupported record type '%s'", zone.Origin, rType)
 				continue
 			}
 
@@ -247,6 +390,20 @@ func setupZoneData(data map[string]interface{}, zone *Zone) {
 							record.Test = h
 						}
 
+						// notes for the debug output and query log
+						if c, ok := rec["comment"]; ok {
+							record.Comment = typeutil.ToString(c)
+						}
+
+						// and TTL overrides
+						if v, ok := rec["ttl"]; ok {
+							ttl, err := parseTtl(v, dk)
+							if err != nil {
+								panic(err)
+							}
+							h.Ttl = uint32(ttl)
+							record.ttlSet = true
+						}
 					}
 				}
 
@@ -301,7 +458,10 @@ func setupZoneData(data map[string]interface{}, zone *Zone) {
 
 					switch dnsType {
 					case dns.TypePTR:
-						record.RR = &dns.PTR{Hdr: h, Ptr: ip}
+						if len(ip) == 0 {
+							panic(fmt.Errorf("Empty PTR record for %q", dk))
+						}
+						record.RR = &dns.PTR{Hdr: h, Ptr: dns.Fqdn(ip)}
 						break
 					case dns.TypeA:
 						if x := net.ParseIP(ip); x != nil {
@@ -318,32 +478,44 @@ func setupZoneData(data map[string]interface{}, zone *Zone) {
 					}
 
 				case dns.TypeMX:
-					rec := records[rType][i].(map[string]interface{})
-					pref := uint16(0)
-					mx := rec["mx"].(string)
+					rec, ok := records[rType][i].(map[string]interface{})
+					if !ok {
+						panic(fmt.Errorf("MX record for %q must be an object", dk))
+					}
+					mx, _ := rec["mx"].(string)
+					if len(mx) == 0 {
+						panic(fmt.Errorf("MX record for %q is missing the mx target", dk))
+					}
 					if !strings.HasSuffix(mx, ".") {
 						mx = mx + "."
 					}
 					if rec["weight"] != nil {
 						record.Weight = typeutil.ToInt(rec["weight"])
 					}
+					pref := 0
 					if rec["preference"] != nil {
-						pref = uint16(typeutil.ToInt(rec["preference"]))
+						pref = typeutil.ToInt(rec["preference"])
+					}
+					if pref < 0 || pref > 65535 {
+						panic(fmt.Errorf("MX record for %q has invalid preference %d", dk, pref))
 					}
 					record.RR = &dns.MX{
 						Hdr:        h,
 						Mx:         mx,
-						Preference: pref}
+						Preference: uint16(pref)}
 
 				case dns.TypeSRV:
 					rec := records[rType][i].(map[string]interface{})
 					priority := uint16(0)
 					srv_weight := uint16(0)
 					port := uint16(0)
-					target := rec["target"].(string)
+					target, _ := rec["target"].(string)
+					if len(target) == 0 {
+						panic(fmt.Errorf("SRV record for %q is missing a target", dk))
+					}
 
 					if !dns.IsFqdn(target) {
-						target = target + "." + zone.Origin
+						target = dns.Fqdn(target + "." + zone.Origin)
 					}
 
 					if rec["srv_weight"] != nil {
@@ -362,6 +534,30 @@ func setupZoneData(data map[string]interface{}, zone *Zone) {
 						Port:     port,
 						Target:   target}
 
+				case dns.TypeCAA:
+					rec, ok := records[rType][i].(map[string]interface{})
+					if !ok {
+						panic(fmt.Errorf("CAA record for %q must be an object", dk))
+					}
+					tag := typeutil.ToString(rec["tag"])
+					switch tag {
+					case "issue", "issuewild", "iodef":
+					default:
+						panic(fmt.Errorf("CAA record for %q has invalid tag %q", dk, tag))
+					}
+					flag := 0
+					if rec["flag"] != nil {
+						flag = typeutil.ToInt(rec["flag"])
+					}
+					if flag < 0 || flag > 255 {
+						panic(fmt.Errorf("CAA record for %q has invalid flag %d", dk, flag))
+					}
+					record.RR = &dns.CAA{
+						Hdr:   h,
+						Flag:  uint8(flag),
+						Tag:   tag,
+						Value: typeutil.ToString(rec["value"])}
+
 				case dns.TypeCNAME:
 					rec := records[rType][i]
 					var target string
@@ -392,6 +588,12 @@ func setupZoneData(data map[string]interface{}, zone *Zone) {
 					record.Weight = weight
 					record.RR = &dns.CNAME{Hdr: h, Target: dns.Fqdn(target)}
 
+				case TypeSVCB, TypeHTTPS:
+					record.RR = parseSVCB(h, records[rType][i], dk)
+
+				case dns.TypeDNSKEY, dns.TypeDS, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeNSEC3PARAM:
+					record.RR = parseDnssecRR(h, records[rType][i], dk)
+
 				case dns.TypeMF:
 					rec := records[rType][i]
 					// MF records (how we store aliases) are not FQDNs
@@ -409,7 +611,7 @@ func setupZoneData(data map[string]interface{}, zone *Zone) {
 						recl := rec.([]string)
 						ns = recl[0]
 						if len(recl[1]) > 0 {
-							log.Println("NS records with names syntax not supported")
+							applog.Warnf("NS records with names syntax not supported")
 						}
 					default:
 						log.Printf("Data: %T %#v\n", rec, rec)
@@ -436,14 +638,14 @@ func setupZoneData(data map[string]interface{}, zone *Zone) {
 							record.Weight = typeutil.ToInt(weight)
 						}
 						if t, ok := recmap["txt"]; ok {
-							txt = t.(string)
+							txt = joinTxt(t)
 						}
 					}
 					if len(txt) > 0 {
-						rr := &dns.TXT{Hdr: h, Txt: []string{txt}}
+						rr := &dns.TXT{Hdr: h, Txt: splitTxt(txt)}
 						record.RR = rr
 					} else {
-						log.Printf("Zero length txt record for '%s' in '%s'\n", label.Label, zone.Origin)
+						applog.Warnf("Zero length txt record for '%s' in '%s'", label.Label, zone.Origin)
 						continue
 					}
 					// Initial SPF support added here, cribbed from the TypeTXT case definition - SPF records should be handled identically
@@ -464,14 +666,14 @@ func setupZoneData(data map[string]interface{}, zone *Zone) {
 							record.Weight = typeutil.ToInt(weight)
 						}
 						if t, ok := recmap["spf"]; ok {
-							spf = t.(string)
+							spf = joinTxt(t)
 						}
 					}
 					if len(spf) > 0 {
-						rr := &dns.SPF{Hdr: h, Txt: []string{spf}}
+						rr := &dns.SPF{Hdr: h, Txt: splitTxt(spf)}
 						record.RR = rr
 					} else {
-						log.Printf("Zero length SPF record for '%s' in '%s'\n", label.Label, zone.Origin)
+						applog.Warnf("Zero length SPF record for '%s' in '%s'", label.Label, zone.Origin)
 						continue
 					}
 
@@ -493,11 +695,23 @@ func setupZoneData(data map[string]interface{}, zone *Zone) {
 		}
 	}
 
+	for dk, ok := range flatten {
+		if !ok {
+			continue
+		}
+		label := zone.Labels[dk]
+		if len(label.Records[dns.TypeCNAME]) == 0 {
+			panic(fmt.Errorf("label '%s' has flatten but no cname", dk))
+		}
+		target := label.FirstRR(dns.TypeCNAME).(*dns.CNAME).Target
+		label.Flatten = newFlattener(target)
+	}
+
 	// Loop over exisiting labels, create zone records for missing sub-domains
 	// and set TTLs
 	for k, l := range zone.Labels {
-		if strings.Contains(k, ".") {
-			subLabels := strings.Split(k, ".")
+		if base := zone.geoBase(k); strings.Contains(base, ".") {
+			subLabels := strings.Split(base, ".")
 			for i := 1; i < len(subLabels); i++ {
 				subSubLabel := strings.Join(subLabels[i:], ".")
 				if _, ok := zone.Labels[subSubLabel]; !ok {
@@ -532,17 +746,220 @@ func setupZoneData(data map[string]interface{}, zone *Zone) {
 				if zone.Labels[k].Ttl > 0 {
 					defaultTtl = uint32(zone.Labels[k].Ttl)
 				}
-				if r.RR.Header().Ttl == 0 {
+				if r.RR.Header().Ttl == 0 && !r.ttlSet {
 					r.RR.Header().Ttl = defaultTtl
 				}
 			}
 		}
 	}
 
+	for dk, label := range zone.Labels {
+		if len(dk) > 0 && len(label.Records[dns.TypeNS]) > 0 {
+			checkGlue(zone, dk, label)
+		}
+	}
+
 	zone.addSOA()
 
 }
 
+// checkGlue checks that the nameservers of the delegation in label
+// that are in the zone have addresses, to send as glue in referrals.
+func checkGlue(zone *Zone, dk string, label *Label) {
+	origin := dns.Fqdn(zone.Origin)
+	for _, record := range label.Records[dns.TypeNS] {
+		ns := strings.ToLower(record.RR.(*dns.NS).Ns)
+		if !dns.IsSubDomain(origin, ns) {
+			continue
+		}
+		glue, ok := zone.Labels[strings.TrimSuffix(strings.TrimSuffix(ns, origin), ".")]
+		if !ok || len(glue.Records[dns.TypeA])+len(glue.Records[dns.TypeAAAA]) == 0 {
+			panic(fmt.Errorf("label '%s': nameserver '%s' is in the zone but has no A or AAAA records for glue", dk, ns))
+		}
+	}
+}
+
+// reverseLabel returns the label in a reverse zone for name; labels
+// can be written as the IP address instead of the reversed octets or
+// nibbles.
+func reverseLabel(zone *Zone, name string) string {
+	if net.ParseIP(name) == nil {
+		return name
+	}
+	arpa, err := dns.ReverseAddr(name)
+	if err != nil {
+		panic(fmt.Errorf("label '%s': %s", name, err))
+	}
+	origin := dns.Fqdn(strings.ToLower(zone.Origin))
+	if !dns.IsSubDomain(origin, arpa) {
+		panic(fmt.Errorf("label '%s' isn't in the reverse zone '%s'", name, zone.Origin))
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(arpa, origin), ".")
+}
+
+// parseTtl reads a zone, label or record "ttl" option. Negative TTLs
+// are an error; TTLs over a week are usually a mistake, so they are
+// logged.
+func parseTtl(v interface{}, name string) (int, error) {
+	ttl := typeutil.ToInt(v)
+	if ttl < 0 {
+		return 0, fmt.Errorf("negative ttl %d for '%s'", ttl, name)
+	}
+	if ttl > 7*86400 {
+		applog.Warnf("ttl %d for '%s' is more than a week", ttl, name)
+	}
+	return ttl, nil
+}
+
+// parseSOA reads the "soa" zone option. The primary nameserver
+// (mname) and the contact (rname) are required; the timers keep the
+// defaults when they aren't set.
+func parseSOA(v interface{}, soa *SOAOptions) error {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("must be an object")
+	}
+
+	timers := map[string]*int{
+		"refresh": &soa.Refresh,
+		"retry":   &soa.Retry,
+		"expire":  &soa.Expire,
+		"minttl":  &soa.Minttl,
+	}
+
+	for k, v := range m {
+		switch k {
+		case "mname":
+			soa.Mname = dns.Fqdn(typeutil.ToString(v))
+		case "rname":
+			soa.Rname = dns.Fqdn(strings.Replace(typeutil.ToString(v), "@", ".", 1))
+		default:
+			timer, ok := timers[k]
+			if !ok {
+				applog.Warnf("unknown soa option '%s'", k)
+				continue
+			}
+			n := typeutil.ToInt(v)
+			if n <= 0 {
+				return fmt.Errorf("invalid %s %d", k, n)
+			}
+			*timer = n
+		}
+	}
+
+	if len(soa.Mname) == 0 || len(soa.Rname) == 0 {
+		return fmt.Errorf("mname and rname are required")
+	}
+	return nil
+}
+
+// parseAllow reads the "allow" zone option, a list of networks in
+// CIDR notation (or a single one).
+func parseAllow(v interface{}) ([]*net.IPNet, error) {
+	var cidrs []interface{}
+	switch v := v.(type) {
+	case string:
+		cidrs = []interface{}{v}
+	case []interface{}:
+		cidrs = v
+	default:
+		return nil, fmt.Errorf("allow must be a list of networks")
+	}
+
+	allow := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		ipnet, err := targeting.ParseNetwork(typeutil.ToString(c))
+		if err != nil {
+			return nil, fmt.Errorf("allow: %s", err)
+		}
+		allow = append(allow, ipnet)
+	}
+	return allow, nil
+}
+
+// parseLocation reads the "location" label option, the latitude and
+// longitude of the label's servers.
+func parseLocation(v interface{}) (*geo.Location, error) {
+	ll, ok := v.([]interface{})
+	if !ok || len(ll) != 2 {
+		return nil, fmt.Errorf("location must be [ latitude, longitude ]")
+	}
+	lat, ok1 := ll[0].(float64)
+	lon, ok2 := ll[1].(float64)
+	if !ok1 || !ok2 || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return nil, fmt.Errorf("invalid location %v", v)
+	}
+	return &geo.Location{Latitude: lat, Longitude: lon}, nil
+}
+
+// parseAliases reads the "aliases" zone option, a list of other
+// domains (or a single one) that are served with the zone's records.
+func parseAliases(v interface{}, origin string) ([]string, error) {
+	var list []interface{}
+	switch v := v.(type) {
+	case string:
+		list = []interface{}{v}
+	case []interface{}:
+		list = v
+	default:
+		return nil, fmt.Errorf("aliases must be a list of domains")
+	}
+
+	aliases := make([]string, 0, len(list))
+	for _, a := range list {
+		alias := strings.TrimSuffix(strings.ToLower(typeutil.ToString(a)), ".")
+		if _, ok := dns.IsDomainName(alias); !ok || len(alias) == 0 {
+			return nil, fmt.Errorf("invalid alias '%s'", a)
+		}
+		if alias == origin {
+			return nil, fmt.Errorf("alias '%s' is the zone itself", alias)
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases, nil
+}
+
+// joinTxt returns the text of a TXT or SPF record, given either as
+// a string or as a list of strings (for long values split in the
+// zone file).
+func joinTxt(v interface{}) string {
+	parts, ok := v.([]interface{})
+	if !ok {
+		return typeutil.ToString(v)
+	}
+	var txt string
+	for _, p := range parts {
+		txt += typeutil.ToString(p)
+	}
+	return txt
+}
+
+// splitTxt splits txt into character-strings of at most 255 bytes,
+// as a TXT record can't have longer ones. Escape sequences (\" or
+// \DDD) are kept together.
+func splitTxt(txt string) []string {
+	var chunks []string
+	start, size := 0, 0
+	for i := 0; i < len(txt); {
+		n := 1
+		if txt[i] == '\\' && i+1 < len(txt) {
+			n = 2
+			if i+3 < len(txt) && isDigit(txt[i+1]) && isDigit(txt[i+2]) && isDigit(txt[i+3]) {
+				n = 4
+			}
+		}
+		if size == 255 {
+			chunks = append(chunks, txt[start:i])
+			start, size = i, 0
+		}
+		size++
+		i += n
+	}
+	return append(chunks, txt[start:])
+}
+
+func isDigit(b byte) bool { return b >= '0' && b <= '9' }
+
 func getStringWeight(rec []interface{}) (string, int) {
 	str := rec[0].(string)
 	var weight int
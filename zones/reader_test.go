@@ -4,11 +4,15 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/abh/geodns/targeting"
 	"github.com/abh/geodns/targeting/geoip2"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -162,3 +166,491 @@ func CopyFile(src, dst string) (int64, error) {
 	defer df.Close()
 	return io.Copy(df, sf)
 }
+
+func readTestZone(t *testing.T, origin, data string) (*Zone, error) {
+	fh, err := ioutil.TempFile("", "geodns-zone.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fh.Name())
+
+	if _, err := fh.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+
+	zone := NewZone(origin)
+	return zone, zone.ReadZoneFile(fh.Name())
+}
+
+func TestReadSRV(t *testing.T) {
+	zone, err := readTestZone(t, "example.net", `{
+		"serial": 3,
+		"data": {
+			"": { "ns": { "ns1.example.net.": null } },
+			"_sip._tcp": {
+				"srv": [ { "port": 5060, "srv_weight": 100, "priority": 10, "target": "sip" } ]
+			},
+			"_sip._tcp.europe": {
+				"srv": [ { "port": 5061, "priority": 20, "target": "sip-eu.example.net." } ]
+			}
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+
+	srv := zone.Labels["_sip._tcp"].FirstRR(dns.TypeSRV).(*dns.SRV)
+	assert.Equal(t, "sip.example.net.", srv.Target)
+	assert.Equal(t, uint16(5060), srv.Port)
+	assert.Equal(t, uint16(10), srv.Priority)
+	assert.Equal(t, uint16(100), srv.Weight)
+
+	matches := zone.FindLabels("_sip._tcp", []string{"dk", "europe", "@"}, []uint16{dns.TypeSRV})
+	if assert.Len(t, matches, 2) {
+		srv = matches[0].Label.FirstRR(dns.TypeSRV).(*dns.SRV)
+		assert.Equal(t, "sip-eu.example.net.", srv.Target)
+		assert.Equal(t, uint16(5061), srv.Port)
+	}
+
+	_, err = readTestZone(t, "example.net", `{
+		"data": { "_sip._tcp": { "srv": [ { "port": 5060, "priority": 10 } ] } }
+	}`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "missing a target")
+	}
+}
+
+func TestReadCAA(t *testing.T) {
+	zone, err := readTestZone(t, "example.net", `{
+		"data": {
+			"": {
+				"ns": [ "ns1.example.net." ],
+				"caa": [
+					{ "tag": "issue", "value": "letsencrypt.org" },
+					{ "flag": 128, "tag": "iodef", "value": "mailto:security@example.net" }
+				]
+			}
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+
+	label := zone.Labels[""]
+	records := zone.Picker(label, dns.TypeCAA, label.MaxHosts, nil)
+	if assert.Len(t, records, 2, "all CAA records are returned") {
+		caa := label.Records[dns.TypeCAA][0].RR.(*dns.CAA)
+		assert.Equal(t, uint8(0), caa.Flag)
+		assert.Equal(t, "issue", caa.Tag)
+		assert.Equal(t, "letsencrypt.org", caa.Value)
+
+		caa = label.Records[dns.TypeCAA][1].RR.(*dns.CAA)
+		assert.Equal(t, uint8(128), caa.Flag)
+		assert.Equal(t, "iodef", caa.Tag)
+	}
+
+	_, err = readTestZone(t, "example.net", `{
+		"data": { "": { "caa": [ { "tag": "issuer", "value": "letsencrypt.org" } ] } }
+	}`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid tag")
+	}
+}
+
+func TestReadDelegation(t *testing.T) {
+	zone, err := readTestZone(t, "example.net", `{
+		"data": {
+			"": { "ns": [ "ns1.example.net." ] },
+			"sub": { "ns": [ "ns1.sub.example.net.", "NS2.example.net.", "ns.example.org." ] },
+			"ns1.sub": { "a": [ [ "192.0.2.53" ] ] },
+			"ns2": { "aaaa": [ [ "2001:db8::53" ] ] }
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+	for name, delegated := range map[string]bool{
+		"":            false,
+		"sub":         true,
+		"www.sub":     true,
+		"a.b.sub":     true,
+		"ns2":         false,
+		"www.sub2":    false,
+		"sub.example": false,
+	} {
+		assert.Equal(t, delegated, zone.Delegation(name) != nil, "delegation for '%s'", name)
+	}
+
+	_, err = readTestZone(t, "example.net", `{
+		"data": {
+			"": { "ns": [ "ns1.example.net." ] },
+			"sub": { "ns": [ "ns1.sub.example.net.", "ns.example.org." ] }
+		}
+	}`)
+	if assert.Error(t, err, "nameserver in the zone without glue") {
+		assert.Contains(t, err.Error(), "nameserver 'ns1.sub.example.net.' is in the zone but has no A or AAAA records")
+	}
+}
+
+func TestReadSVCB(t *testing.T) {
+	zone, err := readTestZone(t, "example.net", `{
+		"data": {
+			"": {
+				"ns": [ "ns1.example.net." ],
+				"https": [ { "priority": 1, "target": "." } ]
+			},
+			"www": {
+				"https": [
+					{ "priority": 1, "target": ".", "alpn": [ "h2", "h3" ], "port": 8443 },
+					{ "priority": 2, "target": "alt.example.net", "alpn": "h2", "no-default-alpn": true,
+					  "ipv4hint": [ "192.0.2.1" ], "ipv6hint": [ "2001:db8::1" ] }
+				]
+			},
+			"_8443._foo": { "svcb": [ { "priority": 0, "target": "svc.example.net." } ] }
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+
+	rdata := func(label string, qtype uint16, i int) string {
+		rr := zone.Labels[label].Records[qtype][i].RR.(*dns.RFC3597)
+		assert.Equal(t, qtype, rr.Hdr.Rrtype)
+		return rr.Rdata
+	}
+	assert.Equal(t, "000100", rdata("", TypeHTTPS, 0))
+	assert.Equal(t, "000100"+"00010006026832026833"+"0003000220fb", rdata("www", TypeHTTPS, 0))
+	assert.Equal(t, "0002"+"03616c74076578616d706c65036e657400"+
+		"00010003026832"+"00020000"+"00040004c0000201"+"0006001020010db8000000000000000000000001",
+		rdata("www", TypeHTTPS, 1))
+	assert.Equal(t, "0000"+"03737663076578616d706c65036e657400",
+		rdata("_8443._foo", TypeSVCB, 0))
+
+	for data, msg := range map[string]string{
+		`{ "priority": 0, "target": "www.example.net", "port": 443 }`: "priority 0 (alias) can't have parameters",
+		`{ "priority": 1, "ipv4hint": "2001:db8::1" }`:                "invalid ipv4hint",
+		`{ "priority": 1, "ech": "AEn+" }`:                            "unsupported parameter \"ech\"",
+		`{ "priority": 1, "no-default-alpn": true }`:                  "no-default-alpn without alpn",
+	} {
+		_, err = readTestZone(t, "example.net", `{ "data": { "www": { "https": [ `+data+` ] } } }`)
+		if assert.Error(t, err, data) {
+			assert.Contains(t, err.Error(), msg)
+		}
+	}
+}
+
+func TestReadLongTxt(t *testing.T) {
+	long := strings.Repeat("0123456789", 60)
+
+	zone, err := readTestZone(t, "example.net", `{
+		"data": {
+			"": { "ns": [ "ns1.example.net." ] },
+			"dkim": { "txt": "`+long+`" },
+			"split": { "txt": [ { "txt": [ "`+long[:300]+`", "`+long[300:]+`" ] } ] }
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+
+	for _, name := range []string{"dkim", "split"} {
+		txt := zone.Labels[name].FirstRR(dns.TypeTXT).(*dns.TXT)
+		if assert.Len(t, txt.Txt, 3, name) {
+			assert.Len(t, txt.Txt[0], 255)
+			assert.Len(t, txt.Txt[1], 255)
+			assert.Len(t, txt.Txt[2], 90)
+		}
+
+		// the record can be packed and has the same text on the wire
+		m := new(dns.Msg)
+		m.SetQuestion(name+".example.net.", dns.TypeTXT)
+		m.Answer = []dns.RR{txt}
+		buf, err := m.Pack()
+		if !assert.Nil(t, err, name) {
+			continue
+		}
+		r := new(dns.Msg)
+		if assert.Nil(t, r.Unpack(buf)) {
+			wire := r.Answer[0].(*dns.TXT).Txt
+			assert.Len(t, wire, 3)
+			assert.Equal(t, long, strings.Join(wire, ""))
+		}
+	}
+
+	// escape sequences aren't split
+	chunks := splitTxt(strings.Repeat("a", 254) + `\059b`)
+	assert.Equal(t, []string{strings.Repeat("a", 254) + `\059`, "b"}, chunks)
+}
+
+func TestReadSOA(t *testing.T) {
+	zone, err := readTestZone(t, "example.net", `{
+		"serial": 2019010101,
+		"soa": { "mname": "ns1.example.net", "rname": "dns@example.net", "refresh": 3600, "minttl": 300 },
+		"data": { "": { "ns": [ "ns2.example.net." ] } }
+	}`)
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+
+	soa := zone.SoaRR().(*dns.SOA)
+	assert.Equal(t, "ns1.example.net.", soa.Ns)
+	assert.Equal(t, "dns.example.net.", soa.Mbox)
+	assert.Equal(t, uint32(2019010101), soa.Serial)
+	assert.Equal(t, uint32(3600), soa.Refresh)
+	assert.Equal(t, uint32(5400), soa.Retry, "default retry")
+	assert.Equal(t, uint32(1209600), soa.Expire, "default expire")
+	assert.Equal(t, uint32(300), soa.Minttl)
+
+	// without the option the first NS record and the contact are used
+	zone, err = readTestZone(t, "example.net", `{
+		"data": { "": { "ns": [ "ns2.example.net." ] } }
+	}`)
+	if assert.Nil(t, err) {
+		soa = zone.SoaRR().(*dns.SOA)
+		assert.Equal(t, "ns2.example.net.", soa.Ns)
+		assert.Equal(t, "hostmaster.example.net.", soa.Mbox)
+		assert.Equal(t, uint32(3600), soa.Minttl)
+	}
+
+	_, err = readTestZone(t, "example.net", `{
+		"soa": { "refresh": 3600 },
+		"data": { "": { "ns": [ "ns2.example.net." ] } }
+	}`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "mname and rname are required")
+	}
+
+	_, err = readTestZone(t, "example.net", `{
+		"soa": { "mname": "ns1.example.net", "rname": "dns.example.net", "retry": -1 },
+		"data": {}
+	}`)
+	assert.Error(t, err)
+}
+
+func TestReadAllow(t *testing.T) {
+	zone, err := readTestZone(t, "example.net", `{
+		"allow": [ "10.0.0.0/8", "192.0.2.1", "2001:db8::/32" ],
+		"data": { "": { "ns": [ "ns1.example.net." ] } }
+	}`)
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+	assert.True(t, zone.Allowed(net.ParseIP("10.1.2.3")))
+	assert.True(t, zone.Allowed(net.ParseIP("192.0.2.1")))
+	assert.True(t, zone.Allowed(net.ParseIP("2001:db8::53")))
+	assert.False(t, zone.Allowed(net.ParseIP("192.0.2.2")))
+
+	zone, err = readTestZone(t, "example.net", `{ "data": { "": { "ns": [ "ns1.example.net." ] } } }`)
+	if assert.Nil(t, err) {
+		assert.True(t, zone.Allowed(net.ParseIP("192.0.2.2")), "zones without allow are open")
+	}
+
+	_, err = readTestZone(t, "example.net", `{ "allow": [ "10.0.0.0/33" ], "data": {} }`)
+	assert.Error(t, err)
+}
+
+func TestRequiresGeo(t *testing.T) {
+	zone, err := readTestZone(t, "example.net", `{
+		"targeting": "country continent @",
+		"data": {
+			"www": { "a": [ [ "192.0.2.1" ] ] },
+			"www.europe": { "a": [ [ "192.0.2.2" ] ] },
+			"api.dk": { "a": [ [ "192.0.2.3" ] ] },
+			"near": { "a": [ [ "192.0.2.4" ] ], "closest": true },
+			"mail": { "a": [ [ "192.0.2.5" ] ] },
+			"_sip._tcp": { "srv": [ { "port": 5060, "target": "sip" } ] }
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+
+	for label, expected := range map[string]bool{
+		"www":  true,
+		"api":  true,
+		"near": true,
+		"mail": false,
+		"_sip": false,
+	} {
+		assert.Equal(t, expected, zone.RequiresGeo(label), "RequiresGeo(%q)", label)
+	}
+}
+
+func TestReadTtl(t *testing.T) {
+	zone, err := readTestZone(t, "example.net", `{
+		"ttl": 300,
+		"data": {
+			"": { "ns": { "ns1.example.net.": null } },
+			"zone": { "a": [ [ "192.0.2.1" ] ] },
+			"label": { "a": [ [ "192.0.2.2" ] ], "ttl": 60 },
+			"record": {
+				"a": [ { "ip": "192.0.2.3", "ttl": 30 }, { "ip": "192.0.2.4" }, { "ip": "192.0.2.5", "ttl": 0 } ],
+				"ttl": 60
+			}
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+
+	ttl := func(label string, i int) uint32 {
+		return zone.Labels[label].Records[dns.TypeA][i].RR.Header().Ttl
+	}
+	assert.Equal(t, uint32(300), ttl("zone", 0))
+	assert.Equal(t, uint32(60), ttl("label", 0))
+	assert.Equal(t, uint32(30), ttl("record", 0))
+	assert.Equal(t, uint32(60), ttl("record", 1))
+	assert.Equal(t, uint32(0), ttl("record", 2), "an explicit TTL of 0 is kept")
+
+	for _, data := range []string{
+		`{ "ttl": -1, "data": {} }`,
+		`{ "data": { "www": { "a": [ [ "192.0.2.1" ] ], "ttl": -1 } } }`,
+		`{ "data": { "www": { "a": [ { "ip": "192.0.2.1", "ttl": -1 } ] } } }`,
+	} {
+		_, err = readTestZone(t, "example.net", data)
+		if assert.Error(t, err, data) {
+			assert.Contains(t, err.Error(), "negative ttl")
+		}
+	}
+}
+
+func TestReadDefaultTtl(t *testing.T) {
+	SetDefaultTtl(900)
+	defer SetDefaultTtl(120)
+
+	data := `{
+		"data": {
+			"": { "ns": { "ns1.example.net.": null } },
+			"www": { "a": [ [ "192.0.2.1" ] ] },
+			"label": { "a": [ [ "192.0.2.2" ] ], "ttl": 60 }
+		}
+	}`
+	zone, err := readTestZone(t, "example.net", data)
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+	assert.Equal(t, uint32(900), zone.Labels["www"].Records[dns.TypeA][0].RR.Header().Ttl)
+	assert.Equal(t, uint32(60), zone.Labels["label"].Records[dns.TypeA][0].RR.Header().Ttl)
+
+	// the zone ttl overrides the default
+	zone, err = readTestZone(t, "example.net", `{ "ttl": 300,`+data[1:])
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+	assert.Equal(t, uint32(300), zone.Labels["www"].Records[dns.TypeA][0].RR.Header().Ttl)
+}
+
+func TestReloadBrokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geodns-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = CopyFile("../dns/test.example.org.json", dir+"/test.example.org.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(dir+"/broken.example.org.json", []byte(`{ "data": { "www": `), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	muxm, err := NewMuxManager(dir, &NilReg{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "1 zone file(s) failed")
+	}
+	assert.Equal(t, 1, muxm.ZoneCount(), "the valid zone was loaded")
+
+	// break the loaded zone; the previous version is kept
+	err = ioutil.WriteFile(dir+"/test.example.org.json", []byte(`{ "data": `), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	os.Chtimes(dir+"/test.example.org.json", later, later)
+
+	summary, err := muxm.Reload()
+	assert.Error(t, err)
+	assert.Contains(t, summary.Failed, "test.example.org")
+	assert.Empty(t, summary.Changed)
+	if assert.Contains(t, muxm.Zones(), "test.example.org") {
+		assert.Contains(t, muxm.Zones()["test.example.org"].Labels, "bar")
+	}
+}
+
+func TestReadLocationGroups(t *testing.T) {
+	if err := targeting.SetGroups(map[string][]string{"emea": {"de", "za"}}); err != nil {
+		t.Fatalf("SetGroups: %s", err)
+	}
+	defer targeting.SetGroups(nil)
+
+	zone, err := readTestZone(t, "example.net", `{
+		"data": {
+			"www": { "a": [ [ "192.0.2.1" ] ] },
+			"www.group:emea": { "a": [ [ "192.0.2.2" ] ] }
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+	assert.True(t, zone.RequiresGeo("www"))
+
+	_, err = readTestZone(t, "example.net", `{
+		"data": { "www.group:apac": { "a": [ [ "192.0.2.3" ] ] } }
+	}`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "undefined location group 'group:apac'")
+	}
+}
+
+func TestReadAliases(t *testing.T) {
+	zone, err := readTestZone(t, "example.com", `{
+		"aliases": [ "Example.NET.", "example.org" ],
+		"data": { "": { "ns": [ "ns1.example.net." ] } }
+	}`)
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+	assert.Equal(t, []string{"example.net", "example.org"}, zone.Options.Aliases)
+
+	_, err = readTestZone(t, "example.com", `{ "aliases": [ "example.com" ], "data": {} }`)
+	assert.Error(t, err)
+
+	_, err = readTestZone(t, "example.com", `{ "aliases": { "example.net": 1 }, "data": {} }`)
+	assert.Error(t, err)
+}
+
+func TestReadReverse(t *testing.T) {
+	zone, err := readTestZone(t, "2.0.192.in-addr.arpa", `{
+		"targeting": "@ country continent",
+		"data": {
+			"": { "ns": [ "ns1.example.net." ] },
+			"192.0.2.10": { "ptr": [ [ "www.example.com" ] ] },
+			"11": { "ptr": [ [ "mail.example.com." ] ] }
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+	assert.True(t, zone.IsReverse())
+	assert.Equal(t, "@", zone.Options.Targeting.String(), "no geo targeting in reverse zones")
+
+	if assert.NotNil(t, zone.Labels["10"], "address label converted") {
+		ptr := zone.Labels["10"].FirstRR(dns.TypePTR).(*dns.PTR)
+		assert.Equal(t, "10.2.0.192.in-addr.arpa.", ptr.Hdr.Name)
+		assert.Equal(t, "www.example.com.", ptr.Ptr)
+	}
+	assert.NotNil(t, zone.Labels["11"])
+
+	_, err = readTestZone(t, "2.0.192.in-addr.arpa", `{
+		"data": { "198.51.100.1": { "ptr": [ [ "www.example.com." ] ] } }
+	}`)
+	assert.Error(t, err, "address outside the reverse zone")
+
+	zone, err = readTestZone(t, "example.com", `{ "data": { "": { "ns": [ "ns1.example.net." ] } } }`)
+	if assert.Nil(t, err) {
+		assert.False(t, zone.IsReverse())
+	}
+}
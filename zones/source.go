@@ -0,0 +1,124 @@
+package zones
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ZoneSource is where the MuxManager gets the zones from.
+type ZoneSource interface {
+	// Zones lists all the zones in the source. If it returns an
+	// error the loaded zones are kept.
+	Zones() ([]SourceZone, error)
+
+	// Interval is how often the source is checked for changes.
+	Interval() time.Duration
+
+	String() string
+}
+
+// SourceZone is a zone in a ZoneSource. The zone is read again when
+// the modification time is after the last read and the data changed.
+type SourceZone struct {
+	Name    string
+	ModTime time.Time
+
+	// Location is the file name or URL of the zone, for the logs
+	Location string
+
+	// Hash returns a hash of the zone data, to skip zones that are
+	// unchanged even if the modification time is newer
+	Hash func() string
+
+	// Read reads the zone data into zone
+	Read func(zone *Zone) error
+}
+
+// dirSource reads the zones from the .json (or .yaml) files in a
+// directory. The snippets included by the zones are tracked so a
+// change to them reloads the zones including them.
+type dirSource struct {
+	path string
+
+	mu       sync.Mutex
+	includes map[string][]string
+}
+
+// NewDirSource returns a source for the zone files in the directory
+// path, named for the zone with the .json, .yaml or .yml suffix.
+func NewDirSource(path string) ZoneSource {
+	return &dirSource{path: path, includes: make(map[string][]string)}
+}
+
+func (s *dirSource) Zones() ([]SourceZone, error) {
+	dir, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read '%s': %s", s.path, err)
+	}
+
+	var list []SourceZone
+	for _, file := range dir {
+		fileName := file.Name()
+		if !(strings.HasSuffix(strings.ToLower(fileName), ".json") || isYAML(fileName)) ||
+			strings.HasPrefix(path.Base(fileName), ".") ||
+			file.IsDir() {
+			continue
+		}
+
+		filename := path.Join(s.path, fileName)
+		modTime := file.ModTime()
+		includes := s.included(filename)
+		for _, inc := range includes {
+			if fi, err := os.Stat(inc); err == nil && fi.ModTime().After(modTime) {
+				modTime = fi.ModTime()
+			}
+		}
+		list = append(list, SourceZone{
+			Name:     fileName[0:strings.LastIndex(fileName, ".")],
+			ModTime:  modTime,
+			Location: filename,
+			Hash: func() string {
+				hash := sha256File(filename)
+				for _, inc := range includes {
+					hash += sha256File(inc)
+				}
+				return hash
+			},
+			Read: func(zone *Zone) error {
+				err := zone.ReadZoneFile(filename)
+				s.setIncluded(filename, zone.Includes)
+				return err
+			},
+		})
+	}
+	return list, nil
+}
+
+// included returns the snippets the zone file included when it was
+// last read.
+func (s *dirSource) included(filename string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.includes[filename]
+}
+
+func (s *dirSource) setIncluded(filename string, includes []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.includes[filename] = includes
+}
+
+// Interval is the polling interval, in case the notifications about
+// changes to the directory aren't available or get lost.
+func (s *dirSource) Interval() time.Duration {
+	return 2 * time.Second
+}
+
+func (s *dirSource) String() string {
+	return s.path
+}
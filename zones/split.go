@@ -0,0 +1,100 @@
+package zones
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+
+	"github.com/abh/geodns/targeting"
+	"github.com/abh/geodns/typeutil"
+)
+
+// SplitTarget sends a percentage of the clients that match a label to
+// the variant of the label for another target, for example 20% of
+// the clients of www.europe to www.us.
+type SplitTarget struct {
+	Target  string `json:"target"`
+	Percent int    `json:"percent"`
+}
+
+// parseSplit reads the "split" option of a label, an object with the
+// targets and the percentage of the clients for each.
+func parseSplit(v interface{}) ([]SplitTarget, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("split must be an object with the percentage for each target")
+	}
+	split := make([]SplitTarget, 0, len(m))
+	total := 0
+	for target, p := range m {
+		percent := typeutil.ToInt(p)
+		if len(target) == 0 || percent <= 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid split %v for target '%s'", p, target)
+		}
+		total += percent
+		split = append(split, SplitTarget{Target: target, Percent: percent})
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("split adds up to %d%%", total)
+	}
+	// in a fixed order, so the clients stay with the same target
+	sort.Slice(split, func(i, j int) bool { return split[i].Target < split[j].Target })
+	return split, nil
+}
+
+// splitBucket returns a number in [0, 100) from the hash of the client
+// address and the label, so a client always gets the same share.
+func splitBucket(ip net.IP, name string) int {
+	h := fnv.New64a()
+	h.Write(targeting.ClientNetwork(ip))
+	h.Write([]byte(name))
+	x := h.Sum64()
+	// mix the bits, FNV barely changes the high bits for the last
+	// bytes
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return int(x % 100)
+}
+
+// splitTarget returns the first label of s for the targets that has
+// a split, and the target the client at ip is sent to; "" if the
+// client stays with the label.
+func (z *Zone) splitTarget(s string, targets []string, ip net.IP) (*Label, string) {
+	for _, t := range targets {
+		label, ok := z.Labels[targetLabel(s, t)]
+		if !ok || len(label.Split) == 0 {
+			continue
+		}
+		bucket := splitBucket(ip, label.Label)
+		for _, split := range label.Split {
+			if bucket < split.Percent {
+				return label, split.Target
+			}
+			bucket -= split.Percent
+		}
+		return label, ""
+	}
+	return nil, ""
+}
+
+// SplitTargets adds the split target of the label of s that matches
+// the targets, for the clients at ip that get it, before the target
+// of the label. If the label for the split target doesn't have the
+// records the client gets the label's own.
+func (z *Zone) SplitTargets(s string, targets []string, ip net.IP) []string {
+	s = z.Wildcard(s)
+	label, target := z.splitTarget(s, targets, ip)
+	if len(target) == 0 {
+		return targets
+	}
+	result := make([]string, 0, len(targets)+1)
+	for _, t := range targets {
+		if targetLabel(s, t) == label.Label {
+			result = append(result, target)
+		}
+		result = append(result, t)
+	}
+	return result
+}
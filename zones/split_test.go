@@ -0,0 +1,83 @@
+package zones
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplit(t *testing.T) {
+	zone, err := readTestZone(t, "example.com", `{
+		"targeting": "@ continent",
+		"data": {
+			"": { "ns": [ "ns1.example.net." ] },
+			"www": { "a": [ [ "192.0.2.1" ] ], "split": { "asia": 50 } },
+			"www.europe": { "a": [ [ "192.0.2.2" ] ], "split": { "north-america": 20 } },
+			"www.north-america": { "a": [ [ "192.0.2.3" ] ] },
+			"www.asia": { "txt": "no addresses" }
+		}
+	}`)
+	require.Nil(t, err)
+	require.True(t, zone.HasSplit)
+
+	europe := []string{"europe", "@"}
+	match := func(targets []string, qtype uint16) string {
+		matches := zone.FindLabels("www", targets, []uint16{dns.TypeMF, dns.TypeCNAME, qtype})
+		require.NotEmpty(t, matches)
+		return matches[0].Label.Label
+	}
+
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		ip := net.ParseIP(fmt.Sprintf("10.%d.%d.1", i/256, i%256))
+		targets := zone.SplitTargets("www", europe, ip)
+		assert.Equal(t, targets, zone.SplitTargets("www", europe, ip), "the same split for a client")
+		switch len(targets) {
+		case 2:
+			assert.Equal(t, "www.europe", match(targets, dns.TypeA))
+		case 3:
+			assert.Equal(t, []string{"north-america", "europe", "@"}, targets)
+			assert.Equal(t, "www.north-america", match(targets, dns.TypeA))
+			moved++
+		default:
+			t.Fatalf("unexpected targets %v", targets)
+		}
+	}
+	assert.InDelta(t, 200, moved, 50, "about 20% of the clients are moved")
+
+	// the label of the split target doesn't have the records
+	for i := 0; i < 20; i++ {
+		ip := net.ParseIP(fmt.Sprintf("10.0.0.%d", i))
+		targets := zone.SplitTargets("www", []string{"@"}, ip)
+		assert.Equal(t, "www", match(targets, dns.TypeA))
+	}
+
+	// and it's shown in the trace
+	for i := 0; i < 20; i++ {
+		trace := zone.Trace("www", dns.TypeTXT, net.ParseIP(fmt.Sprintf("10.0.0.%d", i)))
+		require.NotNil(t, trace.Split)
+		assert.Equal(t, "www", trace.Split.Label)
+		assert.Equal(t, []SplitTarget{{Target: "asia", Percent: 50}}, trace.Split.Split)
+		if trace.Split.Target == "asia" {
+			assert.Equal(t, "www.asia", trace.Match)
+		} else {
+			assert.Empty(t, trace.Split.Target)
+			assert.Empty(t, trace.Match)
+		}
+	}
+
+	for _, data := range []string{
+		`{ "asia": 80, "europe": 30 }`,
+		`{ "asia": 0 }`,
+		`[ "asia" ]`,
+	} {
+		_, err := readTestZone(t, "example.com", `{
+			"data": { "www": { "a": [ [ "192.0.2.1" ] ], "split": `+data+` } }
+		}`)
+		assert.Error(t, err, data)
+	}
+}
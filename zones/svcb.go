@@ -0,0 +1,159 @@
+package zones
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/abh/geodns/typeutil"
+	"github.com/miekg/dns"
+)
+
+// The SVCB and HTTPS record types (RFC 9460). The vendored dns
+// package predates them, so the records are sent as generic (RFC
+// 3597) records with the rdata in the wire format.
+const (
+	TypeSVCB  uint16 = 64
+	TypeHTTPS uint16 = 65
+)
+
+// the SvcParamKeys that can be set in the zone file
+const (
+	svcbAlpn          = 1
+	svcbNoDefaultAlpn = 2
+	svcbPort          = 3
+	svcbIPv4Hint      = 4
+	svcbIPv6Hint      = 6
+)
+
+func init() {
+	// for the query type in metrics, logs and the debug endpoint
+	for qtype, name := range map[uint16]string{TypeSVCB: "SVCB", TypeHTTPS: "HTTPS"} {
+		if _, ok := dns.TypeToString[qtype]; !ok {
+			dns.TypeToString[qtype] = name
+			dns.StringToType[name] = qtype
+		}
+	}
+}
+
+// parseSVCB reads an SVCB or HTTPS record; rec is an object with the
+// priority, the target and the alpn, no-default-alpn, port, ipv4hint
+// and ipv6hint parameters. Priority 0 is an alias to the target and
+// can't have parameters.
+func parseSVCB(h dns.RR_Header, rec interface{}, dk string) dns.RR {
+	typ := dns.TypeToString[h.Rrtype]
+	r, ok := rec.(map[string]interface{})
+	if !ok {
+		panic(fmt.Errorf("%s record for %q must be an object", typ, dk))
+	}
+
+	if r["priority"] == nil {
+		panic(fmt.Errorf("%s record for %q is missing the priority", typ, dk))
+	}
+	priority := typeutil.ToInt(r["priority"])
+	if priority < 0 || priority > 65535 {
+		panic(fmt.Errorf("%s record for %q has invalid priority %d", typ, dk, priority))
+	}
+	target := "."
+	if r["target"] != nil {
+		target = dns.Fqdn(typeutil.ToString(r["target"]))
+	}
+
+	rdata := make([]byte, 2, 64)
+	binary.BigEndian.PutUint16(rdata, uint16(priority))
+	name := make([]byte, 256)
+	n, err := dns.PackDomainName(target, name, 0, nil, false)
+	if err != nil {
+		panic(fmt.Errorf("%s record for %q has invalid target %q", typ, dk, target))
+	}
+	rdata = append(rdata, name[:n]...)
+
+	params := map[uint16][]byte{}
+	for k, v := range r {
+		var key uint16
+		var value []byte
+		switch k {
+		case "priority", "target", "ttl", "comment":
+			continue
+		case "alpn":
+			key = svcbAlpn
+			for _, id := range svcbList(v) {
+				if len(id) == 0 || len(id) > 255 {
+					panic(fmt.Errorf("%s record for %q has invalid alpn %q", typ, dk, id))
+				}
+				value = append(value, byte(len(id)))
+				value = append(value, id...)
+			}
+		case "no-default-alpn":
+			if !typeutil.ToBool(v) {
+				continue
+			}
+			key = svcbNoDefaultAlpn
+			value = []byte{}
+		case "port":
+			port := typeutil.ToInt(v)
+			if port < 0 || port > 65535 {
+				panic(fmt.Errorf("%s record for %q has invalid port %d", typ, dk, port))
+			}
+			key = svcbPort
+			value = []byte{byte(port >> 8), byte(port)}
+		case "ipv4hint", "ipv6hint":
+			key = svcbIPv4Hint
+			if k == "ipv6hint" {
+				key = svcbIPv6Hint
+			}
+			for _, s := range svcbList(v) {
+				ip := net.ParseIP(s)
+				switch {
+				case ip == nil || (key == svcbIPv4Hint) != (ip.To4() != nil):
+					panic(fmt.Errorf("%s record for %q has invalid %s %q", typ, dk, k, s))
+				case key == svcbIPv4Hint:
+					value = append(value, ip.To4()...)
+				default:
+					value = append(value, ip.To16()...)
+				}
+			}
+		default:
+			panic(fmt.Errorf("%s record for %q has unsupported parameter %q", typ, dk, k))
+		}
+		params[key] = value
+	}
+	if priority == 0 && len(params) > 0 {
+		panic(fmt.Errorf("%s record for %q with priority 0 (alias) can't have parameters", typ, dk))
+	}
+	if _, ok := params[svcbNoDefaultAlpn]; ok && len(params[svcbAlpn]) == 0 {
+		panic(fmt.Errorf("%s record for %q has no-default-alpn without alpn", typ, dk))
+	}
+
+	// the parameters are in increasing key order
+	keys := make([]int, 0, len(params))
+	for key := range params {
+		keys = append(keys, int(key))
+	}
+	sort.Ints(keys)
+	for _, key := range keys {
+		value := params[uint16(key)]
+		rdata = append(rdata, byte(key>>8), byte(key), byte(len(value)>>8), byte(len(value)))
+		rdata = append(rdata, value...)
+	}
+
+	return &dns.RFC3597{Hdr: h, Rdata: hex.EncodeToString(rdata)}
+}
+
+// svcbList returns the values of a parameter given as a string or a
+// list of strings.
+func svcbList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, s := range v {
+			list = append(list, typeutil.ToString(s))
+		}
+		return list
+	}
+	return nil
+}
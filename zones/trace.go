@@ -0,0 +1,116 @@
+package zones
+
+import (
+	"net"
+
+	"github.com/abh/geodns/targeting"
+	"github.com/abh/geodns/targeting/geo"
+	"github.com/miekg/dns"
+)
+
+// Trace explains how a query would be answered: the targets for the
+// client IP, the labels that were looked up and the records picked.
+type Trace struct {
+	Name      string        `json:"name"`
+	Qtype     string        `json:"qtype"`
+	IP        string        `json:"ip"`
+	Country   string        `json:"country,omitempty"`
+	Continent string        `json:"continent,omitempty"`
+	Location  *geo.Location `json:"location,omitempty"`
+	Targets   []string      `json:"targets"`
+	Netmask   int           `json:"netmask"`
+	Split     *TraceSplit   `json:"split,omitempty"`
+	Labels    []TraceLabel  `json:"labels"`
+	Match     string        `json:"match"`
+	MatchedBy string        `json:"matched_by,omitempty"`
+	Answer    []string      `json:"answer"`
+}
+
+// TraceLabel is a label name tried for one of the targets.
+type TraceLabel struct {
+	Target  string `json:"target"`
+	Label   string `json:"label"`
+	Exists  bool   `json:"exists"`
+	Matched bool   `json:"matched"`
+}
+
+// TraceSplit is the split of the label that matched the targets, and
+// the target the client was sent to ("" if it stayed).
+type TraceSplit struct {
+	Label  string        `json:"label"`
+	Split  []SplitTarget `json:"split"`
+	Target string        `json:"target"`
+}
+
+// Trace runs the targeting and record selection of a query for the
+// label name from ip without answering it, for debugging.
+func (z *Zone) Trace(name string, qtype uint16, ip net.IP) *Trace {
+	t := &Trace{
+		Name:   name,
+		Qtype:  dns.TypeToString[qtype],
+		IP:     ip.String(),
+		Answer: []string{},
+	}
+
+	if g := targeting.Geo(); g != nil {
+		t.Country, t.Continent, _ = g.GetCountry(ip)
+	}
+
+	targets, netmask, location := z.Options.Targeting.GetTargets(ip, z.NeedsLocation())
+	if z.Options.NearestRegion {
+		targets = z.NearestRegionTargets(name, targets, location)
+	}
+	if z.HasSplit {
+		if label, target := z.splitTarget(z.Wildcard(name), targets, ip); label != nil {
+			t.Split = &TraceSplit{Label: label.Label, Split: label.Split, Target: target}
+		}
+		targets = z.SplitTargets(name, targets, ip)
+	}
+	t.Targets = targets
+	t.Netmask = netmask
+	t.Location = location
+
+	matches := z.FindLabels(name, targets, []uint16{dns.TypeMF, dns.TypeCNAME, qtype})
+
+	var answer *Label
+	for _, match := range matches {
+		label := match.Label
+		if !label.Closest {
+			location = nil
+		}
+		servers := z.picker(label, match.Type, label.MaxHosts, location, ip, true)
+		if len(servers) == 0 {
+			continue
+		}
+		answer = label
+		t.Match = label.Label
+		t.MatchedBy = targeting.TargetType(match.Target)
+		fqdn := dns.Fqdn(name + "." + z.Origin)
+		if len(name) == 0 {
+			fqdn = dns.Fqdn(z.Origin)
+		}
+		for _, record := range servers {
+			rr := dns.Copy(record.RR)
+			rr.Header().Name = fqdn
+			answer := rr.String()
+			if len(record.Comment) > 0 {
+				answer += " ; " + record.Comment
+			}
+			t.Answer = append(t.Answer, answer)
+		}
+		break
+	}
+
+	for _, target := range targets {
+		labelName := targetLabel(name, target)
+		_, exists := z.Labels[labelName]
+		t.Labels = append(t.Labels, TraceLabel{
+			Target:  target,
+			Label:   labelName,
+			Exists:  exists,
+			Matched: answer != nil && answer.Label == labelName,
+		})
+	}
+
+	return t
+}
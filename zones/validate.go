@@ -0,0 +1,71 @@
+package zones
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/abh/geodns/targeting"
+	"github.com/miekg/dns"
+)
+
+// Validate returns the problems in a loaded zone that break some of
+// its answers: no SOA or NS records at the apex, labels for location
+// groups that aren't defined (anymore), and geo targeted labels with
+// records of a type the untargeted label doesn't have, so clients
+// elsewhere get no answer.
+func (z *Zone) Validate() []string {
+	var problems []string
+
+	apex, ok := z.Labels[""]
+	switch {
+	case !ok || len(apex.Records[dns.TypeSOA]) == 0:
+		problems = append(problems, "no SOA record")
+	case len(apex.Records[dns.TypeNS]) == 0:
+		problems = append(problems, "no NS records")
+	}
+
+	geo := z.Options.Targeting&geoTargeting != 0
+	for name, label := range z.Labels {
+		base, target := "", name
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			base, target = name[:i], name[i+1:]
+		}
+		if !geo || !isGeoTarget(target) || len(label.Records) == 0 {
+			continue
+		}
+		if strings.HasPrefix(target, targeting.GroupPrefix) && !targeting.HasGroup(strings.TrimPrefix(target, targeting.GroupPrefix)) {
+			problems = append(problems, fmt.Sprintf("label '%s': undefined location group '%s'", name, target))
+		}
+
+		fallback := z.Labels[base]
+		for _, rtype := range label.recordTypes() {
+			if fallback != nil && (len(fallback.Records[rtype]) > 0 ||
+				len(fallback.Records[dns.TypeCNAME]) > 0 || len(fallback.Records[dns.TypeMF]) > 0) {
+				continue
+			}
+			if rtype == dns.TypeCNAME && fallback != nil && len(fallback.Records) > 0 {
+				continue
+			}
+			problems = append(problems, fmt.Sprintf("label '%s': no %s records in '%s' for other clients",
+				name, dns.TypeToString[rtype], z.fqdn(base)))
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+// Validate returns the problems of each loaded zone that has any.
+func (mm *MuxManager) Validate() map[string][]string {
+	invalid := map[string][]string{}
+	for name, zone := range mm.Zones() {
+		if name == "pgeodns" {
+			continue
+		}
+		if problems := zone.Validate(); len(problems) > 0 {
+			invalid[name] = problems
+		}
+	}
+	return invalid
+}
@@ -0,0 +1,48 @@
+package zones
+
+import (
+	"testing"
+
+	"github.com/abh/geodns/targeting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	zone, err := readTestZone(t, "example.net", `{
+		"data": {
+			"": { "ns": [ "ns1.example.net." ], "mx": [ { "mx": "mx.example.net.", "preference": 10 } ] },
+			"europe": { "mx": [ { "mx": "mx.eu.example.net.", "preference": 10 } ] },
+			"www": { "a": [ [ "192.0.2.1" ] ] },
+			"www.dk": { "a": [ [ "192.0.2.2" ] ], "aaaa": [ [ "2001:db8::2" ] ] },
+			"www.se": { "cname": "www.example.org." },
+			"alias": { "alias": "www" },
+			"alias.de": { "a": [ [ "192.0.2.3" ] ] },
+			"only.europe": { "a": [ [ "192.0.2.4" ] ] }
+		}
+	}`)
+	require.Nil(t, err)
+	assert.Equal(t, []string{
+		"label 'only.europe': no A records in 'only.example.net.' for other clients",
+		"label 'www.dk': no AAAA records in 'www.example.net.' for other clients",
+	}, zone.Validate())
+
+	zone, err = readTestZone(t, "example.net", `{ "data": { "www": { "a": [ [ "192.0.2.1" ] ] } } }`)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"no NS records"}, zone.Validate())
+
+	// the group was removed after the zone was loaded
+	require.Nil(t, targeting.SetGroups(map[string][]string{"emea": {"de"}}))
+	defer targeting.SetGroups(nil)
+	zone, err = readTestZone(t, "example.net", `{
+		"data": {
+			"": { "ns": [ "ns1.example.net." ] },
+			"www": { "a": [ [ "192.0.2.1" ] ] },
+			"www.group:emea": { "a": [ [ "192.0.2.2" ] ] }
+		}
+	}`)
+	require.Nil(t, err)
+	assert.Len(t, zone.Validate(), 0)
+	require.Nil(t, targeting.SetGroups(nil))
+	assert.Equal(t, []string{"label 'www.group:emea': undefined location group 'group:emea'"}, zone.Validate())
+}
@@ -0,0 +1,40 @@
+package zones
+
+import "strings"
+
+// Wildcard returns the label that answers for s; s itself if it's in
+// the zone (or has geo targeted variants), otherwise the wildcard
+// label ("*" or "*.sub") at the closest name above s that is in the
+// zone, as in RFC 4592. If there is no wildcard there s is returned.
+// A name with labels below it is in the zone even without records of
+// its own (an empty non-terminal), so the wildcards don't match it.
+func (z *Zone) Wildcard(s string) string {
+	if z.exists(s) || z.geoLabels[s] {
+		return s
+	}
+	encloser := s
+	for len(encloser) > 0 {
+		if i := strings.Index(encloser, "."); i >= 0 {
+			encloser = encloser[i+1:]
+		} else {
+			encloser = ""
+		}
+		if z.exists(encloser) {
+			break
+		}
+	}
+	wildcard := targetLabel("*", encloser)
+	if encloser == "" {
+		wildcard = "*"
+	}
+	if _, ok := z.Labels[wildcard]; ok {
+		return wildcard
+	}
+	return s
+}
+
+// exists returns true if s has a label or has labels below it.
+func (z *Zone) exists(s string) bool {
+	_, ok := z.Labels[s]
+	return ok || z.parents[s]
+}
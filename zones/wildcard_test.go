@@ -0,0 +1,72 @@
+package zones
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWildcard(t *testing.T) {
+	zone, err := readTestZone(t, "example.com", `{
+		"targeting": "@ continent",
+		"data": {
+			"": { "ns": [ "ns1.example.net." ] },
+			"*": { "a": [ [ "192.0.2.1" ] ] },
+			"*.europe": { "a": [ [ "192.0.2.2" ] ] },
+			"www": { "a": [ [ "192.0.2.3" ] ] },
+			"sub": { "txt": "sub" },
+			"*.sub": { "txt": "wildcard" },
+			"geo.asia": { "a": [ [ "192.0.2.4" ] ] },
+			"a.b": { "a": [ [ "192.0.2.5" ] ] }
+		}
+	}`)
+	require.Nil(t, err)
+
+	match := func(s string, targets []string, qtype uint16) string {
+		matches := zone.FindLabels(s, targets, []uint16{dns.TypeMF, dns.TypeCNAME, qtype})
+		if len(matches) == 0 {
+			return ""
+		}
+		return matches[0].Label.Label
+	}
+
+	global := []string{"@"}
+	europe := []string{"europe", "@"}
+
+	// exact matches take precedence over the wildcard
+	assert.Equal(t, "www", match("www", europe, dns.TypeA))
+	assert.Equal(t, "www", match("www", global, dns.TypeTXT), "no wildcard for other types of a name in the zone")
+	assert.Equal(t, "geo.asia", match("geo", []string{"asia", "@"}, dns.TypeA), "label with only geo targeted variants")
+
+	assert.Equal(t, "*", match("novel", global, dns.TypeA))
+	assert.Equal(t, "*.europe", match("novel", europe, dns.TypeA), "geo targeting of the wildcard")
+	assert.Equal(t, "*", match("a.b.novel", global, dns.TypeA), "wildcard below the closest encloser")
+	assert.Equal(t, "*.sub", match("novel.sub", global, dns.TypeTXT))
+
+	// the closest encloser www doesn't have a wildcard
+	assert.Equal(t, "", match("novel.www", global, dns.TypeA))
+
+	// b exists as the parent of a.b (an empty non-terminal), so it
+	// isn't matched by the wildcard and is the closest encloser of
+	// the names below it
+	assert.Equal(t, "b", match("b", global, dns.TypeA), "no data for an empty non-terminal")
+	assert.Equal(t, "", match("x.b", global, dns.TypeA), "no wildcard below an empty non-terminal")
+
+	// the target of a geo targeted variant (asia in geo.asia) isn't a
+	// name in the zone
+	assert.Equal(t, "*", match("asia", global, dns.TypeA))
+	assert.Equal(t, "*", match("x.asia", global, dns.TypeA))
+	assert.Equal(t, "*", zone.Wildcard("europe"))
+	assert.Equal(t, "*", zone.Wildcard("x.europe"))
+
+	// the same without the labels for the empty non-terminals the
+	// reader adds
+	zone = NewZone("example.com")
+	zone.AddLabel("*")
+	zone.AddLabel("a.b")
+	assert.Equal(t, "b", zone.Wildcard("b"))
+	assert.Equal(t, "x.b", zone.Wildcard("x.b"))
+	assert.Equal(t, "*", zone.Wildcard("x"))
+}
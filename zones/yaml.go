@@ -0,0 +1,101 @@
+package zones
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// isYAML returns true if the file or URL name is a YAML zone file.
+func isYAML(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// parseZone parses the zone data in buf, as YAML for the .yaml and
+// .yml files and as JSON otherwise.
+func parseZone(buf []byte, name string) (map[string]interface{}, error) {
+	if isYAML(name) {
+		return parseZoneYAML(buf, name)
+	}
+	return parseZoneJSON(buf, name)
+}
+
+// parseZoneYAML parses the YAML mapping in buf into the same values
+// the JSON decoder returns, so the zone is read the same way from
+// either format.
+func parseZoneYAML(buf []byte, name string) (map[string]interface{}, error) {
+	var doc yamlValue
+	if err := yaml.Unmarshal(buf, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing YAML in config file %s\n%v", name, err)
+	}
+	objmap, ok := doc.v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("error parsing YAML in config file %s\nthe zone must be a mapping", name)
+	}
+	return objmap, nil
+}
+
+// yamlValue is a YAML value as encoding/json would decode it: the
+// mappings have string keys and the numbers are float64. The keys and
+// the YAML 1.1 bools other than true and false are kept as written,
+// so a "no" label doesn't become "false" and "txt: on" isn't a bool.
+type yamlValue struct {
+	v interface{}
+}
+
+func (y *yamlValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v interface{}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		var m map[string]yamlValue
+		if err := unmarshal(&m); err != nil {
+			return err
+		}
+		obj := make(map[string]interface{}, len(m))
+		for k, e := range m {
+			obj[k] = e.v
+		}
+		y.v = obj
+	case []interface{}:
+		var l []yamlValue
+		if err := unmarshal(&l); err != nil {
+			return err
+		}
+		list := make([]interface{}, len(l))
+		for i, e := range l {
+			list[i] = e.v
+		}
+		y.v = list
+	case int:
+		y.v = float64(v)
+	case int64:
+		y.v = float64(v)
+	case uint64:
+		y.v = float64(v)
+	case bool:
+		// only true and false are bools, like in JSON (and YAML 1.2);
+		// yes, no, on and off are text
+		var s string
+		if err := unmarshal(&s); err != nil {
+			return err
+		}
+		switch strings.ToLower(s) {
+		case "true", "false":
+			y.v = v
+		default:
+			y.v = s
+		}
+	default:
+		y.v = v
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package zones
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadZoneYAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geodns-yaml.")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	read := func(name, data string) *Zone {
+		fn := filepath.Join(dir, name)
+		require.Nil(t, ioutil.WriteFile(fn, []byte(data), 0644))
+		zone := NewZone("example.com")
+		require.Nil(t, zone.ReadZoneFile(fn))
+		return zone
+	}
+
+	fromJSON := read("example.com.json", `{
+		"serial": 3,
+		"ttl": 600,
+		"max_hosts": 2,
+		"targeting": "@ continent",
+		"data": {
+			"": {
+				"ns": [ "ns1.example.net.", "ns2.example.net." ],
+				"mx": [ { "mx": "mail.example.com", "preference": 10 } ],
+				"txt": "example zone"
+			},
+			"www": { "a": [ [ "192.0.2.1", 100 ], [ "192.0.2.2", 50 ] ], "ttl": 60 },
+			"www.europe": { "a": [ [ "192.0.2.3" ] ] },
+			"mail": { "a": [ [ "192.0.2.4" ] ], "aaaa": [ [ "2001:db8::4" ] ] },
+			"_sip._udp": { "srv": [ { "target": "sip.example.com.", "port": 5060, "priority": 10, "weight": 1 } ] },
+			"ftp": { "cname": "www" }
+		}
+	}`)
+
+	fromYAML := read("example.com.yaml", `
+# the same zone in YAML
+serial: 3
+ttl: 600
+max_hosts: 2
+targeting: "@ continent"
+data:
+  "":
+    ns: [ ns1.example.net., ns2.example.net. ]
+    mx: [ { mx: mail.example.com, preference: 10 } ]
+    txt: example zone
+  www:
+    a:
+      - [ 192.0.2.1, 100 ]
+      - [ 192.0.2.2, 50 ]
+    ttl: 60
+  www.europe:
+    a: [ [ 192.0.2.3 ] ]
+  mail:
+    a: [ [ 192.0.2.4 ] ]
+    aaaa: [ [ "2001:db8::4" ] ]
+  _sip._udp:
+    srv:
+      - { target: sip.example.com., port: 5060, priority: 10, weight: 1 }
+  ftp: { cname: www }
+`)
+
+	// the file names and times differ, the zones don't
+	fromYAML.FileName, fromYAML.ModTime = fromJSON.FileName, fromJSON.ModTime
+	assert.Equal(t, fromJSON, fromYAML)
+
+	zone := NewZone("example.com")
+	err = zone.ReadZone([]byte("- not a mapping\n"), "example.com.yml")
+	assert.Error(t, err, "a YAML list isn't a zone")
+
+	list, err := NewDirSource(dir).Zones()
+	require.Nil(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "example.com", list[1].Name, ".yaml files are zones")
+}
+
+func TestReadZoneYAMLScalars(t *testing.T) {
+	zone := NewZone("example.com")
+	err := zone.ReadZone([]byte(`
+closest: true
+data:
+  "":
+    ns: [ ns1.example.net. ]
+  no:
+    txt: on
+  "yes":
+    a: [ [ 192.0.2.1 ] ]
+    closest: false
+`), "example.com.yaml")
+	require.Nil(t, err)
+
+	assert.True(t, zone.Options.Closest, "true is a bool")
+
+	label, ok := zone.Labels["no"]
+	require.True(t, ok, "the label 'no' is kept as written")
+	require.Len(t, label.Records[dns.TypeTXT], 1)
+	assert.Equal(t, []string{"on"}, label.Records[dns.TypeTXT][0].RR.(*dns.TXT).Txt, "'on' is text")
+
+	label, ok = zone.Labels["yes"]
+	require.True(t, ok, "the label 'yes' is kept as written")
+	assert.False(t, label.Closest)
+
+	_, ok = zone.Labels["false"]
+	assert.False(t, ok)
+
+	err = zone.ReadZone([]byte("data:\n  [ a, b ]: { a: [ [ 192.0.2.1 ] ] }\n"), "example.com.yaml")
+	assert.Error(t, err, "a label has to be a string")
+}
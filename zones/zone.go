@@ -2,13 +2,18 @@ package zones
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/abh/geodns/applog"
+	"github.com/abh/geodns/countries"
 	"github.com/abh/geodns/health"
 	"github.com/abh/geodns/targeting"
 	"github.com/abh/geodns/targeting/geo"
@@ -23,12 +28,43 @@ type ZoneOptions struct {
 	Contact   string
 	Targeting targeting.TargetOptions
 	Closest   bool
+	Selection SelectionMode
+
+	// Allow restricts the zone to queries from these networks
+	Allow []*net.IPNet
+
+	// Aliases are other domains that are answered with the zone
+	// data
+	Aliases []string
+
+	// NearestRegion answers clients in a region without a label
+	// with the closest region label
+	NearestRegion bool
+
+	// ApexDefault is the label whose A and AAAA records answer for
+	// the apex when it doesn't have any
+	ApexDefault string
+
+	// SOA has the SOA fields set with the "soa" option; the
+	// primary nameserver defaults to the first NS record and the
+	// contact to Contact
+	SOA SOAOptions
 
 	// temporary, using this to keep the healthtest code
 	// compiling and vaguely included
 	healthChecker bool
 }
 
+// SOAOptions are the SOA fields of a zone.
+type SOAOptions struct {
+	Mname   string
+	Rname   string
+	Refresh int
+	Retry   int
+	Expire  int
+	Minttl  int
+}
+
 type ZoneLogging struct {
 	StatHat    bool
 	StatHatAPI string
@@ -39,6 +75,13 @@ type Record struct {
 	Weight int
 	Loc    *geo.Location
 	Test   string
+
+	// Comment is a note about the record from the zone file (like
+	// the data center), shown in the debug output and query log
+	Comment string
+
+	// the record has its own "ttl", which can be 0
+	ttlSet bool
 }
 
 type Records []*Record
@@ -50,19 +93,80 @@ type RecordsByWeight struct{ Records }
 
 func (s RecordsByWeight) Less(i, j int) bool { return s.Records[i].Weight > s.Records[j].Weight }
 
+// SelectionMode is how weighted records are picked for an answer
+type SelectionMode uint8
+
+const (
+	// SelectRandom picks records randomly in proportion to their weight
+	SelectRandom SelectionMode = iota
+	// SelectRoundRobin rotates through the records with a smooth
+	// weighted round-robin, so the weights are honored exactly over
+	// repeated queries
+	SelectRoundRobin
+	// SelectSticky picks records by hashing the client address, so a
+	// client keeps getting the same records
+	SelectSticky
+)
+
+func (m SelectionMode) String() string {
+	switch m {
+	case SelectRoundRobin:
+		return "round_robin"
+	case SelectSticky:
+		return "sticky"
+	default:
+		return "random"
+	}
+}
+
+// ParseSelectionMode parses the "selection" zone and label option
+func ParseSelectionMode(s string) (SelectionMode, error) {
+	switch s {
+	case "random", "":
+		return SelectRandom, nil
+	case "round_robin":
+		return SelectRoundRobin, nil
+	case "sticky":
+		return SelectSticky, nil
+	}
+	return SelectRandom, fmt.Errorf("unknown selection mode '%s'", s)
+}
+
 type Label struct {
-	Label    string
-	MaxHosts int
-	Ttl      int
-	Records  map[uint16]Records
-	Weight   map[uint16]int
-	Closest  bool
-	Test     health.HealthTester
+	Label     string
+	MaxHosts  int
+	Ttl       int
+	Records   map[uint16]Records
+	Weight    map[uint16]int
+	Closest   bool
+	Selection SelectionMode
+	Test      health.HealthTester
+	Check     *health.Checker
+	Flatten   *Flattener
+
+	// MinHealthy is how many records must be healthy, and
+	// BelowMinHealthy how the label answers when fewer are
+	MinHealthy      int
+	BelowMinHealthy HealthPolicy
+
+	// Location of a region label for the nearest region fallback
+	Location *geo.Location
+
+	// Split sends a share of the clients to other targets
+	Split []SplitTarget
+
+	// round-robin state for each record type
+	rrMutex sync.Mutex
+	rr      map[uint16]*roundRobin
 }
 
 type LabelMatch struct {
 	Label *Label
 	Type  uint16
+
+	// Target is the target the label was found for ("@" for the
+	// label itself)
+	Target string
 }
 
 type labelmap map[string]*Label
@@ -70,6 +174,7 @@ type labelmap map[string]*Label
 type ZoneMetrics struct {
 	LabelStats  *zoneLabelStats
 	ClientStats *zoneLabelStats
+	Queries     *QueryCount
 }
 
 type Zone struct {
@@ -80,23 +185,56 @@ type Zone struct {
 	Logging      *ZoneLogging
 	Metrics      ZoneMetrics
 	HasClosest   bool
+	HasSplit     bool
 	HealthStatus health.Status
 	healthExport bool
 	ParseIP      bool
 
+	// file the zone was read from and its modification time
+	FileName string
+	ModTime  time.Time
+
+	// Includes are the snippet files included in the zone
+	Includes []string
+
+	// labels that have geo targeted variants
+	geoLabels map[string]bool
+
+	// names with labels below them, including the empty non-terminals
+	parents map[string]bool
+
+	// region labels for each label, for NearestRegion
+	regionLabels map[string][]*Label
+
 	sync.RWMutex
 }
 
+// defaultTtl is the TTL of zones without a "ttl" option.
+var defaultTtl int32 = 120
+
+// SetDefaultTtl sets the TTL used for zones that don't have a "ttl"
+// option; it applies to zones loaded after it's called.
+func SetDefaultTtl(ttl int) {
+	atomic.StoreInt32(&defaultTtl, int32(ttl))
+}
+
+// DefaultTtl returns the TTL used for zones without a "ttl" option.
+func DefaultTtl() int {
+	return int(atomic.LoadInt32(&defaultTtl))
+}
+
 func NewZone(name string) *Zone {
 	zone := new(Zone)
 	zone.Labels = make(labelmap)
+	zone.parents = map[string]bool{}
 	zone.Origin = name
 	zone.LabelCount = dns.CountLabel(zone.Origin)
 
 	// defaults
-	zone.Options.Ttl = 120
+	zone.Options.Ttl = DefaultTtl()
 	zone.Options.MaxHosts = 2
 	zone.Options.Contact = "hostmaster." + name
+	zone.Options.SOA = SOAOptions{Refresh: 5400, Retry: 5400, Expire: 1209600, Minttl: 3600}
 	zone.Options.Targeting = targeting.TargetGlobal + targeting.TargetCountry + targeting.TargetContinent
 
 	return zone
@@ -115,11 +253,17 @@ func (z *Zone) SetupMetrics(old *Zone) {
 	if z.Metrics.ClientStats == nil {
 		z.Metrics.ClientStats = NewZoneLabelStats(10000)
 	}
+	if z.Metrics.Queries == nil {
+		z.Metrics.Queries = new(QueryCount)
+	}
 }
 
 func (z *Zone) Close() {
 	// todo: prune prometheus metrics for the zone ...
 
+	z.closeHealthChecks()
+	z.closeFlatten()
+
 	if z.Metrics.LabelStats != nil {
 		z.Metrics.LabelStats.Close()
 	}
@@ -132,6 +276,19 @@ func (l *Label) FirstRR(dnsType uint16) dns.RR {
 	return l.Records[dnsType][0].RR
 }
 
+// recordTypes returns the types of the records in the label, in
+// numeric order so answers with all of them are stable.
+func (l *Label) recordTypes() []uint16 {
+	types := make([]uint16, 0, len(l.Records))
+	for rtype, records := range l.Records {
+		if len(records) > 0 {
+			types = append(types, rtype)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
 func (z *Zone) AddLabel(k string) *Label {
 	k = strings.ToLower(k)
 	z.Labels[k] = new(Label)
@@ -140,10 +297,16 @@ func (z *Zone) AddLabel(k string) *Label {
 	label.Ttl = 0 // replaced later
 	label.MaxHosts = z.Options.MaxHosts
 	label.Closest = z.Options.Closest
+	label.Selection = z.Options.Selection
 
 	label.Records = make(map[uint16]Records)
 	label.Weight = make(map[uint16]int)
 
+	for p := z.geoBase(k); strings.Contains(p, "."); {
+		p = p[strings.Index(p, ".")+1:]
+		z.parents[p] = true
+	}
+
 	return label
 }
 
@@ -151,6 +314,18 @@ func (z *Zone) SoaRR() dns.RR {
 	return z.Labels[""].FirstRR(dns.TypeSOA)
 }
 
+// NegativeSoaRR returns the SOA record for the authority section of
+// NXDOMAIN and NODATA answers. Its TTL is the lower of the SOA TTL and
+// the SOA minimum, which resolvers use for caching the answer
+// (RFC 2308).
+func (z *Zone) NegativeSoaRR() dns.RR {
+	soa := dns.Copy(z.SoaRR()).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
 func (zone *Zone) AddSOA() {
 	zone.addSOA()
 }
@@ -171,6 +346,14 @@ func (zone *Zone) addSOA() {
 	if record, ok := label.Records[dns.TypeNS]; ok {
 		primaryNs = record[0].RR.(*dns.NS).Ns
 	}
+	if len(zone.Options.SOA.Mname) > 0 {
+		primaryNs = zone.Options.SOA.Mname
+	}
+
+	contact := zone.Options.Contact
+	if len(zone.Options.SOA.Rname) > 0 {
+		contact = zone.Options.SOA.Rname
+	}
 
 	ttl := zone.Options.Ttl * 10
 	if ttl > 3600 {
@@ -180,19 +363,21 @@ func (zone *Zone) addSOA() {
 		ttl = 600
 	}
 
+	soa := zone.Options.SOA
 	s := zone.Origin + ". " + strconv.Itoa(ttl) + " IN SOA " +
-		primaryNs + " " + zone.Options.Contact + " " +
-		strconv.Itoa(zone.Options.Serial) +
-		// refresh, retry, expire, minimum are all
-		// meaningless with this implementation
-		" 5400 5400 1209600 3600"
+		primaryNs + " " + contact + " " +
+		strconv.Itoa(zone.Options.Serial) + " " +
+		// refresh, retry and expire only matter to secondaries
+		// transferring the zone from somewhere else
+		strconv.Itoa(soa.Refresh) + " " + strconv.Itoa(soa.Retry) + " " +
+		strconv.Itoa(soa.Expire) + " " + strconv.Itoa(soa.Minttl)
 
 	// log.Println("SOA: ", s)
 
 	rr, err := dns.NewRR(s)
 
 	if err != nil {
-		log.Println("SOA Error", err)
+		applog.Errorf("SOA Error: %s", err)
 		panic("Could not setup SOA")
 	}
 
@@ -202,6 +387,102 @@ func (zone *Zone) addSOA() {
 	label.Records[dns.TypeSOA][0] = &record
 }
 
+// isGeoTarget returns true if t is the name of a country, continent,
+// region, region group or ASN target.
+func isGeoTarget(t string) bool {
+	if _, ok := countries.CountryContinent[t]; ok {
+		return true
+	}
+	if _, ok := countries.ContinentCountries[t]; ok {
+		return true
+	}
+	if _, ok := countries.RegionGroups[t]; ok {
+		return true
+	}
+	if _, ok := countries.RegionGroupRegions[t]; ok {
+		return true
+	}
+	if strings.HasPrefix(t, targeting.GroupPrefix) {
+		return true
+	}
+	if strings.HasPrefix(t, "as") {
+		if _, err := strconv.Atoi(t[2:]); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// geoBase returns the label that k is a geo targeted variant of (www
+// for www.europe), or k itself. The target isn't a name in the zone.
+func (z *Zone) geoBase(k string) string {
+	if z.Options.Targeting&geoTargeting == 0 {
+		return k
+	}
+	i := strings.LastIndex(k, ".")
+	if i < 0 {
+		return k
+	}
+	if target := k[i+1:]; isGeoTarget(target) || isRegionTarget(target) {
+		return k[:i]
+	}
+	return k
+}
+
+// geoTargeting are the targeting options that use the geo provider.
+const geoTargeting = targeting.TargetContinent | targeting.TargetCountry |
+	targeting.TargetRegionGroup | targeting.TargetRegion | targeting.TargetASN
+
+// setupGeoLabels finds the labels that depend on the geo provider;
+// labels with "closest" or with labels for geo targets below them
+// (www.europe for www).
+func (z *Zone) setupGeoLabels() {
+	z.geoLabels = map[string]bool{}
+
+	for name, label := range z.Labels {
+		if label.Closest {
+			z.geoLabels[name] = true
+		}
+		if z.Options.Targeting&geoTargeting == 0 {
+			continue
+		}
+		base, target := "", name
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			base, target = name[:i], name[i+1:]
+		}
+		if isGeoTarget(target) {
+			z.geoLabels[base] = true
+		}
+	}
+}
+
+// RequiresGeo returns true if the answers for the label depend on the
+// geo provider.
+func (z *Zone) RequiresGeo(label string) bool {
+	return z.geoLabels[z.Wildcard(label)]
+}
+
+// IsReverse returns true for reverse lookup zones, below in-addr.arpa
+// or ip6.arpa.
+func (z *Zone) IsReverse() bool {
+	origin := dns.Fqdn(strings.ToLower(z.Origin))
+	return dns.IsSubDomain("in-addr.arpa.", origin) || dns.IsSubDomain("ip6.arpa.", origin)
+}
+
+// Allowed returns true if the zone answers queries from ip; zones
+// without an "allow" option answer everyone.
+func (z *Zone) Allowed(ip net.IP) bool {
+	if z.Options.Allow == nil {
+		return true
+	}
+	for _, ipnet := range z.Options.Allow {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func (z *Zone) findFirstLabel(s string, targets []string, qts []uint16) *LabelMatch {
 	matches := z.FindLabels(s, targets, qts)
 	if len(matches) == 0 {
@@ -216,34 +497,33 @@ func (z *Zone) findFirstLabel(s string, targets []string, qts []uint16) *LabelMa
 // LabelMatch for potential labels that might satisfy the query.
 // "MF" records are treated as aliases. The API returns all the
 // matches the targeting will allow so health check filtering won't
-// filter out the "best" results leaving no others.
+// filter out the "best" results leaving no others. Names that aren't
+// in the zone are answered by a matching wildcard label.
 func (z *Zone) FindLabels(s string, targets []string, qts []uint16) []LabelMatch {
 
+	s = z.Wildcard(s)
 	matches := make([]LabelMatch, 0)
+	anyTypes := map[uint16]bool{}
 
 	for _, target := range targets {
-		var name string
-
-		switch target {
-		case "@":
-			name = s
-		default:
-			if len(s) > 0 {
-				name = s + "." + target
-			} else {
-				name = target
-			}
-		}
+		name := targetLabel(s, target)
 
 		if label, ok := z.Labels[name]; ok {
 			var name string
 			for _, qtype := range qts {
 				switch qtype {
 				case dns.TypeANY:
-					// short-circuit mostly to avoid subtle bugs later
-					// to be correct we should run through all the selectors and
-					// pick types not already picked
-					matches = append(matches, LabelMatch{z.Labels[s], qtype})
+					// a match for each record type, from the most
+					// specific label that has it, like the answer for
+					// a query for the type. The CNAME is matched on
+					// its own and MF is internal.
+					for _, rtype := range label.recordTypes() {
+						if anyTypes[rtype] || rtype == dns.TypeMF || rtype == dns.TypeCNAME || rtype == dns.TypeRRSIG {
+							continue
+						}
+						anyTypes[rtype] = true
+						matches = append(matches, LabelMatch{label, rtype, target})
+					}
 					continue
 				case dns.TypeMF:
 					if label.Records[dns.TypeMF] != nil {
@@ -256,7 +536,7 @@ func (z *Zone) FindLabels(s string, targets []string, qts []uint16) []LabelMatch
 				default:
 					// return the label if it has the right record
 					if label.Records[qtype] != nil && len(label.Records[qtype]) > 0 {
-						matches = append(matches, LabelMatch{label, qtype})
+						matches = append(matches, LabelMatch{label, qtype, target})
 						continue
 					}
 				}
@@ -268,13 +548,42 @@ func (z *Zone) FindLabels(s string, targets []string, qts []uint16) []LabelMatch
 		// this is to make sure we return 'noerror' instead of 'nxdomain' when
 		// appropriate.
 		if label, ok := z.Labels[s]; ok {
-			matches = append(matches, LabelMatch{label, 0})
+			matches = append(matches, LabelMatch{label, 0, "@"})
 		}
 	}
 
 	return matches
 }
 
+// Delegation returns the label with the NS records of the delegated
+// sub-zone that name is in, or nil if it's not in one. NS records on
+// the zone apex aren't a delegation.
+func (z *Zone) Delegation(name string) *Label {
+	for len(name) > 0 {
+		if label, ok := z.Labels[name]; ok && len(label.Records[dns.TypeNS]) > 0 {
+			return label
+		}
+		i := strings.Index(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return nil
+}
+
+// targetLabel returns the name of the variant of label s for target.
+func targetLabel(s, target string) string {
+	switch {
+	case target == "@":
+		return s
+	case len(s) > 0:
+		return s + "." + target
+	default:
+		return target
+	}
+}
+
 // Find the locations of all the A and AAAA records within a zone. If we were
 // being really clever here we could use LOC records too. But for the time
 // being we'll just use GeoIP.
@@ -326,6 +635,20 @@ func (z *Zone) addHealthReference(l *Label, data interface{}) {
 	}
 
 	if i, ok := data.(map[string]interface{}); ok {
+		if _, ok := i["check"]; ok {
+			name := l.Label + "." + z.Origin
+			if len(l.Label) == 0 {
+				name = z.Origin
+			}
+			checker, err := health.NewCheckerFromMap(name, i)
+			if err != nil {
+				applog.Printf("Could not setup health check for '%s': %s", name, err)
+				return
+			}
+			l.Check = checker
+			return
+		}
+
 		tester, err := health.NewReferenceFromMap(i)
 		if err != nil {
 			applog.Printf("Could not setup reference to health check: %s", err)
@@ -335,9 +658,12 @@ func (z *Zone) addHealthReference(l *Label, data interface{}) {
 	}
 }
 
+// setupHealthTests sets the health test name of each record in labels
+// with a health reference or check (unless the record has its own).
+// Records checked by the label are added to the label's checker.
 func (z *Zone) setupHealthTests() {
 	for _, label := range z.Labels {
-		if label.Test == nil {
+		if label.Test == nil && label.Check == nil {
 			// log.Printf("label.Test for '%s' == nil", label.Label)
 			continue
 		}
@@ -360,12 +686,52 @@ func (z *Zone) setupHealthTests() {
 				default:
 					continue
 				}
-				rec.Test = t
+				if label.Check != nil {
+					rec.Test = t
+					label.Check.Add(t)
+					continue
+				}
+				rec.Test = label.Test.Name(t)
 			}
 		}
 	}
 }
 
+// closeHealthChecks stops the active health checks in the zone.
+func (z *Zone) closeHealthChecks() {
+	for _, label := range z.Labels {
+		if label.Check != nil {
+			label.Check.Close()
+		}
+	}
+}
+
+// startFlatten starts looking up the targets of flattened CNAMEs. The
+// labels answer with the records old (the zone before a reload, or
+// nil) had for them until then.
+func (z *Zone) startFlatten(old *Zone) {
+	for name, label := range z.Labels {
+		if label.Flatten == nil {
+			continue
+		}
+		if old != nil {
+			if l, ok := old.Labels[name]; ok && l.Flatten != nil {
+				label.Flatten.keep(l.Flatten)
+			}
+		}
+		label.Flatten.Start()
+	}
+}
+
+// closeFlatten stops the lookups of flattened CNAME targets.
+func (z *Zone) closeFlatten() {
+	for _, label := range z.Labels {
+		if label.Flatten != nil {
+			label.Flatten.Close()
+		}
+	}
+}
+
 // func (z *Zone) StartStopHealthTests(start bool, oldZone *Zone) {}
 // 	applog.Printf("Start/stop health checks on zone %s start=%v", z.Origin, start)
 // for labelName, label := range z.Labels {
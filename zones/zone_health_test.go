@@ -2,7 +2,9 @@ package zones
 
 import (
 	"math/rand"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/abh/geodns/health"
 	"github.com/miekg/dns"
@@ -51,7 +53,14 @@ func TestHealth(t *testing.T) {
 
 	matches := tz.FindLabels("tucs", []string{"@"}, []uint16{dns.TypeA})
 	// t.Logf("qt: %d, label: '%+v'", qt, label)
+	// with every record unhealthy the label fails open by default
 	records := tz.Picker(matches[0].Label, matches[0].Type, 2, nil)
+	if len(records) != 1 {
+		t.Errorf("got %d records when expecting 1", len(records))
+	}
+
+	matches[0].Label.BelowMinHealthy = HealthServfail
+	records = tz.Picker(matches[0].Label, matches[0].Type, 2, nil)
 	if len(records) > 0 {
 		t.Errorf("got %d records when expecting 0", len(records))
 	}
@@ -62,3 +71,45 @@ func TestHealth(t *testing.T) {
 		t.Log("didn't get any records")
 	}
 }
+
+func TestHealthCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	zone, err := readTestZone(t, "example.net", `{
+		"data": {
+			"www": {
+				"a": [ [ "127.0.0.1", 10 ], [ "127.0.0.2", 10 ] ],
+				"health": { "check": "tcp", "port": `+port+`, "jitter": 0 }
+			}
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("reading zone: %s", err)
+	}
+	zone.setupHealthTests()
+	defer zone.Close()
+
+	label := zone.Labels["www"]
+	deadline := time.Now().Add(2 * time.Second)
+	for label.Check.GetStatus("127.0.0.2") != health.StatusUnhealthy {
+		if time.Now().After(deadline) {
+			t.Fatalf("127.0.0.2 wasn't marked unhealthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 10; i++ {
+		records := zone.Picker(label, dns.TypeA, 2, nil)
+		if len(records) != 1 {
+			t.Fatalf("got %d records, expected 1", len(records))
+		}
+		if ip := records[0].RR.(*dns.A).A.String(); ip != "127.0.0.1" {
+			t.Fatalf("got unhealthy record %s", ip)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package zones
 import (
 	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 type zoneLabelStats struct {
@@ -22,8 +23,8 @@ type labelStatsByCount struct{ labelStats }
 func (s labelStatsByCount) Less(i, j int) bool { return s.labelStats[i].Count > s.labelStats[j].Count }
 
 type labelStat struct {
-	Label string
-	Count int
+	Label string `json:"label"`
+	Count int    `json:"count"`
 }
 
 func NewZoneLabelStats(size int) *zoneLabelStats {
@@ -93,3 +94,23 @@ func (zs *zoneLabelStats) Counts() map[string]int {
 	}
 	return counts
 }
+
+// QueryCount is the number of queries for a zone since it was last
+// reset, for exact counts over fixed windows.
+type QueryCount struct {
+	n int64
+}
+
+func (c *QueryCount) Add() {
+	atomic.AddInt64(&c.n, 1)
+}
+
+func (c *QueryCount) Count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// Reset returns the count and sets it to zero in one step, so queries
+// counted while it's read aren't lost.
+func (c *QueryCount) Reset() int64 {
+	return atomic.SwapInt64(&c.n, 0)
+}
@@ -1,6 +1,8 @@
 package zones
 
 import (
+	"sync"
+
 	"github.com/stretchr/testify/assert"
 
 	"testing"
@@ -51,3 +53,37 @@ func TestZoneStats(t *testing.T) {
 	zs.Close()
 
 }
+
+func TestQueryCount(t *testing.T) {
+	c := new(QueryCount)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10000; j++ {
+				c.Add()
+			}
+		}()
+	}
+
+	// resetting while counting doesn't lose any queries
+	var total int64
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		total += c.Reset()
+	}
+	total += c.Reset()
+	assert.Equal(t, int64(80000), total)
+	assert.Equal(t, int64(0), c.Count())
+}